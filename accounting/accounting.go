@@ -3,12 +3,15 @@ package accounting
 import (
 	"context"
 	"github.com/fs714/goiftop/utils/log"
+	"sort"
+	"sync"
 	"time"
 )
 
 const DefaultFlowDbSize = 2
 const DefaultStatChannelSize = 16
 const DefaultRotateInterval = 5
+const DefaultSubscriberChannelSize = 64
 
 var GlobalAcct *Accounting
 
@@ -16,19 +19,152 @@ type Accounting struct {
 	FlowAccd  map[string]*FlowCollectionHistory
 	Retention int64
 	Ch        chan *FlowCollection
+	Mu        *sync.RWMutex
+
+	subscribers map[int]*subscriber
+	nextSubId   int
+	subMu       *sync.Mutex
 }
 
 func NewAccounting() (acct *Accounting) {
 	acct = &Accounting{
-		FlowAccd: make(map[string]*FlowCollectionHistory, DefaultFlowDbSize),
-		Ch:       make(chan *FlowCollection, DefaultStatChannelSize),
+		FlowAccd:    make(map[string]*FlowCollectionHistory, DefaultFlowDbSize),
+		Ch:          make(chan *FlowCollection, DefaultStatChannelSize),
+		Mu:          &sync.RWMutex{},
+		subscribers: make(map[int]*subscriber),
+		subMu:       &sync.Mutex{},
+	}
+
+	return
+}
+
+// subscriber receives copies of the flow collections accounted, done is closed on unsubscribe to release a
+// blocking subscriber
+type subscriber struct {
+	ch         chan *FlowCollection
+	isBlocking bool
+	done       chan struct{}
+}
+
+// Subscribe returns a channel receiving a copy of every flow collection arriving on Ch. Collections are
+// dropped for a subscriber which does not keep up, so a slow subscriber never blocks accounting.
+func (a *Accounting) Subscribe() (id int, ch chan *FlowCollection) {
+	return a.subscribe(false)
+}
+
+// SubscribeBlocking returns a channel receiving a copy of every flow collection arriving on Ch without dropping
+// any, accounting waits for the subscriber until it unsubscribes. It is meant for a subscriber counting every
+// collection, which has to unsubscribe before it stops receiving.
+func (a *Accounting) SubscribeBlocking() (id int, ch chan *FlowCollection) {
+	return a.subscribe(true)
+}
+
+func (a *Accounting) subscribe(isBlocking bool) (id int, ch chan *FlowCollection) {
+	a.subMu.Lock()
+	defer a.subMu.Unlock()
+
+	id = a.nextSubId
+	a.nextSubId++
+	ch = make(chan *FlowCollection, DefaultSubscriberChannelSize)
+	a.subscribers[id] = &subscriber{
+		ch:         ch,
+		isBlocking: isBlocking,
+		done:       make(chan struct{}),
 	}
 
 	return
 }
 
+func (a *Accounting) Unsubscribe(id int) {
+	a.subMu.Lock()
+	sub, ok := a.subscribers[id]
+	delete(a.subscribers, id)
+	a.subMu.Unlock()
+
+	if ok {
+		close(sub.done)
+	}
+}
+
+// publish hands a copy of flowCol to the subscribers, they are sent to without holding the lock so a blocking
+// subscriber could unsubscribe while accounting waits for it
+func (a *Accounting) publish(flowCol *FlowCollection) {
+	a.subMu.Lock()
+	subs := make([]*subscriber, 0, len(a.subscribers))
+	for _, sub := range a.subscribers {
+		subs = append(subs, sub)
+	}
+	a.subMu.Unlock()
+
+	for _, sub := range subs {
+		if sub.isBlocking {
+			select {
+			case sub.ch <- flowCol.Copy():
+			case <-sub.done:
+			}
+			continue
+		}
+
+		select {
+		case sub.ch <- flowCol.Copy():
+		default:
+		}
+	}
+}
+
 func (a *Accounting) AddInterface(ifaceName string) {
-	a.FlowAccd[ifaceName] = NewFlowCollectionHistory(ifaceName)
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
+
+	_, ok := a.FlowAccd[ifaceName]
+	if !ok {
+		a.FlowAccd[ifaceName] = NewFlowCollectionHistory(ifaceName)
+	}
+}
+
+// RemoveInterface stops accounting of an interface and drops its history
+func (a *Accounting) RemoveInterface(ifaceName string) {
+	a.Mu.Lock()
+	defer a.Mu.Unlock()
+
+	delete(a.FlowAccd, ifaceName)
+}
+
+func (a *Accounting) GetInterface(ifaceName string) (flowColHist *FlowCollectionHistory, ok bool) {
+	a.Mu.RLock()
+	defer a.Mu.RUnlock()
+
+	flowColHist, ok = a.FlowAccd[ifaceName]
+
+	return
+}
+
+// InterfaceNames returns the names of the accounted interfaces in sorted order
+func (a *Accounting) InterfaceNames() (names []string) {
+	a.Mu.RLock()
+	defer a.Mu.RUnlock()
+
+	names = make([]string, 0, len(a.FlowAccd))
+	for ifaceName := range a.FlowAccd {
+		names = append(names, ifaceName)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// Interfaces returns a snapshot of the accounted interfaces which is safe to range over while interfaces
+// are added or removed
+func (a *Accounting) Interfaces() (flowAccd map[string]*FlowCollectionHistory) {
+	a.Mu.RLock()
+	defer a.Mu.RUnlock()
+
+	flowAccd = make(map[string]*FlowCollectionHistory, len(a.FlowAccd))
+	for ifaceName, flowColHist := range a.FlowAccd {
+		flowAccd[ifaceName] = flowColHist
+	}
+
+	return
 }
 
 func (a *Accounting) SetRetention(t int64) {
@@ -40,36 +176,55 @@ func (a *Accounting) Start(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Infoln("statistic exit")
-			return
+			// Account the final flush of the engines still queued
+			for {
+				select {
+				case flowCol := <-a.Ch:
+					a.account(flowCol)
+				default:
+					log.Infoln("statistic exit")
+					return
+				}
+			}
 		case <-ticker.C:
+			// Retention is relative to the latest sample rather than the wall clock, so replayed
+			// captures with old timestamps are kept as well.
 			if a.Retention > 0 {
-				before := time.Now().Unix() - a.Retention
-				for _, v := range a.FlowAccd {
+				for _, v := range a.Interfaces() {
 					v.Mu.Lock()
-					v.Retention(before)
+					v.Retention(v.LastTimestamp.End - a.Retention)
 					v.Mu.Unlock()
 				}
 			}
 		case flowCol := <-a.Ch:
-			flowColHist, ok := a.FlowAccd[flowCol.InterfaceName]
-			if !ok {
-				log.Errorf("invalid interface name: %s", flowCol.InterfaceName)
-				continue
-			}
-
-			flowColHist.Mu.Lock()
-			fc, ok := flowColHist.HistCollection[flowCol.FlowTimestamp]
-			if !ok {
-				flowColHist.HistCollection[flowCol.FlowTimestamp] = flowCol
-				flowColHist.SetLastTimestamp(flowCol.FlowTimestamp)
-			} else {
-				fc.Mu.Lock()
-				fc.UpdateByFlowCol(flowCol)
-				fc.Mu.Unlock()
-				flowColHist.SetLastTimestamp(flowCol.FlowTimestamp)
-			}
-			flowColHist.Mu.Unlock()
+			a.account(flowCol)
 		}
 	}
 }
+
+func (a *Accounting) account(flowCol *FlowCollection) {
+	flowColHist, ok := a.GetInterface(flowCol.InterfaceName)
+	if !ok {
+		log.Errorf("invalid interface name: %s", flowCol.InterfaceName)
+		return
+	}
+
+	a.publish(flowCol)
+
+	flowColHist.Mu.Lock()
+	flowColHist.UpdateCounter(flowCol)
+	fc, ok := flowColHist.HistCollection[flowCol.FlowTimestamp]
+	if !ok {
+		flowColHist.HistCollection[flowCol.FlowTimestamp] = flowCol
+	} else {
+		fc.Mu.Lock()
+		fc.UpdateByFlowCol(flowCol)
+		fc.Mu.Unlock()
+	}
+
+	// Samples posted late, like the spool of a node, are kept without moving the latest sample back
+	if flowCol.End > flowColHist.LastTimestamp.End {
+		flowColHist.SetLastTimestamp(flowCol.FlowTimestamp)
+	}
+	flowColHist.Mu.Unlock()
+}
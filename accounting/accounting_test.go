@@ -0,0 +1,127 @@
+package accounting
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAddRemoveInterface keeps the history of an interface added again and drops it on removal
+func TestAddRemoveInterface(t *testing.T) {
+	a := NewAccounting()
+	a.AddInterface("eth1")
+	a.AddInterface("eth0")
+
+	h, ok := a.GetInterface("eth0")
+	if !ok {
+		t.Fatal("eth0 not accounted")
+	}
+	h.SetLastTimestamp(FlowTimestamp{Start: 10, End: 11})
+
+	a.AddInterface("eth0")
+	if h2, _ := a.GetInterface("eth0"); h2 != h {
+		t.Error("history of eth0 replaced when added again")
+	}
+	if names := a.InterfaceNames(); !reflect.DeepEqual(names, []string{"eth0", "eth1"}) {
+		t.Errorf("got interfaces %q", names)
+	}
+
+	snapshot := a.Interfaces()
+	a.RemoveInterface("eth0")
+	if _, ok = a.GetInterface("eth0"); ok {
+		t.Error("eth0 accounted after removal")
+	}
+	if len(snapshot) != 2 {
+		t.Error("snapshot of the interfaces changed by removal")
+	}
+
+	a.AddInterface("eth0")
+	if h2, _ := a.GetInterface("eth0"); h2.LastTimestamp != (FlowTimestamp{}) {
+		t.Error("history of eth0 kept after removal")
+	}
+}
+
+// TestAccountLateSample accounts samples out of order, like the spool of a node posting them late, the latest
+// sample of the interface is not moved back
+func TestAccountLateSample(t *testing.T) {
+	tests := []struct {
+		name     string
+		samples  []FlowTimestamp
+		wantLast FlowTimestamp
+	}{
+		{"in order", []FlowTimestamp{{100, 101}, {101, 102}}, FlowTimestamp{101, 102}},
+		{"late", []FlowTimestamp{{200, 201}, {100, 101}}, FlowTimestamp{200, 201}},
+		{"same sample", []FlowTimestamp{{100, 101}, {100, 101}}, FlowTimestamp{100, 101}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acct := NewAccounting()
+			acct.AddInterface("eth0")
+			for _, ts := range tt.samples {
+				fc := NewFlowCollection("eth0")
+				fc.SetTimestamp(ts.Start, ts.End)
+				fc.UpdateL3Inbound(FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 100, 1)
+				acct.account(fc)
+			}
+
+			h, _ := acct.GetInterface("eth0")
+			if h.LastTimestamp != tt.wantLast {
+				t.Errorf("got latest sample %+v, want %+v", h.LastTimestamp, tt.wantLast)
+			}
+
+			for _, ts := range tt.samples {
+				if _, ok := h.HistCollection[ts]; !ok {
+					t.Errorf("sample %+v not kept", ts)
+				}
+			}
+		})
+	}
+}
+
+// TestSubscribeBlocking hands a blocking subscriber every collection beyond its channel size, while a
+// subscriber which does not keep up misses them, and releases accounting once it unsubscribes
+func TestSubscribeBlocking(t *testing.T) {
+	a := NewAccounting()
+	a.AddInterface("eth0")
+	_, ch := a.Subscribe()
+	blockingId, blockingCh := a.SubscribeBlocking()
+
+	total := DefaultSubscriberChannelSize + 8
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < total; i++ {
+			fc := NewFlowCollection("eth0")
+			fc.SetTimestamp(int64(i), int64(i+1))
+			a.account(fc)
+		}
+	}()
+
+	for i := 0; i < total; i++ {
+		fc := <-blockingCh
+		if fc.Start != int64(i) {
+			t.Fatalf("got collection at %d, want %d", fc.Start, i)
+		}
+	}
+	<-done
+	if len(ch) != DefaultSubscriberChannelSize {
+		t.Errorf("got %d collections of the non-blocking subscriber, want %d", len(ch), DefaultSubscriberChannelSize)
+	}
+
+	// Nothing receives any more, accounting must not wait for the subscriber once it is gone
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		for i := 0; i < DefaultSubscriberChannelSize+1; i++ {
+			a.account(NewFlowCollection("eth0"))
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.Unsubscribe(blockingId)
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("accounting blocked after unsubscribe")
+	}
+}
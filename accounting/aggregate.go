@@ -0,0 +1,255 @@
+package accounting
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+)
+
+const GroupByHost = "host"
+const GroupByPeer = "peer"
+const GroupBySubnet = "subnet"
+const GroupByPeerSubnet = "peer_subnet"
+const GroupByVlan = "vlan"
+
+var GroupByList = []string{GroupByHost, GroupByPeer, GroupBySubnet, GroupByPeerSubnet, GroupByVlan}
+
+const DefaultPrefixV4 = 24
+const DefaultPrefixV6 = 64
+
+// Grouping rolls flows up by the local address (host), the remote address (peer), the subnet of the local or
+// remote address with the prefix lengths given, or the vlan
+type Grouping struct {
+	By       string
+	PrefixV4 int
+	PrefixV6 int
+}
+
+func (g *Grouping) Validate() (err error) {
+	err = ValidateGroupBy(g.By)
+	if err != nil {
+		return
+	}
+
+	if g.PrefixV4 < 0 || g.PrefixV4 > 32 {
+		err = errors.New("ipv4 prefix length should be between 0 and 32")
+		return
+	}
+
+	if g.PrefixV6 < 0 || g.PrefixV6 > 128 {
+		err = errors.New("ipv6 prefix length should be between 0 and 128")
+		return
+	}
+
+	return
+}
+
+func ValidateGroupBy(groupBy string) (err error) {
+	for _, g := range GroupByList {
+		if g == groupBy {
+			return
+		}
+	}
+
+	err = errors.New("invalid group key: " + groupBy)
+
+	return
+}
+
+// Subnet returns the subnet of addr as prefix/length, or addr itself when it is not an ip address
+func (g *Grouping) Subnet(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(g.PrefixV4, 32)).String() + "/" + strconv.Itoa(g.PrefixV4)
+	}
+
+	return ip.Mask(net.CIDRMask(g.PrefixV6, 128)).String() + "/" + strconv.Itoa(g.PrefixV6)
+}
+
+// Fingerprint returns the fingerprint of the group of f, which only keeps the fields of the group. As
+// fingerprints hold the remote address as source, the host is the destination address.
+func (g *Grouping) Fingerprint(f *Flow) (ff FlowFingerprint) {
+	switch g.By {
+	case GroupByHost:
+		ff.DstAddr = f.DstAddr
+	case GroupByPeer:
+		ff.SrcAddr = f.SrcAddr
+	case GroupBySubnet:
+		ff.DstAddr = g.Subnet(f.DstAddr)
+	case GroupByPeerSubnet:
+		ff.SrcAddr = g.Subnet(f.SrcAddr)
+	case GroupByVlan:
+		ff.Vlan = f.Vlan
+		ff.InnerVlan = f.InnerVlan
+	}
+
+	return
+}
+
+// Key returns the group of f as a string, the address or subnet, or the vlan
+func (g *Grouping) Key(f *Flow) string {
+	ff := g.Fingerprint(f)
+	switch g.By {
+	case GroupByHost, GroupBySubnet:
+		return ff.DstAddr
+	case GroupByPeer, GroupByPeerSubnet:
+		return ff.SrcAddr
+	default:
+		return ff.VlanString()
+	}
+}
+
+// FlowGroup is the aggregation of the flows of one group, with the rates in bits per second
+type FlowGroup struct {
+	Key              string
+	Flows            int
+	InboundBytes     int64
+	InboundPackets   int64
+	InboundDuration  int64
+	InboundRate      float64
+	OutboundBytes    int64
+	OutboundPackets  int64
+	OutboundDuration int64
+	OutboundRate     float64
+}
+
+// Add adds the counters of f to the group. The durations are the longest of the group, as the flows are
+// sampled over the same time window.
+func (fg *FlowGroup) Add(f *Flow) {
+	fg.Flows++
+	fg.addCounters(f)
+}
+
+// Merge adds the flows of another group to the group
+func (fg *FlowGroup) Merge(o *FlowGroup) {
+	fg.Flows += o.Flows
+	fg.addCounters(o.Counters())
+}
+
+func (fg *FlowGroup) addCounters(f *Flow) {
+	c := fg.Counters()
+	c.Combine(f)
+
+	fg.InboundBytes = c.InboundBytes
+	fg.InboundPackets = c.InboundPackets
+	fg.InboundDuration = c.InboundDuration
+	fg.InboundRate = c.InboundRate()
+	fg.OutboundBytes = c.OutboundBytes
+	fg.OutboundPackets = c.OutboundPackets
+	fg.OutboundDuration = c.OutboundDuration
+	fg.OutboundRate = c.OutboundRate()
+}
+
+// Counters returns the counters of the group as a flow without fingerprint
+func (fg *FlowGroup) Counters() *Flow {
+	return &Flow{
+		InboundBytes:     fg.InboundBytes,
+		InboundPackets:   fg.InboundPackets,
+		InboundDuration:  fg.InboundDuration,
+		OutboundBytes:    fg.OutboundBytes,
+		OutboundPackets:  fg.OutboundPackets,
+		OutboundDuration: fg.OutboundDuration,
+	}
+}
+
+func (fg *FlowGroup) TotalBytes() int64 {
+	return fg.InboundBytes + fg.OutboundBytes
+}
+
+func (fg *FlowGroup) TotalPackets() int64 {
+	return fg.InboundPackets + fg.OutboundPackets
+}
+
+// Rate returns the rate in bits per second of bytes sent over duration seconds
+func Rate(bytes int64, duration int64) float64 {
+	if duration == 0 {
+		return 0
+	}
+
+	return float64(bytes*8) / float64(duration)
+}
+
+// AggregateFlows rolls flows up into one group per key, and returns the groups in order of first appearance
+// together with the total of all flows
+func AggregateFlows(flows []*Flow, grouping Grouping) (groups []*FlowGroup, total *FlowGroup) {
+	total = &FlowGroup{}
+	groupMap := make(map[string]*FlowGroup)
+	for _, f := range flows {
+		key := grouping.Key(f)
+		fg, ok := groupMap[key]
+		if !ok {
+			fg = &FlowGroup{Key: key}
+			groupMap[key] = fg
+			groups = append(groups, fg)
+		}
+
+		fg.Add(f)
+		total.Add(f)
+	}
+
+	return
+}
+
+// GroupFlows rolls flows up into one flow per group, the fingerprint of a grouped flow only keeps the fields
+// of the group
+func GroupFlows(flows []*Flow, grouping Grouping) (grouped []*Flow) {
+	groupMap := make(map[FlowFingerprint]*Flow)
+	for _, f := range flows {
+		ff := grouping.Fingerprint(f)
+		g, ok := groupMap[ff]
+		if !ok {
+			g = &Flow{FlowFingerprint: ff}
+			groupMap[ff] = g
+			grouped = append(grouped, g)
+		}
+
+		g.Combine(f)
+	}
+
+	return
+}
+
+func flowGroupSortValue(fg *FlowGroup, sortBy string) int64 {
+	switch sortBy {
+	case SortByInboundBytes:
+		return fg.InboundBytes
+	case SortByOutboundBytes:
+		return fg.OutboundBytes
+	case SortByPackets:
+		return fg.TotalPackets()
+	case SortByInboundPackets:
+		return fg.InboundPackets
+	case SortByOutboundPackets:
+		return fg.OutboundPackets
+	case SortByRate:
+		return int64(fg.InboundRate + fg.OutboundRate)
+	case SortByInboundRate:
+		return int64(fg.InboundRate)
+	case SortByOutboundRate:
+		return int64(fg.OutboundRate)
+	default:
+		return fg.TotalBytes()
+	}
+}
+
+// SortFlowGroups sorts groups in place, in descending order unless isAscending is set. Groups of the same value
+// are ordered by their keys.
+func SortFlowGroups(groups []*FlowGroup, sortBy string, isAscending bool) {
+	sort.Slice(groups, func(i, j int) bool {
+		vi, vj := flowGroupSortValue(groups[i], sortBy), flowGroupSortValue(groups[j], sortBy)
+		if vi != vj {
+			if isAscending {
+				return vi < vj
+			}
+
+			return vi > vj
+		}
+
+		return groups[i].Key < groups[j].Key
+	})
+}
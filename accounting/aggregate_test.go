@@ -0,0 +1,187 @@
+package accounting
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testFlows() []*Flow {
+	return []*Flow{
+		{
+			FlowFingerprint: FlowFingerprint{SrcAddr: "198.51.100.1", DstAddr: "192.0.2.1", Vlan: 10},
+			InboundBytes:    100, InboundPackets: 1, InboundDuration: 1,
+			OutboundBytes: 200, OutboundPackets: 2, OutboundDuration: 1,
+		},
+		{
+			FlowFingerprint: FlowFingerprint{SrcAddr: "198.51.100.2", DstAddr: "192.0.2.1", Vlan: 10, InnerVlan: 20},
+			InboundBytes:    300, InboundPackets: 3, InboundDuration: 2,
+		},
+		{
+			FlowFingerprint: FlowFingerprint{SrcAddr: "198.51.100.1", DstAddr: "192.0.2.200"},
+			OutboundBytes:   400, OutboundPackets: 4, OutboundDuration: 2,
+		},
+		{
+			FlowFingerprint: FlowFingerprint{SrcAddr: "2001:db8:1::1", DstAddr: "2001:db8:2::1"},
+			InboundBytes:    500, InboundPackets: 5, InboundDuration: 1,
+		},
+	}
+}
+
+func TestAggregateFlows(t *testing.T) {
+	tests := []struct {
+		grouping Grouping
+		want     []FlowGroup
+	}{
+		{
+			Grouping{By: GroupByHost},
+			[]FlowGroup{
+				{Key: "192.0.2.1", Flows: 2, InboundBytes: 400, InboundPackets: 4, InboundDuration: 2,
+					OutboundBytes: 200, OutboundPackets: 2, OutboundDuration: 1},
+				{Key: "192.0.2.200", Flows: 1, OutboundBytes: 400, OutboundPackets: 4, OutboundDuration: 2},
+				{Key: "2001:db8:2::1", Flows: 1, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1},
+			},
+		},
+		{
+			Grouping{By: GroupByPeer},
+			[]FlowGroup{
+				{Key: "198.51.100.1", Flows: 2, InboundBytes: 100, InboundPackets: 1, InboundDuration: 1,
+					OutboundBytes: 600, OutboundPackets: 6, OutboundDuration: 2},
+				{Key: "198.51.100.2", Flows: 1, InboundBytes: 300, InboundPackets: 3, InboundDuration: 2},
+				{Key: "2001:db8:1::1", Flows: 1, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1},
+			},
+		},
+		{
+			Grouping{By: GroupBySubnet, PrefixV4: 24, PrefixV6: 32},
+			[]FlowGroup{
+				{Key: "192.0.2.0/24", Flows: 3, InboundBytes: 400, InboundPackets: 4, InboundDuration: 2,
+					OutboundBytes: 600, OutboundPackets: 6, OutboundDuration: 2},
+				{Key: "2001:db8::/32", Flows: 1, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1},
+			},
+		},
+		{
+			Grouping{By: GroupByPeerSubnet, PrefixV4: 32, PrefixV6: 48},
+			[]FlowGroup{
+				{Key: "198.51.100.1/32", Flows: 2, InboundBytes: 100, InboundPackets: 1, InboundDuration: 1,
+					OutboundBytes: 600, OutboundPackets: 6, OutboundDuration: 2},
+				{Key: "198.51.100.2/32", Flows: 1, InboundBytes: 300, InboundPackets: 3, InboundDuration: 2},
+				{Key: "2001:db8:1::/48", Flows: 1, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1},
+			},
+		},
+		{
+			Grouping{By: GroupByVlan},
+			[]FlowGroup{
+				{Key: "10", Flows: 1, InboundBytes: 100, InboundPackets: 1, InboundDuration: 1,
+					OutboundBytes: 200, OutboundPackets: 2, OutboundDuration: 1},
+				{Key: "10.20", Flows: 1, InboundBytes: 300, InboundPackets: 3, InboundDuration: 2},
+				{Key: "", Flows: 2, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1,
+					OutboundBytes: 400, OutboundPackets: 4, OutboundDuration: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.grouping.By, func(t *testing.T) {
+			groups, total := AggregateFlows(testFlows(), tt.grouping)
+
+			var got []FlowGroup
+			for _, fg := range groups {
+				g := *fg
+				g.InboundRate, g.OutboundRate = 0, 0
+				got = append(got, g)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got groups %+v, want %+v", got, tt.want)
+			}
+
+			wantTotal := FlowGroup{Flows: 4, InboundBytes: 900, InboundPackets: 9, InboundDuration: 2,
+				InboundRate: 3600, OutboundBytes: 600, OutboundPackets: 6, OutboundDuration: 2, OutboundRate: 2400}
+			if *total != wantTotal {
+				t.Errorf("got total %+v, want %+v", *total, wantTotal)
+			}
+		})
+	}
+}
+
+func TestGroupFlows(t *testing.T) {
+	tests := []struct {
+		grouping Grouping
+		want     []Flow
+	}{
+		{
+			Grouping{By: GroupByHost},
+			[]Flow{
+				{FlowFingerprint: FlowFingerprint{DstAddr: "192.0.2.1"}, InboundBytes: 400, InboundPackets: 4,
+					InboundDuration: 2, OutboundBytes: 200, OutboundPackets: 2, OutboundDuration: 1},
+				{FlowFingerprint: FlowFingerprint{DstAddr: "192.0.2.200"}, OutboundBytes: 400, OutboundPackets: 4,
+					OutboundDuration: 2},
+				{FlowFingerprint: FlowFingerprint{DstAddr: "2001:db8:2::1"}, InboundBytes: 500, InboundPackets: 5,
+					InboundDuration: 1},
+			},
+		},
+		{
+			Grouping{By: GroupByVlan},
+			[]Flow{
+				{FlowFingerprint: FlowFingerprint{Vlan: 10}, InboundBytes: 100, InboundPackets: 1,
+					InboundDuration: 1, OutboundBytes: 200, OutboundPackets: 2, OutboundDuration: 1},
+				{FlowFingerprint: FlowFingerprint{Vlan: 10, InnerVlan: 20}, InboundBytes: 300, InboundPackets: 3,
+					InboundDuration: 2},
+				{FlowFingerprint: FlowFingerprint{}, InboundBytes: 500, InboundPackets: 5, InboundDuration: 1,
+					OutboundBytes: 400, OutboundPackets: 4, OutboundDuration: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.grouping.By, func(t *testing.T) {
+			var got []Flow
+			for _, f := range GroupFlows(testFlows(), tt.grouping) {
+				got = append(got, *f)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupingValidate(t *testing.T) {
+	tests := []struct {
+		grouping Grouping
+		isErr    bool
+	}{
+		{Grouping{By: GroupByHost}, false},
+		{Grouping{By: GroupBySubnet, PrefixV4: 32, PrefixV6: 128}, false},
+		{Grouping{By: "port"}, true},
+		{Grouping{By: ""}, true},
+		{Grouping{By: GroupBySubnet, PrefixV4: 33}, true},
+		{Grouping{By: GroupBySubnet, PrefixV6: -1}, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.grouping.Validate()
+		if tt.isErr && err == nil {
+			t.Errorf("grouping %+v accepted", tt.grouping)
+		}
+		if !tt.isErr && err != nil {
+			t.Errorf("grouping %+v rejected: %s", tt.grouping, err.Error())
+		}
+	}
+}
+
+func TestGroupingSubnet(t *testing.T) {
+	g := Grouping{PrefixV4: DefaultPrefixV4, PrefixV6: DefaultPrefixV6}
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.0.2.77", "192.0.2.0/24"},
+		{"2001:db8:1:2:3::4", "2001:db8:1:2::/64"},
+		{"not an address", "not an address"},
+	}
+
+	for _, tt := range tests {
+		if got := g.Subnet(tt.addr); got != tt.want {
+			t.Errorf("Subnet(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package accounting
 
 import (
+	"sort"
+	"strconv"
 	"sync"
 )
 
@@ -12,12 +14,42 @@ var FlowPool = sync.Pool{
 	New: func() interface{} { return new(Flow) },
 }
 
+// FlowFingerprint identifies a flow. Vlan and InnerVlan are the ids of the vlan tag, or of the outer and inner
+// tags of QinQ, and are zero unless vlan accounting is enabled. Tunnel and TunnelId tag the inner flows of
+// decapsulated tunnels with the tunnel type and its VNI, key or session id, and are empty unless tunnel tagging
+// is enabled.
 type FlowFingerprint struct {
-	SrcAddr  string
-	DstAddr  string
-	SrcPort  uint16
-	DstPort  uint16
-	Protocol string
+	SrcAddr   string
+	DstAddr   string
+	SrcPort   uint16
+	DstPort   uint16
+	Protocol  string
+	Vlan      uint16
+	InnerVlan uint16
+	Tunnel    string
+	TunnelId  uint32
+}
+
+// VlanString returns the vlan id, outer.inner for QinQ, or an empty string for flows without vlan
+func (ff *FlowFingerprint) VlanString() string {
+	if ff.Vlan == 0 {
+		return ""
+	}
+
+	if ff.InnerVlan == 0 {
+		return strconv.FormatUint(uint64(ff.Vlan), 10)
+	}
+
+	return strconv.FormatUint(uint64(ff.Vlan), 10) + "." + strconv.FormatUint(uint64(ff.InnerVlan), 10)
+}
+
+// TunnelString returns the tunnel tag as type:id, or an empty string for flows not tagged
+func (ff *FlowFingerprint) TunnelString() string {
+	if ff.Tunnel == "" {
+		return ""
+	}
+
+	return ff.Tunnel + ":" + strconv.FormatUint(uint64(ff.TunnelId), 10)
 }
 
 type Flow struct {
@@ -30,11 +62,66 @@ type Flow struct {
 	OutboundDuration int64
 }
 
+func (f *Flow) TotalBytes() int64 {
+	return f.InboundBytes + f.OutboundBytes
+}
+
+func (f *Flow) TotalPackets() int64 {
+	return f.InboundPackets + f.OutboundPackets
+}
+
+// InboundRate returns the inbound rate in bits per second
+func (f *Flow) InboundRate() float64 {
+	return Rate(f.InboundBytes, f.InboundDuration)
+}
+
+// OutboundRate returns the outbound rate in bits per second
+func (f *Flow) OutboundRate() float64 {
+	return Rate(f.OutboundBytes, f.OutboundDuration)
+}
+
+// Combine adds the counters of another flow sampled over the same time window to f, so the durations are the
+// longest of both instead of their sum
+func (f *Flow) Combine(o *Flow) {
+	f.InboundBytes += o.InboundBytes
+	f.InboundPackets += o.InboundPackets
+	f.OutboundBytes += o.OutboundBytes
+	f.OutboundPackets += o.OutboundPackets
+	if o.InboundDuration > f.InboundDuration {
+		f.InboundDuration = o.InboundDuration
+	}
+	if o.OutboundDuration > f.OutboundDuration {
+		f.OutboundDuration = o.OutboundDuration
+	}
+}
+
+// FlowList returns the flows of a flow map as a slice
+func FlowList(flowMap map[FlowFingerprint]*Flow) (flows []*Flow) {
+	flows = make([]*Flow, 0, len(flowMap))
+	for _, f := range flowMap {
+		flows = append(flows, f)
+	}
+
+	return
+}
+
+type InterfaceCounter struct {
+	InboundBytes    int64
+	InboundPackets  int64
+	OutboundBytes   int64
+	OutboundPackets int64
+}
+
 type FlowTimestamp struct {
 	Start int64
 	End   int64
 }
 
+type InterfaceSample struct {
+	FlowTimestamp
+	InterfaceCounter
+}
+
 func (t *FlowTimestamp) Offset(offset int64) (ts FlowTimestamp) {
 	ts.Start = t.Start + offset
 	ts.End = t.End + offset
@@ -213,6 +300,7 @@ type FlowCollectionHistory struct {
 	InterfaceName  string
 	HistCollection map[FlowTimestamp]*FlowCollection
 	LastTimestamp  FlowTimestamp
+	Counter        InterfaceCounter
 	Mu             *sync.Mutex
 }
 
@@ -230,6 +318,16 @@ func (h *FlowCollectionHistory) SetLastTimestamp(ts FlowTimestamp) {
 	h.LastTimestamp = ts
 }
 
+// UpdateCounter adds the network layer bytes and packets of fc to the counter of the interface since start
+func (h *FlowCollectionHistory) UpdateCounter(fc *FlowCollection) {
+	for _, f := range fc.L3FlowMap {
+		h.Counter.InboundBytes += f.InboundBytes
+		h.Counter.InboundPackets += f.InboundPackets
+		h.Counter.OutboundBytes += f.OutboundBytes
+		h.Counter.OutboundPackets += f.OutboundPackets
+	}
+}
+
 func (h *FlowCollectionHistory) Retention(before int64) {
 	for k := range h.HistCollection {
 		if k.End < before {
@@ -238,32 +336,132 @@ func (h *FlowCollectionHistory) Retention(before int64) {
 	}
 }
 
+// SeriesByDuration returns the network layer totals of each sample kept within the last duration seconds in
+// time order. Samples are walked by their own timestamps, so samples longer than a second, like the ones posted
+// to the aggregator, show up as they are.
+func (h *FlowCollectionHistory) SeriesByDuration(duration int64) (series []InterfaceSample) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	lastTs := h.LastTimestamp
+	for ts, fc := range h.HistCollection {
+		if ts.End > lastTs.End || lastTs.End-ts.End >= duration {
+			continue
+		}
+
+		sample := InterfaceSample{FlowTimestamp: ts}
+		fc.Mu.Lock()
+		for _, f := range fc.L3FlowMap {
+			sample.InboundBytes += f.InboundBytes
+			sample.InboundPackets += f.InboundPackets
+			sample.OutboundBytes += f.OutboundBytes
+			sample.OutboundPackets += f.OutboundPackets
+		}
+		fc.Mu.Unlock()
+		series = append(series, sample)
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Start < series[j].Start
+	})
+
+	return
+}
+
+// AggregationByRange aggregates the samples within [start, end], samples older than the retention are already dropped
+func (h *FlowCollectionHistory) AggregationByRange(start int64, end int64) (fc *FlowCollection, timestamp *FlowTimestamp) {
+	fc = NewFlowCollection(h.InterfaceName)
+	timestamp = &FlowTimestamp{
+		Start: start,
+		End:   end,
+	}
+
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for ts, fcSample := range h.HistCollection {
+		if ts.Start < start || ts.End > end {
+			continue
+		}
+
+		fcSample.Mu.Lock()
+		fc.UpdateByFlowCol(fcSample)
+		fcSample.Mu.Unlock()
+	}
+
+	return
+}
+
+// AggregationAll aggregates all the samples kept, the timestamp spans from the first to the last sample
+func (h *FlowCollectionHistory) AggregationAll() (fc *FlowCollection, timestamp *FlowTimestamp) {
+	fc = NewFlowCollection(h.InterfaceName)
+	timestamp = &FlowTimestamp{}
+
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for ts, fcSample := range h.HistCollection {
+		if timestamp.Start == 0 || ts.Start < timestamp.Start {
+			timestamp.Start = ts.Start
+		}
+		if ts.End > timestamp.End {
+			timestamp.End = ts.End
+		}
+
+		fcSample.Mu.Lock()
+		fc.UpdateByFlowCol(fcSample)
+		fcSample.Mu.Unlock()
+	}
+
+	return
+}
+
+// SamplesAfter returns copies of the samples ending after the given unix timestamp in time order
+func (h *FlowCollectionHistory) SamplesAfter(after int64) (samples []*FlowCollection) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for ts, fcSample := range h.HistCollection {
+		if ts.End <= after {
+			continue
+		}
+
+		fcSample.Mu.Lock()
+		samples = append(samples, fcSample.Copy())
+		fcSample.Mu.Unlock()
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Start < samples[j].Start
+	})
+
+	return
+}
+
 /*
 Assume duration = 5, flow timestamp list is aggregated as below:
 10, 11, | 12, 13, 14, 15, 16, | 17, 18, 19, 20, 21, | 22, 23, 24, 25, 26(LastTimestamp.End)
 */
 func (h *FlowCollectionHistory) AggregationByDuration(duration int64) (fc *FlowCollection, timestamp *FlowTimestamp) {
 	fc = NewFlowCollection(h.InterfaceName)
+
 	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
 	lastTs := h.LastTimestamp
-	h.Mu.Unlock()
 	timestamp = &FlowTimestamp{
 		Start: lastTs.Offset(-duration).Start + 1,
 		End:   lastTs.End,
 	}
 
-	for ts := lastTs; lastTs.End-ts.End < duration; ts = ts.Offset(-1) {
-		h.Mu.Lock()
-		fcSample, ok := h.HistCollection[ts]
-		h.Mu.Unlock()
-		if !ok {
+	// The samples kept are walked rather than every second of the window, so long windows cost no more
+	for ts, fcSample := range h.HistCollection {
+		if ts.End > lastTs.End || lastTs.End-ts.End >= duration {
 			continue
 		}
 
-		fc.Mu.Lock()
 		fcSample.Mu.Lock()
 		fc.UpdateByFlowCol(fcSample)
-		fc.Mu.Unlock()
 		fcSample.Mu.Unlock()
 	}
 
@@ -0,0 +1,107 @@
+package accounting
+
+import (
+	"testing"
+)
+
+// testHistory returns the history of an interface with a sample per second from 10 to 26, every sample has
+// a flow of 1 inbound byte
+func testHistory() *FlowCollectionHistory {
+	h := NewFlowCollectionHistory("eth0")
+	for start := int64(10); start < 26; start++ {
+		fc := NewFlowCollection("eth0")
+		fc.SetTimestamp(start, start+1)
+		fc.UpdateL3Inbound(FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 1, 1)
+		h.HistCollection[fc.FlowTimestamp] = fc
+		h.SetLastTimestamp(fc.FlowTimestamp)
+	}
+
+	return h
+}
+
+func inboundBytes(fc *FlowCollection) (bytes int64) {
+	for _, f := range fc.L3FlowMap {
+		bytes += f.InboundBytes
+	}
+
+	return
+}
+
+func TestAggregationByDuration(t *testing.T) {
+	tests := []struct {
+		duration  int64
+		wantBytes int64
+		wantTs    FlowTimestamp
+	}{
+		{1, 1, FlowTimestamp{25, 26}},
+		{5, 5, FlowTimestamp{21, 26}},
+		{16, 16, FlowTimestamp{10, 26}},
+		{100, 16, FlowTimestamp{-74, 26}},
+	}
+
+	for _, tt := range tests {
+		h := testHistory()
+
+		// A sample after the latest one is not part of the window
+		late := NewFlowCollection("eth0")
+		late.SetTimestamp(30, 31)
+		late.UpdateL3Inbound(FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 1, 1)
+		h.HistCollection[late.FlowTimestamp] = late
+
+		fc, ts := h.AggregationByDuration(tt.duration)
+		if got := inboundBytes(fc); got != tt.wantBytes {
+			t.Errorf("duration %d: got %d bytes, want %d", tt.duration, got, tt.wantBytes)
+		}
+		if *ts != tt.wantTs {
+			t.Errorf("duration %d: got window %+v, want %+v", tt.duration, *ts, tt.wantTs)
+		}
+	}
+}
+
+func TestAggregationByRange(t *testing.T) {
+	tests := []struct {
+		start     int64
+		end       int64
+		wantBytes int64
+	}{
+		{10, 26, 16},
+		{12, 15, 3},
+		{12, 12, 0},
+		{0, 100, 16},
+		{30, 40, 0},
+	}
+
+	for _, tt := range tests {
+		fc, ts := testHistory().AggregationByRange(tt.start, tt.end)
+		if got := inboundBytes(fc); got != tt.wantBytes {
+			t.Errorf("range %d - %d: got %d bytes, want %d", tt.start, tt.end, got, tt.wantBytes)
+		}
+		if ts.Start != tt.start || ts.End != tt.end {
+			t.Errorf("range %d - %d: got window %+v", tt.start, tt.end, *ts)
+		}
+	}
+}
+
+// TestSeriesByDuration returns the samples kept by their own timestamps, also samples longer than a second
+func TestSeriesByDuration(t *testing.T) {
+	series := testHistory().SeriesByDuration(3)
+	if len(series) != 3 || series[0].FlowTimestamp != (FlowTimestamp{23, 24}) ||
+		series[2].FlowTimestamp != (FlowTimestamp{25, 26}) || series[2].InboundBytes != 1 {
+		t.Errorf("got series %+v of per-second samples", series)
+	}
+
+	h := NewFlowCollectionHistory("node1:eth0")
+	for start := int64(100); start < 160; start += 15 {
+		fc := NewFlowCollection("node1:eth0")
+		fc.SetTimestamp(start, start+15)
+		fc.UpdateL3Inbound(FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 15, 15)
+		h.HistCollection[fc.FlowTimestamp] = fc
+		h.SetLastTimestamp(fc.FlowTimestamp)
+	}
+
+	series = h.SeriesByDuration(30)
+	if len(series) != 2 || series[0].FlowTimestamp != (FlowTimestamp{130, 145}) ||
+		series[1].FlowTimestamp != (FlowTimestamp{145, 160}) || series[1].InboundBytes != 15 {
+		t.Errorf("got series %+v of 15 second samples", series)
+	}
+}
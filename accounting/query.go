@@ -0,0 +1,136 @@
+package accounting
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const SortByBytes = "bytes"
+const SortByInboundBytes = "in_bytes"
+const SortByOutboundBytes = "out_bytes"
+const SortByPackets = "packets"
+const SortByInboundPackets = "in_packets"
+const SortByOutboundPackets = "out_packets"
+const SortByRate = "rate"
+const SortByInboundRate = "in_rate"
+const SortByOutboundRate = "out_rate"
+
+var SortByList = []string{SortByBytes, SortByInboundBytes, SortByOutboundBytes, SortByPackets, SortByInboundPackets,
+	SortByOutboundPackets, SortByRate, SortByInboundRate, SortByOutboundRate}
+
+// FlowFilter matches flows by address, port, protocol and vlan, empty or zero fields match any flow. Vlan
+// matches the outer or the inner vlan id.
+type FlowFilter struct {
+	Addr     string
+	Port     uint16
+	Protocol string
+	Vlan     uint16
+}
+
+func (ff *FlowFilter) Match(f *Flow) bool {
+	if ff.Addr != "" && f.SrcAddr != ff.Addr && f.DstAddr != ff.Addr {
+		return false
+	}
+
+	if ff.Port != 0 && f.SrcPort != ff.Port && f.DstPort != ff.Port {
+		return false
+	}
+
+	if ff.Protocol != "" && !strings.EqualFold(f.Protocol, ff.Protocol) {
+		return false
+	}
+
+	if ff.Vlan != 0 && f.Vlan != ff.Vlan && f.InnerVlan != ff.Vlan {
+		return false
+	}
+
+	return true
+}
+
+func FilterFlows(flows []*Flow, filter FlowFilter) (filtered []*Flow) {
+	filtered = make([]*Flow, 0, len(flows))
+	for _, f := range flows {
+		if filter.Match(f) {
+			filtered = append(filtered, f)
+		}
+	}
+
+	return
+}
+
+func flowSortValue(f *Flow, sortBy string) int64 {
+	switch sortBy {
+	case SortByInboundBytes:
+		return f.InboundBytes
+	case SortByOutboundBytes:
+		return f.OutboundBytes
+	case SortByPackets:
+		return f.TotalPackets()
+	case SortByInboundPackets:
+		return f.InboundPackets
+	case SortByOutboundPackets:
+		return f.OutboundPackets
+	case SortByRate:
+		return int64(f.InboundRate() + f.OutboundRate())
+	case SortByInboundRate:
+		return int64(f.InboundRate())
+	case SortByOutboundRate:
+		return int64(f.OutboundRate())
+	default:
+		return f.TotalBytes()
+	}
+}
+
+func ValidateSortBy(sortBy string) (err error) {
+	for _, s := range SortByList {
+		if s == sortBy {
+			return
+		}
+	}
+
+	err = errors.New("invalid sort key: " + sortBy)
+
+	return
+}
+
+// SortFlows sorts flows in place, in descending order unless isAscending is set. Flows of the same value are
+// ordered by their fingerprints, so the order and the top N flows do not change between calls.
+func SortFlows(flows []*Flow, sortBy string, isAscending bool) {
+	sort.Slice(flows, func(i, j int) bool {
+		vi, vj := flowSortValue(flows[i], sortBy), flowSortValue(flows[j], sortBy)
+		if vi != vj {
+			if isAscending {
+				return vi < vj
+			}
+
+			return vi > vj
+		}
+
+		return FingerprintLess(&flows[i].FlowFingerprint, &flows[j].FlowFingerprint)
+	})
+}
+
+// FingerprintLess orders fingerprints by addresses, then ports, protocol, vlans and tunnel
+func FingerprintLess(a *FlowFingerprint, b *FlowFingerprint) bool {
+	switch {
+	case a.SrcAddr != b.SrcAddr:
+		return a.SrcAddr < b.SrcAddr
+	case a.DstAddr != b.DstAddr:
+		return a.DstAddr < b.DstAddr
+	case a.SrcPort != b.SrcPort:
+		return a.SrcPort < b.SrcPort
+	case a.DstPort != b.DstPort:
+		return a.DstPort < b.DstPort
+	case a.Protocol != b.Protocol:
+		return a.Protocol < b.Protocol
+	case a.Vlan != b.Vlan:
+		return a.Vlan < b.Vlan
+	case a.InnerVlan != b.InnerVlan:
+		return a.InnerVlan < b.InnerVlan
+	case a.Tunnel != b.Tunnel:
+		return a.Tunnel < b.Tunnel
+	default:
+		return a.TunnelId < b.TunnelId
+	}
+}
@@ -0,0 +1,113 @@
+package accounting
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortFlows(t *testing.T) {
+	flows := func() []*Flow {
+		return []*Flow{
+			{FlowFingerprint: FlowFingerprint{SrcAddr: "10.0.0.3"}, InboundBytes: 100, OutboundPackets: 9},
+			{FlowFingerprint: FlowFingerprint{SrcAddr: "10.0.0.1", SrcPort: 2}, InboundBytes: 300},
+			{FlowFingerprint: FlowFingerprint{SrcAddr: "10.0.0.1", SrcPort: 1}, InboundBytes: 300},
+			{FlowFingerprint: FlowFingerprint{SrcAddr: "10.0.0.2"}, OutboundBytes: 200, OutboundPackets: 1},
+			{FlowFingerprint: FlowFingerprint{SrcAddr: "10.0.0.1", SrcPort: 1, Vlan: 5}, InboundBytes: 300},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		sortBy      string
+		isAscending bool
+		want        []FlowFingerprint
+	}{
+		{"bytes", SortByBytes, false, []FlowFingerprint{
+			{SrcAddr: "10.0.0.1", SrcPort: 1}, {SrcAddr: "10.0.0.1", SrcPort: 1, Vlan: 5},
+			{SrcAddr: "10.0.0.1", SrcPort: 2}, {SrcAddr: "10.0.0.2"}, {SrcAddr: "10.0.0.3"}}},
+		{"bytes ascending", SortByBytes, true, []FlowFingerprint{
+			{SrcAddr: "10.0.0.3"}, {SrcAddr: "10.0.0.2"}, {SrcAddr: "10.0.0.1", SrcPort: 1},
+			{SrcAddr: "10.0.0.1", SrcPort: 1, Vlan: 5}, {SrcAddr: "10.0.0.1", SrcPort: 2}}},
+		{"out packets", SortByOutboundPackets, false, []FlowFingerprint{
+			{SrcAddr: "10.0.0.3"}, {SrcAddr: "10.0.0.2"}, {SrcAddr: "10.0.0.1", SrcPort: 1},
+			{SrcAddr: "10.0.0.1", SrcPort: 1, Vlan: 5}, {SrcAddr: "10.0.0.1", SrcPort: 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Ties are broken by fingerprint, so the order does not depend on the order of the flows given
+			for _, reversed := range []bool{false, true} {
+				fs := flows()
+				if reversed {
+					for i, j := 0, len(fs)-1; i < j; i, j = i+1, j-1 {
+						fs[i], fs[j] = fs[j], fs[i]
+					}
+				}
+
+				SortFlows(fs, tt.sortBy, tt.isAscending)
+				var got []FlowFingerprint
+				for _, f := range fs {
+					got = append(got, f.FlowFingerprint)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got %+v, want %+v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSortFlowGroups(t *testing.T) {
+	groups := []*FlowGroup{
+		{Key: "c", InboundBytes: 100},
+		{Key: "b", InboundBytes: 300},
+		{Key: "a", InboundBytes: 100},
+		{Key: "d", InboundBytes: 300},
+	}
+
+	SortFlowGroups(groups, SortByBytes, false)
+	var got []string
+	for _, fg := range groups {
+		got = append(got, fg.Key)
+	}
+	if want := []string{"b", "d", "a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestFilterFlows(t *testing.T) {
+	flows := []*Flow{
+		{FlowFingerprint: FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2", SrcPort: 443, DstPort: 40000,
+			Protocol: "tcp"}},
+		{FlowFingerprint: FlowFingerprint{SrcAddr: "192.0.2.3", DstAddr: "192.0.2.1", SrcPort: 53, DstPort: 40001,
+			Protocol: "udp", Vlan: 10, InnerVlan: 20}},
+		{FlowFingerprint: FlowFingerprint{SrcAddr: "192.0.2.3", DstAddr: "192.0.2.4", Vlan: 20}},
+	}
+
+	tests := []struct {
+		name   string
+		filter FlowFilter
+		want   []int
+	}{
+		{"any", FlowFilter{}, []int{0, 1, 2}},
+		{"source or destination address", FlowFilter{Addr: "192.0.2.1"}, []int{0, 1}},
+		{"source or destination port", FlowFilter{Port: 40001}, []int{1}},
+		{"protocol ignoring case", FlowFilter{Protocol: "TCP"}, []int{0}},
+		{"outer or inner vlan", FlowFilter{Vlan: 20}, []int{1, 2}},
+		{"all fields", FlowFilter{Addr: "192.0.2.3", Port: 53, Protocol: "udp", Vlan: 10}, []int{1}},
+		{"none", FlowFilter{Addr: "198.51.100.1"}, []int{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := make([]*Flow, 0, len(tt.want))
+			for _, i := range tt.want {
+				want = append(want, flows[i])
+			}
+
+			if got := FilterFlows(flows, tt.filter); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
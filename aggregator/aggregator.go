@@ -0,0 +1,690 @@
+package aggregator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/notify"
+	"github.com/fs714/goiftop/utils/log"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// NodeSeparator joins the node id and the interface name into the name an interface of a node is accounted by
+const NodeSeparator = ":"
+
+const MaxPayloadBytes = 64 << 20
+const DefaultMaxSkew = 300
+const DefaultRetention = 3600
+const DefaultExpireInterval = 10
+
+// MaxNodes, MaxNodeInterfaces and MaxPendingIntervals bound the memory the posts of the nodes could take, posts
+// beyond them are rejected. MaxNameLength bounds the node ids and interface names, which end up in the api paths
+// and the metric labels.
+const (
+	MaxNodes            = 1024
+	MaxNodeInterfaces   = 256
+	MaxPendingIntervals = 4096
+	MaxNameLength       = 128
+)
+
+// ErrBusy is returned for a post the aggregator could not take at the moment, as its accounting lags behind
+var ErrBusy = errors.New("too many intervals waiting to be accounted")
+
+var GlobalAggregator *Aggregator
+
+// Settings are the settings of the aggregator which could be changed by reload. Posts need the bearer token
+// when it is given, and a signature by the hmac secret at most MaxSkew seconds old when the secret is given.
+// Nodes not posting for NodeTimeout seconds are dropped with their interfaces, or kept when it is 0.
+type Settings struct {
+	Token       string
+	HmacSecret  []byte
+	MaxSkew     int64
+	NodeTimeout int64
+}
+
+// Node is a node posting its flows to the aggregator, as known from its latest post
+type Node struct {
+	Id              string
+	OamAddr         string
+	Hostname        string
+	SoftwareVersion string
+	PayloadVersion  int
+	RemoteAddr      string
+	FirstSeen       int64
+	LastSeen        int64
+	Posts           uint64
+	Interfaces      []string
+}
+
+// Aggregator accounts the flows the webhook notifiers of many nodes post, every interface of a node as an
+// interface of its own named by InterfaceName, so the query api, ui and notifiers cover the whole fleet.
+type Aggregator struct {
+	ctx      context.Context
+	acct     *accounting.Accounting
+	settings Settings
+	nodes    map[string]*Node
+	stats    map[string][]engine.EngineStats
+	pending  map[string]map[accounting.FlowTimestamp]bool
+	mu       *sync.Mutex
+}
+
+func NewAggregator(ctx context.Context, acct *accounting.Accounting, s Settings) *Aggregator {
+	return &Aggregator{
+		ctx:      ctx,
+		acct:     acct,
+		settings: s,
+		nodes:    make(map[string]*Node),
+		stats:    make(map[string][]engine.EngineStats),
+		pending:  make(map[string]map[accounting.FlowTimestamp]bool),
+		mu:       &sync.Mutex{},
+	}
+}
+
+// InterfaceName returns the name an interface of a node is accounted by
+func InterfaceName(nodeId string, ifaceName string) string {
+	return nodeId + NodeSeparator + ifaceName
+}
+
+func (a *Aggregator) SetSettings(s Settings) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.settings = s
+}
+
+// Start drops the nodes which stopped posting until ctx is done
+func (a *Aggregator) Start() {
+	ticker := time.NewTicker(time.Duration(DefaultExpireInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.ctx.Done():
+			log.Infoln("aggregator exit")
+			return
+		case <-ticker.C:
+			a.expire(time.Now().Unix())
+		}
+	}
+}
+
+func (a *Aggregator) expire(now int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.expirePending()
+
+	if a.settings.NodeTimeout <= 0 {
+		return
+	}
+
+	for id, node := range a.nodes {
+		if now-node.LastSeen <= a.settings.NodeTimeout {
+			continue
+		}
+
+		for _, ifaceName := range node.Interfaces {
+			a.acct.RemoveInterface(ifaceName)
+			delete(a.stats, ifaceName)
+			delete(a.pending, ifaceName)
+		}
+		delete(a.nodes, id)
+		log.Infof("node %s removed after %d seconds without posts", id, now-node.LastSeen)
+	}
+}
+
+// Verify checks the bearer token and the signature of a post, as the webhook notifier sends them
+func (a *Aggregator) Verify(header http.Header, body []byte) (err error) {
+	a.mu.Lock()
+	s := a.settings
+	a.mu.Unlock()
+
+	if s.Token != "" {
+		auth := []byte(header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+s.Token)) != 1 {
+			err = errors.New("invalid bearer token")
+			return
+		}
+	}
+
+	if len(s.HmacSecret) > 0 {
+		timestamp := header.Get(notify.TimestampHeader)
+		ts, perr := strconv.ParseInt(timestamp, 10, 64)
+		if perr != nil {
+			err = errors.New("invalid signature timestamp: " + timestamp)
+			return
+		}
+
+		skew := time.Now().Unix() - ts
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > s.MaxSkew {
+			err = errors.New("signature timestamp is " + strconv.FormatInt(skew, 10) + " seconds off")
+			return
+		}
+
+		signature := []byte(header.Get(notify.SignatureHeader))
+		if !hmac.Equal(signature, []byte(notify.Sign(s.HmacSecret, timestamp, body))) {
+			err = errors.New("invalid signature")
+			return
+		}
+	}
+
+	return
+}
+
+// Decode returns the body of a post decompressed by its content encoding
+func Decode(encoding string, body []byte) (payload []byte, err error) {
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+
+	if encoding != "gzip" {
+		err = errors.New("unsupported content encoding: " + encoding)
+		return
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	payload, err = io.ReadAll(io.LimitReader(zr, MaxPayloadBytes+1))
+	if err != nil {
+		return
+	}
+
+	if len(payload) > MaxPayloadBytes {
+		err = errors.New("decompressed payload is larger than " + strconv.Itoa(MaxPayloadBytes) + " bytes")
+		return
+	}
+
+	return
+}
+
+// Ingest accounts the flows of a payload of version 1 or 2 posted from remoteAddr
+func (a *Aggregator) Ingest(remoteAddr string, payload []byte) (err error) {
+	var head struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(payload, &head)
+	if err != nil {
+		return
+	}
+
+	// Payloads of version 1 carry no version
+	switch head.Version {
+	case 0:
+		err = a.ingestV1(remoteAddr, payload)
+	case notify.PayloadVersion2:
+		err = a.ingestV2(remoteAddr, payload)
+	default:
+		err = errors.New("unsupported payload version: " + strconv.Itoa(head.Version))
+	}
+
+	return
+}
+
+// validateName checks a node id or an interface name of a payload, the node id should not contain NodeSeparator
+// either so the names the interfaces of the nodes are accounted by are distinct
+func validateName(kind string, name string) (err error) {
+	if name == "" {
+		err = errors.New("no " + kind + " provided")
+		return
+	}
+
+	if len(name) > MaxNameLength {
+		err = errors.New(kind + " is longer than " + strconv.Itoa(MaxNameLength) + " bytes")
+		return
+	}
+
+	if strings.Contains(name, "/") {
+		err = errors.New(kind + " should not contain /: " + name)
+		return
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			err = errors.New(kind + " should not contain control characters: " + strconv.Quote(name))
+			return
+		}
+	}
+
+	return
+}
+
+func validateNodeId(nodeId string) (err error) {
+	if nodeId == "" {
+		err = errors.New("no node id provided, it is set by -webhook.node_id on the node")
+		return
+	}
+
+	if strings.Contains(nodeId, NodeSeparator) {
+		err = errors.New("node id should not contain " + NodeSeparator + ": " + nodeId)
+		return
+	}
+
+	return validateName("node id", nodeId)
+}
+
+// admit adds a node and the sorted names its interfaces are accounted by, unless they are beyond MaxNodes or
+// MaxNodeInterfaces. The node is seen from now on, so its interfaces are dropped with it once it stops posting.
+func (a *Aggregator) admit(nodeId string, ifaceNames []string) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	node, ok := a.nodes[nodeId]
+	if !ok && len(a.nodes) >= MaxNodes {
+		err = errors.New("too many nodes, at most " + strconv.Itoa(MaxNodes) + " are kept")
+		return
+	}
+
+	// ifaceNames are sorted, and the ones the node is known with are counted once
+	var newNames []string
+	for i, ifaceName := range ifaceNames {
+		if i > 0 && ifaceNames[i-1] == ifaceName {
+			continue
+		}
+		if node != nil {
+			j := sort.SearchStrings(node.Interfaces, ifaceName)
+			if j < len(node.Interfaces) && node.Interfaces[j] == ifaceName {
+				continue
+			}
+		}
+		newNames = append(newNames, ifaceName)
+	}
+
+	count := len(newNames)
+	if node != nil {
+		count += len(node.Interfaces)
+	}
+	if count > MaxNodeInterfaces {
+		err = errors.New("too many interfaces of node " + nodeId + ", at most " + strconv.Itoa(MaxNodeInterfaces) +
+			" are kept")
+		return
+	}
+
+	if node == nil {
+		now := time.Now().Unix()
+		node = &Node{
+			Id:        nodeId,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		a.nodes[nodeId] = node
+	}
+
+	// Interfaces are kept once posted, a notifier could only report some of them
+	for _, ifaceName := range newNames {
+		i := sort.SearchStrings(node.Interfaces, ifaceName)
+		node.Interfaces = append(node.Interfaces, "")
+		copy(node.Interfaces[i+1:], node.Interfaces[i:])
+		node.Interfaces[i] = ifaceName
+	}
+
+	return
+}
+
+func (a *Aggregator) ingestV1(remoteAddr string, payload []byte) (err error) {
+	var flows notify.Flows
+	err = json.Unmarshal(payload, &flows)
+	if err != nil {
+		return
+	}
+
+	err = validateNodeId(flows.RouterId)
+	if err != nil {
+		return
+	}
+
+	node := Node{
+		Id:             flows.RouterId,
+		OamAddr:        flows.OamAddr,
+		PayloadVersion: notify.PayloadVersion1,
+		RemoteAddr:     remoteAddr,
+	}
+
+	ifaceNames := make([]string, 0, len(flows.FLowsMap))
+	names := make([]string, 0, len(flows.FLowsMap))
+	for ifaceName := range flows.FLowsMap {
+		err = validateName("interface name", ifaceName)
+		if err != nil {
+			return
+		}
+		ifaceNames = append(ifaceNames, ifaceName)
+		names = append(names, InterfaceName(node.Id, ifaceName))
+	}
+	sort.Strings(ifaceNames)
+	sort.Strings(names)
+
+	err = a.admit(node.Id, names)
+	if err != nil {
+		return
+	}
+
+	// Version 1 has one interval for all interfaces, which is the interval of the last interface
+	for _, ifaceName := range ifaceNames {
+		name := InterfaceName(node.Id, ifaceName)
+		fc := accounting.NewFlowCollection(name)
+		fc.SetTimestamp(flows.Start, flows.End)
+		for _, f := range flows.FLowsMap[ifaceName] {
+			flow := &accounting.Flow{
+				FlowFingerprint: accounting.FlowFingerprint{
+					SrcAddr:   f.SrcAddr,
+					DstAddr:   f.DstAddr,
+					SrcPort:   f.SrcPort,
+					DstPort:   f.DstPort,
+					Protocol:  f.Protocol,
+					Vlan:      f.Vlan,
+					InnerVlan: f.InnerVlan,
+					Tunnel:    f.Tunnel,
+					TunnelId:  f.TunnelId,
+				},
+				InboundBytes:     f.InboundBytes,
+				InboundPackets:   f.InboundPackets,
+				InboundDuration:  f.InboundDuration,
+				OutboundBytes:    f.OutboundBytes,
+				OutboundPackets:  f.OutboundPackets,
+				OutboundDuration: f.OutboundDuration,
+			}
+			if f.Layer == notify.Layer4String {
+				addFlow(fc.L4FlowMap, flow)
+			} else {
+				addFlow(fc.L3FlowMap, flow)
+			}
+		}
+
+		stats := make([]engine.EngineStats, 0, len(flows.StatsMap[ifaceName]))
+		for _, s := range flows.StatsMap[ifaceName] {
+			s.Interface = name
+			stats = append(stats, s)
+		}
+
+		err = a.account(fc, stats)
+		if err != nil {
+			return
+		}
+	}
+
+	a.updateNode(node)
+
+	return
+}
+
+func (a *Aggregator) ingestV2(remoteAddr string, payload []byte) (err error) {
+	var p notify.PayloadV2
+	err = json.Unmarshal(payload, &p)
+	if err != nil {
+		return
+	}
+
+	err = validateNodeId(p.Node.Id)
+	if err != nil {
+		return
+	}
+
+	node := Node{
+		Id:              p.Node.Id,
+		OamAddr:         p.Node.OamAddr,
+		Hostname:        p.Node.Hostname,
+		SoftwareVersion: p.Node.SoftwareVersion,
+		PayloadVersion:  notify.PayloadVersion2,
+		RemoteAddr:      remoteAddr,
+	}
+
+	names := make([]string, 0, len(p.Interfaces))
+	for _, iface := range p.Interfaces {
+		err = validateName("interface name", iface.Name)
+		if err != nil {
+			return
+		}
+		names = append(names, InterfaceName(node.Id, iface.Name))
+	}
+	sort.Strings(names)
+
+	err = a.admit(node.Id, names)
+	if err != nil {
+		return
+	}
+
+	for _, iface := range p.Interfaces {
+		name := InterfaceName(node.Id, iface.Name)
+		fc := accounting.NewFlowCollection(name)
+		fc.SetTimestamp(iface.Start, iface.End)
+		for _, f := range iface.L3Flows {
+			addFlow(fc.L3FlowMap, newFlow(f, accounting.FlowFingerprint{}))
+		}
+		for _, f := range iface.L4Flows {
+			addFlow(fc.L4FlowMap, newFlow(&f.L3FlowV2, accounting.FlowFingerprint{
+				SrcPort:  f.SrcPort,
+				DstPort:  f.DstPort,
+				Protocol: f.Protocol,
+			}))
+		}
+
+		stats := make([]engine.EngineStats, 0, len(iface.Engines))
+		for _, s := range iface.Engines {
+			stats = append(stats, engine.EngineStats{
+				Interface: name,
+				Direction: s.Direction,
+				CaptureStats: engine.CaptureStats{
+					Received:     s.ReceivedPackets,
+					Dropped:      s.DroppedPackets,
+					IfDropped:    s.IfDroppedPackets,
+					QueueFreezes: s.QueueFreezes,
+				},
+			})
+		}
+
+		err = a.account(fc, stats)
+		if err != nil {
+			return
+		}
+	}
+
+	a.updateNode(node)
+
+	return
+}
+
+// newFlow returns the flow of f, with the transport layer fields of the fingerprint given
+func newFlow(f *notify.L3FlowV2, fp accounting.FlowFingerprint) *accounting.Flow {
+	fp.SrcAddr = f.SrcAddr
+	fp.DstAddr = f.DstAddr
+	fp.Vlan = f.Vlan
+	fp.InnerVlan = f.InnerVlan
+	fp.Tunnel = f.Tunnel
+	fp.TunnelId = f.TunnelId
+
+	return &accounting.Flow{
+		FlowFingerprint:  fp,
+		InboundBytes:     f.InBytes,
+		InboundPackets:   f.InPackets,
+		InboundDuration:  f.InDuration,
+		OutboundBytes:    f.OutBytes,
+		OutboundPackets:  f.OutPackets,
+		OutboundDuration: f.OutDuration,
+	}
+}
+
+// addFlow adds a flow to flowMap, flows of the same fingerprint are combined
+func addFlow(flowMap map[accounting.FlowFingerprint]*accounting.Flow, f *accounting.Flow) {
+	flow, ok := flowMap[f.FlowFingerprint]
+	if !ok {
+		flowMap[f.FlowFingerprint] = f
+		return
+	}
+
+	flow.Combine(f)
+}
+
+// account hands the flows of an interface of a node to the accounting. An interval already accounted for the
+// interface is skipped, so a post retried after its response was lost is not counted twice. The interval is
+// recorded as pending under the same lock it is checked by, so retries posted at the same time are skipped as
+// well while the first one is still on its way to the accounting.
+func (a *Aggregator) account(fc *accounting.FlowCollection, stats []engine.EngineStats) (err error) {
+	a.mu.Lock()
+	if a.isAccounted(fc) {
+		a.mu.Unlock()
+		log.Debugf("skip interval %d - %d of interface %s accounted already", fc.Start, fc.End, fc.InterfaceName)
+		return
+	}
+
+	pending, ok := a.pending[fc.InterfaceName]
+	if ok && len(pending) >= MaxPendingIntervals {
+		a.expirePending()
+		if len(pending) >= MaxPendingIntervals {
+			a.mu.Unlock()
+			err = ErrBusy
+			return
+		}
+	}
+	if !ok {
+		pending = make(map[accounting.FlowTimestamp]bool)
+		a.pending[fc.InterfaceName] = pending
+	}
+	pending[fc.FlowTimestamp] = true
+	a.mu.Unlock()
+
+	select {
+	case a.acct.Ch <- fc:
+	case <-a.ctx.Done():
+		a.mu.Lock()
+		delete(pending, fc.FlowTimestamp)
+		a.mu.Unlock()
+
+		err = errors.New("aggregator is stopping")
+		return
+	}
+
+	a.mu.Lock()
+	a.stats[fc.InterfaceName] = stats
+	a.mu.Unlock()
+
+	return
+}
+
+// isAccounted tells whether the interval of fc is accounted or pending already, the interface is added to the
+// accounting when it is new. a.mu is held by the caller.
+func (a *Aggregator) isAccounted(fc *accounting.FlowCollection) bool {
+	if a.pending[fc.InterfaceName][fc.FlowTimestamp] {
+		return true
+	}
+
+	flowColHist, ok := a.acct.GetInterface(fc.InterfaceName)
+	if !ok {
+		a.acct.AddInterface(fc.InterfaceName)
+		log.Infof("interface %s added", fc.InterfaceName)
+		return false
+	}
+
+	flowColHist.Mu.Lock()
+	defer flowColHist.Mu.Unlock()
+	_, ok = flowColHist.HistCollection[fc.FlowTimestamp]
+
+	return ok
+}
+
+// expirePending drops the pending intervals which reached the history of their interface, or whose interface
+// is gone. a.mu is held by the caller.
+func (a *Aggregator) expirePending() {
+	for ifaceName, pending := range a.pending {
+		flowColHist, ok := a.acct.GetInterface(ifaceName)
+		if !ok {
+			delete(a.pending, ifaceName)
+			continue
+		}
+
+		flowColHist.Mu.Lock()
+		for ts := range pending {
+			if _, ok = flowColHist.HistCollection[ts]; ok {
+				delete(pending, ts)
+			}
+		}
+		flowColHist.Mu.Unlock()
+
+		if len(pending) == 0 {
+			delete(a.pending, ifaceName)
+		}
+	}
+}
+
+func (a *Aggregator) updateNode(n Node) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().Unix()
+	node, ok := a.nodes[n.Id]
+	if !ok {
+		return
+	}
+	if node.Posts == 0 {
+		log.Infof("node %s added from %s", n.Id, n.RemoteAddr)
+	}
+
+	node.OamAddr = n.OamAddr
+	node.Hostname = n.Hostname
+	node.SoftwareVersion = n.SoftwareVersion
+	node.PayloadVersion = n.PayloadVersion
+	node.RemoteAddr = n.RemoteAddr
+	node.LastSeen = now
+	node.Posts++
+}
+
+// Nodes returns the nodes posting to the aggregator, ordered by id
+func (a *Aggregator) Nodes() (nodes []Node) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	nodes = make([]Node, 0, len(a.nodes))
+	for _, node := range a.nodes {
+		n := *node
+		n.Interfaces = append([]string(nil), node.Interfaces...)
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Id < nodes[j].Id
+	})
+
+	return
+}
+
+// Stats returns the capture statistics the nodes posted last for an interface, or for all interfaces when
+// ifaceName is empty, ordered by interface and direction
+func (a *Aggregator) Stats(ifaceName string) (stats []engine.EngineStats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for name, s := range a.stats {
+		if ifaceName != "" && name != ifaceName {
+			continue
+		}
+		stats = append(stats, s...)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Interface != stats[j].Interface {
+			return stats[i].Interface < stats[j].Interface
+		}
+
+		return stats[i].Direction < stats[j].Direction
+	})
+
+	return
+}
@@ -0,0 +1,371 @@
+package aggregator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/notify"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testReport() *notify.Report {
+	l3 := &accounting.Flow{
+		FlowFingerprint: accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2", Vlan: 10,
+			InnerVlan: 20, Tunnel: "vxlan", TunnelId: 42},
+		InboundBytes:     1000,
+		InboundPackets:   2,
+		InboundDuration:  1,
+		OutboundBytes:    3000,
+		OutboundPackets:  4,
+		OutboundDuration: 1,
+	}
+	l4 := &accounting.Flow{
+		FlowFingerprint: accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2", SrcPort: 40000,
+			DstPort: 443, Protocol: "tcp", Vlan: 10, InnerVlan: 20, Tunnel: "vxlan", TunnelId: 42},
+		InboundBytes:     900,
+		InboundPackets:   2,
+		InboundDuration:  1,
+		OutboundBytes:    2900,
+		OutboundPackets:  4,
+		OutboundDuration: 1,
+	}
+
+	return &notify.Report{Interfaces: []*notify.InterfaceReport{{
+		Interface:     "eth0",
+		FlowTimestamp: accounting.FlowTimestamp{Start: 100, End: 101},
+		L3Flows:       []*accounting.Flow{l3},
+		L4Flows:       []*accounting.Flow{l4},
+		Stats: []engine.EngineStats{{Interface: "eth0", Direction: "in",
+			CaptureStats: engine.CaptureStats{Received: 10, Dropped: 1}}},
+	}}}
+}
+
+// TestIngest posts the payloads the webhook notifier sends, and checks the flows handed to the accounting
+func TestIngest(t *testing.T) {
+	r := testReport()
+	tests := []struct {
+		name    string
+		payload interface{}
+		version int
+	}{
+		{"v1", notify.NewPayloadV1(r, "node1", "10.0.0.1"), notify.PayloadVersion1},
+		{"v2", notify.NewPayloadV2(r, notify.NodeV2{Id: "node1", OamAddr: "10.0.0.1"}), notify.PayloadVersion2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			acct := accounting.NewAccounting()
+			a := NewAggregator(ctx, acct, Settings{})
+
+			payload, err := json.Marshal(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = a.Ingest("192.0.2.254:1234", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var fc *accounting.FlowCollection
+			select {
+			case fc = <-acct.Ch:
+			default:
+				t.Fatal("no flows accounted")
+			}
+
+			if fc.InterfaceName != "node1:eth0" || fc.FlowTimestamp != r.Interfaces[0].FlowTimestamp {
+				t.Errorf("got interface %s of %+v", fc.InterfaceName, fc.FlowTimestamp)
+			}
+
+			for _, layer := range []struct {
+				flowMap map[accounting.FlowFingerprint]*accounting.Flow
+				want    []*accounting.Flow
+			}{
+				{fc.L3FlowMap, r.Interfaces[0].L3Flows},
+				{fc.L4FlowMap, r.Interfaces[0].L4Flows},
+			} {
+				if len(layer.flowMap) != len(layer.want) {
+					t.Fatalf("got %d flows, want %d", len(layer.flowMap), len(layer.want))
+				}
+				for _, want := range layer.want {
+					got, ok := layer.flowMap[want.FlowFingerprint]
+					if !ok || !reflect.DeepEqual(got, want) {
+						t.Errorf("got flow %+v, want %+v", got, want)
+					}
+				}
+			}
+
+			stats := a.Stats("node1:eth0")
+			if len(stats) != 1 || stats[0].Interface != "node1:eth0" ||
+				stats[0].CaptureStats != r.Interfaces[0].Stats[0].CaptureStats {
+				t.Errorf("got stats %+v", stats)
+			}
+
+			nodes := a.Nodes()
+			if len(nodes) != 1 {
+				t.Fatalf("got %d nodes, want 1", len(nodes))
+			}
+			n := nodes[0]
+			if n.Id != "node1" || n.OamAddr != "10.0.0.1" || n.PayloadVersion != tt.version ||
+				n.RemoteAddr != "192.0.2.254:1234" || !reflect.DeepEqual(n.Interfaces, []string{"node1:eth0"}) {
+				t.Errorf("got node %+v", n)
+			}
+		})
+	}
+}
+
+// TestIngestRetry counts a payload posted again, at the same time or after it is accounted, only once
+func TestIngestRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acct := accounting.NewAccounting()
+	a := NewAggregator(ctx, acct, Settings{})
+	payload, err := json.Marshal(notify.NewPayloadV2(testReport(), notify.NodeV2{Id: "node1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := a.Ingest("192.0.2.254:1234", payload); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(acct.Ch) != 1 {
+		t.Fatalf("got %d flow collections of concurrent retries, want 1", len(acct.Ch))
+	}
+
+	// Once the interval reached the history it is no longer pending, and still skipped
+	fc := <-acct.Ch
+	h, _ := acct.GetInterface(fc.InterfaceName)
+	h.HistCollection[fc.FlowTimestamp] = fc
+	a.expire(time.Now().Unix())
+	if len(a.pending) != 0 {
+		t.Errorf("got pending intervals of %d interfaces after they are accounted", len(a.pending))
+	}
+
+	err = a.Ingest("192.0.2.254:1234", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acct.Ch) != 0 {
+		t.Error("interval accounted already is accounted again")
+	}
+}
+
+func TestIngestInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"not json", "flows"},
+		{"unsupported version", `{"version": 3}`},
+		{"v1 without node id", `{"RouterId": ""}`},
+		{"v2 without node id", `{"version": 2, "node": {}}`},
+		{"node id with /", `{"version": 2, "node": {"id": "a/b"}}`},
+		{"node id with separator", `{"version": 2, "node": {"id": "a:b"}}`},
+		{"node id with control character", `{"version": 2, "node": {"id": "a\nb"}}`},
+		{"long node id", `{"version": 2, "node": {"id": "` + strings.Repeat("a", MaxNameLength+1) + `"}}`},
+		{"v1 interface with /", `{"RouterId": "node1", "FLowsMap": {"eth0/1": []}}`},
+		{"v2 interface without name", `{"version": 2, "node": {"id": "node1"}, "interfaces": [{"name": ""}]}`},
+		{"v2 interface with control character",
+			`{"version": 2, "node": {"id": "node1"}, "interfaces": [{"name": "eth0\u0000"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(context.Background(), accounting.NewAccounting(), Settings{})
+			err := a.Ingest("192.0.2.254:1234", []byte(tt.payload))
+			if err == nil {
+				t.Error("invalid payload ingested")
+			}
+			if len(a.Nodes()) != 0 {
+				t.Error("node of an invalid payload added")
+			}
+		})
+	}
+}
+
+// TestIngestLimits rejects posts of nodes and interfaces beyond the caps, and posts while too many intervals
+// are waiting to be accounted
+func TestIngestLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acct := accounting.NewAccounting()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-acct.Ch:
+			}
+		}
+	}()
+	a := NewAggregator(ctx, acct, Settings{})
+
+	ingest := func(nodeId string, ifaceNames ...string) error {
+		p := notify.PayloadV2{Version: notify.PayloadVersion2, Node: notify.NodeV2{Id: nodeId}}
+		for _, ifaceName := range ifaceNames {
+			p.Interfaces = append(p.Interfaces, &notify.InterfaceV2{Name: ifaceName, Start: 100, End: 101})
+		}
+		payload, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return a.Ingest("192.0.2.254:1234", payload)
+	}
+
+	for i := 0; i < MaxNodes; i++ {
+		if err := ingest("node" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ingest("node" + strconv.Itoa(MaxNodes)); err == nil {
+		t.Error("node beyond the max nodes accepted")
+	}
+	if err := ingest("node0", "eth0"); err != nil {
+		t.Errorf("known node rejected: %s", err)
+	}
+
+	var ifaceNames []string
+	for i := 1; i < MaxNodeInterfaces; i++ {
+		ifaceNames = append(ifaceNames, "eth"+strconv.Itoa(i))
+	}
+	if err := ingest("node0", ifaceNames...); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingest("node0", "eth0", "eth1"); err != nil {
+		t.Errorf("known interfaces rejected: %s", err)
+	}
+	if err := ingest("node0", "eth"+strconv.Itoa(MaxNodeInterfaces)); err == nil {
+		t.Error("interface beyond the max interfaces of a node accepted")
+	}
+	if n := a.Nodes()[0]; n.Id != "node0" || len(n.Interfaces) != MaxNodeInterfaces {
+		t.Errorf("got node %s with %d interfaces", n.Id, len(n.Interfaces))
+	}
+
+	// Intervals never reaching the history stay pending
+	a.mu.Lock()
+	pending := a.pending["node0:eth0"]
+	for i := int64(0); len(pending) < MaxPendingIntervals; i++ {
+		pending[accounting.FlowTimestamp{Start: 1000 + i, End: 1001 + i}] = true
+	}
+	a.mu.Unlock()
+	if err := ingest("node0", "eth0"); err != nil {
+		t.Errorf("interval pending already rejected: %s", err)
+	}
+	p := notify.PayloadV2{Version: notify.PayloadVersion2, Node: notify.NodeV2{Id: "node0"},
+		Interfaces: []*notify.InterfaceV2{{Name: "eth0", Start: 200, End: 201}}}
+	payload, _ := json.Marshal(p)
+	if err := a.Ingest("192.0.2.254:1234", payload); !errors.Is(err, ErrBusy) {
+		t.Errorf("got err %v with too many intervals pending, want %v", err, ErrBusy)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	acct := accounting.NewAccounting()
+	a := NewAggregator(context.Background(), acct, Settings{NodeTimeout: 60})
+
+	payload, err := json.Marshal(notify.NewPayloadV1(testReport(), "node1", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Ingest("192.0.2.254:1234", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastSeen := a.Nodes()[0].LastSeen
+	a.expire(lastSeen + 60)
+	if len(a.Nodes()) != 1 {
+		t.Fatal("node removed before the node timeout")
+	}
+
+	a.expire(lastSeen + 61)
+	if len(a.Nodes()) != 0 {
+		t.Error("node kept after the node timeout")
+	}
+	if _, ok := acct.GetInterface("node1:eth0"); ok {
+		t.Error("interface of the node kept after the node timeout")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"version": 2}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Unix()-600, 10)
+
+	header := func(token string, timestamp string, signature string) http.Header {
+		h := http.Header{}
+		if token != "" {
+			h.Set("Authorization", "Bearer "+token)
+		}
+		if timestamp != "" {
+			h.Set(notify.TimestampHeader, timestamp)
+		}
+		if signature != "" {
+			h.Set(notify.SignatureHeader, signature)
+		}
+
+		return h
+	}
+
+	tests := []struct {
+		name     string
+		settings Settings
+		header   http.Header
+		isErr    bool
+	}{
+		{"open", Settings{}, header("", "", ""), false},
+		{"token", Settings{Token: "t0ken"}, header("t0ken", "", ""), false},
+		{"invalid token", Settings{Token: "t0ken"}, header("token", "", ""), true},
+		{"no token", Settings{Token: "t0ken"}, header("", "", ""), true},
+		{"signed", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("", now, notify.Sign([]byte("s3cret"), now, body)), false},
+		{"signed by another secret", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("", now, notify.Sign([]byte("secret"), now, body)), true},
+		{"signature of another time", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("", now, notify.Sign([]byte("s3cret"), old, body)), true},
+		{"signature too old", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("", old, notify.Sign([]byte("s3cret"), old, body)), true},
+		{"no timestamp", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("", "", notify.Sign([]byte("s3cret"), "", body)), true},
+		{"no signature", Settings{HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew}, header("", now, ""), true},
+		{"token and signature", Settings{Token: "t0ken", HmacSecret: []byte("s3cret"), MaxSkew: DefaultMaxSkew},
+			header("t0ken", now, notify.Sign([]byte("s3cret"), now, body)), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAggregator(context.Background(), accounting.NewAccounting(), tt.settings)
+			err := a.Verify(tt.header, body)
+			if tt.isErr && err == nil {
+				t.Error("post accepted")
+			}
+			if !tt.isErr && err != nil {
+				t.Errorf("post rejected: %s", err.Error())
+			}
+		})
+	}
+}
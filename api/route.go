@@ -1,22 +1,34 @@
 package api
 
 import (
+	"github.com/fs714/goiftop/api/ui"
 	"github.com/fs714/goiftop/api/v1"
 	"github.com/fs714/goiftop/utils/config"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
+	"net/http"
 )
 
+// decompress decompresses gzip request bodies, except the posts of the nodes which are signed as compressed
+func decompress(c *gin.Context) {
+	if c.Request.URL.Path == v1.IngestPath {
+		return
+	}
+
+	gzip.DefaultDecompressHandle(c)
+}
+
 func InitRouter() *gin.Engine {
 	gin.SetMode("release")
 	gin.DisableConsoleColor()
 	r := gin.New()
 	r.Use(gin.LoggerWithConfig(gin.LoggerConfig{
-		SkipPaths: []string{"/api/v1/health"},
+		SkipPaths: []string{"/api/v1/health", "/metrics"},
 	}))
-	r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithDecompressFn(gzip.DefaultDecompressHandle)))
+	r.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithDecompressFn(decompress),
+		gzip.WithExcludedPaths([]string{"/api/v1/stream"})))
 	r.Use(gin.Recovery())
 	r.Use(cors.Default())
 
@@ -24,9 +36,25 @@ func InitRouter() *gin.Engine {
 		pprof.Register(r)
 	}
 
+	r.GET("/metrics", v1.Metrics)
+	r.StaticFS("/ui", ui.FileSystem())
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+
 	apiv1 := r.Group("/api/v1")
 	{
 		apiv1.GET("/health", v1.Health)
+		apiv1.POST("/ingest", v1.Ingest)
+		apiv1.GET("/interfaces", v1.ListInterfaces)
+		apiv1.GET("/interfaces/:name/flows", v1.GetFlows)
+		apiv1.GET("/interfaces/:name/groups", v1.GetGroups)
+		apiv1.GET("/interfaces/:name/series", v1.GetSeries)
+		apiv1.GET("/nodes", v1.ListNodes)
+		apiv1.GET("/stats", v1.GetStats)
+		apiv1.GET("/stream/sse", v1.StreamSSE)
+		apiv1.GET("/stream/ws", v1.StreamWebsocket)
+		apiv1.POST("/reload", v1.Reload)
 	}
 
 	return r
@@ -0,0 +1,288 @@
+"use strict";
+
+const API = "../api/v1";
+const REFRESH_MS = 2000;
+const SERIES_SECONDS = 300;
+const TOP_N = 10;
+
+const FLOW_COLUMNS = [
+  { key: "SrcAddr", title: "Remote" },
+  { key: "SrcPort", title: "RPort", num: true, l4: true },
+  { key: "DstAddr", title: "Local" },
+  { key: "DstPort", title: "LPort", num: true, l4: true },
+  { key: "Protocol", title: "Proto", l4: true },
+  { key: "InboundBytes", title: "BytesIn", num: true, bytes: true },
+  { key: "InboundPackets", title: "PacketsIn", num: true },
+  { key: "InboundRate", title: "RateIn", num: true, rate: true },
+  { key: "OutboundBytes", title: "BytesOut", num: true, bytes: true },
+  { key: "OutboundPackets", title: "PacketsOut", num: true },
+  { key: "OutboundRate", title: "RateOut", num: true, rate: true },
+];
+
+const state = {
+  iface: "",
+  paused: false,
+  sortKey: "InboundBytes",
+  sortAsc: false,
+  flows: [],
+};
+
+const $ = (id) => document.getElementById(id);
+
+async function getData(path) {
+  const resp = await fetch(API + path);
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.msg || resp.statusText);
+  }
+  return body.data;
+}
+
+function formatBytes(n) {
+  const units = ["B", "KB", "MB", "GB", "TB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i === 0 ? n.toFixed(0) : n.toFixed(2)) + units[i];
+}
+
+function formatRate(bps) {
+  const units = ["bps", "Kbps", "Mbps", "Gbps"];
+  let i = 0;
+  while (bps >= 1000 && i < units.length - 1) {
+    bps /= 1000;
+    i++;
+  }
+  return (i === 0 ? bps.toFixed(0) : bps.toFixed(2)) + units[i];
+}
+
+function hostPort(addr, port) {
+  return (addr.includes(":") ? "[" + addr + "]" : addr) + ":" + port;
+}
+
+function cell(text, num) {
+  const td = document.createElement("td");
+  td.textContent = text;
+  if (num) {
+    td.className = "num";
+  }
+  return td;
+}
+
+function fillTable(table, rows) {
+  const tbody = table.querySelector("tbody");
+  tbody.replaceChildren(...rows.map((cells) => {
+    const tr = document.createElement("tr");
+    tr.append(...cells);
+    return tr;
+  }));
+}
+
+async function loadInterfaces() {
+  const ifaces = await getData("/interfaces");
+  const select = $("iface");
+  const names = ifaces.map((i) => i.Name);
+  select.replaceChildren(...names.map((n) => new Option(n, n)));
+  if (!names.includes(state.iface)) {
+    state.iface = names[0] || "";
+  }
+  select.value = state.iface;
+}
+
+function drawChart(series) {
+  const canvas = $("chart");
+  const ctx = canvas.getContext("2d");
+  canvas.width = canvas.clientWidth * window.devicePixelRatio;
+  canvas.height = 220 * window.devicePixelRatio;
+  ctx.scale(window.devicePixelRatio, window.devicePixelRatio);
+
+  const w = canvas.clientWidth;
+  const h = 220;
+  const pad = { left: 70, right: 10, top: 10, bottom: 20 };
+  ctx.clearRect(0, 0, w, h);
+
+  const rates = series.map((s) => ({
+    in: (s.InboundBytes * 8) / (s.End - s.Start),
+    out: (s.OutboundBytes * 8) / (s.End - s.Start),
+  }));
+  const max = Math.max(1000, ...rates.map((r) => Math.max(r.in, r.out))) * 1.1;
+
+  ctx.strokeStyle = "#eceff1";
+  ctx.fillStyle = "#607d8b";
+  ctx.font = "11px sans-serif";
+  for (let i = 0; i <= 4; i++) {
+    const y = pad.top + ((h - pad.top - pad.bottom) * i) / 4;
+    ctx.beginPath();
+    ctx.moveTo(pad.left, y);
+    ctx.lineTo(w - pad.right, y);
+    ctx.stroke();
+    ctx.fillText(formatRate((max * (4 - i)) / 4), 4, y + 4);
+  }
+
+  const plot = (key, color) => {
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 1.5;
+    ctx.beginPath();
+    rates.forEach((r, i) => {
+      const x = pad.left + ((w - pad.left - pad.right) * i) / Math.max(1, rates.length - 1);
+      const y = pad.top + (h - pad.top - pad.bottom) * (1 - r[key] / max);
+      if (i === 0) {
+        ctx.moveTo(x, y);
+      } else {
+        ctx.lineTo(x, y);
+      }
+    });
+    ctx.stroke();
+  };
+  plot("in", "#1e88e5");
+  plot("out", "#e53935");
+
+  ctx.fillStyle = "#1e88e5";
+  ctx.fillText("in", w - 60, h - 6);
+  ctx.fillStyle = "#e53935";
+  ctx.fillText("out", w - 36, h - 6);
+}
+
+function renderTalkers(l3Flows) {
+  const hosts = new Map();
+  for (const f of l3Flows) {
+    const host = hosts.get(f.SrcAddr) || { in: 0, out: 0 };
+    host.in += f.InboundBytes;
+    host.out += f.OutboundBytes;
+    hosts.set(f.SrcAddr, host);
+  }
+
+  const rows = [...hosts.entries()]
+    .sort((a, b) => b[1].in + b[1].out - (a[1].in + a[1].out))
+    .slice(0, TOP_N)
+    .map(([addr, t]) => [cell(addr), cell(formatBytes(t.in), true), cell(formatBytes(t.out), true),
+      cell(formatBytes(t.in + t.out), true)]);
+  fillTable($("talkers"), rows);
+}
+
+function renderConversations(l4Flows) {
+  const rows = l4Flows.slice(0, TOP_N).map((f) => [
+    cell(hostPort(f.DstAddr, f.DstPort)),
+    cell(hostPort(f.SrcAddr, f.SrcPort)),
+    cell(f.Protocol),
+    cell(formatBytes(f.InboundBytes), true),
+    cell(formatBytes(f.OutboundBytes), true),
+  ]);
+  fillTable($("conversations"), rows);
+}
+
+function flowColumns() {
+  const isL4 = $("layer").value === "l4";
+  return FLOW_COLUMNS.filter((c) => isL4 || !c.l4);
+}
+
+function renderFlowHeader() {
+  const tr = $("flows").querySelector("thead tr");
+  tr.replaceChildren(...flowColumns().map((c) => {
+    const th = document.createElement("th");
+    th.textContent = c.title;
+    if (c.num) {
+      th.classList.add("num");
+    }
+    if (c.key === state.sortKey) {
+      th.classList.add("sorted");
+      if (state.sortAsc) {
+        th.classList.add("asc");
+      }
+    }
+    th.addEventListener("click", () => {
+      if (state.sortKey === c.key) {
+        state.sortAsc = !state.sortAsc;
+      } else {
+        state.sortKey = c.key;
+        state.sortAsc = false;
+      }
+      renderFlows();
+    });
+    return th;
+  }));
+}
+
+function renderFlows() {
+  renderFlowHeader();
+
+  const key = state.sortKey;
+  const flows = [...state.flows].sort((a, b) => {
+    const order = a[key] < b[key] ? -1 : a[key] > b[key] ? 1 : 0;
+    return state.sortAsc ? order : -order;
+  });
+
+  const columns = flowColumns();
+  const rows = flows.map((f) => columns.map((c) => {
+    let v = f[c.key];
+    if (c.bytes) {
+      v = formatBytes(v);
+    } else if (c.rate) {
+      v = formatRate(v);
+    }
+    return cell(v, c.num);
+  }));
+  fillTable($("flows"), rows);
+}
+
+function withRates(flows) {
+  for (const f of flows) {
+    f.InboundRate = f.InboundDuration ? (f.InboundBytes * 8) / f.InboundDuration : 0;
+    f.OutboundRate = f.OutboundDuration ? (f.OutboundBytes * 8) / f.OutboundDuration : 0;
+  }
+  return flows;
+}
+
+async function refresh() {
+  if (state.paused) {
+    return;
+  }
+
+  try {
+    await loadInterfaces();
+    if (!state.iface) {
+      $("status").textContent = "no interface";
+      return;
+    }
+
+    const iface = encodeURIComponent(state.iface);
+    const duration = $("window").value;
+    const addr = encodeURIComponent($("filter").value.trim());
+    const query = `duration=${duration}&addr=${addr}`;
+
+    const [series, l3, l4, flows] = await Promise.all([
+      getData(`/interfaces/${iface}/series?duration=${SERIES_SECONDS}`),
+      getData(`/interfaces/${iface}/flows?layer=l3&${query}`),
+      getData(`/interfaces/${iface}/flows?layer=l4&limit=${TOP_N}&${query}`),
+      getData(`/interfaces/${iface}/flows?layer=${$("layer").value}&${query}`),
+    ]);
+
+    drawChart(series);
+    renderTalkers(l3.Flows);
+    renderConversations(l4.Flows);
+    state.flows = withRates(flows.Flows);
+    renderFlows();
+
+    $("status").textContent = "updated " + new Date(flows.End * 1000).toLocaleTimeString();
+  } catch (err) {
+    $("status").textContent = "error: " + err.message;
+  }
+}
+
+$("iface").addEventListener("change", (e) => {
+  state.iface = e.target.value;
+  refresh();
+});
+$("window").addEventListener("change", refresh);
+$("layer").addEventListener("change", refresh);
+$("filter").addEventListener("change", refresh);
+$("pause").addEventListener("click", (e) => {
+  state.paused = !state.paused;
+  e.target.textContent = state.paused ? "Resume" : "Pause";
+  refresh();
+});
+
+refresh();
+setInterval(refresh, REFRESH_MS);
@@ -0,0 +1,407 @@
+package v1
+
+import (
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/notify"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultQueryDuration = 10
+const DefaultSeriesDuration = 60
+const MaxSeriesDuration = 3600
+
+// MaxQueryDuration bounds the windows of queries and streams by the retention, as older samples are dropped
+// anyway, or by MaxSeriesDuration when all samples are kept
+func MaxQueryDuration() int64 {
+	if accounting.GlobalAcct.Retention > 0 {
+		return accounting.GlobalAcct.Retention
+	}
+
+	return MaxSeriesDuration
+}
+
+type FlowQuery struct {
+	Layer       string
+	Duration    int64
+	Start       int64
+	End         int64
+	Filter      accounting.FlowFilter
+	Grouping    accounting.Grouping
+	SortBy      string
+	IsAscending bool
+	Limit       int
+}
+
+func parseQueryInt(c *gin.Context, key string, defaultValue int64) (v int64, err error) {
+	s := c.Query(key)
+	if s == "" {
+		v = defaultValue
+		return
+	}
+
+	v, err = strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		err = errors.New("invalid " + key + ": " + s)
+	}
+
+	return
+}
+
+// parseGrouping parses the group key from the key query parameter and the prefix lengths of subnets, which
+// default to the configured ones. An empty group key is only valid with an empty default.
+func parseGrouping(c *gin.Context, key string, defaultBy string) (g accounting.Grouping, err error) {
+	g.By = strings.ToLower(c.DefaultQuery(key, defaultBy))
+	if g.By == "" {
+		return
+	}
+
+	prefixV4, err := parseQueryInt(c, "prefix_v4", int64(config.GroupPrefixV4))
+	if err != nil {
+		return
+	}
+	g.PrefixV4 = int(prefixV4)
+
+	prefixV6, err := parseQueryInt(c, "prefix_v6", int64(config.GroupPrefixV6))
+	if err != nil {
+		return
+	}
+	g.PrefixV6 = int(prefixV6)
+
+	err = g.Validate()
+
+	return
+}
+
+// ParseFlowQuery parses the layer, time window, filter, grouping, sorting and limit query parameters
+func ParseFlowQuery(c *gin.Context) (q FlowQuery, err error) {
+	q.Layer = strings.ToLower(c.DefaultQuery("layer", notify.Layer3String))
+	if q.Layer != notify.Layer3String && q.Layer != notify.Layer4String {
+		err = errors.New("invalid layer: " + q.Layer)
+		return
+	}
+
+	q.Duration, err = parseQueryInt(c, "duration", DefaultQueryDuration)
+	if err != nil {
+		return
+	}
+	if q.Duration <= 0 || q.Duration > MaxQueryDuration() {
+		err = errors.New("duration should be between 1 and " + strconv.FormatInt(MaxQueryDuration(), 10))
+		return
+	}
+
+	q.Start, err = parseQueryInt(c, "start", 0)
+	if err != nil {
+		return
+	}
+
+	q.End, err = parseQueryInt(c, "end", 0)
+	if err != nil {
+		return
+	}
+	if q.Start == 0 && q.End != 0 {
+		err = errors.New("end should be given with start")
+		return
+	}
+	if q.Start != 0 && q.End != 0 && q.End-q.Start > MaxQueryDuration() {
+		err = errors.New("range should be at most " + strconv.FormatInt(MaxQueryDuration(), 10) + " seconds")
+		return
+	}
+
+	q.Filter.Addr = c.Query("addr")
+	q.Filter.Protocol = c.Query("protocol")
+	if port := c.Query("port"); port != "" {
+		var p uint64
+		p, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			err = errors.New("invalid port: " + port)
+			return
+		}
+		q.Filter.Port = uint16(p)
+	}
+	if vlan := c.Query("vlan"); vlan != "" {
+		var v uint64
+		v, err = strconv.ParseUint(vlan, 10, 12)
+		if err != nil {
+			err = errors.New("invalid vlan: " + vlan)
+			return
+		}
+		q.Filter.Vlan = uint16(v)
+	}
+
+	q.Grouping, err = parseGrouping(c, "group", "")
+	if err != nil {
+		return
+	}
+
+	q.SortBy = c.DefaultQuery("sort", accounting.SortByBytes)
+	err = accounting.ValidateSortBy(q.SortBy)
+	if err != nil {
+		return
+	}
+
+	order := strings.ToLower(c.DefaultQuery("order", "desc"))
+	if order != "asc" && order != "desc" {
+		err = errors.New("invalid order: " + order)
+		return
+	}
+	q.IsAscending = order == "asc"
+
+	limit, err := parseQueryInt(c, "limit", 0)
+	if err != nil {
+		return
+	}
+	if limit < 0 {
+		err = errors.New("limit should not be negative")
+		return
+	}
+	q.Limit = int(limit)
+
+	return
+}
+
+// Aggregate aggregates the flows of flowColHist over the last duration seconds of the query, or over
+// [start, end] when start is given
+func (q *FlowQuery) Aggregate(flowColHist *accounting.FlowCollectionHistory) (fc *accounting.FlowCollection,
+	ts *accounting.FlowTimestamp, err error) {
+	if q.Start == 0 {
+		if q.End != 0 {
+			err = errors.New("end should be given with start")
+			return
+		}
+
+		fc, ts = flowColHist.AggregationByDuration(q.Duration)
+		return
+	}
+
+	end := q.End
+	if end == 0 {
+		flowColHist.Mu.Lock()
+		end = flowColHist.LastTimestamp.End
+		flowColHist.Mu.Unlock()
+	}
+
+	if q.Start >= end {
+		err = errors.New("start should be before end")
+		return
+	}
+	if end-q.Start > MaxQueryDuration() {
+		err = errors.New("range should be at most " + strconv.FormatInt(MaxQueryDuration(), 10) + " seconds")
+		return
+	}
+
+	fc, ts = flowColHist.AggregationByRange(q.Start, end)
+
+	return
+}
+
+// Apply filters, groups, sorts and limits the flows of the queried layer in fc
+func (q *FlowQuery) Apply(fc *accounting.FlowCollection) (flows []*notify.Flow) {
+	flowMap := fc.L3FlowMap
+	if q.Layer == notify.Layer4String {
+		flowMap = fc.L4FlowMap
+	}
+
+	flowList := accounting.FilterFlows(accounting.FlowList(flowMap), q.Filter)
+	if q.Grouping.By != "" {
+		flowList = accounting.GroupFlows(flowList, q.Grouping)
+	}
+	accounting.SortFlows(flowList, q.SortBy, q.IsAscending)
+	if q.Limit > 0 && len(flowList) > q.Limit {
+		flowList = flowList[:q.Limit]
+	}
+
+	flows = make([]*notify.Flow, 0, len(flowList))
+	for _, f := range flowList {
+		flows = append(flows, notify.NewFlow(q.Layer, f))
+	}
+
+	return
+}
+
+type GroupsResult struct {
+	Interface string
+	Layer     string
+	GroupBy   string
+	Start     int64
+	End       int64
+	Total     *accounting.FlowGroup
+	Groups    []*accounting.FlowGroup
+}
+
+type InterfaceInfo struct {
+	Name          string
+	LastTimestamp accounting.FlowTimestamp
+	Counter       accounting.InterfaceCounter
+	CaptureStats  []engine.EngineStats
+}
+
+type FlowsResult struct {
+	Interface string
+	Layer     string
+	Start     int64
+	End       int64
+	Flows     []*notify.Flow
+}
+
+func ListInterfaces(c *gin.Context) {
+	flowAccd := accounting.GlobalAcct.Interfaces()
+	ifaces := make([]InterfaceInfo, 0, len(flowAccd))
+	for ifaceName, flowColHist := range flowAccd {
+		flowColHist.Mu.Lock()
+		ifaces = append(ifaces, InterfaceInfo{
+			Name:          ifaceName,
+			LastTimestamp: flowColHist.LastTimestamp,
+			Counter:       flowColHist.Counter,
+		})
+		flowColHist.Mu.Unlock()
+		ifaces[len(ifaces)-1].CaptureStats = notify.CaptureStats(ifaceName)
+	}
+
+	sort.Slice(ifaces, func(i, j int) bool {
+		return ifaces[i].Name < ifaces[j].Name
+	})
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": ifaces,
+	})
+}
+
+// GetFlows aggregates the flows of an interface over the last duration seconds, or over [start, end] when
+// start is given, and returns them filtered, sorted and limited by the query
+func GetFlows(c *gin.Context) {
+	ifaceName := c.Param("name")
+	flowColHist, ok := accounting.GlobalAcct.GetInterface(ifaceName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":  "interface not found: " + ifaceName,
+			"data": "",
+		})
+		return
+	}
+
+	q, err := ParseFlowQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	fc, ts, err := q.Aggregate(flowColHist)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "",
+		"data": FlowsResult{
+			Interface: ifaceName,
+			Layer:     q.Layer,
+			Start:     ts.Start,
+			End:       ts.End,
+			Flows:     q.Apply(fc),
+		},
+	})
+}
+
+// GetSeries returns the network layer totals of each sample of an interface over the last duration seconds
+func GetSeries(c *gin.Context) {
+	ifaceName := c.Param("name")
+	flowColHist, ok := accounting.GlobalAcct.GetInterface(ifaceName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":  "interface not found: " + ifaceName,
+			"data": "",
+		})
+		return
+	}
+
+	duration, err := parseQueryInt(c, "duration", DefaultSeriesDuration)
+	if err == nil && (duration <= 0 || duration > MaxSeriesDuration) {
+		err = errors.New("duration should be between 1 and " + strconv.Itoa(MaxSeriesDuration))
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": flowColHist.SeriesByDuration(duration),
+	})
+}
+
+// GetGroups rolls the flows of an interface up per host, peer, subnet or vlan, with the totals of the
+// interface, so the hosts using the bandwidth are found before drilling into their flows
+func GetGroups(c *gin.Context) {
+	ifaceName := c.Param("name")
+	flowColHist, ok := accounting.GlobalAcct.GetInterface(ifaceName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":  "interface not found: " + ifaceName,
+			"data": "",
+		})
+		return
+	}
+
+	q, err := ParseFlowQuery(c)
+	if err == nil {
+		q.Grouping, err = parseGrouping(c, "by", accounting.GroupByHost)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	fc, ts, err := q.Aggregate(flowColHist)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	flowMap := fc.L3FlowMap
+	if q.Layer == notify.Layer4String {
+		flowMap = fc.L4FlowMap
+	}
+
+	groups, total := accounting.AggregateFlows(accounting.FilterFlows(accounting.FlowList(flowMap), q.Filter), q.Grouping)
+	accounting.SortFlowGroups(groups, q.SortBy, q.IsAscending)
+	if q.Limit > 0 && len(groups) > q.Limit {
+		groups = groups[:q.Limit]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg": "",
+		"data": GroupsResult{
+			Interface: ifaceName,
+			Layer:     q.Layer,
+			GroupBy:   q.Grouping.By,
+			Start:     ts.Start,
+			End:       ts.End,
+			Total:     total,
+			Groups:    groups,
+		},
+	})
+}
@@ -0,0 +1,91 @@
+package v1
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func testContext(query string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/api/v1/flows?"+query, nil)
+
+	return c
+}
+
+func TestParseFlowQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	accounting.GlobalAcct = accounting.NewAccounting()
+	accounting.GlobalAcct.SetRetention(600)
+	config.GroupPrefixV4, config.GroupPrefixV6 = 24, 64
+
+	tests := []struct {
+		query string
+		want  FlowQuery
+		isErr bool
+	}{
+		{
+			query: "",
+			want:  FlowQuery{Layer: "l3", Duration: DefaultQueryDuration, SortBy: accounting.SortByBytes},
+		},
+		{
+			query: "layer=L4&duration=600&addr=192.0.2.1&port=443&protocol=tcp&vlan=10&sort=rate&order=asc&limit=5",
+			want: FlowQuery{Layer: "l4", Duration: 600, SortBy: accounting.SortByRate, IsAscending: true, Limit: 5,
+				Filter: accounting.FlowFilter{Addr: "192.0.2.1", Port: 443, Protocol: "tcp", Vlan: 10}},
+		},
+		{
+			query: "start=100&end=700&group=subnet&prefix_v4=16",
+			want: FlowQuery{Layer: "l3", Duration: DefaultQueryDuration, Start: 100, End: 700,
+				SortBy:   accounting.SortByBytes,
+				Grouping: accounting.Grouping{By: accounting.GroupBySubnet, PrefixV4: 16, PrefixV6: 64}},
+		},
+		{query: "layer=l7", isErr: true},
+		{query: "duration=0", isErr: true},
+		{query: "duration=601", isErr: true},
+		{query: "start=100&end=701", isErr: true},
+		{query: "end=700", isErr: true},
+		{query: "duration=ten", isErr: true},
+		{query: "start=yesterday", isErr: true},
+		{query: "port=65536", isErr: true},
+		{query: "vlan=4096", isErr: true},
+		{query: "group=port", isErr: true},
+		{query: "group=subnet&prefix_v4=33", isErr: true},
+		{query: "sort=name", isErr: true},
+		{query: "order=up", isErr: true},
+		{query: "limit=-1", isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := ParseFlowQuery(testContext(tt.query))
+			if tt.isErr {
+				if err == nil {
+					t.Errorf("invalid query accepted as %+v", q)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("valid query rejected: %s", err.Error())
+			}
+			if !reflect.DeepEqual(q, tt.want) {
+				t.Errorf("got %+v, want %+v", q, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxQueryDuration(t *testing.T) {
+	accounting.GlobalAcct = accounting.NewAccounting()
+	if got := MaxQueryDuration(); got != MaxSeriesDuration {
+		t.Errorf("got %d without retention, want %d", got, MaxSeriesDuration)
+	}
+
+	accounting.GlobalAcct.SetRetention(7200)
+	if got := MaxQueryDuration(); got != 7200 {
+		t.Errorf("got %d with retention, want 7200", got)
+	}
+}
@@ -0,0 +1,232 @@
+package v1
+
+import (
+	"fmt"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/aggregator"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/notify"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+const MetricsOtherLabel = "other"
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	buf *strings.Builder
+}
+
+func (w *metricsWriter) header(name string, metricType string, help string) {
+	fmt.Fprintf(w.buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w.buf, "# TYPE %s %s\n", name, metricType)
+}
+
+// sample writes one series, labels are given as name and value pairs
+func (w *metricsWriter) sample(name string, value int64, labels ...string) {
+	w.buf.WriteString(name)
+	if len(labels) > 0 {
+		w.buf.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteString(",")
+			}
+			fmt.Fprintf(w.buf, `%s="%s"`, labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+		}
+		w.buf.WriteString("}")
+	}
+	w.buf.WriteString(" ")
+	w.buf.WriteString(strconv.FormatInt(value, 10))
+	w.buf.WriteString("\n")
+}
+
+type metricsFlowSample struct {
+	labels []string
+	flow   *accounting.Flow
+}
+
+// topFlowSamples keeps the topN flows by total bytes and rolls the rest into one "other" flow. Flows only told
+// apart by their vlans or tunnels get a series each by the vlan and tunnel labels, which are empty for flows
+// without them.
+func topFlowSamples(ifaceName string, layer string, flowMap map[accounting.FlowFingerprint]*accounting.Flow, topN int) (samples []metricsFlowSample) {
+	flows := accounting.FlowList(flowMap)
+	accounting.SortFlows(flows, accounting.SortByBytes, false)
+
+	other := &accounting.Flow{}
+	for i, f := range flows {
+		if i >= topN {
+			other.InboundBytes += f.InboundBytes
+			other.InboundPackets += f.InboundPackets
+			other.OutboundBytes += f.OutboundBytes
+			other.OutboundPackets += f.OutboundPackets
+			continue
+		}
+
+		labels := []string{"interface", ifaceName, "layer", layer, "src_addr", f.SrcAddr, "dst_addr", f.DstAddr,
+			"vlan", f.VlanString(), "tunnel", f.TunnelString()}
+		if layer == "l4" {
+			labels = append(labels, "src_port", strconv.Itoa(int(f.SrcPort)), "dst_port", strconv.Itoa(int(f.DstPort)),
+				"protocol", f.Protocol)
+		}
+		samples = append(samples, metricsFlowSample{labels: labels, flow: f})
+	}
+
+	if len(flows) > topN {
+		labels := []string{"interface", ifaceName, "layer", layer, "src_addr", MetricsOtherLabel, "dst_addr", MetricsOtherLabel,
+			"vlan", MetricsOtherLabel, "tunnel", MetricsOtherLabel}
+		if layer == "l4" {
+			labels = append(labels, "src_port", MetricsOtherLabel, "dst_port", MetricsOtherLabel, "protocol", MetricsOtherLabel)
+		}
+		samples = append(samples, metricsFlowSample{labels: labels, flow: other})
+	}
+
+	return
+}
+
+// InterfaceDecodeL4 tells whether transport layer flows are decoded on the accounted interface ifaceName. The
+// exporter interfaces of a collector follow the config of the collector, and interfaces not in the config, like
+// the ones of the nodes in aggregator mode, follow the global setting.
+func InterfaceDecodeL4(ifaceName string) bool {
+	for i := range config.Interfaces {
+		c := &config.Interfaces[i]
+		if c.Name == ifaceName ||
+			(c.Engine == engine.CollectorEngineName && engine.IsCollectorInterface(c.Name, ifaceName)) {
+			return c.DecodeL4()
+		}
+	}
+
+	return config.IsDecodeL4
+}
+
+// Metrics publishes the interface counters since start and the flows of the last metrics window in
+// Prometheus text format. Only the top N flows of each interface get their own series.
+func Metrics(c *gin.Context) {
+	flowAccd := accounting.GlobalAcct.Interfaces()
+	ifaceNames := make([]string, 0, len(flowAccd))
+	for ifaceName := range flowAccd {
+		ifaceNames = append(ifaceNames, ifaceName)
+	}
+	sort.Strings(ifaceNames)
+
+	w := &metricsWriter{buf: &strings.Builder{}}
+
+	w.header("goiftop_interface_bytes_total", "counter", "Network layer bytes accounted on the interface since start.")
+	for _, ifaceName := range ifaceNames {
+		flowColHist := flowAccd[ifaceName]
+		flowColHist.Mu.Lock()
+		counter := flowColHist.Counter
+		flowColHist.Mu.Unlock()
+
+		w.sample("goiftop_interface_bytes_total", counter.InboundBytes, "interface", ifaceName, "direction", "in")
+		w.sample("goiftop_interface_bytes_total", counter.OutboundBytes, "interface", ifaceName, "direction", "out")
+	}
+
+	w.header("goiftop_interface_packets_total", "counter", "Network layer packets accounted on the interface since start.")
+	for _, ifaceName := range ifaceNames {
+		flowColHist := flowAccd[ifaceName]
+		flowColHist.Mu.Lock()
+		counter := flowColHist.Counter
+		flowColHist.Mu.Unlock()
+
+		w.sample("goiftop_interface_packets_total", counter.InboundPackets, "interface", ifaceName, "direction", "in")
+		w.sample("goiftop_interface_packets_total", counter.OutboundPackets, "interface", ifaceName, "direction", "out")
+	}
+
+	captureStats := notify.CaptureStats("")
+	captureMetrics := []struct {
+		name  string
+		help  string
+		value func(s engine.EngineStats) uint64
+	}{
+		{"goiftop_capture_received_packets_total", "Packets received by the capture engine.",
+			func(s engine.EngineStats) uint64 { return s.Received }},
+		{"goiftop_capture_dropped_packets_total", "Packets dropped because the capture engine did not keep up.",
+			func(s engine.EngineStats) uint64 { return s.Dropped }},
+		{"goiftop_capture_if_dropped_packets_total", "Packets dropped by the interface.",
+			func(s engine.EngineStats) uint64 { return s.IfDropped }},
+		{"goiftop_capture_queue_freezes_total", "Times the TPACKET_V3 ring of the capture engine was full.",
+			func(s engine.EngineStats) uint64 { return s.QueueFreezes }},
+	}
+	for _, m := range captureMetrics {
+		w.header(m.name, "counter", m.help)
+		for _, s := range captureStats {
+			w.sample(m.name, int64(m.value(s)), "interface", s.Interface, "direction", s.Direction)
+		}
+	}
+
+	deliveryStats := notify.GetDeliveryStats()
+	deliveryMetrics := []struct {
+		name       string
+		metricType string
+		help       string
+		value      func(ds notify.DeliveryStats) int64
+	}{
+		{"goiftop_notifier_delivered_total", "counter", "Payloads delivered by the notifier, including spooled ones.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.Delivered) }},
+		{"goiftop_notifier_failed_total", "counter", "Payloads the notifier failed to deliver after all retries.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.Failed) }},
+		{"goiftop_notifier_retries_total", "counter", "Retries of the notifier after a failed delivery.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.Retries) }},
+		{"goiftop_notifier_spooled_total", "counter", "Payloads spooled to disk after a failed delivery.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.Spooled) }},
+		{"goiftop_notifier_spool_dropped_total", "counter", "Oldest spooled payloads dropped because the spool was full.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.SpoolDropped) }},
+		{"goiftop_notifier_spool_drained_total", "counter", "Spooled payloads delivered once the receiver recovered.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.SpoolDrained) }},
+		{"goiftop_notifier_spool_files", "gauge", "Payloads waiting in the spool of the notifier.",
+			func(ds notify.DeliveryStats) int64 { return int64(ds.SpoolFiles) }},
+		{"goiftop_notifier_last_success_timestamp_seconds", "gauge", "Unix time of the last successful delivery.",
+			func(ds notify.DeliveryStats) int64 { return ds.LastSuccess }},
+	}
+	for _, m := range deliveryMetrics {
+		w.header(m.name, m.metricType, m.help)
+		for _, ds := range deliveryStats {
+			w.sample(m.name, m.value(ds), "notifier", ds.Notifier)
+		}
+	}
+
+	if aggregator.GlobalAggregator != nil {
+		nodes := aggregator.GlobalAggregator.Nodes()
+		w.header("goiftop_node_posts_total", "counter", "Posts accepted from the node by the aggregator.")
+		for _, n := range nodes {
+			w.sample("goiftop_node_posts_total", int64(n.Posts), "node", n.Id)
+		}
+
+		w.header("goiftop_node_last_seen_timestamp_seconds", "gauge", "Unix time of the last post of the node.")
+		for _, n := range nodes {
+			w.sample("goiftop_node_last_seen_timestamp_seconds", n.LastSeen, "node", n.Id)
+		}
+	}
+
+	var samples []metricsFlowSample
+	for _, ifaceName := range ifaceNames {
+		fc, _ := flowAccd[ifaceName].AggregationByDuration(config.MetricsWindow)
+		samples = append(samples, topFlowSamples(ifaceName, "l3", fc.L3FlowMap, config.MetricsTopN)...)
+		if InterfaceDecodeL4(ifaceName) {
+			samples = append(samples, topFlowSamples(ifaceName, "l4", fc.L4FlowMap, config.MetricsTopN)...)
+		}
+	}
+
+	w.header("goiftop_flow_window_seconds", "gauge", "Length of the window the flow metrics are aggregated over.")
+	w.sample("goiftop_flow_window_seconds", config.MetricsWindow)
+
+	w.header("goiftop_flow_window_bytes", "gauge", "Bytes of the flow within the metrics window.")
+	for _, s := range samples {
+		w.sample("goiftop_flow_window_bytes", s.flow.InboundBytes, append(s.labels, "direction", "in")...)
+		w.sample("goiftop_flow_window_bytes", s.flow.OutboundBytes, append(s.labels, "direction", "out")...)
+	}
+
+	w.header("goiftop_flow_window_packets", "gauge", "Packets of the flow within the metrics window.")
+	for _, s := range samples {
+		w.sample("goiftop_flow_window_packets", s.flow.InboundPackets, append(s.labels, "direction", "in")...)
+		w.sample("goiftop_flow_window_packets", s.flow.OutboundPackets, append(s.labels, "direction", "out")...)
+	}
+
+	c.Data(http.StatusOK, MetricsContentType, []byte(w.buf.String()))
+}
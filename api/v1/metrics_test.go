@@ -0,0 +1,138 @@
+package v1
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// metricsFlowCollection returns a sample of eth0 with a flow of 100, 200 and 300 inbound bytes
+func metricsFlowCollection(start int64) *accounting.FlowCollection {
+	fc := accounting.NewFlowCollection("eth0")
+	fc.SetTimestamp(start, start+1)
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		l3 := accounting.FlowFingerprint{SrcAddr: addr, DstAddr: "198.51.100.1"}
+		fc.UpdateL3Inbound(l3, int64(100*(i+1)), int64(i+1))
+		l4 := l3
+		l4.SrcPort, l4.DstPort, l4.Protocol = 40000, 443, "tcp"
+		fc.UpdateL4Inbound(l4, int64(80*(i+1)), int64(i+1))
+	}
+
+	return fc
+}
+
+func getMetrics(t *testing.T) string {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("GET", "/metrics", nil)
+
+	Metrics(c)
+	if w.Code != 200 || w.Header().Get("Content-Type") != MetricsContentType {
+		t.Fatalf("got status %d and content type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	return w.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	accounting.GlobalAcct = accounting.NewAccounting()
+	accounting.GlobalAcct.AddInterface("eth0")
+	h := accounting.GlobalAcct.FlowAccd["eth0"]
+	for _, start := range []int64{100, 159, 160} {
+		fc := metricsFlowCollection(start)
+		h.HistCollection[fc.FlowTimestamp] = fc
+		h.UpdateCounter(fc)
+		h.SetLastTimestamp(fc.FlowTimestamp)
+	}
+	config.MetricsTopN, config.MetricsWindow = 2, 60
+
+	tests := []struct {
+		isDecodeL4 bool
+		want       []string
+		notWant    []string
+	}{
+		{
+			want: []string{
+				"# TYPE goiftop_interface_bytes_total counter",
+				`goiftop_interface_bytes_total{interface="eth0",direction="in"} 1800`,
+				`goiftop_interface_bytes_total{interface="eth0",direction="out"} 0`,
+				`goiftop_interface_packets_total{interface="eth0",direction="in"} 18`,
+				"goiftop_flow_window_seconds 60",
+				`goiftop_flow_window_bytes{interface="eth0",layer="l3",src_addr="192.0.2.3",dst_addr="198.51.100.1",vlan="",tunnel="",direction="in"} 600`,
+				`goiftop_flow_window_bytes{interface="eth0",layer="l3",src_addr="192.0.2.2",dst_addr="198.51.100.1",vlan="",tunnel="",direction="in"} 400`,
+				`goiftop_flow_window_bytes{interface="eth0",layer="l3",src_addr="other",dst_addr="other",vlan="other",tunnel="other",direction="in"} 200`,
+				`goiftop_flow_window_packets{interface="eth0",layer="l3",src_addr="other",dst_addr="other",vlan="other",tunnel="other",direction="in"} 2`,
+			},
+			notWant: []string{`src_addr="192.0.2.1"`, `layer="l4"`},
+		},
+		{
+			isDecodeL4: true,
+			want: []string{
+				`goiftop_flow_window_bytes{interface="eth0",layer="l4",src_addr="192.0.2.3",dst_addr="198.51.100.1",vlan="",tunnel="",src_port="40000",dst_port="443",protocol="tcp",direction="in"} 480`,
+				`goiftop_flow_window_bytes{interface="eth0",layer="l4",src_addr="other",dst_addr="other",vlan="other",tunnel="other",src_port="other",dst_port="other",protocol="other",direction="in"} 160`,
+			},
+		},
+	}
+
+	// The config of the interface decides over the global setting
+	for _, tt := range tests {
+		isDecodeL4 := tt.isDecodeL4
+		config.Interfaces = []config.InterfaceConfig{{Name: "eth0", IsDecodeL4: &isDecodeL4}}
+		config.IsDecodeL4 = !tt.isDecodeL4
+		body := getMetrics(t)
+		for _, line := range tt.want {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("l4 %t: metrics miss %s in\n%s", tt.isDecodeL4, line, body)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(body, s) {
+				t.Errorf("l4 %t: metrics contain %s in\n%s", tt.isDecodeL4, s, body)
+			}
+		}
+	}
+	config.Interfaces, config.IsDecodeL4 = nil, false
+}
+
+func TestInterfaceDecodeL4(t *testing.T) {
+	isDecodeL4 := true
+	config.Interfaces = []config.InterfaceConfig{
+		{Name: "eth0", IsDecodeL4: &isDecodeL4},
+		{Name: "nf", Engine: engine.CollectorEngineName, IsDecodeL4: &isDecodeL4},
+	}
+	config.IsDecodeL4 = false
+	defer func() {
+		config.Interfaces = nil
+	}()
+
+	tests := map[string]bool{
+		"eth0":               true,
+		"eth0:192.0.2.1:3":   false,
+		"nf:192.0.2.1:3":     true,
+		"nf:[2001:db8::1]:3": true,
+		"nf:eth0":            false,
+		"nf":                 true,
+		"node1:eth0":         false,
+		"eth1":               false,
+	}
+	for ifaceName, want := range tests {
+		if got := InterfaceDecodeL4(ifaceName); got != want {
+			t.Errorf("%s: got %t, want %t", ifaceName, got, want)
+		}
+	}
+}
+
+func TestMetricsLabelEscape(t *testing.T) {
+	w := &metricsWriter{buf: &strings.Builder{}}
+	w.sample("goiftop_test", 1, "interface", "a\"b\\c\nd")
+	if got, want := w.buf.String(), "goiftop_test{interface=\"a\\\"b\\\\c\\nd\"} 1\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,91 @@
+package v1
+
+import (
+	"errors"
+	"github.com/fs714/goiftop/aggregator"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// IngestPath is where the webhook notifiers of the nodes post their flows to in aggregator mode
+const IngestPath = "/api/v1/ingest"
+
+// Ingest accounts the flows a node posts by its webhook notifier in aggregator mode. The post is verified as
+// sent, before it is decompressed.
+func Ingest(c *gin.Context) {
+	if aggregator.GlobalAggregator == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":  "aggregator mode is not enabled",
+			"data": "",
+		})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, aggregator.MaxPayloadBytes+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  "failed to read payload: " + err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	if len(body) > aggregator.MaxPayloadBytes {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"msg":  "payload is larger than " + strconv.Itoa(aggregator.MaxPayloadBytes) + " bytes",
+			"data": "",
+		})
+		return
+	}
+
+	err = aggregator.GlobalAggregator.Verify(c.Request.Header, body)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	payload, err := aggregator.Decode(c.GetHeader("Content-Encoding"), body)
+	if err == nil {
+		err = aggregator.GlobalAggregator.Ingest(c.ClientIP(), payload)
+	}
+	if errors.Is(err, aggregator.ErrBusy) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  "invalid payload: " + err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": "accepted",
+	})
+}
+
+// ListNodes returns the nodes posting to the aggregator with the interfaces they posted
+func ListNodes(c *gin.Context) {
+	if aggregator.GlobalAggregator == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"msg":  "aggregator mode is not enabled",
+			"data": "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": aggregator.GlobalAggregator.Nodes(),
+	})
+}
@@ -0,0 +1,56 @@
+package v1
+
+import (
+	"crypto/subtle"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// ReloadRequests passes the reload requests of the api to main, which replies with the result of the reload
+// on the request channel
+var ReloadRequests = make(chan chan error)
+
+// Reload reloads the config the same way as SIGHUP. The reload token is required as bearer token, and the
+// api is disabled when no reload token is configured.
+func Reload(c *gin.Context) {
+	if config.ReloadToken == "" {
+		c.JSON(http.StatusForbidden, gin.H{
+			"msg":  "reload api is disabled",
+			"data": "",
+		})
+		return
+	}
+
+	auth := c.GetHeader("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(config.ReloadToken)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"msg":  "invalid reload token",
+			"data": "",
+		})
+		return
+	}
+
+	result := make(chan error, 1)
+	select {
+	case ReloadRequests <- result:
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	err := <-result
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  "reload failed: " + err.Error(),
+			"data": "",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": "reloaded",
+	})
+}
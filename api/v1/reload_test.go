@@ -0,0 +1,70 @@
+package v1
+
+import (
+	"errors"
+	"github.com/fs714/goiftop/utils/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func() {
+		config.ReloadToken = ""
+	}()
+
+	// Main replies to the reload requests, failing the reload when asked for
+	failReload := false
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case result := <-ReloadRequests:
+				if failReload {
+					result <- errors.New("invalid config")
+				} else {
+					result <- nil
+				}
+			}
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		token      string
+		auth       string
+		failReload bool
+		wantStatus int
+	}{
+		{"disabled", "", "Bearer secret", false, http.StatusForbidden},
+		{"no token", "secret", "", false, http.StatusUnauthorized},
+		{"not bearer", "secret", "secret", false, http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", false, http.StatusUnauthorized},
+		{"reloaded", "secret", "Bearer secret", false, http.StatusOK},
+		{"reload failed", "secret", "Bearer secret", true, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.ReloadToken = tt.token
+			failReload = tt.failReload
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("POST", "/api/v1/reload", nil)
+			if tt.auth != "" {
+				c.Request.Header.Set("Authorization", tt.auth)
+			}
+
+			Reload(c)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package v1
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/notify"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// GetStats returns the capture statistics of the engines of every interface, or of the interface given by
+// the interface query parameter
+func GetStats(c *gin.Context) {
+	ifaceName := c.Query("interface")
+	if ifaceName != "" {
+		_, ok := accounting.GlobalAcct.GetInterface(ifaceName)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"msg":  "interface not found: " + ifaceName,
+				"data": "",
+			})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"msg":  "",
+		"data": notify.CaptureStats(ifaceName),
+	})
+}
@@ -0,0 +1,200 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/utils/log"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const StreamEventName = "flows"
+
+// FlowStream sends the flows of every per-second flow collection arriving at accounting, or the flows
+// aggregated over the last Interval seconds every Interval seconds when Interval is positive
+type FlowStream struct {
+	IfaceName string
+	Interval  int64
+	Query     FlowQuery
+
+	subId  int
+	ch     chan *accounting.FlowCollection
+	ticker *time.Ticker
+}
+
+func NewFlowStream(c *gin.Context) (s *FlowStream, err error) {
+	s = &FlowStream{
+		IfaceName: c.Query("interface"),
+	}
+
+	if s.IfaceName != "" {
+		_, ok := accounting.GlobalAcct.GetInterface(s.IfaceName)
+		if !ok {
+			err = errors.New("interface not found: " + s.IfaceName)
+			return
+		}
+	}
+
+	s.Interval, err = parseQueryInt(c, "interval", 0)
+	if err != nil {
+		return
+	}
+	if s.Interval < 0 || s.Interval > MaxQueryDuration() {
+		err = errors.New("interval should be between 0 and " + strconv.FormatInt(MaxQueryDuration(), 10))
+		return
+	}
+
+	s.Query, err = ParseFlowQuery(c)
+	if err != nil {
+		return
+	}
+
+	if s.Interval > 0 {
+		s.ticker = time.NewTicker(time.Duration(s.Interval) * time.Second)
+	} else {
+		s.subId, s.ch = accounting.GlobalAcct.Subscribe()
+	}
+
+	return
+}
+
+func (s *FlowStream) Close() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	} else {
+		accounting.GlobalAcct.Unsubscribe(s.subId)
+	}
+}
+
+// Next blocks until the next flows are available or ctx is done
+func (s *FlowStream) Next(ctx context.Context) (results []FlowsResult, err error) {
+	if s.ticker != nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-s.ticker.C:
+		}
+
+		for ifaceName, flowColHist := range accounting.GlobalAcct.Interfaces() {
+			if s.IfaceName != "" && ifaceName != s.IfaceName {
+				continue
+			}
+
+			fc, ts := flowColHist.AggregationByDuration(s.Interval)
+			results = append(results, FlowsResult{
+				Interface: ifaceName,
+				Layer:     s.Query.Layer,
+				Start:     ts.Start,
+				End:       ts.End,
+				Flows:     s.Query.Apply(fc),
+			})
+		}
+
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case fc := <-s.ch:
+			if s.IfaceName != "" && fc.InterfaceName != s.IfaceName {
+				continue
+			}
+
+			results = append(results, FlowsResult{
+				Interface: fc.InterfaceName,
+				Layer:     s.Query.Layer,
+				Start:     fc.Start,
+				End:       fc.End,
+				Flows:     s.Query.Apply(fc),
+			})
+			return
+		}
+	}
+}
+
+// StreamSSE streams flows as Server-Sent Events until the client goes away
+func StreamSSE(c *gin.Context) {
+	s, err := NewFlowStream(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+	defer s.Close()
+
+	ctx := c.Request.Context()
+	c.Stream(func(w io.Writer) bool {
+		results, err := s.Next(ctx)
+		if err != nil {
+			return false
+		}
+
+		for _, r := range results {
+			c.SSEvent(StreamEventName, r)
+		}
+
+		return true
+	})
+}
+
+// StreamWebsocket streams flows as websocket json messages until the client goes away
+func StreamWebsocket(c *gin.Context) {
+	s, err := NewFlowStream(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"msg":  err.Error(),
+			"data": "",
+		})
+		return
+	}
+	defer s.Close()
+
+	handler := func(ws *websocket.Conn) {
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		// The stream is one way, reading only detects the client closing the connection
+		go func() {
+			defer cancel()
+
+			buf := make([]byte, 512)
+			for {
+				_, err := ws.Read(buf)
+				if err != nil {
+					return
+				}
+			}
+		}()
+
+		// Lift the write timeout of the http server inherited by the hijacked connection
+		_ = ws.SetWriteDeadline(time.Time{})
+
+		for {
+			results, err := s.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			for _, r := range results {
+				err = websocket.JSON.Send(ws, r)
+				if err != nil {
+					log.Infof("websocket stream to %s closed with err: %s", c.Request.RemoteAddr, err.Error())
+					return
+				}
+			}
+		}
+	}
+
+	websocket.Server{Handler: handler}.ServeHTTP(c.Writer, c.Request)
+}
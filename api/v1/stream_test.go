@@ -0,0 +1,175 @@
+package v1
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// streamServer serves the stream endpoints and keeps sending a flow collection of eth0 and eth1 to the
+// accounting until the test ends, so a stream receives them whenever it subscribes
+func streamServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	gin.SetMode(gin.TestMode)
+	accounting.GlobalAcct = accounting.NewAccounting()
+	accounting.GlobalAcct.AddInterface("eth0")
+	accounting.GlobalAcct.AddInterface("eth1")
+
+	acct := accounting.GlobalAcct
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		acct.Start(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+
+		for start := int64(100); ; start++ {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			for _, ifaceName := range []string{"eth0", "eth1"} {
+				fc := accounting.NewFlowCollection(ifaceName)
+				fc.SetTimestamp(start, start+1)
+				fc.UpdateL3Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 100, 1)
+				select {
+				case <-ctx.Done():
+					return
+				case acct.Ch <- fc:
+				}
+			}
+		}
+	}()
+
+	// Handlers are waited for as the server does not track hijacked websocket connections
+	var handlers sync.WaitGroup
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		handlers.Add(1)
+		defer handlers.Done()
+		c.Next()
+	})
+	r.GET("/api/v1/stream/sse", StreamSSE)
+	r.GET("/api/v1/stream/ws", StreamWebsocket)
+	srv := httptest.NewServer(r)
+
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+		cancel()
+		wg.Wait()
+	})
+
+	return srv
+}
+
+func checkStreamResult(t *testing.T, r FlowsResult) {
+	t.Helper()
+
+	if r.Interface != "eth0" || r.Layer != "l3" || r.End != r.Start+1 || len(r.Flows) != 1 {
+		t.Fatalf("got %+v, want a second of l3 flows of eth0", r)
+	}
+	if f := r.Flows[0]; f.SrcAddr != "192.0.2.1" || f.InboundBytes != 100 {
+		t.Errorf("got flow %+v", f)
+	}
+}
+
+func TestStreamSSE(t *testing.T) {
+	srv := streamServer(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/api/v1/stream/sse?interface=eth0", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("got content type %s", ct)
+	}
+
+	var events int
+	scanner := bufio.NewScanner(resp.Body)
+	for events < 2 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			if line != "event:"+StreamEventName {
+				t.Errorf("got event %s", line)
+			}
+		case strings.HasPrefix(line, "data:"):
+			var r FlowsResult
+			err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkStreamResult(t, r)
+			events++
+		}
+	}
+	if events < 2 {
+		t.Fatalf("got %d events before the stream ended: %v", events, scanner.Err())
+	}
+}
+
+func TestStreamWebsocket(t *testing.T) {
+	srv := streamServer(t)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/api/v1/stream/ws?interface=eth0"
+	ws, err := websocket.Dial(url, "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = ws.Close()
+	}()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for i := 0; i < 2; i++ {
+		var r FlowsResult
+		err = websocket.JSON.Receive(ws, &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStreamResult(t, r)
+	}
+}
+
+func TestStreamInvalidQuery(t *testing.T) {
+	srv := streamServer(t)
+
+	for _, query := range []string{"interface=eth9", "interval=-1", "layer=l7"} {
+		for _, endpoint := range []string{"sse", "ws"} {
+			resp, err := http.Get(srv.URL + "/api/v1/stream/" + endpoint + "?" + query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s %s: got status %d, want %d", endpoint, query, resp.StatusCode, http.StatusBadRequest)
+			}
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package decoder
 
 import (
+	"encoding/binary"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"reflect"
@@ -24,6 +25,16 @@ type LayerDecoder struct {
 	DecodingLayerMap map[gopacket.LayerType]gopacket.DecodingLayer
 	df               gopacket.DecodeFeedback
 	Truncated        bool
+
+	// VlanIds are the ids of the vlan tags of the last packet decoded, the outer tag first
+	VlanIds []uint16
+
+	// TunnelLayers are the layers after which decoding stops when they carry an inner packet, which is left
+	// in TunnelPayload for another decoder so the inner layers do not overwrite the outer ones
+	TunnelLayers    map[gopacket.LayerType]bool
+	TunnelLayer     gopacket.LayerType
+	TunnelNextLayer gopacket.LayerType
+	TunnelPayload   []byte
 }
 
 func (ld *LayerDecoder) SetTruncated() {
@@ -36,6 +47,27 @@ func (ld *LayerDecoder) PutDecodingLayer(d gopacket.DecodingLayer) {
 	}
 }
 
+// SetTunnelLayers makes decoding stop at the given tunnel layers
+func (ld *LayerDecoder) SetTunnelLayers(layerTypes ...gopacket.LayerType) {
+	ld.TunnelLayers = make(map[gopacket.LayerType]bool)
+	for _, layerType := range layerTypes {
+		ld.TunnelLayers[layerType] = true
+	}
+}
+
+func (ld *LayerDecoder) isTunnel(layerType gopacket.LayerType, nextLayerType gopacket.LayerType) bool {
+	if !ld.TunnelLayers[layerType] {
+		return false
+	}
+
+	switch nextLayerType {
+	case layers.LayerTypeEthernet, layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return true
+	}
+
+	return false
+}
+
 func (ld *LayerDecoder) GetDecodingLayerByType(layerType gopacket.LayerType) (gopacket.DecodingLayer, bool) {
 	d, ok := ld.DecodingLayerMap[layerType]
 	return d, ok
@@ -56,6 +88,10 @@ func (ld *LayerDecoder) GetFirstLayerType(linkType layers.LinkType) gopacket.Lay
 
 func (ld *LayerDecoder) DecodeLayers(data []byte, firstLayer gopacket.LayerType, decoded *[]gopacket.LayerType) error {
 	ld.Truncated = false
+	ld.VlanIds = ld.VlanIds[:0]
+	ld.TunnelLayer = gopacket.LayerTypeZero
+	ld.TunnelNextLayer = gopacket.LayerTypeZero
+	ld.TunnelPayload = nil
 
 	layerType, err := ld.Decoder(data, firstLayer, decoded)
 	if layerType != gopacket.LayerTypeZero {
@@ -82,6 +118,11 @@ func (ld *LayerDecoder) Decoder(data []byte, firstLayer gopacket.LayerType, deco
 		*decoded = append(*decoded, layerType)
 		nextLayerType := decoder.NextLayerType()
 
+		// QinQ packets carry several vlan tags decoded into the same layer, so their ids are kept as decoded
+		if dot1q, ok := decoder.(*layers.Dot1Q); ok {
+			ld.VlanIds = append(ld.VlanIds, dot1q.VLANIdentifier)
+		}
+
 		// By default, IPv4 layer will decode fragmented packet to Segment layer.
 		// To statistic fragmented packet, the first IPv4 layer payload will be decoded
 		if layerType == layers.LayerTypeIPv4 {
@@ -92,6 +133,21 @@ func (ld *LayerDecoder) Decoder(data []byte, firstLayer gopacket.LayerType, deco
 			}
 		}
 
+		// Only the first IPv6 fragment carries the transport layer header, so stop decoding other fragments
+		if layerType == layers.LayerTypeIPv6Fragment {
+			skipper, ok := decoder.(*layers.IPv6ExtensionSkipper)
+			if ok && len(skipper.Contents) >= 4 && binary.BigEndian.Uint16(skipper.Contents[2:4])>>3 != 0 {
+				break
+			}
+		}
+
+		if ld.isTunnel(layerType, nextLayerType) {
+			ld.TunnelLayer = layerType
+			ld.TunnelNextLayer = nextLayerType
+			ld.TunnelPayload = decoder.LayerPayload()
+			break
+		}
+
 		layerType = nextLayerType
 
 		data = decoder.LayerPayload()
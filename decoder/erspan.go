@@ -0,0 +1,25 @@
+package decoder
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ErrERSPANTooShort is returned for an erspan header cut short
+var ErrERSPANTooShort = errors.New("erspan packet too short")
+
+// ERSPANII guards layers.ERSPANII, which reads the 8 bytes of the header without checking the length and
+// panics on shorter packets
+type ERSPANII struct {
+	layers.ERSPANII
+}
+
+func (erspan *ERSPANII) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 8 {
+		df.SetTruncated()
+		return ErrERSPANTooShort
+	}
+
+	return erspan.ERSPANII.DecodeFromBytes(data, df)
+}
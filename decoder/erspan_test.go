@@ -0,0 +1,27 @@
+package decoder
+
+import (
+	"testing"
+)
+
+func TestERSPANIIDecodeTruncated(t *testing.T) {
+	header := []byte{0x10, 0, 0, 5, 0, 0, 0, 0}
+
+	for _, n := range []int{0, 4, 7} {
+		erspan := &ERSPANII{}
+		ld := &LayerDecoder{}
+		err := erspan.DecodeFromBytes(header[:n], ld)
+		if err == nil || !ld.Truncated {
+			t.Errorf("%d bytes: got err %v and truncated %t, want a truncated packet", n, err, ld.Truncated)
+		}
+	}
+
+	erspan := &ERSPANII{}
+	err := erspan.DecodeFromBytes(header, &LayerDecoder{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erspan.Version != 1 || erspan.SessionID != 5 {
+		t.Errorf("got %+v", erspan.ERSPANII)
+	}
+}
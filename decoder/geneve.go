@@ -0,0 +1,33 @@
+package decoder
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ErrGeneveTooShort is returned for a geneve header or its options cut short
+var ErrGeneveTooShort = errors.New("geneve packet too short")
+
+// Geneve makes layers.Geneve usable as a DecodingLayer, which it is missing CanDecode for
+type Geneve struct {
+	layers.Geneve
+}
+
+func (gn *Geneve) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGeneve
+}
+
+// DecodeFromBytes resets the options first, layers.Geneve appends the options of every packet decoded. The
+// header and its options are checked to be complete, layers.Geneve checks for 7 bytes only but reads 8 and
+// panics on shorter packets.
+func (gn *Geneve) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	gn.Options = gn.Options[:0]
+
+	if len(data) < 8 || len(data) < 8+int(data[0]&0x3f)*4 {
+		df.SetTruncated()
+		return ErrGeneveTooShort
+	}
+
+	return gn.Geneve.DecodeFromBytes(data, df)
+}
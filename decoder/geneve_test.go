@@ -0,0 +1,44 @@
+package decoder
+
+import (
+	"github.com/google/gopacket/layers"
+	"testing"
+)
+
+func TestGeneveDecodeTruncated(t *testing.T) {
+	// Geneve header of VNI 200 with 8 bytes of options announced, carrying an ethernet frame
+	header := []byte{0x02, 0, 0x65, 0x58, 0, 0, 0xc8, 0}
+	option := []byte{0, 1, 2, 1, 0, 0, 0, 0}
+
+	tests := []struct {
+		name  string
+		data  []byte
+		isErr bool
+	}{
+		{"header and options", append(append([]byte{}, header...), option...), false},
+		{"7 bytes", header[:7], true},
+		{"empty", []byte{}, true},
+		{"options cut", append(append([]byte{}, header...), option[:4]...), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gn := &Geneve{}
+			ld := &LayerDecoder{}
+			err := gn.DecodeFromBytes(tt.data, ld)
+			if tt.isErr {
+				if err == nil || !ld.Truncated {
+					t.Errorf("got err %v and truncated %t, want a truncated packet", err, ld.Truncated)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gn.VNI != 200 || gn.Protocol != layers.EthernetTypeTransparentEthernetBridging || len(gn.Options) != 1 {
+				t.Errorf("got %+v", gn.Geneve)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/fs714/goiftop/accounting"
@@ -11,6 +12,8 @@ import (
 	"github.com/google/gopacket/pcap"
 	"golang.org/x/net/bpf"
 	"os"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -111,32 +114,75 @@ func AfpacketComputeSize(targetSizeMb int, snaplen int, pageSize int) (
 	return frameSize, blockSize, numBlocks, nil
 }
 
-func NewAfpacketEngine(ifaceName string, direction pcap.Direction, isDecodeL4 bool, ch chan *accounting.FlowCollection) (engine *AfpacketEngine) {
+const FanoutModeHash = "hash"
+const FanoutModeCpu = "cpu"
+const FanoutModeLoadBalance = "lb"
+
+var FanoutModeList = []string{FanoutModeHash, FanoutModeCpu, FanoutModeLoadBalance}
+
+// fanoutIdSeq gives every engine its own fanout group, it starts from the pid so the groups of several
+// goiftop processes on the same host do not collide
+var fanoutIdSeq = uint32(os.Getpid())
+
+func FanoutType(mode string) (t afpacket.FanoutType, err error) {
+	switch mode {
+	case FanoutModeHash:
+		t = afpacket.FanoutHash
+	case FanoutModeCpu:
+		t = afpacket.FanoutCPU
+	case FanoutModeLoadBalance:
+		t = afpacket.FanoutLoadBalance
+	default:
+		err = errors.New("invalid fanout mode: " + mode)
+	}
+
+	return
+}
+
+// NewAfpacketEngine captures by fanoutWorkers sockets joined into one PACKET_FANOUT group when fanoutWorkers
+// is bigger than 1. Every worker decodes on its own goroutine into its own flow collection, and the flow
+// collections are merged before being flushed.
+func NewAfpacketEngine(ifaceName, bpfFilter string, direction pcap.Direction, snaplen int, mmapBufferSizeMb int,
+	fanoutWorkers int, fanoutMode string, opts DecodeOptions, ch chan *accounting.FlowCollection) (engine *AfpacketEngine) {
 	engine = &AfpacketEngine{
 		IfaceName:            ifaceName,
+		BpfFilter:            bpfFilter,
 		Direction:            direction,
-		SnapLen:              65535,
-		MmapBufferSizeMb:     16,
-		UseVlan:              false,
-		IsDecodeL4:           isDecodeL4,
+		SnapLen:              snaplen,
+		MmapBufferSizeMb:     mmapBufferSizeMb,
+		FanoutWorkers:        fanoutWorkers,
+		FanoutMode:           fanoutMode,
+		DecodeOptions:        opts,
 		NotifyChannel:        ch,
 		FlowCol:              accounting.NewFlowCollection(ifaceName),
 		FlowColResetInterval: DefaultFlowColResetInterval,
 	}
 
+	if fanoutWorkers > 1 {
+		for i := 0; i < fanoutWorkers; i++ {
+			engine.workerFlowCols = append(engine.workerFlowCols, accounting.NewFlowCollection(ifaceName))
+		}
+	}
+
 	return
 }
 
 type AfpacketEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
 	IfaceName            string
+	BpfFilter            string
 	Direction            pcap.Direction
 	SnapLen              int
 	MmapBufferSizeMb     int
-	UseVlan              bool
-	IsDecodeL4           bool
+	FanoutWorkers        int
+	FanoutMode           string
 	NotifyChannel        chan *accounting.FlowCollection
 	FlowCol              *accounting.FlowCollection
 	FlowColResetInterval int64
+
+	workerFlowCols []*accounting.FlowCollection
 }
 
 func (e *AfpacketEngine) GetDirection() pcap.Direction {
@@ -151,29 +197,39 @@ func (e *AfpacketEngine) GetResetInterval() int64 {
 	return e.FlowColResetInterval
 }
 
-func (e *AfpacketEngine) GetIsDecodeL4() bool {
-	return e.IsDecodeL4
-}
-
 func (e *AfpacketEngine) GetNotifyChannel() chan *accounting.FlowCollection {
 	return e.NotifyChannel
 }
 
-func (e *AfpacketEngine) StartEngine() (err error) {
-	go Nofify(e)
-	err = e.StartCapture()
+// MergeFlowCollections moves the flows accounted by the fanout workers into the flow collection of the engine
+func (e *AfpacketEngine) MergeFlowCollections() {
+	for _, fc := range e.workerFlowCols {
+		fc.Mu.Lock()
+		e.FlowCol.Mu.Lock()
+		e.FlowCol.UpdateByFlowCol(fc)
+		e.FlowCol.Mu.Unlock()
+		fc.Reset()
+		fc.Mu.Unlock()
+	}
+}
+
+func (e *AfpacketEngine) StartEngine(ctx context.Context) (err error) {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	err = RunEngine(ctx, e, e.StartCapture)
 
 	return
 }
 
-func (e *AfpacketEngine) StartCapture() (err error) {
+func (e *AfpacketEngine) openHandle() (handle *AfpacketHandle, err error) {
 	szFrame, szBlock, numBlocks, err := AfpacketComputeSize(e.MmapBufferSizeMb, e.SnapLen, os.Getpagesize())
 	if err != nil {
 		log.Errorf("failed to calc frame size, block size and block num with err: %s", err.Error())
 		return
 	}
 
-	handle, err := NewAfpacketHandle(e.IfaceName, szFrame, szBlock, numBlocks, e.UseVlan, pcap.BlockForever)
+	handle, err = NewAfpacketHandle(e.IfaceName, szFrame, szBlock, numBlocks, e.UseVlan, DefaultCaptureTimeout)
 	if err != nil {
 		log.Errorf("failed to open live interface %s by AfpacketEngine with err: %s", e.IfaceName, err.Error())
 		return
@@ -186,15 +242,96 @@ func (e *AfpacketEngine) StartCapture() (err error) {
 		bpfFilter = "outbound"
 	}
 
+	if e.BpfFilter != "" {
+		if bpfFilter != "" {
+			bpfFilter = bpfFilter + " and (" + e.BpfFilter + ")"
+		} else {
+			bpfFilter = e.BpfFilter
+		}
+	}
+
 	err = handle.SetBPFFilter(bpfFilter, e.SnapLen)
 	if err != nil {
-		log.Errorf("failed to set direction by AfpacketEngine with err: %s", err.Error())
+		log.Errorf("failed to set BPF filter %s by AfpacketEngine with err: %s", bpfFilter, err.Error())
+		handle.Close()
+		return
+	}
+
+	return
+}
+
+func (e *AfpacketEngine) StartCapture(ctx context.Context) (err error) {
+	if e.FanoutWorkers <= 1 {
+		var handle *AfpacketHandle
+		handle, err = e.openHandle()
+		if err != nil {
+			return
+		}
+		defer handle.Close()
+
+		err = e.captureLoop(ctx, handle, e.FlowCol, 0)
+
+		return
+	}
+
+	fanoutType, err := FanoutType(e.FanoutMode)
+	if err != nil {
+		log.Errorln(err.Error())
 		return
 	}
+	fanoutId := uint16(atomic.AddUint32(&fanoutIdSeq, 1))
+
+	// All the sockets join the fanout group before capturing, so no worker gets the whole traffic meanwhile
+	var handles []*AfpacketHandle
+	defer func() {
+		for _, h := range handles {
+			h.Close()
+		}
+	}()
+	for i := 0; i < e.FanoutWorkers; i++ {
+		var handle *AfpacketHandle
+		handle, err = e.openHandle()
+		if err != nil {
+			return
+		}
+		handles = append(handles, handle)
+
+		err = handle.TPacket.SetFanout(fanoutType, fanoutId)
+		if err != nil {
+			log.Errorf("failed to join fanout group %d of interface %s by AfpacketEngine with err: %s",
+				fanoutId, e.IfaceName, err.Error())
+			return
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, len(handles))
+	for i, handle := range handles {
+		go func(handle *AfpacketHandle, flowCol *accounting.FlowCollection, slot int) {
+			errCh <- e.captureLoop(ctx, handle, flowCol, slot)
+		}(handle, e.workerFlowCols[i], i)
+	}
+
+	// A failing worker stops the others, so the engine fails as a whole
+	for range handles {
+		werr := <-errCh
+		if werr != nil && err == nil {
+			err = werr
+			cancel()
+		}
+	}
 
-	defer handle.Close()
+	return
+}
 
+// captureLoop decodes the packets of handle into flowCol, and keeps the socket statistics of handle in the
+// capture statistics slot of the engine
+func (e *AfpacketEngine) captureLoop(ctx context.Context, handle *AfpacketHandle, flowCol *accounting.FlowCollection,
+	slot int) (err error) {
 	capture := NewCapture(e)
+	capture.FlowCol = flowCol
 	firstLayer := capture.Dec.GetFirstLayerType(handle.LinkType())
 	if firstLayer == gopacket.LayerTypeZero {
 		err = errors.New("failed to find first decode layer type")
@@ -203,13 +340,42 @@ func (e *AfpacketEngine) StartCapture() (err error) {
 	}
 	capture.SetFirstLayer(firstLayer)
 
+	updateStats := func() {
+		_, statsV3, err := handle.SocketStats()
+		if err != nil {
+			return
+		}
+
+		e.setCaptureStats(slot, CaptureStats{
+			Received:     uint64(statsV3.Packets()),
+			Dropped:      uint64(statsV3.Drops()),
+			QueueFreezes: uint64(statsV3.QueueFreezes()),
+		})
+	}
+	defer updateStats()
+
+	statsTicker := time.NewTicker(DefaultStatsInterval)
+	defer statsTicker.Stop()
+
 	var data []byte
 	for {
+		select {
+		case <-ctx.Done():
+			err = nil
+			return
+		case <-statsTicker.C:
+			updateStats()
+		default:
+		}
+
 		data, _, err = handle.ZeroCopyReadPacketData()
-		if err != nil {
-			log.Errorf("error getting packet: %s", err.Error())
+		if err == afpacket.ErrTimeout || errors.Is(err, syscall.EAGAIN) {
 			continue
 		}
+		if err != nil {
+			log.Errorf("error getting packet on %s: %s", e.IfaceName, err.Error())
+			return
+		}
 
 		capture.DecodeAndAccount(data)
 	}
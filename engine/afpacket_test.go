@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/google/gopacket/pcap"
+	"sync"
+	"testing"
+)
+
+func TestFanoutType(t *testing.T) {
+	for _, mode := range FanoutModeList {
+		if _, err := FanoutType(mode); err != nil {
+			t.Errorf("fanout mode %s rejected: %s", mode, err.Error())
+		}
+	}
+
+	if _, err := FanoutType("rollover"); err == nil {
+		t.Error("unknown fanout mode accepted")
+	}
+}
+
+// TestMergeFlowCollections flushes the flows of all fanout workers as one flow collection of the interface
+func TestMergeFlowCollections(t *testing.T) {
+	ch := make(chan *accounting.FlowCollection, 8)
+	e := NewAfpacketEngine("eth0", "", pcap.DirectionIn, 65535, 16, 3, FanoutModeHash,
+		DecodeOptions{IsDecodeL4: true}, ch)
+	if len(e.workerFlowCols) != 3 {
+		t.Fatalf("got %d worker flow collections, want 3", len(e.workerFlowCols))
+	}
+
+	shared := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}
+	for i, fc := range e.workerFlowCols {
+		fc.UpdateL3Inbound(shared, 100, 1)
+		fc.UpdateL4Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2",
+			SrcPort: uint16(40000 + i), DstPort: 443, Protocol: "tcp"}, 80, 1)
+	}
+
+	FlushFlowCollection(e, 10, 11)
+	merged := <-ch
+	if merged.InterfaceName != "eth0" || merged.FlowTimestamp != (accounting.FlowTimestamp{Start: 10, End: 11}) {
+		t.Errorf("got flow collection of %s at %+v", merged.InterfaceName, merged.FlowTimestamp)
+	}
+	if f := merged.L3FlowMap[shared]; len(merged.L3FlowMap) != 1 || f.InboundBytes != 300 || f.InboundPackets != 3 {
+		t.Errorf("got l3 flows %+v, want the flow of every worker merged", merged.L3FlowMap)
+	}
+	if len(merged.L4FlowMap) != 3 {
+		t.Errorf("got %d l4 flows, want 3", len(merged.L4FlowMap))
+	}
+
+	// The flows of the workers are moved, not copied, into the flushed collection
+	FlushFlowCollection(e, 11, 12)
+	if next := <-ch; len(next.L3FlowMap) != 0 || len(next.L4FlowMap) != 0 {
+		t.Errorf("got flows %+v flushed again", next.L3FlowMap)
+	}
+}
+
+// TestMergeFlowCollectionsConcurrent loses no packet accounted by the workers while flushing
+func TestMergeFlowCollectionsConcurrent(t *testing.T) {
+	const packets = 1000
+
+	ch := make(chan *accounting.FlowCollection, 8)
+	e := NewAfpacketEngine("eth0", "", pcap.DirectionIn, 65535, 16, 4, FanoutModeCpu, DecodeOptions{}, ch)
+	fp := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}
+
+	totalCh := make(chan int64)
+	go func() {
+		var total int64
+		for fc := range ch {
+			for _, f := range fc.L3FlowMap {
+				total += f.InboundPackets
+			}
+		}
+		totalCh <- total
+	}()
+
+	wg := &sync.WaitGroup{}
+	for _, fc := range e.workerFlowCols {
+		wg.Add(1)
+		go func(fc *accounting.FlowCollection) {
+			defer wg.Done()
+
+			for i := 0; i < packets; i++ {
+				fc.Mu.Lock()
+				fc.UpdateL3Inbound(fp, 1, 1)
+				fc.Mu.Unlock()
+			}
+		}(fc)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	flushes := 0
+	for isDone := false; !isDone; flushes++ {
+		select {
+		case <-done:
+			isDone = true
+		default:
+		}
+		FlushFlowCollection(e, int64(flushes), int64(flushes+1))
+	}
+	close(ch)
+
+	if total := <-totalCh; total != 4*packets {
+		t.Errorf("got %d packets in %d flushes, want %d", total, flushes, 4*packets)
+	}
+}
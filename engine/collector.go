@@ -0,0 +1,542 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/netflow"
+	"github.com/fs714/goiftop/utils/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CollectorSeparator joins the collector name, the exporter address and the interface index into the names the
+// interfaces of exporters are accounted by. IPv6 exporter addresses are bracketed like in host:port, so the
+// address and the index stay apart.
+const CollectorSeparator = ":"
+
+const collectorBufferSize = 65535
+
+// DefaultCollectorIdleTimeout is the seconds without flows after which exporter interfaces are dropped
+const DefaultCollectorIdleTimeout = 600
+
+// Exporters and exporter interfaces of a collector beyond these are dropped, so datagrams of spoofed sources
+// could not grow them without bounds
+const (
+	MaxCollectorExporters  = 1024
+	MaxCollectorInterfaces = 16384
+)
+
+// CollectorInterfaceName returns the name the interface ifIndex of an exporter is accounted by, index 0 holds
+// the flows whose interfaces are not known
+func CollectorInterfaceName(ifaceName string, exporter string, ifIndex uint32) string {
+	return ifaceName + CollectorSeparator + net.JoinHostPort(exporter, strconv.FormatUint(uint64(ifIndex), 10))
+}
+
+// ParseCollectorInterfaceName splits the name of an exporter interface into the collector name, the exporter
+// address and the interface index, ok is false for the names of other interfaces
+func ParseCollectorInterfaceName(name string) (ifaceName string, exporter string, ifIndex uint32, ok bool) {
+	i := strings.Index(name, CollectorSeparator)
+	if i < 0 {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(name[i+len(CollectorSeparator):])
+	if err != nil || net.ParseIP(host) == nil {
+		return
+	}
+
+	idx, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return
+	}
+
+	return name[:i], host, uint32(idx), true
+}
+
+// IsCollectorInterface tells whether ifaceName is an exporter interface of the collector collectorName
+func IsCollectorInterface(collectorName string, ifaceName string) bool {
+	name, _, _, ok := ParseCollectorInterfaceName(ifaceName)
+
+	return ok && name == collectorName
+}
+
+// ParseExporters parses the addresses and prefixes of the exporters a collector accepts datagrams from
+func ParseExporters(list []string) (exporters []*net.IPNet, err error) {
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				err = errors.New("invalid exporter address " + s)
+				return
+			}
+
+			bits := net.IPv6len * 8
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = net.IPv4len * 8
+			}
+			exporters = append(exporters, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		var prefix *net.IPNet
+		_, prefix, err = net.ParseCIDR(s)
+		if err != nil {
+			err = errors.New("invalid exporter prefix " + s)
+			return
+		}
+		exporters = append(exporters, prefix)
+	}
+
+	return
+}
+
+// NewCollectorEngine receives NetFlow v5, v9, IPFIX and sFlow v5 datagrams on a udp address from exporters, or
+// from any exporter when exporters is empty. The interfaces of the exporters are added to acct as they show up,
+// and dropped with the templates of their exporter after idleTimeout seconds without flows, or kept when it is 0.
+func NewCollectorEngine(ifaceName string, listenAddr string, exporters []*net.IPNet, idleTimeout int64,
+	opts DecodeOptions, acct *accounting.Accounting) (engine *CollectorEngine) {
+	engine = &CollectorEngine{
+		IfaceName:            ifaceName,
+		ListenAddr:           listenAddr,
+		Exporters:            exporters,
+		IdleTimeout:          idleTimeout,
+		DecodeOptions:        opts,
+		NotifyChannel:        acct.Ch,
+		FlowCol:              accounting.NewFlowCollection(ifaceName),
+		FlowColResetInterval: DefaultFlowColResetInterval,
+		acct:                 acct,
+		decoder:              netflow.NewDecoder(),
+		flowCols:             make(map[string]*exporterInterface),
+		exporters:            make(map[string]int64),
+	}
+	engine.capture = NewCapture(engine)
+
+	return
+}
+
+// CollectorEngine accounts the flows exported by switches and routers to the interfaces of the exporters, named
+// by CollectorInterfaceName. A flow is accounted as inbound on its ingress interface and as outbound on its egress
+// interface, so the flows of every exporter interface look like the ones captured on it. Flow records carry the
+// bytes of the ip packets, which are accounted to the transport layer flows as well. Sampled packet headers of
+// sFlow are decoded like captured packets, and scaled by the sampling rate.
+//
+// Flows are accounted to the second their datagram is received, FlowCol is not used. Received of the capture
+// statistics counts the datagrams, and Dropped the datagrams of exporters not accepted or beyond
+// MaxCollectorExporters.
+type CollectorEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
+	IfaceName            string
+	ListenAddr           string
+	Exporters            []*net.IPNet
+	IdleTimeout          int64
+	NotifyChannel        chan *accounting.FlowCollection
+	FlowCol              *accounting.FlowCollection
+	FlowColResetInterval int64
+
+	acct      *accounting.Accounting
+	decoder   *netflow.Decoder
+	capture   *Capture
+	mu        sync.Mutex
+	now       int64
+	flowCols  map[string]*exporterInterface
+	exporters map[string]int64
+	isCapped  bool
+}
+
+// exporterInterface is the flow collection of an exporter interface, and the last second it had flows
+type exporterInterface struct {
+	flowCol  *accounting.FlowCollection
+	exporter string
+	lastSeen int64
+}
+
+// GetDirection is in, sampled packet headers are decoded as received and turned around for egress interfaces
+func (e *CollectorEngine) GetDirection() pcap.Direction {
+	return pcap.DirectionIn
+}
+
+func (e *CollectorEngine) GetFlowCollection() *accounting.FlowCollection {
+	return e.FlowCol
+}
+
+func (e *CollectorEngine) GetResetInterval() int64 {
+	return e.FlowColResetInterval
+}
+
+func (e *CollectorEngine) GetNotifyChannel() chan *accounting.FlowCollection {
+	return e.NotifyChannel
+}
+
+func (e *CollectorEngine) StartEngine(ctx context.Context) (err error) {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	conn, err := net.ListenPacket("udp", e.ListenAddr)
+	if err != nil {
+		log.Errorf("failed to listen on %s by CollectorEngine with err: %s", e.ListenAddr, err.Error())
+		return
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	log.Infof("collector %s listening on %s", e.IfaceName, conn.LocalAddr().String())
+
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(time.Duration(e.FlowColResetInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// Interfaces expire before their flows are flushed, so no sample of them is left to account
+				now := time.Now().Unix()
+				e.expire(now)
+				e.flush(now-e.FlowColResetInterval, now)
+			}
+		}
+	}()
+
+	err = e.receive(ctx, conn)
+	cancel()
+	wg.Wait()
+
+	now := time.Now().Unix()
+	e.flush(now-e.FlowColResetInterval, now)
+
+	return
+}
+
+func (e *CollectorEngine) receive(ctx context.Context, conn net.PacketConn) (err error) {
+	buf := make([]byte, collectorBufferSize)
+	var received, dropped uint64
+	defer func() {
+		e.setCaptureStats(0, CaptureStats{Received: received, Dropped: dropped})
+	}()
+
+	statsTicker := time.NewTicker(DefaultStatsInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-statsTicker.C:
+			e.setCaptureStats(0, CaptureStats{Received: received, Dropped: dropped})
+		default:
+		}
+
+		err = conn.SetReadDeadline(time.Now().Add(DefaultCaptureTimeout))
+		if err != nil {
+			return
+		}
+
+		n, addr, rerr := conn.ReadFrom(buf)
+		if rerr != nil {
+			var ne net.Error
+			if errors.As(rerr, &ne) && ne.Timeout() {
+				continue
+			}
+
+			err = rerr
+			log.Errorf("error receiving datagram on %s: %s", e.ListenAddr, err.Error())
+			return
+		}
+		received++
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		if !e.isAccepted(udpAddr.IP) {
+			dropped++
+			continue
+		}
+
+		if !e.handle(udpAddr.IP.String(), buf[:n]) {
+			dropped++
+		}
+	}
+}
+
+// isAccepted tells whether datagrams from an exporter address are accepted
+func (e *CollectorEngine) isAccepted(ip net.IP) bool {
+	if len(e.Exporters) == 0 {
+		return true
+	}
+
+	for _, prefix := range e.Exporters {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// seen marks the exporter of a datagram as active, and tells whether its datagrams are handled, which they are
+// not for exporters beyond MaxCollectorExporters
+func (e *CollectorEngine) seen(exporter string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.now = time.Now().Unix()
+	_, ok := e.exporters[exporter]
+	if !ok && len(e.exporters) >= MaxCollectorExporters {
+		return false
+	}
+	e.exporters[exporter] = e.now
+
+	return true
+}
+
+// handle accounts the flows of a datagram, the flows decoded before an error are accounted still. It tells
+// whether the datagram was handled.
+func (e *CollectorEngine) handle(exporter string, data []byte) bool {
+	if !e.seen(exporter) {
+		return false
+	}
+
+	if netflow.IsSflow(data) {
+		samples, err := netflow.DecodeSflow(data)
+		if err != nil {
+			log.Debugf("failed to decode sflow datagram from %s with err: %s", exporter, err.Error())
+		}
+
+		for i := range samples {
+			e.accountSample(exporter, &samples[i])
+		}
+
+		return true
+	}
+
+	records, err := e.decoder.Decode(exporter, data)
+	if err != nil {
+		log.Debugf("failed to decode netflow datagram from %s with err: %s", exporter, err.Error())
+	}
+
+	for i := range records {
+		e.accountRecord(exporter, &records[i])
+	}
+
+	return true
+}
+
+func (e *CollectorEngine) accountRecord(exporter string, r *netflow.Record) {
+	l3 := accounting.FlowFingerprint{
+		SrcAddr: r.SrcAddr.String(),
+		DstAddr: r.DstAddr.String(),
+	}
+	if e.UseVlan {
+		l3.Vlan = r.Vlan
+	}
+
+	l4 := l3
+	protocol, isL4 := netflow.ProtocolName(r.Protocol)
+	isL4 = isL4 && e.IsDecodeL4
+	if isL4 {
+		l4.Protocol = protocol
+
+		// The ports of icmp flows carry the type and code
+		if protocol == "tcp" || protocol == "udp" {
+			l4.SrcPort, l4.DstPort = r.SrcPort, r.DstPort
+		}
+	}
+
+	e.account(exporter, r.InputIf, r.OutputIf, r.Direction == netflow.DirectionEgress, l3, l4, isL4,
+		int64(r.Octets), int64(r.Octets), int64(r.Packets))
+}
+
+func (e *CollectorEngine) accountSample(exporter string, s *netflow.SflowSample) {
+	var firstLayer gopacket.LayerType
+	switch s.HeaderProtocol {
+	case netflow.SflowHeaderEthernet:
+		firstLayer = layers.LayerTypeEthernet
+	case netflow.SflowHeaderIPv4:
+		firstLayer = layers.LayerTypeIPv4
+	case netflow.SflowHeaderIPv6:
+		firstLayer = layers.LayerTypeIPv6
+	default:
+		return
+	}
+
+	c := e.capture
+	c.SetFirstLayer(firstLayer)
+	c.Decode(s.Header)
+	defer c.Reset()
+
+	if c.L3Fingerprint.SrcAddr == "" {
+		return
+	}
+
+	rate := int64(s.SamplingRate)
+	if rate < 1 {
+		rate = 1
+	}
+
+	e.account(exporter, s.InputIf, s.OutputIf, false, *c.L3Fingerprint, *c.L4Fingerprint,
+		c.IsDecodeL4 && c.L4Fingerprint.Protocol != "", *c.L3Bytes*rate, *c.L4Bytes*rate, rate)
+}
+
+// account accounts a flow as inbound on its ingress interface and outbound on its egress interface. Flows
+// without interfaces are accounted to interface 0 by their direction.
+func (e *CollectorEngine) account(exporter string, inputIf uint32, outputIf uint32, isEgress bool,
+	l3 accounting.FlowFingerprint, l4 accounting.FlowFingerprint, isL4 bool, l3Bytes int64, l4Bytes int64,
+	packets int64) {
+	if inputIf == 0 && outputIf == 0 {
+		e.update(exporter, 0, isEgress, l3, l4, isL4, l3Bytes, l4Bytes, packets)
+		return
+	}
+
+	if inputIf != 0 {
+		e.update(exporter, inputIf, false, l3, l4, isL4, l3Bytes, l4Bytes, packets)
+	}
+
+	if outputIf != 0 {
+		e.update(exporter, outputIf, true, l3, l4, isL4, l3Bytes, l4Bytes, packets)
+	}
+}
+
+// update accounts a flow to an exporter interface. Outbound flows are accounted with the addresses and ports turned
+// around, like the engines capturing the outbound packets of an interface do.
+func (e *CollectorEngine) update(exporter string, ifIndex uint32, isOutbound bool, l3 accounting.FlowFingerprint,
+	l4 accounting.FlowFingerprint, isL4 bool, l3Bytes int64, l4Bytes int64, packets int64) {
+	flowCol := e.flowCollection(exporter, CollectorInterfaceName(e.IfaceName, exporter, ifIndex))
+	if flowCol == nil {
+		return
+	}
+
+	flowCol.Mu.Lock()
+	defer flowCol.Mu.Unlock()
+
+	if isOutbound {
+		flowCol.UpdateL3Outbound(reverse(l3), l3Bytes, packets)
+		if isL4 {
+			flowCol.UpdateL4Outbound(reverse(l4), l4Bytes, packets)
+		}
+	} else {
+		flowCol.UpdateL3Inbound(l3, l3Bytes, packets)
+		if isL4 {
+			flowCol.UpdateL4Inbound(l4, l4Bytes, packets)
+		}
+	}
+}
+
+// flowCollection returns the flow collection of an exporter interface, which is added to the accounting the
+// first time. It is nil for interfaces beyond MaxCollectorInterfaces.
+func (e *CollectorEngine) flowCollection(exporter string, ifaceName string) (flowCol *accounting.FlowCollection) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	iface, ok := e.flowCols[ifaceName]
+	if !ok {
+		if len(e.flowCols) >= MaxCollectorInterfaces {
+			if !e.isCapped {
+				log.Warnf("collector %s has %d interfaces, further interfaces are dropped", e.IfaceName,
+					MaxCollectorInterfaces)
+				e.isCapped = true
+			}
+			return
+		}
+
+		iface = &exporterInterface{
+			flowCol:  accounting.NewFlowCollection(ifaceName),
+			exporter: exporter,
+		}
+		e.flowCols[ifaceName] = iface
+		e.acct.AddInterface(ifaceName)
+		log.Infof("interface %s added", ifaceName)
+	}
+	iface.lastSeen = e.now
+	flowCol = iface.flowCol
+
+	return
+}
+
+// expire drops the exporter interfaces without flows for IdleTimeout seconds, and the templates of the exporters
+// without datagrams for as long
+func (e *CollectorEngine) expire(now int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.IdleTimeout <= 0 {
+		return
+	}
+
+	for ifaceName, iface := range e.flowCols {
+		if now-iface.lastSeen <= e.IdleTimeout {
+			continue
+		}
+
+		e.acct.RemoveInterface(ifaceName)
+		delete(e.flowCols, ifaceName)
+		e.isCapped = false
+		log.Infof("interface %s removed after %d seconds without flows", ifaceName, now-iface.lastSeen)
+	}
+
+	for exporter, lastSeen := range e.exporters {
+		if now-lastSeen <= e.IdleTimeout {
+			continue
+		}
+
+		e.decoder.Forget(exporter)
+		delete(e.exporters, exporter)
+		log.Infof("exporter %s of collector %s removed after %d seconds without datagrams", exporter, e.IfaceName,
+			now-lastSeen)
+	}
+}
+
+// flush hands the flows of every exporter interface over to the notify channel as the sample of [start, end],
+// both directions of a flow are accounted for the whole sample
+func (e *CollectorEngine) flush(start int64, end int64) {
+	e.mu.Lock()
+	flowCols := make([]*accounting.FlowCollection, 0, len(e.flowCols))
+	for _, iface := range e.flowCols {
+		flowCols = append(flowCols, iface.flowCol)
+	}
+	e.mu.Unlock()
+
+	duration := end - start
+	for _, flowCol := range flowCols {
+		flowCol.Mu.Lock()
+		flowColCopy := flowCol.Copy()
+		flowCol.Reset()
+		flowCol.Mu.Unlock()
+
+		flowColCopy.SetTimestamp(start, end)
+		for _, f := range flowColCopy.L3FlowMap {
+			f.InboundDuration, f.OutboundDuration = duration, duration
+		}
+		for _, f := range flowColCopy.L4FlowMap {
+			f.InboundDuration, f.OutboundDuration = duration, duration
+		}
+
+		e.NotifyChannel <- flowColCopy
+	}
+}
+
+func reverse(fp accounting.FlowFingerprint) accounting.FlowFingerprint {
+	fp.SrcAddr, fp.DstAddr = fp.DstAddr, fp.SrcAddr
+	fp.SrcPort, fp.DstPort = fp.DstPort, fp.SrcPort
+
+	return fp
+}
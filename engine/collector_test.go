@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/netflow"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseExporters(t *testing.T) {
+	tests := []struct {
+		list  []string
+		want  []string
+		isErr bool
+	}{
+		{list: nil, want: nil},
+		{list: []string{"192.0.2.1"}, want: []string{"192.0.2.1/32"}},
+		{list: []string{" 2001:db8::1 "}, want: []string{"2001:db8::1/128"}},
+		{list: []string{"192.0.2.7/24", "2001:db8::/32"}, want: []string{"192.0.2.0/24", "2001:db8::/32"}},
+		{list: []string{"192.0.2"}, isErr: true},
+		{list: []string{"192.0.2.0/33"}, isErr: true},
+		{list: []string{"192.0.2.1", "exporter"}, isErr: true},
+	}
+
+	for _, tt := range tests {
+		exporters, err := ParseExporters(tt.list)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("ParseExporters(%q) returned no error", tt.list)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseExporters(%q) returned error: %s", tt.list, err.Error())
+			continue
+		}
+
+		var got []string
+		for _, prefix := range exporters {
+			got = append(got, prefix.String())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseExporters(%q) = %q, want %q", tt.list, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseExporters(%q) = %q, want %q", tt.list, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// TestCollectorInterfaceName brackets IPv6 exporters, so their addresses and the interface index stay apart
+func TestCollectorInterfaceName(t *testing.T) {
+	tests := []struct {
+		ifaceName string
+		exporter  string
+		ifIndex   uint32
+		want      string
+	}{
+		{"nf", "192.0.2.1", 3, "nf:192.0.2.1:3"},
+		{"nf", "2001:db8::1", 3, "nf:[2001:db8::1]:3"},
+		{"nf", "2001:db8::1:3", 0, "nf:[2001:db8::1:3]:0"},
+	}
+
+	for _, tt := range tests {
+		got := CollectorInterfaceName(tt.ifaceName, tt.exporter, tt.ifIndex)
+		if got != tt.want {
+			t.Errorf("CollectorInterfaceName(%s, %s, %d) = %s, want %s", tt.ifaceName, tt.exporter, tt.ifIndex,
+				got, tt.want)
+			continue
+		}
+
+		ifaceName, exporter, ifIndex, ok := ParseCollectorInterfaceName(got)
+		if !ok || ifaceName != tt.ifaceName || exporter != tt.exporter || ifIndex != tt.ifIndex {
+			t.Errorf("ParseCollectorInterfaceName(%s) = %s, %s, %d, %t", got, ifaceName, exporter, ifIndex, ok)
+		}
+	}
+
+	others := []string{"nf", "eth0:1", "nf:exporter:1", "nf:192.0.2.1:x", "nf:2001:db8::1:3", "node1:eth0"}
+	for _, name := range others {
+		if _, _, _, ok := ParseCollectorInterfaceName(name); ok {
+			t.Errorf("ParseCollectorInterfaceName(%s) parsed a name of another interface", name)
+		}
+	}
+}
+
+func TestCollectorIsAccepted(t *testing.T) {
+	exporters, err := ParseExporters([]string{"192.0.2.0/24", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		exporters []*net.IPNet
+		ip        string
+		want      bool
+	}{
+		{nil, "203.0.113.1", true},
+		{exporters, "192.0.2.200", true},
+		{exporters, "192.0.3.1", false},
+		{exporters, "2001:db8::1", true},
+		{exporters, "2001:db8::2", false},
+	}
+
+	for _, tt := range tests {
+		e := NewCollectorEngine("nf", ":0", tt.exporters, 0, DecodeOptions{}, accounting.NewAccounting())
+		if got := e.isAccepted(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isAccepted(%s) = %t, want %t", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCollectorHandle(t *testing.T) {
+	acct := accounting.NewAccounting()
+	e := NewCollectorEngine("nf", ":0", nil, 60, DecodeOptions{IsDecodeL4: true}, acct)
+
+	record := netflow.Record{
+		SrcAddr:  net.ParseIP("198.51.100.1").To4(),
+		DstAddr:  net.ParseIP("198.51.100.2").To4(),
+		SrcPort:  1234,
+		DstPort:  80,
+		Protocol: 6,
+		InputIf:  1,
+		OutputIf: 2,
+		Octets:   1000,
+		Packets:  2,
+	}
+	msgs := netflow.NewEncoder(netflow.VersionIpfix, 1, netflow.DefaultMaxMessageSize).Encode(
+		[]netflow.Record{record}, true, time.Now())
+	if !e.handle("192.0.2.1", msgs[0]) {
+		t.Fatal("datagram not handled")
+	}
+	if !e.handle("2001:db8::1", msgs[0]) {
+		t.Fatal("datagram of an IPv6 exporter not handled")
+	}
+
+	l4 := accounting.FlowFingerprint{SrcAddr: "198.51.100.1", DstAddr: "198.51.100.2", SrcPort: 1234, DstPort: 80,
+		Protocol: "tcp"}
+	tests := []struct {
+		ifaceName  string
+		fp         accounting.FlowFingerprint
+		isOutbound bool
+	}{
+		{"nf:192.0.2.1:1", l4, false},
+		{"nf:192.0.2.1:2", reverse(l4), true},
+		{"nf:[2001:db8::1]:1", l4, false},
+		{"nf:[2001:db8::1]:2", reverse(l4), true},
+	}
+
+	for _, tt := range tests {
+		iface, ok := e.flowCols[tt.ifaceName]
+		if !ok {
+			t.Errorf("interface %s not added", tt.ifaceName)
+			continue
+		}
+
+		f, ok := iface.flowCol.L4FlowMap[tt.fp]
+		if !ok {
+			t.Errorf("flow %+v not accounted to %s", tt.fp, tt.ifaceName)
+			continue
+		}
+
+		bytes, packets := f.InboundBytes, f.InboundPackets
+		if tt.isOutbound {
+			bytes, packets = f.OutboundBytes, f.OutboundPackets
+		}
+		if bytes != 1000 || packets != 2 {
+			t.Errorf("flow of %s has %d bytes and %d packets, want 1000 and 2", tt.ifaceName, bytes, packets)
+		}
+	}
+
+	if _, ok := acct.GetInterface("nf:192.0.2.1:1"); !ok {
+		t.Error("interface not added to the accounting")
+	}
+
+	e.expire(e.now + e.IdleTimeout)
+	if len(e.flowCols) != 4 {
+		t.Errorf("%d interfaces left before the idle timeout, want 4", len(e.flowCols))
+	}
+
+	e.expire(e.now + e.IdleTimeout + 1)
+	if len(e.flowCols) != 0 || len(e.exporters) != 0 {
+		t.Errorf("%d interfaces and %d exporters left after the idle timeout", len(e.flowCols), len(e.exporters))
+	}
+	if _, ok := acct.GetInterface("nf:192.0.2.1:1"); ok {
+		t.Error("interface not removed from the accounting")
+	}
+
+	// The templates of the exporter are forgotten with it
+	msgs = netflow.NewEncoder(netflow.VersionIpfix, 1, netflow.DefaultMaxMessageSize).Encode(
+		[]netflow.Record{record}, false, time.Now())
+	e.handle("192.0.2.1", msgs[0])
+	if len(e.flowCols) != 0 {
+		t.Errorf("%d interfaces added by records of forgotten templates", len(e.flowCols))
+	}
+}
@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"github.com/fs714/goiftop/accounting"
 	"github.com/fs714/goiftop/decoder"
 	"github.com/fs714/goiftop/utils/log"
@@ -8,88 +10,322 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"strings"
+	"sync"
 	"time"
 )
 
 const LibPcapEngineName = "libpcap"
 const AfpacketEngineName = "afpacket"
 const NflogEngineName = "nflog"
+const PcapFileEngineName = "pcapfile"
+const CollectorEngineName = "collector"
 const DefaultFlowColResetInterval = 1
 
+// DefaultStatsInterval is how often the capture loops read the capture statistics of their handles
+const DefaultStatsInterval = 1 * time.Second
+
+// DefaultCaptureTimeout bounds how long a capture loop blocks waiting for packets, so it notices
+// its context being cancelled
+const DefaultCaptureTimeout = 500 * time.Millisecond
+
+// PktCapEngine captures packets of an interface. StartEngine blocks until ctx is done, StopEngine is called
+// or the capture fails, and flushes the flows accounted so far before it returns. StopEngine returns after
+// StartEngine has returned.
 type PktCapEngine interface {
-	StartEngine() error
+	StartEngine(ctx context.Context) error
+	StopEngine()
+	GetCaptureStats() CaptureStats
 	GetDirection() pcap.Direction
 	GetFlowCollection() *accounting.FlowCollection
 	GetResetInterval() int64
-	GetIsDecodeL4() bool
+	GetDecodeOptions() DecodeOptions
 	GetNotifyChannel() chan *accounting.FlowCollection
 }
 
-func Nofify(engine PktCapEngine) {
-	direction := engine.GetDirection()
-	flowCol := engine.GetFlowCollection()
+// CaptureStats are the packet counters of the capture, accumulated since the engine started. Received
+// counts the packets seen by the kernel socket, libpcap or nflog, Dropped the packets lost because the
+// capture did not keep up, IfDropped the packets dropped by the interface and QueueFreezes the times the
+// TPACKET_V3 ring was full.
+type CaptureStats struct {
+	Received     uint64
+	Dropped      uint64
+	IfDropped    uint64
+	QueueFreezes uint64
+}
+
+func (s *CaptureStats) Add(o CaptureStats) {
+	s.Received += o.Received
+	s.Dropped += o.Dropped
+	s.IfDropped += o.IfDropped
+	s.QueueFreezes += o.QueueFreezes
+}
+
+// captureStats is embedded by the engines to keep the capture statistics, every handle of an engine updates
+// its own slot from the capture loop
+type captureStats struct {
+	statsMu    sync.Mutex
+	statsSlots []CaptureStats
+}
+
+func (s *captureStats) setCaptureStats(slot int, stats CaptureStats) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	for len(s.statsSlots) <= slot {
+		s.statsSlots = append(s.statsSlots, CaptureStats{})
+	}
+	s.statsSlots[slot] = stats
+}
+
+func (s *captureStats) GetCaptureStats() (stats CaptureStats) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	for _, slot := range s.statsSlots {
+		stats.Add(slot)
+	}
+
+	return
+}
+
+// lifecycle is embedded by the engines to stop StartEngine from another goroutine
+type lifecycle struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	mu     sync.Mutex
+}
+
+func (l *lifecycle) begin(ctx context.Context) context.Context {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+
+	return ctx
+}
+
+func (l *lifecycle) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cancel()
+	close(l.done)
+}
+
+func (l *lifecycle) StopEngine() {
+	l.mu.Lock()
+	cancel, done := l.cancel, l.done
+	l.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+
+	cancel()
+	<-done
+}
+
+// RunEngine runs the capture loop of a live engine together with its notify ticker, and flushes the flows
+// accounted since the last tick once both have returned
+func RunEngine(ctx context.Context, engine PktCapEngine, capture func(ctx context.Context) error) (err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		Nofify(ctx, engine)
+	}()
+
+	err = capture(ctx)
+	cancel()
+	wg.Wait()
+
+	now := time.Now().Unix()
+	FlushFlowCollection(engine, now-engine.GetResetInterval(), now)
+
+	return
+}
+
+func Nofify(ctx context.Context, engine PktCapEngine) {
 	resetInterval := engine.GetResetInterval()
-	notifyChannel := engine.GetNotifyChannel()
 
 	ticker := time.NewTicker(time.Duration(resetInterval) * time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
-			flowCol.Mu.Lock()
-			flowColCopy := flowCol.Copy()
-			flowCol.Reset()
-			flowCol.Mu.Unlock()
-
 			now := time.Now().Unix()
-			flowColCopy.SetTimestamp(now-resetInterval, now)
-
-			if direction == pcap.DirectionOut {
-				for _, f := range flowColCopy.L3FlowMap {
-					f.OutboundDuration = resetInterval
-				}
-				for _, f := range flowColCopy.L4FlowMap {
-					f.OutboundDuration = resetInterval
-				}
-			} else {
-				for _, f := range flowColCopy.L3FlowMap {
-					f.InboundDuration = resetInterval
-				}
-				for _, f := range flowColCopy.L4FlowMap {
-					f.InboundDuration = resetInterval
-				}
-			}
+			FlushFlowCollection(engine, now-resetInterval, now)
+		}
+	}
+}
+
+// flowCollectionMerger is implemented by engines accounting into several flow collections, which are merged
+// into the flow collection of the engine before it is flushed
+type flowCollectionMerger interface {
+	MergeFlowCollections()
+}
 
-			notifyChannel <- flowColCopy
+// FlushFlowCollection hands the flows accounted so far by engine over to its notify channel as
+// the sample of [start, end], and resets the collection for the next sample.
+func FlushFlowCollection(engine PktCapEngine, start int64, end int64) {
+	if m, ok := engine.(flowCollectionMerger); ok {
+		m.MergeFlowCollections()
+	}
+
+	direction := engine.GetDirection()
+	flowCol := engine.GetFlowCollection()
+	notifyChannel := engine.GetNotifyChannel()
+
+	flowCol.Mu.Lock()
+	flowColCopy := flowCol.Copy()
+	flowCol.Reset()
+	flowCol.Mu.Unlock()
+
+	flowColCopy.SetTimestamp(start, end)
+
+	duration := end - start
+	if direction == pcap.DirectionOut {
+		for _, f := range flowColCopy.L3FlowMap {
+			f.OutboundDuration = duration
+		}
+		for _, f := range flowColCopy.L4FlowMap {
+			f.OutboundDuration = duration
+		}
+	} else {
+		for _, f := range flowColCopy.L3FlowMap {
+			f.InboundDuration = duration
+		}
+		for _, f := range flowColCopy.L4FlowMap {
+			f.InboundDuration = duration
 		}
 	}
+
+	notifyChannel <- flowColCopy
+}
+
+// DecodeOptions are the decoding settings of an engine. With UseVlan flows are kept apart by their vlan tags.
+// With TunnelDecap the bytes of VXLAN, Geneve, GRE, ERSPAN and IP-in-IP packets are accounted to the inner
+// flow instead of the flow between the tunnel endpoints, and with TunnelTag the inner flows are tagged with
+// the tunnel type and its VNI, key or session id.
+type DecodeOptions struct {
+	IsDecodeL4  bool
+	UseVlan     bool
+	TunnelDecap bool
+	TunnelTag   bool
 }
 
+func (o DecodeOptions) GetDecodeOptions() DecodeOptions {
+	return o
+}
+
+const TunnelVxlan = "vxlan"
+const TunnelGeneve = "geneve"
+const TunnelGre = "gre"
+const TunnelErspan = "erspan"
+const TunnelIpip = "ipip"
+
 type CaptureLayers struct {
 	eth      *layers.Ethernet
 	linuxSll *layers.LinuxSLL
 	dot1q    *layers.Dot1Q
 	ipv4     *layers.IPv4
+	ipv6     *layers.IPv6
+	ipv6Ext  *layers.IPv6ExtensionSkipper
 	tcp      *layers.TCP
 	udp      *layers.UDP
 	dns      *layers.DNS
 	icmpv4   *layers.ICMPv4
+	icmpv6   *layers.ICMPv6
 	gre      *layers.GRE
+	vxlan    *layers.VXLAN
+	geneve   *decoder.Geneve
+	erspan   *decoder.ERSPANII
 	llc      *layers.LLC
 	arp      *layers.ARP
 	payload  *gopacket.Payload
 }
 
+func newCaptureLayers() (ly *CaptureLayers) {
+	ly = &CaptureLayers{}
+	ly.eth = &layers.Ethernet{}
+	ly.linuxSll = &layers.LinuxSLL{}
+	ly.dot1q = &layers.Dot1Q{}
+	ly.ipv4 = &layers.IPv4{}
+	ly.ipv6 = &layers.IPv6{}
+	ly.ipv6Ext = &layers.IPv6ExtensionSkipper{}
+	ly.tcp = &layers.TCP{}
+	ly.udp = &layers.UDP{}
+	ly.dns = &layers.DNS{}
+	ly.icmpv4 = &layers.ICMPv4{}
+	ly.icmpv6 = &layers.ICMPv6{}
+	ly.gre = &layers.GRE{}
+	ly.vxlan = &layers.VXLAN{}
+	ly.geneve = &decoder.Geneve{}
+	ly.erspan = &decoder.ERSPANII{}
+	ly.llc = &layers.LLC{}
+	ly.arp = &layers.ARP{}
+	ly.payload = &gopacket.Payload{}
+
+	return
+}
+
+func (ly *CaptureLayers) decodingLayers(isDecodeL4 bool, isTunnelDecap bool) (decodingLayers []gopacket.DecodingLayer) {
+	decodingLayers = []gopacket.DecodingLayer{
+		ly.eth,
+		ly.linuxSll,
+		ly.dot1q,
+		ly.ipv4,
+		ly.ipv6,
+	}
+
+	if isDecodeL4 {
+		decodingLayers = append(decodingLayers,
+			ly.ipv6Ext,
+			ly.tcp,
+			ly.udp,
+			ly.dns,
+			ly.icmpv4,
+			ly.icmpv6,
+			ly.gre,
+			ly.llc,
+			ly.arp,
+		)
+	}
+
+	// The tunnel headers are reached through udp and gre, so those are decoded without l4 as well
+	if isTunnelDecap {
+		if !isDecodeL4 {
+			decodingLayers = append(decodingLayers, ly.udp, ly.gre)
+		}
+		decodingLayers = append(decodingLayers, ly.vxlan, ly.geneve, ly.erspan)
+	}
+
+	decodingLayers = append(decodingLayers, ly.payload)
+
+	return
+}
+
 type Capture struct {
 	CaptureLayers
-	IsDecodeL4 bool
-	Direction  pcap.Direction
-	FlowCol    *accounting.FlowCollection
+	DecodeOptions
+	Direction pcap.Direction
+	FlowCol   *accounting.FlowCollection
 
 	DecodingLayerList []gopacket.DecodingLayer
 	Dec               *decoder.LayerDecoder
 	Decoded           []gopacket.LayerType
 	FirstLayer        gopacket.LayerType
 
+	// Inner packets of tunnels are decoded into their own layers
+	inner        *CaptureLayers
+	innerDec     *decoder.LayerDecoder
+	innerDecoded []gopacket.LayerType
+
 	L3Fingerprint *accounting.FlowFingerprint
 	L4Fingerprint *accounting.FlowFingerprint
 	L3Bytes       *int64
@@ -98,51 +334,28 @@ type Capture struct {
 
 func NewCapture(engine PktCapEngine) (capture *Capture) {
 	capture = &Capture{}
-	capture.eth = &layers.Ethernet{}
-	capture.linuxSll = &layers.LinuxSLL{}
-	capture.dot1q = &layers.Dot1Q{}
-	capture.ipv4 = &layers.IPv4{}
-	capture.tcp = &layers.TCP{}
-	capture.udp = &layers.UDP{}
-	capture.dns = &layers.DNS{}
-	capture.icmpv4 = &layers.ICMPv4{}
-	capture.gre = &layers.GRE{}
-	capture.llc = &layers.LLC{}
-	capture.arp = &layers.ARP{}
-	capture.payload = &gopacket.Payload{}
-
-	capture.IsDecodeL4 = engine.GetIsDecodeL4()
+	capture.CaptureLayers = *newCaptureLayers()
+
+	capture.DecodeOptions = engine.GetDecodeOptions()
 	capture.Direction = engine.GetDirection()
 	capture.FlowCol = engine.GetFlowCollection()
 
-	if capture.IsDecodeL4 {
-		capture.DecodingLayerList = []gopacket.DecodingLayer{
-			capture.eth,
-			capture.linuxSll,
-			capture.dot1q,
-			capture.ipv4,
-			capture.tcp,
-			capture.udp,
-			capture.dns,
-			capture.icmpv4,
-			capture.gre,
-			capture.llc,
-			capture.arp,
-			capture.payload,
-		}
-	} else {
-		capture.DecodingLayerList = []gopacket.DecodingLayer{
-			capture.eth,
-			capture.linuxSll,
-			capture.dot1q,
-			capture.ipv4,
-			capture.payload,
-		}
-	}
-
+	capture.DecodingLayerList = capture.decodingLayers(capture.IsDecodeL4, capture.TunnelDecap)
 	capture.Dec = decoder.NewLayerDecoder(capture.DecodingLayerList...)
 	capture.Decoded = make([]gopacket.LayerType, 0, 8)
 
+	// Decoding stops at tunnels without decap as well, else the inner packet of GRE and IP-in-IP would be decoded
+	// into the outer layers and accounted without the encapsulation
+	capture.Dec.SetTunnelLayers(layers.LayerTypeIPv4, layers.LayerTypeIPv6, layers.LayerTypeGRE,
+		layers.LayerTypeVXLAN, layers.LayerTypeGeneve, layers.LayerTypeERSPANII)
+
+	if capture.TunnelDecap {
+		// Tunnels nested in the inner packet are not decapsulated again
+		capture.inner = newCaptureLayers()
+		capture.innerDec = decoder.NewLayerDecoder(capture.inner.decodingLayers(capture.IsDecodeL4, false)...)
+		capture.innerDecoded = make([]gopacket.LayerType, 0, 8)
+	}
+
 	capture.L3Fingerprint = &accounting.FlowFingerprint{}
 	capture.L4Fingerprint = &accounting.FlowFingerprint{}
 	capture.L3Bytes = new(int64)
@@ -155,123 +368,243 @@ func (c *Capture) SetFirstLayer(l gopacket.LayerType) {
 	c.FirstLayer = l
 }
 
-func (c *Capture) DecodeAndAccount(data []byte) {
-	err := c.Dec.DecodeLayers(data, c.FirstLayer, &c.Decoded)
-	if err != nil {
-		if c.IsDecodeL4 {
-			ignoreErr := false
-			for _, s := range []string{"IPv6", "DHCPv4", "IGMP", "TLS", "STP", "NTP", "VRRP", "SNAP", "LinkLayerDiscovery", "Fragment"} {
-				if strings.Contains(err.Error(), s) {
-					ignoreErr = true
-					break
-				}
-			}
-			if !ignoreErr {
-				log.Errorf("error decoding packet with err: %s", err.Error())
-			}
+// icmpv6SubLayerTypes are the layers following ICMPv6, which are not decoded as the ICMPv6 layer is the one
+// accounted
+var icmpv6SubLayerTypes = map[gopacket.LayerType]bool{
+	layers.LayerTypeICMPv6Echo:                   true,
+	layers.LayerTypeICMPv6RouterSolicitation:     true,
+	layers.LayerTypeICMPv6RouterAdvertisement:    true,
+	layers.LayerTypeICMPv6NeighborSolicitation:   true,
+	layers.LayerTypeICMPv6NeighborAdvertisement:  true,
+	layers.LayerTypeICMPv6Redirect:               true,
+	layers.LayerTypeMLDv1MulticastListenerQuery:  true,
+	layers.LayerTypeMLDv2MulticastListenerQuery:  true,
+	layers.LayerTypeMLDv1MulticastListenerDone:   true,
+	layers.LayerTypeMLDv1MulticastListenerReport: true,
+	layers.LayerTypeMLDv2MulticastListenerReport: true,
+}
+
+// tunnelLayerTypes are the tunnel headers, which are not decoded without decap as the outer packet is the one
+// accounted
+var tunnelLayerTypes = map[gopacket.LayerType]bool{
+	layers.LayerTypeVXLAN:    true,
+	layers.LayerTypeGeneve:   true,
+	layers.LayerTypeERSPANII: true,
+}
+
+// isIgnoredDecodeErr tells whether err is expected for packets decoded as far as they are accounted, like
+// layers without a decoder following the ones accounted, and tunnel headers cut short, which leave the packet
+// accounted to the tunnel endpoints
+func isIgnoredDecodeErr(err error) bool {
+	var unsupported gopacket.UnsupportedLayerType
+	if errors.As(err, &unsupported) && (icmpv6SubLayerTypes[gopacket.LayerType(unsupported)] ||
+		tunnelLayerTypes[gopacket.LayerType(unsupported)]) {
+		return true
+	}
+
+	if errors.Is(err, decoder.ErrGeneveTooShort) || errors.Is(err, decoder.ErrERSPANTooShort) {
+		return true
+	}
+
+	for _, s := range []string{"DHCPv4", "IGMP", "TLS", "STP", "NTP", "VRRP", "SNAP", "LinkLayerDiscovery", "Fragment"} {
+		if strings.Contains(err.Error(), s) {
+			return true
 		}
 	}
 
-	if !c.IsDecodeL4 {
-		for _, ly := range c.Decoded {
-			switch ly {
-			case layers.LayerTypeIPv4:
-				if c.Direction == pcap.DirectionOut {
-					c.L3Fingerprint.SrcAddr = c.ipv4.DstIP.String()
-					c.L3Fingerprint.DstAddr = c.ipv4.SrcIP.String()
-				} else {
-					c.L3Fingerprint.SrcAddr = c.ipv4.SrcIP.String()
-					c.L3Fingerprint.DstAddr = c.ipv4.DstIP.String()
-				}
-				*c.L3Bytes = int64(c.ipv4.Length)
-				break
-			}
+	return false
+}
+
+func (c *Capture) logDecodeErr(err error) {
+	if err == nil || !c.IsDecodeL4 || isIgnoredDecodeErr(err) {
+		return
+	}
+
+	log.Errorf("error decoding packet with err: %s", err.Error())
+}
+
+func (c *Capture) DecodeAndAccount(data []byte) {
+	c.Decode(data)
+
+	c.FlowCol.Mu.Lock()
+	if c.L3Fingerprint.SrcAddr != "" {
+		if c.Direction == pcap.DirectionOut {
+			c.FlowCol.UpdateL3Outbound(*c.L3Fingerprint, *c.L3Bytes, 1)
+		} else {
+			c.FlowCol.UpdateL3Inbound(*c.L3Fingerprint, *c.L3Bytes, 1)
 		}
 
-		c.FlowCol.Mu.Lock()
-		if c.L3Fingerprint.SrcAddr != "" {
+		if c.IsDecodeL4 && c.L4Fingerprint.Protocol != "" {
 			if c.Direction == pcap.DirectionOut {
-				c.FlowCol.UpdateL3Outbound(*c.L3Fingerprint, *c.L3Bytes, 1)
+				c.FlowCol.UpdateL4Outbound(*c.L4Fingerprint, *c.L4Bytes, 1)
 			} else {
-				c.FlowCol.UpdateL3Inbound(*c.L3Fingerprint, *c.L3Bytes, 1)
+				c.FlowCol.UpdateL4Inbound(*c.L4Fingerprint, *c.L4Bytes, 1)
 			}
 		}
-		c.FlowCol.Mu.Unlock()
+	}
+	c.FlowCol.Mu.Unlock()
 
-		c.L3Fingerprint.SrcAddr = ""
-		c.L3Fingerprint.DstAddr = ""
-		*c.L3Bytes = 0
-	} else {
-		for _, ly := range c.Decoded {
-			switch ly {
-			case layers.LayerTypeIPv4:
-				if c.Direction == pcap.DirectionOut {
-					c.L3Fingerprint.SrcAddr = c.ipv4.DstIP.String()
-					c.L3Fingerprint.DstAddr = c.ipv4.SrcIP.String()
-				} else {
-					c.L3Fingerprint.SrcAddr = c.ipv4.SrcIP.String()
-					c.L3Fingerprint.DstAddr = c.ipv4.DstIP.String()
-				}
-				*c.L3Bytes = int64(c.ipv4.Length)
-
-				c.L4Fingerprint.SrcAddr = c.L3Fingerprint.SrcAddr
-				c.L4Fingerprint.DstAddr = c.L3Fingerprint.DstAddr
-				break
-			case layers.LayerTypeTCP:
-				if c.Direction == pcap.DirectionOut {
-					c.L4Fingerprint.SrcPort = uint16(c.tcp.DstPort)
-					c.L4Fingerprint.DstPort = uint16(c.tcp.SrcPort)
-				} else {
-					c.L4Fingerprint.SrcPort = uint16(c.tcp.SrcPort)
-					c.L4Fingerprint.DstPort = uint16(c.tcp.DstPort)
-				}
-				c.L4Fingerprint.Protocol = "tcp"
-				*c.L4Bytes = int64(len(c.tcp.Contents) + len(c.tcp.LayerPayload()))
-				break
-			case layers.LayerTypeUDP:
-				if c.Direction == pcap.DirectionOut {
-					c.L4Fingerprint.SrcPort = uint16(c.udp.DstPort)
-					c.L4Fingerprint.DstPort = uint16(c.udp.SrcPort)
-				} else {
-					c.L4Fingerprint.SrcPort = uint16(c.udp.SrcPort)
-					c.L4Fingerprint.DstPort = uint16(c.udp.DstPort)
-				}
-				c.L4Fingerprint.Protocol = "udp"
-				*c.L4Bytes = int64(c.udp.Length)
-				break
-			case layers.LayerTypeICMPv4:
-				c.L4Fingerprint.Protocol = "icmp"
-				*c.L4Bytes = int64(len(c.icmpv4.Contents) + len(c.icmpv4.LayerPayload()))
-				break
-			}
+	c.Reset()
+}
+
+// Decode sets the fingerprints and bytes of the packet in data without accounting it
+func (c *Capture) Decode(data []byte) {
+	err := c.Dec.DecodeLayers(data, c.FirstLayer, &c.Decoded)
+	c.logDecodeErr(err)
+
+	c.fingerprint(&c.CaptureLayers, c.Decoded, c.Dec.Truncated)
+
+	if c.TunnelDecap && c.Dec.TunnelPayload != nil {
+		c.decapTunnel()
+	}
+
+	// The vlan tags of the outer packet are the ones of the captured link
+	if c.UseVlan && len(c.Dec.VlanIds) > 0 {
+		c.L3Fingerprint.Vlan = c.Dec.VlanIds[0]
+		if len(c.Dec.VlanIds) > 1 {
+			c.L3Fingerprint.InnerVlan = c.Dec.VlanIds[1]
+		}
+		c.L4Fingerprint.Vlan, c.L4Fingerprint.InnerVlan = c.L3Fingerprint.Vlan, c.L3Fingerprint.InnerVlan
+	}
+}
+
+// Reset clears the fingerprints and bytes of the packet decoded last
+func (c *Capture) Reset() {
+	*c.L3Fingerprint = accounting.FlowFingerprint{}
+	*c.L4Fingerprint = accounting.FlowFingerprint{}
+	*c.L3Bytes = 0
+	*c.L4Bytes = 0
+}
+
+// decapTunnel decodes the inner packet of a tunnel and replaces the outer fingerprints with the inner ones.
+// The l3 bytes of the outer packet are kept, so the encapsulation overhead is still accounted. Packets
+// without an inner ip layer, like ARP inside VXLAN, stay accounted to the outer flow.
+func (c *Capture) decapTunnel() {
+	err := c.innerDec.DecodeLayers(c.Dec.TunnelPayload, c.Dec.TunnelNextLayer, &c.innerDecoded)
+	c.logDecodeErr(err)
+
+	isInnerIp := false
+	for _, ly := range c.innerDecoded {
+		if ly == layers.LayerTypeIPv4 || ly == layers.LayerTypeIPv6 {
+			isInnerIp = true
+			break
 		}
+	}
+	if !isInnerIp {
+		return
+	}
+
+	l3Bytes := *c.L3Bytes
+	*c.L4Fingerprint = accounting.FlowFingerprint{}
+	*c.L4Bytes = 0
+	c.fingerprint(c.inner, c.innerDecoded, c.innerDec.Truncated)
+	*c.L3Bytes = l3Bytes
 
-		c.FlowCol.Mu.Lock()
-		if c.L3Fingerprint.SrcAddr != "" {
+	if c.TunnelTag {
+		c.L3Fingerprint.Tunnel, c.L3Fingerprint.TunnelId = c.tunnelTag()
+		c.L4Fingerprint.Tunnel, c.L4Fingerprint.TunnelId = c.L3Fingerprint.Tunnel, c.L3Fingerprint.TunnelId
+	}
+}
+
+// tunnelTag returns the type of the tunnel the decoder stopped at, and its VNI, GRE key or ERSPAN session id
+func (c *Capture) tunnelTag() (tunnel string, id uint32) {
+	switch c.Dec.TunnelLayer {
+	case layers.LayerTypeVXLAN:
+		return TunnelVxlan, c.vxlan.VNI
+	case layers.LayerTypeGeneve:
+		return TunnelGeneve, c.geneve.VNI
+	case layers.LayerTypeGRE:
+		if c.gre.KeyPresent {
+			return TunnelGre, c.gre.Key
+		}
+		return TunnelGre, 0
+	case layers.LayerTypeERSPANII:
+		return TunnelErspan, uint32(c.erspan.SessionID)
+	default:
+		return TunnelIpip, 0
+	}
+}
+
+// fingerprint sets the fingerprints and bytes of the flows from the decoded layers of ly. The last ip
+// layer decoded wins. Packets truncated by the snaplen or by sampling agents have the tcp and icmp bytes
+// taken from the payload length of the ip header.
+func (c *Capture) fingerprint(ly *CaptureLayers, decoded []gopacket.LayerType, isTruncated bool) {
+	var ipPayload int64
+	for _, layerType := range decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			if c.Direction == pcap.DirectionOut {
+				c.L3Fingerprint.SrcAddr = ly.ipv4.DstIP.String()
+				c.L3Fingerprint.DstAddr = ly.ipv4.SrcIP.String()
+			} else {
+				c.L3Fingerprint.SrcAddr = ly.ipv4.SrcIP.String()
+				c.L3Fingerprint.DstAddr = ly.ipv4.DstIP.String()
+			}
+			*c.L3Bytes = int64(ly.ipv4.Length)
+			ipPayload = int64(ly.ipv4.Length) - int64(ly.ipv4.IHL)*4
+
+			c.L4Fingerprint.SrcAddr = c.L3Fingerprint.SrcAddr
+			c.L4Fingerprint.DstAddr = c.L3Fingerprint.DstAddr
+		case layers.LayerTypeIPv6:
 			if c.Direction == pcap.DirectionOut {
-				c.FlowCol.UpdateL3Outbound(*c.L3Fingerprint, *c.L3Bytes, 1)
+				c.L3Fingerprint.SrcAddr = ly.ipv6.DstIP.String()
+				c.L3Fingerprint.DstAddr = ly.ipv6.SrcIP.String()
 			} else {
-				c.FlowCol.UpdateL3Inbound(*c.L3Fingerprint, *c.L3Bytes, 1)
+				c.L3Fingerprint.SrcAddr = ly.ipv6.SrcIP.String()
+				c.L3Fingerprint.DstAddr = ly.ipv6.DstIP.String()
 			}
+			*c.L3Bytes = ly.ipv6Bytes()
+			ipPayload = int64(ly.ipv6.Length)
 
-			if c.L4Fingerprint.Protocol != "" {
-				if c.Direction == pcap.DirectionOut {
-					c.FlowCol.UpdateL4Outbound(*c.L4Fingerprint, *c.L4Bytes, 1)
-				} else {
-					c.FlowCol.UpdateL4Inbound(*c.L4Fingerprint, *c.L4Bytes, 1)
-				}
+			c.L4Fingerprint.SrcAddr = c.L3Fingerprint.SrcAddr
+			c.L4Fingerprint.DstAddr = c.L3Fingerprint.DstAddr
+		case layers.LayerTypeTCP:
+			if c.Direction == pcap.DirectionOut {
+				c.L4Fingerprint.SrcPort = uint16(ly.tcp.DstPort)
+				c.L4Fingerprint.DstPort = uint16(ly.tcp.SrcPort)
+			} else {
+				c.L4Fingerprint.SrcPort = uint16(ly.tcp.SrcPort)
+				c.L4Fingerprint.DstPort = uint16(ly.tcp.DstPort)
 			}
+			c.L4Fingerprint.Protocol = "tcp"
+			*c.L4Bytes = truncatedBytes(int64(len(ly.tcp.Contents)+len(ly.tcp.LayerPayload())), ipPayload, isTruncated)
+		case layers.LayerTypeUDP:
+			if c.Direction == pcap.DirectionOut {
+				c.L4Fingerprint.SrcPort = uint16(ly.udp.DstPort)
+				c.L4Fingerprint.DstPort = uint16(ly.udp.SrcPort)
+			} else {
+				c.L4Fingerprint.SrcPort = uint16(ly.udp.SrcPort)
+				c.L4Fingerprint.DstPort = uint16(ly.udp.DstPort)
+			}
+			c.L4Fingerprint.Protocol = "udp"
+			*c.L4Bytes = int64(ly.udp.Length)
+		case layers.LayerTypeICMPv4:
+			c.L4Fingerprint.Protocol = "icmp"
+			*c.L4Bytes = truncatedBytes(int64(len(ly.icmpv4.Contents)+len(ly.icmpv4.LayerPayload())), ipPayload,
+				isTruncated)
+		case layers.LayerTypeICMPv6:
+			c.L4Fingerprint.Protocol = "icmpv6"
+			*c.L4Bytes = truncatedBytes(int64(len(ly.icmpv6.Contents)+len(ly.icmpv6.LayerPayload())), ipPayload,
+				isTruncated)
 		}
-		c.FlowCol.Mu.Unlock()
-
-		c.L3Fingerprint.SrcAddr = ""
-		c.L3Fingerprint.DstAddr = ""
-		c.L4Fingerprint.SrcAddr = ""
-		c.L4Fingerprint.DstAddr = ""
-		c.L4Fingerprint.SrcPort = 0
-		c.L4Fingerprint.DstPort = 0
-		c.L4Fingerprint.Protocol = ""
-		*c.L3Bytes = 0
-		*c.L4Bytes = 0
 	}
 }
+
+// truncatedBytes returns the bytes of a transport layer, which are the ip payload when the packet is truncated
+func truncatedBytes(decoded int64, ipPayload int64, isTruncated bool) int64 {
+	if isTruncated && ipPayload > decoded {
+		return ipPayload
+	}
+
+	return decoded
+}
+
+// ipv6Bytes returns the length of the IPv6 packet including the fixed header. Jumbograms carry
+// a zero payload length, so the decoded payload is used for them instead.
+func (ly *CaptureLayers) ipv6Bytes() int64 {
+	if ly.ipv6.Length == 0 {
+		return int64(len(ly.ipv6.Contents) + len(ly.ipv6.LayerPayload()))
+	}
+
+	return int64(ly.ipv6.Length) + 40
+}
@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/decoder"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"testing"
+)
+
+var (
+	testMac1 = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testMac2 = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// serialize returns the bytes of a packet of ls with the lengths and checksums filled in
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func ethernet(etherType layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testMac1, DstMAC: testMac2, EthernetType: etherType}
+}
+
+func ipv4(src string, dst string, protocol layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: protocol, SrcIP: net.ParseIP(src).To4(),
+		DstIP: net.ParseIP(dst).To4()}
+}
+
+func ipv6(src string, dst string, nextHeader layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: nextHeader, SrcIP: net.ParseIP(src),
+		DstIP: net.ParseIP(dst)}
+}
+
+// tcpPacket returns a tcp segment with 10 bytes of payload carried by ip
+func tcpPacket(t *testing.T, ip gopacket.NetworkLayer, lower ...gopacket.SerializableLayer) []byte {
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, ACK: true, Window: 1024}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+
+	ls := append(lower, ip.(gopacket.SerializableLayer), tcp, gopacket.Payload(make([]byte, 10)))
+
+	return serialize(t, ls...)
+}
+
+// udpPacket returns a udp datagram of payload carried by ip
+func udpPacket(t *testing.T, ip gopacket.NetworkLayer, srcPort layers.UDPPort, dstPort layers.UDPPort,
+	payload []byte, lower ...gopacket.SerializableLayer) []byte {
+	udp := &layers.UDP{SrcPort: srcPort, DstPort: dstPort}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	ls := append(lower, ip.(gopacket.SerializableLayer), udp, gopacket.Payload(payload))
+
+	return serialize(t, ls...)
+}
+
+type decodeTest struct {
+	name       string
+	opts       DecodeOptions
+	direction  pcap.Direction
+	firstLayer gopacket.LayerType
+	data       []byte
+	wantL3     accounting.FlowFingerprint
+	wantL4     accounting.FlowFingerprint
+	wantL3Len  int64
+	wantL4Len  int64
+}
+
+func runDecodeTests(t *testing.T, tests []decodeTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewPcapFileEngine("", "test0", tt.direction, 0, tt.opts, nil)
+			c := NewCapture(e)
+			firstLayer := tt.firstLayer
+			if firstLayer == gopacket.LayerTypeZero {
+				firstLayer = layers.LayerTypeEthernet
+			}
+			c.SetFirstLayer(firstLayer)
+
+			c.Decode(tt.data)
+			if *c.L3Fingerprint != tt.wantL3 || *c.L3Bytes != tt.wantL3Len {
+				t.Errorf("got l3 flow %+v of %d bytes, want %+v of %d bytes", *c.L3Fingerprint, *c.L3Bytes,
+					tt.wantL3, tt.wantL3Len)
+			}
+			if *c.L4Fingerprint != tt.wantL4 || *c.L4Bytes != tt.wantL4Len {
+				t.Errorf("got l4 flow %+v of %d bytes, want %+v of %d bytes", *c.L4Fingerprint, *c.L4Bytes,
+					tt.wantL4, tt.wantL4Len)
+			}
+
+			// The capture is reused for the next packet
+			c.Reset()
+			if *c.L3Fingerprint != (accounting.FlowFingerprint{}) || *c.L3Bytes != 0 || *c.L4Bytes != 0 {
+				t.Error("capture not reset")
+			}
+		})
+	}
+}
+
+func TestDecodeIPv4(t *testing.T) {
+	l3 := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2"}
+	l4 := l3
+	l4.SrcPort, l4.DstPort, l4.Protocol = 40000, 443, "tcp"
+	out := accounting.FlowFingerprint{SrcAddr: "198.51.100.2", DstAddr: "192.0.2.1"}
+	outL4 := out
+	outL4.SrcPort, outL4.DstPort, outL4.Protocol = 443, 40000, "tcp"
+
+	packet := tcpPacket(t, ipv4("192.0.2.1", "198.51.100.2", layers.IPProtocolTCP),
+		ethernet(layers.EthernetTypeIPv4))
+
+	runDecodeTests(t, []decodeTest{
+		{name: "l3", data: packet, wantL3: l3, wantL4: l3, wantL3Len: 50},
+		{name: "l4", opts: DecodeOptions{IsDecodeL4: true}, data: packet, wantL3: l3, wantL4: l4, wantL3Len: 50,
+			wantL4Len: 30},
+		{name: "outbound", opts: DecodeOptions{IsDecodeL4: true}, direction: pcap.DirectionOut, data: packet,
+			wantL3: out, wantL4: outL4, wantL3Len: 50, wantL4Len: 30},
+		{name: "truncated", opts: DecodeOptions{IsDecodeL4: true}, data: packet[:len(packet)-5], wantL3: l3,
+			wantL4: l4, wantL3Len: 50, wantL4Len: 30},
+	})
+}
+
+func TestDecodeIPv6(t *testing.T) {
+	l3 := accounting.FlowFingerprint{SrcAddr: "2001:db8::1", DstAddr: "2001:db8::2"}
+	tcp := l3
+	tcp.SrcPort, tcp.DstPort, tcp.Protocol = 40000, 443, "tcp"
+	udp := l3
+	udp.SrcPort, udp.DstPort, udp.Protocol = 5353, 53, "udp"
+	icmp := l3
+	icmp.Protocol = "icmpv6"
+
+	// Hop-by-hop and destination options headers padded by PadN
+	udpHdr := udpPacket(t, ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolUDP), 5353, 53, make([]byte, 12))[40:]
+	extHdrs := []byte{
+		byte(layers.IPProtocolIPv6Destination), 0, 1, 4, 0, 0, 0, 0,
+		byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0,
+	}
+	extPacket := serialize(t, ethernet(layers.EthernetTypeIPv6),
+		ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolIPv6HopByHop),
+		gopacket.Payload(append(extHdrs, udpHdr...)))
+
+	// The first fragment carries the transport layer header, the others do not
+	tcpHdr := tcpPacket(t, ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolTCP))[40:]
+	firstFragment := serialize(t, ethernet(layers.EthernetTypeIPv6),
+		ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolIPv6Fragment),
+		gopacket.Payload(append([]byte{byte(layers.IPProtocolTCP), 0, 0, 1, 0, 0, 0, 1}, tcpHdr...)))
+	nextFragment := serialize(t, ethernet(layers.EthernetTypeIPv6),
+		ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolIPv6Fragment),
+		gopacket.Payload(append([]byte{byte(layers.IPProtocolTCP), 0, 0, 8, 0, 0, 0, 1}, make([]byte, 30)...)))
+
+	icmpv6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+	ip := ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolICMPv6)
+	_ = icmpv6.SetNetworkLayerForChecksum(ip)
+	icmpPacket := serialize(t, ethernet(layers.EthernetTypeIPv6), ip, icmpv6, gopacket.Payload(make([]byte, 12)))
+
+	opts := DecodeOptions{IsDecodeL4: true}
+	runDecodeTests(t, []decodeTest{
+		{name: "tcp", opts: opts, data: tcpPacket(t, ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolTCP),
+			ethernet(layers.EthernetTypeIPv6)), wantL3: l3, wantL4: tcp, wantL3Len: 70, wantL4Len: 30},
+		{name: "extension headers", opts: opts, data: extPacket, wantL3: l3, wantL4: udp, wantL3Len: 76,
+			wantL4Len: 20},
+		{name: "first fragment", opts: opts, data: firstFragment, wantL3: l3, wantL4: tcp, wantL3Len: 78,
+			wantL4Len: 30},
+		{name: "next fragment", opts: opts, data: nextFragment, wantL3: l3, wantL4: l3, wantL3Len: 78},
+		{name: "icmpv6", opts: opts, data: icmpPacket, wantL3: l3, wantL4: icmp, wantL3Len: 56, wantL4Len: 16},
+		{name: "raw ip", opts: opts, firstLayer: layers.LayerTypeIPv6,
+			data: tcpPacket(t, ipv6("2001:db8::1", "2001:db8::2", layers.IPProtocolTCP)), wantL3: l3, wantL4: tcp,
+			wantL3Len: 70, wantL4Len: 30},
+	})
+}
+
+// innerPacket returns an ethernet frame of a tcp segment from 10.0.0.1 to 10.0.0.2, and the same without the
+// ethernet header
+func innerPacket(t *testing.T) (frame []byte, packet []byte) {
+	frame = tcpPacket(t, ipv4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP), ethernet(layers.EthernetTypeIPv4))
+
+	return frame, frame[14:]
+}
+
+func TestDecodeTunnel(t *testing.T) {
+	frame, packet := innerPacket(t)
+	arp := serialize(t, ethernet(layers.EthernetTypeARP), gopacket.Payload(make([]byte, 28)))
+
+	vxlan := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 4789,
+		append([]byte{0x08, 0, 0, 0, 0, 0, 0x64, 0}, frame...), ethernet(layers.EthernetTypeIPv4))
+	vxlanArp := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 4789,
+		append([]byte{0x08, 0, 0, 0, 0, 0, 0x64, 0}, arp...), ethernet(layers.EthernetTypeIPv4))
+	geneve := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 6081,
+		append([]byte{0, 0, 0x65, 0x58, 0, 0, 0xc8, 0}, frame...), ethernet(layers.EthernetTypeIPv4))
+	gre := serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolGRE),
+		&layers.GRE{KeyPresent: true, Key: 7, Protocol: layers.EthernetTypeIPv4}, gopacket.Payload(packet))
+	erspan := serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolGRE),
+		&layers.GRE{SeqPresent: true, Protocol: layers.EthernetTypeERSPAN},
+		gopacket.Payload(append([]byte{0x10, 0, 0, 5, 0, 0, 0, 0}, frame...)))
+	ipip := serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolIPv4),
+		gopacket.Payload(packet))
+
+	outer := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}
+	inner := accounting.FlowFingerprint{SrcAddr: "10.0.0.1", DstAddr: "10.0.0.2"}
+	innerL4 := inner
+	innerL4.SrcPort, innerL4.DstPort, innerL4.Protocol = 40000, 443, "tcp"
+	udpL4 := func(dstPort uint16) accounting.FlowFingerprint {
+		l4 := outer
+		l4.SrcPort, l4.DstPort, l4.Protocol = 50000, dstPort, "udp"
+		return l4
+	}
+
+	tunnels := []struct {
+		name       string
+		data       []byte
+		outerL4    accounting.FlowFingerprint
+		outerL3    int64
+		outerL4Len int64
+		tunnel     string
+		id         uint32
+	}{
+		{"vxlan", vxlan, udpL4(4789), 100, 80, TunnelVxlan, 100},
+		{"geneve", geneve, udpL4(6081), 100, 80, TunnelGeneve, 200},
+		{"gre", gre, outer, 78, 0, TunnelGre, 7},
+		{"erspan", erspan, outer, 100, 0, TunnelErspan, 5},
+		{"ipip", ipip, outer, 70, 0, TunnelIpip, 0},
+	}
+
+	var tests []decodeTest
+	for _, tn := range tunnels {
+		tagged, taggedL4 := inner, innerL4
+		tagged.Tunnel, tagged.TunnelId = tn.tunnel, tn.id
+		taggedL4.Tunnel, taggedL4.TunnelId = tn.tunnel, tn.id
+
+		tests = append(tests,
+			decodeTest{name: tn.name, opts: DecodeOptions{IsDecodeL4: true}, data: tn.data, wantL3: outer,
+				wantL4: tn.outerL4, wantL3Len: tn.outerL3, wantL4Len: tn.outerL4Len},
+			decodeTest{name: tn.name + " decap", opts: DecodeOptions{IsDecodeL4: true, TunnelDecap: true},
+				data: tn.data, wantL3: inner, wantL4: innerL4, wantL3Len: tn.outerL3, wantL4Len: 30},
+			decodeTest{name: tn.name + " tag",
+				opts: DecodeOptions{IsDecodeL4: true, TunnelDecap: true, TunnelTag: true}, data: tn.data,
+				wantL3: tagged, wantL4: taggedL4, wantL3Len: tn.outerL3, wantL4Len: 30},
+		)
+	}
+
+	// Tunnelled frames without an ip packet, padded to the minimum ethernet frame here, stay accounted to the
+	// tunnel endpoints
+	tests = append(tests, decodeTest{name: "vxlan arp", opts: DecodeOptions{IsDecodeL4: true, TunnelDecap: true},
+		data: vxlanArp, wantL3: outer, wantL4: udpL4(4789), wantL3Len: 96, wantL4Len: 76})
+
+	// Tunnel headers cut short do not panic the decoder and stay accounted to the tunnel endpoints
+	shortGeneve := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 6081,
+		[]byte{0, 0, 0x65, 0x58, 0, 0, 0xc8}, ethernet(layers.EthernetTypeIPv4))
+	shortErspan := serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolGRE),
+		&layers.GRE{SeqPresent: true, Protocol: layers.EthernetTypeERSPAN}, gopacket.Payload([]byte{0x10, 0, 0, 5}))
+	tests = append(tests,
+		decodeTest{name: "geneve truncated", opts: DecodeOptions{IsDecodeL4: true, TunnelDecap: true},
+			data: shortGeneve, wantL3: outer, wantL4: udpL4(6081), wantL3Len: 35, wantL4Len: 15},
+		decodeTest{name: "erspan truncated", opts: DecodeOptions{IsDecodeL4: true, TunnelDecap: true},
+			data: shortErspan, wantL3: outer, wantL4: outer, wantL3Len: 32},
+	)
+
+	runDecodeTests(t, tests)
+}
+
+func TestDecodeVlan(t *testing.T) {
+	dot1q := func(id uint16, etherType layers.EthernetType) *layers.Dot1Q {
+		return &layers.Dot1Q{VLANIdentifier: id, Type: etherType}
+	}
+	ip := func() *layers.IPv4 {
+		return ipv4("192.0.2.1", "198.51.100.2", layers.IPProtocolTCP)
+	}
+
+	tagged := tcpPacket(t, ip(), ethernet(layers.EthernetTypeDot1Q), dot1q(10, layers.EthernetTypeIPv4))
+	qinq := tcpPacket(t, ip(), ethernet(layers.EthernetTypeQinQ), dot1q(100, layers.EthernetTypeDot1Q),
+		dot1q(10, layers.EthernetTypeIPv4))
+	stacked := tcpPacket(t, ip(), ethernet(layers.EthernetTypeDot1Q), dot1q(100, layers.EthernetTypeDot1Q),
+		dot1q(10, layers.EthernetTypeIPv4))
+
+	// The inner frame of a tunnel has a tag of its own which is not the one of the captured link
+	innerFrame := tcpPacket(t, ipv4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP), ethernet(layers.EthernetTypeDot1Q),
+		dot1q(30, layers.EthernetTypeIPv4))
+	vxlan := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 4789,
+		append([]byte{0x08, 0, 0, 0, 0, 0, 0x64, 0}, innerFrame...), ethernet(layers.EthernetTypeDot1Q),
+		dot1q(10, layers.EthernetTypeIPv4))
+
+	flow := func(vlan uint16, innerVlan uint16) (l3 accounting.FlowFingerprint, l4 accounting.FlowFingerprint) {
+		l3 = accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2", Vlan: vlan, InnerVlan: innerVlan}
+		l4 = l3
+		l4.SrcPort, l4.DstPort, l4.Protocol = 40000, 443, "tcp"
+		return
+	}
+	untagged, untaggedL4 := flow(0, 0)
+	single, singleL4 := flow(10, 0)
+	double, doubleL4 := flow(100, 10)
+	tunnelled := accounting.FlowFingerprint{SrcAddr: "10.0.0.1", DstAddr: "10.0.0.2", Vlan: 10}
+	tunnelledL4 := tunnelled
+	tunnelledL4.SrcPort, tunnelledL4.DstPort, tunnelledL4.Protocol = 40000, 443, "tcp"
+
+	opts := DecodeOptions{IsDecodeL4: true, UseVlan: true}
+	runDecodeTests(t, []decodeTest{
+		{name: "vlan", opts: opts, data: tagged, wantL3: single, wantL4: singleL4, wantL3Len: 50, wantL4Len: 30},
+		{name: "qinq", opts: opts, data: qinq, wantL3: double, wantL4: doubleL4, wantL3Len: 50, wantL4Len: 30},
+		{name: "stacked 802.1q", opts: opts, data: stacked, wantL3: double, wantL4: doubleL4, wantL3Len: 50,
+			wantL4Len: 30},
+		{name: "vlan accounting disabled", opts: DecodeOptions{IsDecodeL4: true}, data: qinq, wantL3: untagged,
+			wantL4: untaggedL4, wantL3Len: 50, wantL4Len: 30},
+		{name: "untagged", opts: opts, data: tcpPacket(t, ip(), ethernet(layers.EthernetTypeIPv4)), wantL3: untagged,
+			wantL4: untaggedL4, wantL3Len: 50, wantL4Len: 30},
+		{name: "tunnel", opts: DecodeOptions{IsDecodeL4: true, UseVlan: true, TunnelDecap: true}, data: vxlan,
+			wantL3: tunnelled, wantL4: tunnelledL4, wantL3Len: 104, wantL4Len: 30},
+	})
+}
+
+// TestIsIgnoredDecodeErr ignores the layers following ICMPv6 without a decoder, but not other ICMPv6 errors
+func TestIsIgnoredDecodeErr(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{gopacket.UnsupportedLayerType(layers.LayerTypeICMPv6Echo), true},
+		{gopacket.UnsupportedLayerType(layers.LayerTypeICMPv6NeighborSolicitation), true},
+		{gopacket.UnsupportedLayerType(layers.LayerTypeDHCPv4), true},
+		{gopacket.UnsupportedLayerType(layers.LayerTypeICMPv6), false},
+		{errors.New("ICMPv6 layer less than 4 bytes"), false},
+		{errors.New("Invalid IP header"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isIgnoredDecodeErr(tt.err); got != tt.want {
+			t.Errorf("%s: got %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestDecodeErrIgnored decodes tunnel headers cut short, and tunnels without decap, into errors which are not
+// logged
+func TestDecodeErrIgnored(t *testing.T) {
+	frame, _ := innerPacket(t)
+	shortGeneve := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 6081,
+		[]byte{0, 0, 0x65, 0x58, 0, 0, 0xc8}, ethernet(layers.EthernetTypeIPv4))
+	shortErspan := serialize(t, ethernet(layers.EthernetTypeIPv4), ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolGRE),
+		&layers.GRE{SeqPresent: true, Protocol: layers.EthernetTypeERSPAN}, gopacket.Payload([]byte{0x10, 0, 0, 5}))
+	geneve := udpPacket(t, ipv4("192.0.2.1", "192.0.2.2", layers.IPProtocolUDP), 50000, 6081,
+		append([]byte{0, 0, 0x65, 0x58, 0, 0, 0xc8, 0}, frame...), ethernet(layers.EthernetTypeIPv4))
+
+	tests := []struct {
+		name    string
+		opts    DecodeOptions
+		data    []byte
+		wantErr error
+	}{
+		{"geneve truncated", DecodeOptions{IsDecodeL4: true, TunnelDecap: true}, shortGeneve,
+			decoder.ErrGeneveTooShort},
+		{"erspan truncated", DecodeOptions{IsDecodeL4: true, TunnelDecap: true}, shortErspan,
+			decoder.ErrERSPANTooShort},
+		{"geneve without decap", DecodeOptions{IsDecodeL4: true}, geneve, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCapture(NewPcapFileEngine("", "test0", pcap.DirectionIn, 0, tt.opts, nil))
+			err := c.Dec.DecodeLayers(tt.data, layers.LayerTypeEthernet, &c.Decoded)
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("got err %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && !isIgnoredDecodeErr(err) {
+				t.Errorf("err %v is logged", err)
+			}
+		})
+	}
+}
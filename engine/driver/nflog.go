@@ -8,8 +8,13 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"unsafe"
 )
@@ -75,12 +80,16 @@ const (
 	NfRecvBufferSize = 16 * 1024 * 1024
 	NflogTimeout     = 100 // Timeout before sending data in 1/100th second
 	MaxQueueLogs     = C.MAX_PACKETS - 1
+	RecvTimeoutMs    = 500 // Timeout of recv so the loop notices quit
 )
 
 type CallbackFunc func(data []byte) int
 
 // NfLog
 type NfLog struct {
+	// Packets received and packets missing by sequence number, first for atomic alignment
+	received uint64
+	dropped  uint64
 	// Main nflog_handle
 	h *C.struct_nflog_handle
 	// File descriptor for socket operations
@@ -94,7 +103,8 @@ type NfLog struct {
 	// Errors
 	errors int64
 	// Quit the loop
-	quit chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
 	// Pointer to the packets
 	packets *C.packets
 	// Callback function
@@ -104,14 +114,20 @@ type NfLog struct {
 // Create a new NfLog
 //
 // McastGroup is that specified in ip[6]tables
-func NewNfLog(McastGroup int, fn CallbackFunc) *NfLog {
+func NewNfLog(McastGroup int, fn CallbackFunc) (*NfLog, error) {
 	h, err := C.nflog_open()
 	if h == nil || err != nil {
-		log.Fatalf("Failed to open NFLOG: %s", nflogError(err))
+		return nil, fmt.Errorf("failed to open NFLOG: %s", nflogError(err))
 	}
 
 	if rc, err := C.nflog_bind_pf(h, C.AF_INET); rc < 0 || err != nil {
-		log.Fatalf("nflog_bind_pf failed: %s", nflogError(err))
+		C.nflog_close(h)
+		return nil, fmt.Errorf("nflog_bind_pf failed: %s", nflogError(err))
+	}
+
+	if rc, err := C.nflog_bind_pf(h, C.AF_INET6); rc < 0 || err != nil {
+		C.nflog_close(h)
+		return nil, fmt.Errorf("nflog_bind_pf for AF_INET6 failed: %s", nflogError(err))
 	}
 
 	nflog := &NfLog{
@@ -123,50 +139,59 @@ func NewNfLog(McastGroup int, fn CallbackFunc) *NfLog {
 		fn:         fn,
 	}
 
-	nflog.makeGroup(McastGroup)
+	if err := nflog.makeGroup(McastGroup); err != nil {
+		nflog.Close()
+		return nil, err
+	}
 
-	return nflog
+	tv := syscall.NsecToTimeval(RecvTimeoutMs * 1000 * 1000)
+	if err := syscall.SetsockoptTimeval(int(nflog.fd), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		nflog.Close()
+		return nil, fmt.Errorf("setsockopt SO_RCVTIMEO failed: %s", err)
+	}
+
+	return nflog, nil
 }
 
 // Connects to the group specified with the size
-func (nflog *NfLog) makeGroup(group int) {
+func (nflog *NfLog) makeGroup(group int) error {
 	gh, err := C._nflog_bind_group(nflog.h, C.int(group))
 	if gh == nil || err != nil {
-		log.Fatalf("nflog_bind_group failed: %s", nflogError(err))
+		return fmt.Errorf("nflog_bind_group failed: %s", nflogError(err))
 	}
 	nflog.gh = gh
 
 	// Set the maximum amount of logs in buffer for this group
 	if rc, err := C.nflog_set_qthresh(gh, MaxQueueLogs); rc < 0 || err != nil {
-		log.Fatalf("nflog_set_qthresh failed: %s", nflogError(err))
+		return fmt.Errorf("nflog_set_qthresh failed: %s", nflogError(err))
 	}
 
 	// Set local sequence numbering to detect missing packets
 	if rc, err := C.nflog_set_flags(gh, C.NFULNL_CFG_F_SEQ); rc < 0 || err != nil {
-		log.Fatalf("nflog_set_flags failed: %s", nflogError(err))
+		return fmt.Errorf("nflog_set_flags failed: %s", nflogError(err))
 	}
 
 	// Set buffer size large
 	if rc, err := C.nflog_set_nlbufsiz(gh, NflogBufferSize); rc < 0 || err != nil {
-		log.Fatalf("nflog_set_nlbufsiz: %s", nflogError(err))
+		return fmt.Errorf("nflog_set_nlbufsiz: %s", nflogError(err))
 	}
 
 	// Set recv buffer large - this produces ENOBUFS when too small
 	if rc, err := C.nfnl_rcvbufsiz(C.nflog_nfnlh(nflog.h), NfRecvBufferSize); rc < 0 || err != nil {
-		log.Fatalf("nfnl_rcvbufsiz: %s", err)
+		return fmt.Errorf("nfnl_rcvbufsiz: %s", err)
 	} else {
 		if rc < NfRecvBufferSize {
-			log.Fatalf("nfnl_rcvbufsiz: Failed to set buffer to %d got %d", NfRecvBufferSize, rc)
+			return fmt.Errorf("nfnl_rcvbufsiz: Failed to set buffer to %d got %d", NfRecvBufferSize, rc)
 		}
 	}
 
 	// Set timeout
 	if rc, err := C.nflog_set_timeout(gh, NflogTimeout); rc < 0 || err != nil {
-		log.Fatalf("nflog_set_timeout: %s", nflogError(err))
+		return fmt.Errorf("nflog_set_timeout: %s", nflogError(err))
 	}
 
 	if rc, err := C.nflog_set_mode(gh, C.NFULNL_COPY_PACKET, 0xffff); rc < 0 || err != nil {
-		log.Fatalf("nflog_set_mode failed: %s", nflogError(err))
+		return fmt.Errorf("nflog_set_mode failed: %s", nflogError(err))
 	}
 
 	// Register the callback now we are set up
@@ -175,27 +200,42 @@ func (nflog *NfLog) makeGroup(group int) {
 	// it isn't a good idea for C to hold pointers to go objects
 	// which might move
 	C._callback_register(gh, nflog.packets)
+
+	return nil
 }
 
-// Receive packets in a loop until quit
-func (nflog *NfLog) Loop() {
+// Receive packets in a loop until quit or ctx is done
+//
+// A failed recv ends the loop with its error, except ENOBUFS of messages dropped by the kernel, which
+// show up as missing sequence numbers, and EINTR, which are retried
+func (nflog *NfLog) Loop(ctx context.Context) error {
 	buflen := C.size_t(RecvBufferSize)
 	pbuf := C.malloc(buflen)
 	if pbuf == nil {
-		log.Fatal("No memory for malloc")
+		return errors.New("no memory for malloc")
 	}
 	defer C.free(pbuf)
 	for {
 		nr, err := C.recv(nflog.fd, pbuf, buflen, 0)
 		select {
 		case <-nflog.quit:
-			return
+			return nil
+		case <-ctx.Done():
+			return nil
 		default:
 		}
 
-		if nr < 0 || err != nil {
-			log.Printf("Recv failed: %s", err)
-			nflog.errors++
+		if nr < 0 && (err == syscall.EAGAIN || err == syscall.EWOULDBLOCK) {
+			continue
+		}
+
+		if nr < 0 {
+			if err == syscall.ENOBUFS || err == syscall.EINTR {
+				log.Printf("Recv failed: %s", err)
+				nflog.errors++
+				continue
+			}
+			return fmt.Errorf("recv failed: %s", err)
 		} else {
 			// Handle messages in packet reusing memory
 			nflog.packets.index = 0
@@ -219,12 +259,15 @@ func (nflog *NfLog) Loop() {
 				sliceHeader.Data = uintptr(unsafe.Pointer(p.payload))
 
 				// Process the packet
+				// A sequence number going backwards is taken as a reset of the numbering, not as a gap
 				seq := uint32(p.seq)
-				if seq != 0 && seq != nflog.seq {
+				if seq > nflog.seq && atomic.LoadUint64(&nflog.received) > 0 {
 					nflog.errors++
-					log.Printf("%d missing packets detected, %d to %d", seq-nflog.seq, seq, nflog.seq)
+					atomic.AddUint64(&nflog.dropped, uint64(seq-nflog.seq))
+					log.Printf("%d missing packets detected, %d to %d", seq-nflog.seq, nflog.seq, seq)
 				}
 				nflog.seq = seq + 1
+				atomic.AddUint64(&nflog.received, 1)
 
 				nflog.fn(packet)
 			}
@@ -234,6 +277,11 @@ func (nflog *NfLog) Loop() {
 	}
 }
 
+// Stats returns the packets received and the packets missing by sequence number so far
+func (nflog *NfLog) Stats() (received uint64, dropped uint64) {
+	return atomic.LoadUint64(&nflog.received), atomic.LoadUint64(&nflog.dropped)
+}
+
 // Current nflog error
 func nflogError(err error) error {
 	if C.nflog_errno != 0 {
@@ -242,9 +290,16 @@ func nflogError(err error) error {
 	return err
 }
 
+// Stop the loop, it returns within the recv timeout
+func (nflog *NfLog) Stop() {
+	nflog.quitOnce.Do(func() {
+		close(nflog.quit)
+	})
+}
+
 // Close the NfLog down
 func (nflog *NfLog) Close() {
-	close(nflog.quit)
+	nflog.Stop()
 	// Sometimes hangs and doesn't seem to be necessary
 	// if *Verbose {
 	// 	log.Printf("Unbinding socket %d from group %d", nflog.fd, nflog.McastGroup)
@@ -1,20 +1,22 @@
 package engine
 
 import (
+	"context"
 	"errors"
 	"github.com/fs714/goiftop/accounting"
 	"github.com/fs714/goiftop/utils/log"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
+	"time"
 )
 
-func NewLibPcapEngine(ifaceName, bpfFilter string, direction pcap.Direction, snaplen int32, isDecodeL4 bool, ch chan *accounting.FlowCollection) (engine *LibPcapEngine) {
+func NewLibPcapEngine(ifaceName, bpfFilter string, direction pcap.Direction, snaplen int32, opts DecodeOptions, ch chan *accounting.FlowCollection) (engine *LibPcapEngine) {
 	engine = &LibPcapEngine{
 		IfaceName:            ifaceName,
 		BpfFilter:            bpfFilter,
 		Direction:            direction,
 		SnapLen:              snaplen,
-		IsDecodeL4:           isDecodeL4,
+		DecodeOptions:        opts,
 		NotifyChannel:        ch,
 		FlowCol:              accounting.NewFlowCollection(ifaceName),
 		FlowColResetInterval: DefaultFlowColResetInterval,
@@ -24,11 +26,13 @@ func NewLibPcapEngine(ifaceName, bpfFilter string, direction pcap.Direction, sna
 }
 
 type LibPcapEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
 	IfaceName            string
 	BpfFilter            string
 	Direction            pcap.Direction
 	SnapLen              int32
-	IsDecodeL4           bool
 	NotifyChannel        chan *accounting.FlowCollection
 	FlowCol              *accounting.FlowCollection
 	FlowColResetInterval int64
@@ -46,28 +50,28 @@ func (e *LibPcapEngine) GetResetInterval() int64 {
 	return e.FlowColResetInterval
 }
 
-func (e *LibPcapEngine) GetIsDecodeL4() bool {
-	return e.IsDecodeL4
-}
-
 func (e *LibPcapEngine) GetNotifyChannel() chan *accounting.FlowCollection {
 	return e.NotifyChannel
 }
 
-func (e *LibPcapEngine) StartEngine() (err error) {
-	go Nofify(e)
-	err = e.StartCapture()
+func (e *LibPcapEngine) StartEngine(ctx context.Context) (err error) {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	err = RunEngine(ctx, e, e.StartCapture)
 
 	return
 }
 
-func (e *LibPcapEngine) StartCapture() (err error) {
-	handle, err := pcap.OpenLive(e.IfaceName, e.SnapLen, true, pcap.BlockForever)
+func (e *LibPcapEngine) StartCapture(ctx context.Context) (err error) {
+	handle, err := pcap.OpenLive(e.IfaceName, e.SnapLen, true, DefaultCaptureTimeout)
 	if err != nil {
 		log.Errorf("failed to open live interface %s by LibPcapEngine with err: %s", e.IfaceName, err.Error())
 		return
 	}
 
+	defer handle.Close()
+
 	err = handle.SetBPFFilter(e.BpfFilter)
 	if err != nil {
 		log.Errorf("failed to set BPF filter %s by LibPcapEngine with err: %s", e.BpfFilter, err.Error())
@@ -80,8 +84,6 @@ func (e *LibPcapEngine) StartCapture() (err error) {
 		return
 	}
 
-	defer handle.Close()
-
 	capture := NewCapture(e)
 	firstLayer := capture.Dec.GetFirstLayerType(handle.LinkType())
 	if firstLayer == gopacket.LayerTypeZero {
@@ -91,13 +93,42 @@ func (e *LibPcapEngine) StartCapture() (err error) {
 	}
 	capture.SetFirstLayer(firstLayer)
 
+	updateStats := func() {
+		stats, err := handle.Stats()
+		if err != nil {
+			return
+		}
+
+		e.setCaptureStats(0, CaptureStats{
+			Received:  uint64(stats.PacketsReceived),
+			Dropped:   uint64(stats.PacketsDropped),
+			IfDropped: uint64(stats.PacketsIfDropped),
+		})
+	}
+	defer updateStats()
+
+	statsTicker := time.NewTicker(DefaultStatsInterval)
+	defer statsTicker.Stop()
+
 	var data []byte
 	for {
+		select {
+		case <-ctx.Done():
+			err = nil
+			return
+		case <-statsTicker.C:
+			updateStats()
+		default:
+		}
+
 		data, _, err = handle.ZeroCopyReadPacketData()
-		if err != nil {
-			log.Errorf("error getting packet: %s", err.Error())
+		if err == pcap.NextErrorTimeoutExpired {
 			continue
 		}
+		if err != nil {
+			log.Errorf("error getting packet on %s: %s", e.IfaceName, err.Error())
+			return
+		}
 
 		capture.DecodeAndAccount(data)
 	}
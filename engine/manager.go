@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"context"
+	"github.com/fs714/goiftop/utils/log"
+	"github.com/google/gopacket/pcap"
+	"sort"
+	"sync"
+)
+
+const DefaultEngineErrChannelSize = 16
+
+// StatsProvider gives the capture statistics of an interface, or of all interfaces when ifaceName is empty.
+// It is the engine manager for the interfaces captured locally, and the aggregator for the interfaces of the
+// nodes reporting to it.
+type StatsProvider interface {
+	Stats(ifaceName string) []EngineStats
+}
+
+var GlobalStatsProvider StatsProvider
+
+// EngineStats are the capture statistics of the engine capturing one direction of an interface
+type EngineStats struct {
+	Interface string
+	Direction string
+	CaptureStats
+}
+
+func DirectionString(direction pcap.Direction) string {
+	if direction == pcap.DirectionOut {
+		return "out"
+	}
+
+	return "in"
+}
+
+// EngineError is the failure of an engine of an interface
+type EngineError struct {
+	Interface string
+	Err       error
+
+	group *engineGroup
+}
+
+func (e *EngineError) Error() string {
+	return "engine of interface " + e.Interface + " failed: " + e.Err.Error()
+}
+
+type engineGroup struct {
+	engines []PktCapEngine
+	cancel  context.CancelFunc
+	wg      *sync.WaitGroup
+}
+
+// EngineManager runs the engines of every interface, so the engines of one interface could be started or
+// stopped at runtime without touching the others. Engines failing are reported on ErrCh, and interfaces whose
+// engines all finished on their own, like the replay of a pcap file, are reported on DoneCh.
+type EngineManager struct {
+	ErrCh  chan *EngineError
+	DoneCh chan string
+
+	ctx    context.Context
+	groups map[string]*engineGroup
+	mu     *sync.Mutex
+}
+
+func NewEngineManager(ctx context.Context) (m *EngineManager) {
+	m = &EngineManager{
+		ErrCh:  make(chan *EngineError, DefaultEngineErrChannelSize),
+		DoneCh: make(chan string, DefaultEngineErrChannelSize),
+		ctx:    ctx,
+		groups: make(map[string]*engineGroup),
+		mu:     &sync.Mutex{},
+	}
+
+	return
+}
+
+// Start runs the engines of an interface until Stop is called or the context of the manager is done,
+// engines already running for the interface are stopped first
+func (m *EngineManager) Start(ifaceName string, engines []PktCapEngine) {
+	m.Stop(ifaceName)
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	g := &engineGroup{
+		engines: engines,
+		cancel:  cancel,
+		wg:      &sync.WaitGroup{},
+	}
+
+	for _, e := range engines {
+		g.wg.Add(1)
+		go func(e PktCapEngine) {
+			defer g.wg.Done()
+
+			err := e.StartEngine(ctx)
+			if err != nil {
+				engineErr := &EngineError{Interface: ifaceName, Err: err, group: g}
+				select {
+				case m.ErrCh <- engineErr:
+				default:
+					log.Errorln(engineErr.Error())
+				}
+			}
+		}(e)
+	}
+
+	go func() {
+		g.wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case m.DoneCh <- ifaceName:
+		default:
+		}
+	}()
+
+	m.mu.Lock()
+	m.groups[ifaceName] = g
+	m.mu.Unlock()
+}
+
+// Stop stops the engines of an interface and waits for their final flush
+func (m *EngineManager) Stop(ifaceName string) {
+	m.mu.Lock()
+	g, ok := m.groups[ifaceName]
+	delete(m.groups, ifaceName)
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	g.stop()
+}
+
+// StopFailed stops the engines of the interface of a failed engine, unless the interface was started again
+// since the failure
+func (m *EngineManager) StopFailed(engineErr *EngineError) {
+	m.mu.Lock()
+	g, ok := m.groups[engineErr.Interface]
+	ok = ok && g == engineErr.group
+	if ok {
+		delete(m.groups, engineErr.Interface)
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	g.stop()
+}
+
+// IsRunning tells whether the engines of an interface are started and not stopped, engines finished on their
+// own are still running
+func (m *EngineManager) IsRunning(ifaceName string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.groups[ifaceName]
+
+	return ok
+}
+
+// Len returns the number of interfaces whose engines are running
+func (m *EngineManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.groups)
+}
+
+func (g *engineGroup) stop() {
+	g.cancel()
+	for _, e := range g.engines {
+		e.StopEngine()
+	}
+	g.wg.Wait()
+}
+
+// StopAll stops the engines of all interfaces, it should be called before accounting stops so the final
+// flush of the engines is accounted
+func (m *EngineManager) StopAll() {
+	m.mu.Lock()
+	names := make([]string, 0, len(m.groups))
+	for ifaceName := range m.groups {
+		names = append(names, ifaceName)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(names)
+	for _, ifaceName := range names {
+		m.Stop(ifaceName)
+	}
+}
+
+// Stats returns the capture statistics of the running engines of an interface, or of all interfaces when
+// ifaceName is empty, ordered by interface and direction
+func (m *EngineManager) Stats(ifaceName string) (stats []EngineStats) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for name, g := range m.groups {
+		if ifaceName != "" && name != ifaceName {
+			continue
+		}
+
+		for _, e := range g.engines {
+			stats = append(stats, EngineStats{
+				Interface:    name,
+				Direction:    DirectionString(e.GetDirection()),
+				CaptureStats: e.GetCaptureStats(),
+			})
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Interface != stats[j].Interface {
+			return stats[i].Interface < stats[j].Interface
+		}
+
+		return stats[i].Direction < stats[j].Direction
+	})
+
+	return
+}
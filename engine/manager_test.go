@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/google/gopacket/pcap"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingEngine runs until it is stopped and counts how often it ran, or fails at once with err
+type blockingEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
+	running   *int32
+	runs      *int32
+	err       error
+	direction pcap.Direction
+}
+
+func newBlockingEngine() *blockingEngine {
+	return &blockingEngine{running: new(int32), runs: new(int32), direction: pcap.DirectionIn}
+}
+
+func (e *blockingEngine) StartEngine(ctx context.Context) error {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	atomic.AddInt32(e.runs, 1)
+	if e.err != nil {
+		return e.err
+	}
+	atomic.AddInt32(e.running, 1)
+	defer atomic.AddInt32(e.running, -1)
+
+	<-ctx.Done()
+
+	return nil
+}
+
+func (e *blockingEngine) GetDirection() pcap.Direction {
+	return e.direction
+}
+
+func (e *blockingEngine) GetFlowCollection() *accounting.FlowCollection {
+	return nil
+}
+
+func (e *blockingEngine) GetResetInterval() int64 {
+	return DefaultFlowColResetInterval
+}
+
+func (e *blockingEngine) GetNotifyChannel() chan *accounting.FlowCollection {
+	return nil
+}
+
+func waitRunning(t *testing.T, e *blockingEngine, want int32) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(e.running) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d running engines, want %d", atomic.LoadInt32(e.running), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestEngineManager starts and stops the engines of one interface without touching the others
+func TestEngineManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewEngineManager(ctx)
+
+	eth0, eth1 := newBlockingEngine(), newBlockingEngine()
+	m.Start("eth0", []PktCapEngine{eth0})
+	m.Start("eth1", []PktCapEngine{eth1})
+	waitRunning(t, eth0, 1)
+	waitRunning(t, eth1, 1)
+
+	// Starting an interface again stops its running engines first
+	restarted := newBlockingEngine()
+	m.Start("eth0", []PktCapEngine{restarted})
+	if atomic.LoadInt32(eth0.running) != 0 {
+		t.Error("engine of eth0 still running after restart")
+	}
+	waitRunning(t, restarted, 1)
+
+	m.Stop("eth0")
+	if atomic.LoadInt32(restarted.running) != 0 || atomic.LoadInt32(eth1.running) != 1 {
+		t.Error("stop of eth0 did not stop only the engines of eth0")
+	}
+	m.Stop("eth0")
+
+	cancel()
+	waitRunning(t, eth1, 0)
+	if atomic.LoadInt32(eth0.runs) != 1 || atomic.LoadInt32(eth1.runs) != 1 {
+		t.Error("engines started more than once")
+	}
+}
+
+// TestEngineManagerErr reports a failed engine on the error channel
+func TestEngineManagerErr(t *testing.T) {
+	m := NewEngineManager(context.Background())
+	failed := newBlockingEngine()
+	failed.err = errors.New("capture failed")
+	m.Start("eth0", []PktCapEngine{failed})
+
+	select {
+	case err := <-m.ErrCh:
+		if !strings.Contains(err.Error(), "eth0") || !strings.Contains(err.Error(), "capture failed") {
+			t.Errorf("got error %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed engine not reported")
+	}
+
+	m.StopAll()
+}
+
+// TestEngineManagerStats sums the capture statistics of every handle of an engine, ordered by interface and
+// direction
+func TestEngineManagerStats(t *testing.T) {
+	m := NewEngineManager(context.Background())
+	defer m.StopAll()
+
+	in, out, other := newBlockingEngine(), newBlockingEngine(), newBlockingEngine()
+	out.direction = pcap.DirectionOut
+	in.setCaptureStats(0, CaptureStats{Received: 10, Dropped: 1})
+	in.setCaptureStats(2, CaptureStats{Received: 5, QueueFreezes: 1})
+	out.setCaptureStats(0, CaptureStats{Received: 7, IfDropped: 2})
+	m.Start("eth1", []PktCapEngine{out, in})
+	m.Start("eth0", []PktCapEngine{other})
+
+	want := []EngineStats{
+		{Interface: "eth0", Direction: "in"},
+		{Interface: "eth1", Direction: "in", CaptureStats: CaptureStats{Received: 15, Dropped: 1, QueueFreezes: 1}},
+		{Interface: "eth1", Direction: "out", CaptureStats: CaptureStats{Received: 7, IfDropped: 2}},
+	}
+	if stats := m.Stats(""); !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	if stats := m.Stats("eth1"); !reflect.DeepEqual(stats, want[1:]) {
+		t.Errorf("got %+v of eth1, want %+v", stats, want[1:])
+	}
+}
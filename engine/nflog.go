@@ -1,22 +1,27 @@
 // # iptables -I OUTPUT -p icmp -j NFLOG --nflog-group 100
 // # iptables -t raw -A PREROUTING -i eth1 -j NFLOG --nflog-group 2 --nflog-range 64 --nflog-threshold 10
 // # iptables -t mangle -A POSTROUTING -o eth1 -j NFLOG --nflog-group 5 --nflog-range 64 --nflog-threshold 10
+// # ip6tables -t raw -A PREROUTING -i eth1 -j NFLOG --nflog-group 2 --nflog-range 64 --nflog-threshold 10
+// # ip6tables -t mangle -A POSTROUTING -o eth1 -j NFLOG --nflog-group 5 --nflog-range 64 --nflog-threshold 10
 
 package engine
 
 import (
+	"context"
 	"github.com/fs714/goiftop/accounting"
 	"github.com/fs714/goiftop/engine/driver"
+	"github.com/fs714/goiftop/utils/log"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"time"
 )
 
-func NewNflogEngine(ifaceName string, groupId int, direction pcap.Direction, isDecodeL4 bool, ch chan *accounting.FlowCollection) (engine *NflogEngine) {
+func NewNflogEngine(ifaceName string, groupId int, direction pcap.Direction, opts DecodeOptions, ch chan *accounting.FlowCollection) (engine *NflogEngine) {
 	engine = &NflogEngine{
 		IfaceName:            ifaceName,
 		GroupId:              groupId,
 		Direction:            direction,
-		IsDecodeL4:           isDecodeL4,
+		DecodeOptions:        opts,
 		NotifyChannel:        ch,
 		FlowCol:              accounting.NewFlowCollection(ifaceName),
 		FlowColResetInterval: DefaultFlowColResetInterval,
@@ -26,10 +31,12 @@ func NewNflogEngine(ifaceName string, groupId int, direction pcap.Direction, isD
 }
 
 type NflogEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
 	IfaceName            string
 	GroupId              int
 	Direction            pcap.Direction
-	IsDecodeL4           bool
 	NotifyChannel        chan *accounting.FlowCollection
 	FlowCol              *accounting.FlowCollection
 	FlowColResetInterval int64
@@ -47,35 +54,68 @@ func (e *NflogEngine) GetResetInterval() int64 {
 	return e.FlowColResetInterval
 }
 
-func (e *NflogEngine) GetIsDecodeL4() bool {
-	return e.IsDecodeL4
-}
-
 func (e *NflogEngine) GetNotifyChannel() chan *accounting.FlowCollection {
 	return e.NotifyChannel
 }
 
-func (e *NflogEngine) StartEngine() (err error) {
-	go Nofify(e)
-	err = e.StartCapture()
+func (e *NflogEngine) StartEngine(ctx context.Context) (err error) {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	err = RunEngine(ctx, e, e.StartCapture)
 
 	return
 }
 
-func (e *NflogEngine) StartCapture() (err error) {
+func (e *NflogEngine) StartCapture(ctx context.Context) (err error) {
 	capture := NewCapture(e)
-	firstLayer := layers.LayerTypeIPv4
-	capture.SetFirstLayer(firstLayer)
 
 	fn := func(data []byte) int {
+		if len(data) > 0 && data[0]>>4 == 6 {
+			capture.SetFirstLayer(layers.LayerTypeIPv6)
+		} else {
+			capture.SetFirstLayer(layers.LayerTypeIPv4)
+		}
 		capture.DecodeAndAccount(data)
 		return 0
 	}
 
-	nfl := driver.NewNfLog(e.GroupId, fn)
+	nfl, err := driver.NewNfLog(e.GroupId, fn)
+	if err != nil {
+		log.Errorf("failed to open nflog group %d by NflogEngine with err: %s", e.GroupId, err.Error())
+		return
+	}
 	defer nfl.Close()
 
-	nfl.Loop()
+	updateStats := func() {
+		received, dropped := nfl.Stats()
+		e.setCaptureStats(0, CaptureStats{
+			Received: received,
+			Dropped:  dropped,
+		})
+	}
+	defer updateStats()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		statsTicker := time.NewTicker(DefaultStatsInterval)
+		defer statsTicker.Stop()
+
+		for {
+			select {
+			case <-statsTicker.C:
+				updateStats()
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	err = nfl.Loop(ctx)
+	if err != nil {
+		log.Errorf("failed to receive from nflog group %d by NflogEngine with err: %s", e.GroupId, err.Error())
+	}
 
 	return
 }
@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/utils/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+	"time"
+)
+
+var pcapNgMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+type PcapFileReader interface {
+	ZeroCopyReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error)
+	LinkType() layers.LinkType
+}
+
+// NewPcapFileReader detects whether r is a pcap or a pcapng stream and returns the matching reader.
+func NewPcapFileReader(r io.Reader) (reader PcapFileReader, err error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(pcapNgMagic))
+	if err != nil {
+		return
+	}
+
+	if bytes.Equal(magic, pcapNgMagic) {
+		reader, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		reader, err = pcapgo.NewReader(br)
+	}
+
+	return
+}
+
+// NewPcapFileEngine replays the packets of a pcap or pcapng file. Speed 1 replays the packets at their
+// original timestamps, a bigger speed accelerates the replay and speed 0 replays as fast as possible.
+func NewPcapFileEngine(fileName string, ifaceName string, direction pcap.Direction, speed float64, opts DecodeOptions, ch chan *accounting.FlowCollection) (engine *PcapFileEngine) {
+	engine = &PcapFileEngine{
+		FileName:             fileName,
+		IfaceName:            ifaceName,
+		Direction:            direction,
+		Speed:                speed,
+		DecodeOptions:        opts,
+		NotifyChannel:        ch,
+		FlowCol:              accounting.NewFlowCollection(ifaceName),
+		FlowColResetInterval: DefaultFlowColResetInterval,
+	}
+
+	return
+}
+
+type PcapFileEngine struct {
+	lifecycle
+	captureStats
+	DecodeOptions
+	FileName             string
+	IfaceName            string
+	Direction            pcap.Direction
+	Speed                float64
+	NotifyChannel        chan *accounting.FlowCollection
+	FlowCol              *accounting.FlowCollection
+	FlowColResetInterval int64
+}
+
+func (e *PcapFileEngine) GetDirection() pcap.Direction {
+	return e.Direction
+}
+
+func (e *PcapFileEngine) GetFlowCollection() *accounting.FlowCollection {
+	return e.FlowCol
+}
+
+func (e *PcapFileEngine) GetResetInterval() int64 {
+	return e.FlowColResetInterval
+}
+
+func (e *PcapFileEngine) GetNotifyChannel() chan *accounting.FlowCollection {
+	return e.NotifyChannel
+}
+
+// StartEngine does not run Nofify, flow collections are flushed by packet capture time in StartCapture instead.
+func (e *PcapFileEngine) StartEngine(ctx context.Context) (err error) {
+	ctx = e.begin(ctx)
+	defer e.end()
+
+	err = e.StartCapture(ctx)
+
+	return
+}
+
+func (e *PcapFileEngine) StartCapture(ctx context.Context) (err error) {
+	f, err := os.Open(e.FileName)
+	if err != nil {
+		log.Errorf("failed to open pcap file %s by PcapFileEngine with err: %s", e.FileName, err.Error())
+		return
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	reader, err := NewPcapFileReader(f)
+	if err != nil {
+		log.Errorf("failed to read pcap file %s by PcapFileEngine with err: %s", e.FileName, err.Error())
+		return
+	}
+
+	capture := NewCapture(e)
+	firstLayer := capture.Dec.GetFirstLayerType(reader.LinkType())
+	if firstLayer == gopacket.LayerTypeZero {
+		err = errors.New("failed to find first decode layer type")
+		log.Errorln(err.Error())
+		return
+	}
+	capture.SetFirstLayer(firstLayer)
+
+	var data []byte
+	var ci gopacket.CaptureInfo
+	var firstPktTime time.Time
+	var replayStartTime time.Time
+	var sampleStart int64
+	isSampling := false
+	isStopped := false
+	var received uint64
+	defer func() {
+		e.setCaptureStats(0, CaptureStats{Received: received})
+	}()
+
+	statsTicker := time.NewTicker(DefaultStatsInterval)
+	defer statsTicker.Stop()
+
+	for !isStopped {
+		select {
+		case <-ctx.Done():
+			isStopped = true
+			continue
+		case <-statsTicker.C:
+			e.setCaptureStats(0, CaptureStats{Received: received})
+		default:
+		}
+
+		data, ci, err = reader.ZeroCopyReadPacketData()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			log.Errorf("error reading packet from %s: %s", e.FileName, err.Error())
+			return
+		}
+		received++
+
+		if e.Speed > 0 {
+			if firstPktTime.IsZero() {
+				firstPktTime = ci.Timestamp
+				replayStartTime = time.Now()
+			}
+
+			due := replayStartTime.Add(time.Duration(float64(ci.Timestamp.Sub(firstPktTime)) / e.Speed))
+			wait := time.Until(due)
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					isStopped = true
+					continue
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		// Packets slightly out of order are accounted into the current sample
+		pktTime := ci.Timestamp.Unix()
+		if !isSampling {
+			sampleStart = pktTime
+			isSampling = true
+		} else if pktTime >= sampleStart+e.FlowColResetInterval {
+			FlushFlowCollection(e, sampleStart, sampleStart+e.FlowColResetInterval)
+			sampleStart = pktTime
+		}
+
+		capture.DecodeAndAccount(data)
+	}
+
+	if isSampling {
+		FlushFlowCollection(e, sampleStart, sampleStart+e.FlowColResetInterval)
+	}
+
+	if isStopped {
+		log.Infof("replay of pcap file %s stopped", e.FileName)
+	} else {
+		log.Infof("replay of pcap file %s finished", e.FileName)
+	}
+
+	return
+}
@@ -0,0 +1,224 @@
+package engine
+
+import (
+	"context"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var replayStart = time.Unix(1700000000, 0)
+
+// replayPacket returns an ethernet frame of a udp datagram from 192.0.2.1 to 198.51.100.2 with 72 bytes of ip
+func replayPacket(t *testing.T) []byte {
+	t.Helper()
+
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+		SrcIP: net.ParseIP("192.0.2.1").To4(), DstIP: net.ParseIP("198.51.100.2").To4()}
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	_ = udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, udp, gopacket.Payload(make([]byte, 44)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// writePcapFile writes a packet at each of offsets after replayStart into a pcap or pcapng file
+func writePcapFile(t *testing.T, ng bool, offsets ...time.Duration) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "replay.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	data := replayPacket(t)
+	var write func(ci gopacket.CaptureInfo, data []byte) error
+	var ngWriter *pcapgo.NgWriter
+	if ng {
+		ngWriter, err = pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write = ngWriter.WritePacket
+	} else {
+		w := pcapgo.NewWriter(f)
+		err = w.WriteFileHeader(65535, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write = w.WritePacket
+	}
+
+	for _, offset := range offsets {
+		ci := gopacket.CaptureInfo{Timestamp: replayStart.Add(offset), CaptureLength: len(data), Length: len(data)}
+		err = write(ci, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ngWriter != nil {
+		err = ngWriter.Flush()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+// replay runs e to the end of its file and returns the flow collections it flushed
+func replay(t *testing.T, e *PcapFileEngine) (flowCols []*accounting.FlowCollection) {
+	t.Helper()
+
+	err := e.StartEngine(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(e.NotifyChannel)
+
+	for flowCol := range e.NotifyChannel {
+		flowCols = append(flowCols, flowCol)
+	}
+
+	return
+}
+
+// TestPcapFileEngineFlush flushes a flow collection whenever the packet time passes the reset interval and
+// the last one at the end of the file
+func TestPcapFileEngineFlush(t *testing.T) {
+	start := replayStart.Unix()
+	fingerprint := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2"}
+
+	for _, ng := range []bool{false, true} {
+		path := writePcapFile(t, ng, 0, 500*time.Millisecond, 1200*time.Millisecond, 3*time.Second,
+			3900*time.Millisecond)
+		e := NewPcapFileEngine(path, "test0", pcap.DirectionIn, 0, DecodeOptions{},
+			make(chan *accounting.FlowCollection, 8))
+
+		flowCols := replay(t, e)
+		want := []struct {
+			ts      accounting.FlowTimestamp
+			packets int64
+		}{
+			{accounting.FlowTimestamp{Start: start, End: start + 1}, 2},
+			{accounting.FlowTimestamp{Start: start + 1, End: start + 2}, 1},
+			{accounting.FlowTimestamp{Start: start + 3, End: start + 4}, 2},
+		}
+		if len(flowCols) != len(want) {
+			t.Fatalf("pcapng %t: got %d flow collections, want %d", ng, len(flowCols), len(want))
+		}
+
+		for i, w := range want {
+			flowCol := flowCols[i]
+			if flowCol.InterfaceName != "test0" || flowCol.FlowTimestamp != w.ts {
+				t.Errorf("pcapng %t: got flow collection of %s at %+v, want test0 at %+v", ng,
+					flowCol.InterfaceName, flowCol.FlowTimestamp, w.ts)
+			}
+
+			f, ok := flowCol.L3FlowMap[fingerprint]
+			if !ok {
+				t.Errorf("pcapng %t: flow collection at %+v misses flow %+v", ng, w.ts, fingerprint)
+				continue
+			}
+			if f.InboundPackets != w.packets || f.InboundBytes != 72*w.packets || f.InboundDuration != 1 {
+				t.Errorf("pcapng %t: got %d packets and %d bytes in %d seconds at %+v, want %d packets", ng,
+					f.InboundPackets, f.InboundBytes, f.InboundDuration, w.ts, w.packets)
+			}
+		}
+	}
+}
+
+// TestPcapFileEngineSpeed replays at the original timestamps scaled by the speed, speed 0 does not wait
+func TestPcapFileEngineSpeed(t *testing.T) {
+	path := writePcapFile(t, false, 0, 500*time.Millisecond, time.Second)
+
+	tests := []struct {
+		speed   float64
+		minTime time.Duration
+		maxTime time.Duration
+	}{
+		{0, 0, 100 * time.Millisecond},
+		{5, 200 * time.Millisecond, 2 * time.Second},
+	}
+
+	for _, tt := range tests {
+		e := NewPcapFileEngine(path, "test0", pcap.DirectionIn, tt.speed, DecodeOptions{},
+			make(chan *accounting.FlowCollection, 8))
+
+		begin := time.Now()
+		flowCols := replay(t, e)
+		elapsed := time.Since(begin)
+
+		if elapsed < tt.minTime || elapsed > tt.maxTime {
+			t.Errorf("speed %g: replay took %s, want between %s and %s", tt.speed, elapsed, tt.minTime, tt.maxTime)
+		}
+		if len(flowCols) != 2 {
+			t.Errorf("speed %g: got %d flow collections, want 2", tt.speed, len(flowCols))
+		}
+	}
+}
+
+// TestPcapFileEngineEmpty flushes nothing for a file without packets and fails for a missing file
+func TestPcapFileEngineEmpty(t *testing.T) {
+	e := NewPcapFileEngine(writePcapFile(t, false), "test0", pcap.DirectionIn, 1, DecodeOptions{},
+		make(chan *accounting.FlowCollection, 8))
+	if flowCols := replay(t, e); len(flowCols) != 0 {
+		t.Errorf("got %d flow collections of an empty file", len(flowCols))
+	}
+
+	e = NewPcapFileEngine(filepath.Join(t.TempDir(), "missing.pcap"), "test0", pcap.DirectionIn, 0,
+		DecodeOptions{},
+		make(chan *accounting.FlowCollection, 8))
+	if err := e.StartEngine(context.Background()); err == nil {
+		t.Error("replay of a missing file succeeded")
+	}
+}
+
+// TestPcapFileEngineStop stops a replay waiting for the next packet and flushes the packets replayed so far
+func TestPcapFileEngineStop(t *testing.T) {
+	path := writePcapFile(t, false, 0, 500*time.Millisecond, time.Minute)
+	e := NewPcapFileEngine(path, "test0", pcap.DirectionIn, 1, DecodeOptions{},
+		make(chan *accounting.FlowCollection, 8))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.StartEngine(context.Background())
+	}()
+
+	time.Sleep(800 * time.Millisecond)
+	e.StopEngine()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	close(e.NotifyChannel)
+	var packets int64
+	for flowCol := range e.NotifyChannel {
+		for _, f := range flowCol.L3FlowMap {
+			packets += f.InboundPackets
+		}
+	}
+	if packets != 2 {
+		t.Errorf("got %d packets flushed, want the 2 packets before the stop", packets)
+	}
+}
@@ -6,38 +6,104 @@ import (
 	"flag"
 	"fmt"
 	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/aggregator"
 	"github.com/fs714/goiftop/api"
+	"github.com/fs714/goiftop/api/v1"
 	"github.com/fs714/goiftop/engine"
 	"github.com/fs714/goiftop/notify"
+	"github.com/fs714/goiftop/tui"
 	"github.com/fs714/goiftop/utils/config"
 	"github.com/fs714/goiftop/utils/log"
 	"github.com/fs714/goiftop/utils/version"
 	"github.com/google/gopacket/pcap"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 func init() {
+	flag.StringVar(&config.ConfigFile, "config", "", "Yaml or toml config file with per interface settings, flags given on the command line override the values of the file")
 	flag.StringVar(&config.IfaceListString, "i", "", "Interface name list seperated by comma for libpcap and afpacket, like eth0, eth1. This is used for libpcap and afpacket engine")
 	flag.StringVar(&config.GroupListString, "nflog", "", "Nflog interface, group id and direction list seperated by comma, like eth0:2:in, eth0:3:out, eth1:4:int, eth1:5:out. This is used for nflog engine")
-	flag.StringVar(&config.Engine, "engine", "libpcap", "Packet capture engine, could be libpcap, afpacket and nflog")
+	flag.StringVar(&config.Engine, "engine", "libpcap", "Packet capture engine, could be libpcap, afpacket, nflog, pcapfile and collector")
+	flag.StringVar(&config.ReplayFile, "r", "", "Pcap or pcapng file to replay. This is used for pcapfile engine, the interface name defaults to the file name and could be set by -i")
+	flag.Float64Var(&config.ReplaySpeed, "replay.speed", 1, "Replay speed for pcapfile engine, 1 for original timestamps, bigger for accelerated and 0 for as fast as possible")
+	flag.StringVar(&config.ReplayDirection, "replay.direction", "in", "Direction of replayed packets for pcapfile engine, could be in and out")
+	flag.StringVar(&config.CollectorListen, "collector.listen", "", "Udp address like :2055 to receive NetFlow v5, v9, IPFIX and sFlow v5 datagrams on. This is used for collector engine, the interface name defaults to collector and could be set by -i")
+	flag.StringVar(&config.CollectorExporters, "collector.exporters", "", "Addresses or prefixes of the exporters collector engine accepts datagrams from seperated by comma, like 10.0.0.1, 192.168.0.0/24, empty to accept any exporter")
+	flag.Int64Var(&config.CollectorIdleTimeout, "collector.idle_timeout", engine.DefaultCollectorIdleTimeout, "Seconds without flows after which collector engine drops the interfaces of an exporter, and the templates of an exporter without datagrams, 0 to keep them")
+	flag.IntVar(&config.FanoutWorkers, "afpacket.fanout_workers", 1, "Number of capture workers per interface and direction joined into a PACKET_FANOUT group for afpacket engine, 1 for no fanout")
+	flag.StringVar(&config.FanoutMode, "afpacket.fanout_mode", "hash", "PACKET_FANOUT mode for afpacket engine, could be hash, cpu and lb")
 	flag.BoolVar(&config.IsDecodeL4, "l4", false, "Show transport layer flows")
+	flag.BoolVar(&config.UseVlan, "vlan", false, "Keep flows of different vlans apart by their vlan id, or outer and inner ids for QinQ")
+	flag.BoolVar(&config.TunnelDecap, "tunnel.decap", false, "Account VXLAN, Geneve, GRE, ERSPAN and IP-in-IP packets to their inner flows instead of the flows between tunnel endpoints")
+	flag.BoolVar(&config.TunnelTag, "tunnel.tag", false, "Tag inner flows of decapsulated tunnels with the tunnel type and VNI, key or session id")
+	flag.BoolVar(&config.TuiEnable, "tui", false, "Enable interactive terminal ui, logs are discarded while it is running")
 	flag.BoolVar(&config.PrintEnable, "print.enable", false, "enable print notifier")
 	flag.Int64Var(&config.PrintInterval, "print.interval", 2, "Interval to print flows")
+	flag.StringVar(&config.PrintSortBy, "print.sort", accounting.SortByBytes, "Sort printed flows by bytes, in_bytes, out_bytes, packets, in_packets, out_packets, rate, in_rate or out_rate")
+	flag.IntVar(&config.PrintTopN, "print.top_n", 0, "Number of flows printed per interface and layer, the rest are summed up into an others row, 0 for all flows")
+	flag.BoolVar(&config.PrintHuman, "print.human", false, "Print bytes and rates in human readable units like KB, MB and Mbps, Gbps")
+	flag.StringVar(&config.PrintGroupBy, "print.group", "", "Also print flows rolled up per host, peer, subnet, peer_subnet or vlan")
+	flag.IntVar(&config.GroupPrefixV4, "group.prefix_v4", accounting.DefaultPrefixV4, "Prefix length of ipv4 subnets flows are rolled up into")
+	flag.IntVar(&config.GroupPrefixV6, "group.prefix_v6", accounting.DefaultPrefixV6, "Prefix length of ipv6 subnets flows are rolled up into")
+	flag.Int64Var(&config.OnceDuration, "once.duration", 0, "Capture for the given seconds, then write a summary of the run and exit, 0 to disable")
+	flag.Int64Var(&config.OncePackets, "once.packets", 0, "Capture until the given number of packets is accounted, then write a summary of the run and exit, 0 to disable")
+	flag.StringVar(&config.OnceFormat, "once.format", notify.SummaryFormatTable, "Format of the summary of one-shot mode, could be table and json")
+	flag.StringVar(&config.OnceFile, "once.file", notify.OutputStdout, "File the summary of one-shot mode is written to, - for stdout")
+	flag.StringVar(&config.OutputFormat, "output.format", "", "Write flows of every interval as json lines or csv rows, could be json and csv, empty to disable")
+	flag.StringVar(&config.OutputFile, "output.file", notify.OutputStdout, "File the flows are appended to, - for stdout")
+	flag.Int64Var(&config.OutputInterval, "output.interval", 2, "Interval to write flows")
 	flag.BoolVar(&config.WebHookEnable, "webhook.enable", false, "enable webhook notifier")
 	flag.StringVar(&config.WebHookUrl, "webhook.url", "", "webhokk url")
 	flag.Int64Var(&config.WebHookInterval, "webhook.interval", 15, "Interval for webhook to send out flows")
 	flag.IntVar(&config.WebHookPostTimeout, "webhook.post_timeout", 2, "Post timeout for webhook to send out flows")
 	flag.StringVar(&config.WebHookNodeId, "webhook.node_id", "", "Node identification for webhook")
 	flag.StringVar(&config.WebHookNodeOamAddr, "webhook.node_oam_addr", "", "node oam address for webhook")
+	flag.IntVar(&config.WebHookRetries, "webhook.retries", notify.DefaultWebhookRetries, "Retries of a failed webhook post")
+	flag.Int64Var(&config.WebHookBackoff, "webhook.backoff", notify.DefaultWebhookBackoff, "Seconds to wait before the first retry of a failed webhook post, doubled for every further retry")
+	flag.Int64Var(&config.WebHookMaxBackoff, "webhook.max_backoff", notify.DefaultWebhookMaxBackoff, "Max seconds to wait before a retry of a failed webhook post")
+	flag.StringVar(&config.WebHookSpoolDir, "webhook.spool_dir", "", "Directory flows failed to post are spooled to and posted from once the webhook recovers, empty to drop them")
+	flag.StringVar(&config.WebHookToken, "webhook.token", "", "Bearer token sent with webhook posts")
+	flag.StringVar(&config.WebHookTokenFile, "webhook.token_file", "", "File the bearer token of webhook posts is read from, instead of -webhook.token")
+	flag.StringVar(&config.WebHookHmacSecret, "webhook.hmac_secret", "", "Secret webhook posts are signed with by HMAC-SHA256 together with a timestamp")
+	flag.StringVar(&config.WebHookHmacSecretFile, "webhook.hmac_secret_file", "", "File the hmac secret of webhook posts is read from, instead of -webhook.hmac_secret")
+	flag.StringVar(&config.WebHookCaFile, "webhook.ca_file", "", "CA bundle verifying the webhook server, default the system roots")
+	flag.StringVar(&config.WebHookCertFile, "webhook.cert_file", "", "Client certificate for mutual TLS with the webhook server")
+	flag.StringVar(&config.WebHookKeyFile, "webhook.key_file", "", "Client key for mutual TLS with the webhook server")
+	flag.BoolVar(&config.WebHookGzip, "webhook.gzip", false, "Compress webhook posts with gzip")
+	flag.IntVar(&config.WebHookPayloadVersion, "webhook.payload_version", notify.PayloadVersion1,
+		"Version of the payload posted to the webhook, 1 or 2 to opt in to the versioned payload")
+	flag.IntVar(&config.WebHookSpoolMax, "webhook.spool_max", notify.DefaultWebhookSpoolMax, "Max number of spooled webhook posts, the oldest are dropped beyond")
+	flag.StringVar(&config.NetflowCollector, "netflow.collector", "", "Collector host:port the transport layer flows are exported to as IPFIX or NetFlow v9 over udp, empty to disable")
+	flag.StringVar(&config.NetflowVersion, "netflow.version", notify.NetflowVersionIpfix, "Export protocol of flows to the collector, could be ipfix and v9")
+	flag.Int64Var(&config.NetflowActiveTimeout, "netflow.active_timeout", notify.DefaultNetflowActiveTimeout, "Seconds after which a flow still active is exported to the collector, and counted again from then")
+	flag.Int64Var(&config.NetflowInactiveTimeout, "netflow.inactive_timeout", notify.DefaultNetflowInactiveTimeout, "Seconds without packets after which a flow is exported to the collector")
+	flag.Int64Var(&config.NetflowTemplateRefresh, "netflow.template_refresh", notify.DefaultNetflowTemplateRefresh, "Seconds after which the templates are sent to the collector again")
+	flag.Int64Var(&config.NetflowDomainId, "netflow.domain_id", 0, "Observation domain id of IPFIX, or source id of NetFlow v9, of the flows exported")
+	flag.BoolVar(&config.ServerEnable, "server", false, "Run as aggregator accounting the flows posted by the webhooks of many nodes to http POST /api/v1/ingest instead of capturing, the http server is enabled")
+	flag.StringVar(&config.ServerToken, "server.token", "", "Bearer token the posts of the nodes need in aggregator mode, the posts are not authenticated without a token or hmac secret")
+	flag.StringVar(&config.ServerTokenFile, "server.token_file", "", "File the bearer token of aggregator mode is read from, instead of -server.token")
+	flag.StringVar(&config.ServerHmacSecret, "server.hmac_secret", "", "Secret the posts of the nodes need to be signed with in aggregator mode")
+	flag.StringVar(&config.ServerHmacSecretFile, "server.hmac_secret_file", "", "File the hmac secret of aggregator mode is read from, instead of -server.hmac_secret")
+	flag.Int64Var(&config.ServerMaxSkew, "server.max_skew", aggregator.DefaultMaxSkew, "Max seconds the signature timestamp of a post could be off in aggregator mode")
+	flag.Int64Var(&config.ServerRetention, "server.retention", aggregator.DefaultRetention, "Seconds the flows of the nodes are kept in aggregator mode")
+	flag.Int64Var(&config.ServerNodeTimeout, "server.node_timeout", 0, "Seconds after which a node not posting is dropped with its flows in aggregator mode, 0 to keep it")
 	flag.BoolVar(&config.IsEnableHttpSrv, "http", false, "Enable http server and ui")
 	flag.StringVar(&config.HttpSrvAddr, "addr", "0.0.0.0", "Http server listening address")
 	flag.StringVar(&config.HttpSrvPort, "port", "31415", "Http server listening port")
 	flag.BoolVar(&config.IsProfiling, "profiling", false, "Enable profiling by http")
+	flag.StringVar(&config.ReloadToken, "reload.token", "", "Bearer token of http POST /api/v1/reload to reload config like SIGHUP, the api is disabled when empty")
+	flag.IntVar(&config.MetricsTopN, "metrics.top_n", 10, "Number of flows per interface and layer with own series in http /metrics, the rest are rolled into an other series")
+	flag.Int64Var(&config.MetricsWindow, "metrics.window", 60, "Window in seconds the flows in http /metrics are aggregated over")
 	flag.BoolVar(&config.IsShowVersion, "v", false, "Show version")
 	flag.Parse()
 
@@ -56,27 +122,690 @@ func init() {
 	log.SetOutput(os.Stdout)
 }
 
-func ArgsValidation() (err error) {
-	if config.Engine != engine.LibPcapEngineName && config.Engine != engine.AfpacketEngineName &&
-		config.Engine != engine.NflogEngineName {
-		err = errors.New("invalid engine name: " + config.Engine)
+const MaxFanoutWorkers = 64
+
+// isOnce tells whether goiftop runs in one-shot mode, which exits with a summary after a duration or a number
+// of packets
+func isOnce() bool {
+	return config.OnceDuration > 0 || config.OncePackets > 0
+}
+
+func printOptions() notify.PrintOptions {
+	return notify.PrintOptions{
+		SortBy:  config.PrintSortBy,
+		TopN:    config.PrintTopN,
+		IsHuman: config.PrintHuman,
+	}
+}
+
+func printGrouping() accounting.Grouping {
+	return accounting.Grouping{
+		By:       config.PrintGroupBy,
+		PrefixV4: config.GroupPrefixV4,
+		PrefixV6: config.GroupPrefixV6,
+	}
+}
+
+// notifierSettings returns the notifiers enabled by the print, output, webhook and netflow flags, followed by the
+// notifiers of the config file
+func notifierSettings() (settings []notify.Settings) {
+	if config.PrintEnable {
+		settings = append(settings, notify.Settings{
+			Name:     notify.PrintNotifierType,
+			Type:     notify.PrintNotifierType,
+			Interval: config.PrintInterval,
+			Grouping: printGrouping(),
+			Options: notify.Options{
+				"sort":  config.PrintSortBy,
+				"top_n": config.PrintTopN,
+				"human": config.PrintHuman,
+			},
+		})
+	}
+
+	if config.OutputFormat != "" {
+		settings = append(settings, notify.Settings{
+			Name:     notify.OutputNotifierType,
+			Type:     notify.OutputNotifierType,
+			Interval: config.OutputInterval,
+			Options: notify.Options{
+				"format": config.OutputFormat,
+				"file":   config.OutputFile,
+			},
+		})
+	}
+
+	if config.WebHookEnable {
+		settings = append(settings, notify.Settings{
+			Name:     notify.WebhookNotifierType,
+			Type:     notify.WebhookNotifierType,
+			Interval: config.WebHookInterval,
+			Options: notify.Options{
+				"url":              config.WebHookUrl,
+				"post_timeout":     config.WebHookPostTimeout,
+				"node_id":          config.WebHookNodeId,
+				"node_oam_addr":    config.WebHookNodeOamAddr,
+				"retries":          config.WebHookRetries,
+				"backoff":          config.WebHookBackoff,
+				"max_backoff":      config.WebHookMaxBackoff,
+				"spool_dir":        config.WebHookSpoolDir,
+				"spool_max":        config.WebHookSpoolMax,
+				"token":            config.WebHookToken,
+				"token_file":       config.WebHookTokenFile,
+				"hmac_secret":      config.WebHookHmacSecret,
+				"hmac_secret_file": config.WebHookHmacSecretFile,
+				"ca_file":          config.WebHookCaFile,
+				"cert_file":        config.WebHookCertFile,
+				"key_file":         config.WebHookKeyFile,
+				"gzip":             config.WebHookGzip,
+				"payload_version":  config.WebHookPayloadVersion,
+			},
+		})
+	}
+
+	// The exporter gets every sample, so the interval only sets how soon flows timed out are exported
+	if config.NetflowCollector != "" {
+		settings = append(settings, notify.Settings{
+			Name:     notify.NetflowNotifierType,
+			Type:     notify.NetflowNotifierType,
+			Interval: 1,
+			Options: notify.Options{
+				"collector":        config.NetflowCollector,
+				"version":          config.NetflowVersion,
+				"active_timeout":   config.NetflowActiveTimeout,
+				"inactive_timeout": config.NetflowInactiveTimeout,
+				"template_refresh": config.NetflowTemplateRefresh,
+				"domain_id":        config.NetflowDomainId,
+			},
+		})
+	}
+
+	for _, c := range config.Notifiers {
+		s := notify.Settings{
+			Name:       c.Name,
+			Type:       c.Type,
+			Interval:   c.Interval,
+			Interfaces: c.Interfaces,
+			Filter: accounting.FlowFilter{
+				Addr:     c.Addr,
+				Port:     c.Port,
+				Protocol: c.Protocol,
+				Vlan:     c.Vlan,
+			},
+			Grouping: accounting.Grouping{
+				By:       c.Group,
+				PrefixV4: config.GroupPrefixV4,
+				PrefixV6: config.GroupPrefixV6,
+			},
+			Options: c.Options,
+		}
+		if s.Name == "" {
+			s.Name = c.Type
+		}
+		if c.PrefixV4 != nil {
+			s.Grouping.PrefixV4 = *c.PrefixV4
+		}
+		if c.PrefixV6 != nil {
+			s.Grouping.PrefixV6 = *c.PrefixV6
+		}
+
+		settings = append(settings, s)
+	}
+
+	return
+}
+
+// serverSettings returns the settings of the aggregator with the secrets read from their files
+func serverSettings() (s aggregator.Settings, err error) {
+	s.Token, err = notify.ReadSecret(config.ServerToken, config.ServerTokenFile)
+	if err != nil {
+		err = errors.New("invalid server token: " + err.Error())
+		return
+	}
+
+	hmacSecret, err := notify.ReadSecret(config.ServerHmacSecret, config.ServerHmacSecretFile)
+	if err != nil {
+		err = errors.New("invalid server hmac secret: " + err.Error())
+		return
+	}
+	s.HmacSecret = []byte(hmacSecret)
+
+	s.MaxSkew = config.ServerMaxSkew
+	s.NodeTimeout = config.ServerNodeTimeout
+
+	return
+}
+
+// isStdoutFile tells whether file names stdout
+func isStdoutFile(file string) bool {
+	return file == "" || file == notify.OutputStdout
+}
+
+// isLogToStderr tells whether logs are written to stderr, to keep them out of the flows or the summary written
+// to stdout for other tools. The tables of the print notifier still share stdout with the logs.
+func isLogToStderr() bool {
+	if isOnce() && isStdoutFile(config.OnceFile) {
+		return true
+	}
+
+	for _, s := range notifierSettings() {
+		if s.Type == notify.PrintNotifierType {
+			continue
+		}
+
+		isStdout, err := s.Check()
+		if err == nil && isStdout {
+			return true
+		}
+	}
+
+	return false
+}
+
+func ConfigValidation() (err error) {
+	if config.ServerEnable {
+		err = serverValidation()
+		if err != nil {
+			return
+		}
+	} else if len(config.Interfaces) == 0 {
+		err = errors.New("no interface provided")
+		return
+	}
+
+	names := make(map[string]bool)
+	for _, c := range config.Interfaces {
+		if c.Name == "" {
+			err = errors.New("interface name should not be empty")
+			return
+		}
+
+		if names[c.Name] {
+			err = errors.New("duplicated interface: " + c.Name)
+			return
+		}
+		names[c.Name] = true
+
+		if c.Engine != engine.LibPcapEngineName && c.Engine != engine.AfpacketEngineName &&
+			c.Engine != engine.NflogEngineName && c.Engine != engine.PcapFileEngineName &&
+			c.Engine != engine.CollectorEngineName {
+			err = errors.New("invalid engine name " + c.Engine + " for interface " + c.Name)
+			return
+		}
+
+		if c.Direction != config.DirectionIn && c.Direction != config.DirectionOut && c.Direction != config.DirectionBoth {
+			err = errors.New("invalid direction " + c.Direction + " for interface " + c.Name)
+			return
+		}
+
+		if c.SnapLen <= 0 {
+			err = errors.New("snaplen should be positive for interface " + c.Name)
+			return
+		}
+
+		if c.MmapBufferSizeMb <= 0 {
+			err = errors.New("mmap buffer size should be positive for interface " + c.Name)
+			return
+		}
+
+		if c.Engine == engine.AfpacketEngineName {
+			if c.FanoutWorkers < 1 || c.FanoutWorkers > MaxFanoutWorkers {
+				err = errors.New("fanout workers should be between 1 and " + strconv.Itoa(MaxFanoutWorkers) +
+					" for interface " + c.Name)
+				return
+			}
+
+			_, err = engine.FanoutType(c.FanoutMode)
+			if err != nil {
+				err = errors.New(err.Error() + " for interface " + c.Name)
+				return
+			}
+		}
+
+		if c.Engine == engine.NflogEngineName {
+			if c.Direction != config.DirectionOut && c.NflogGroupIn <= 0 {
+				err = errors.New("no inbound group id provided for interface " + c.Name)
+				return
+			}
+
+			if c.Direction != config.DirectionIn && c.NflogGroupOut <= 0 {
+				err = errors.New("no outbound group id provided for interface " + c.Name)
+				return
+			}
+		} else if c.NflogGroupIn != 0 || c.NflogGroupOut != 0 {
+			err = errors.New("nflog group id is only used by nflog engine for interface " + c.Name)
+			return
+		}
+
+		if c.Engine == engine.PcapFileEngineName {
+			if c.ReplayFile == "" {
+				err = errors.New("no pcap file provided for interface " + c.Name)
+				return
+			}
+
+			if *c.ReplaySpeed < 0 {
+				err = errors.New("replay speed should not be negative for interface " + c.Name)
+				return
+			}
+
+			if c.Direction == config.DirectionBoth {
+				err = errors.New("direction of replayed packets should be in or out for interface " + c.Name)
+				return
+			}
+		} else if c.ReplayFile != "" {
+			err = errors.New("replay file is only used by pcapfile engine for interface " + c.Name)
+			return
+		}
+
+		if c.Engine == engine.CollectorEngineName {
+			if strings.Contains(c.Name, engine.CollectorSeparator) {
+				err = errors.New("collector interface name " + c.Name + " should not contain " +
+					engine.CollectorSeparator)
+				return
+			}
+
+			if c.ListenAddr == "" {
+				err = errors.New("no listen address provided for interface " + c.Name)
+				return
+			}
+
+			_, _, err = net.SplitHostPort(c.ListenAddr)
+			if err != nil {
+				err = errors.New("invalid listen address " + c.ListenAddr + " for interface " + c.Name + ": " +
+					err.Error())
+				return
+			}
+
+			_, err = engine.ParseExporters(c.Exporters)
+			if err != nil {
+				err = errors.New(err.Error() + " for interface " + c.Name)
+				return
+			}
+
+			if c.IdleTimeout < 0 {
+				err = errors.New("idle timeout should not be negative for interface " + c.Name)
+				return
+			}
+		} else if c.ListenAddr != "" || len(c.Exporters) != 0 || c.IdleTimeout != 0 {
+			err = errors.New("listen address, exporters and idle timeout are only used by collector engine for " +
+				"interface " + c.Name)
+			return
+		}
+	}
+
+	if config.TuiEnable && config.PrintEnable {
+		err = errors.New("terminal ui and print notifier could not be enabled together")
 		return
 	}
 
-	if config.Engine == engine.LibPcapEngineName || config.Engine == engine.AfpacketEngineName {
-		if config.IfaceListString == "" {
-			err = errors.New("no interface provided")
+	if config.PrintEnable && config.PrintInterval <= 0 {
+		err = errors.New("print interval should be positive")
+		return
+	}
+
+	if config.PrintEnable || isOnce() {
+		err = accounting.ValidateSortBy(config.PrintSortBy)
+		if err != nil {
+			return
+		}
+
+		if config.PrintTopN < 0 {
+			err = errors.New("print top n should not be negative")
 			return
 		}
 	}
 
-	if config.Engine == engine.NflogEngineName {
-		if config.GroupListString == "" {
-			err = errors.New("no group id provided")
+	if config.OnceDuration < 0 || config.OncePackets < 0 {
+		err = errors.New("one-shot duration and packets should not be negative")
+		return
+	}
+
+	if isOnce() {
+		err = notify.ValidateSummaryFormat(config.OnceFormat)
+		if err != nil {
+			return
+		}
+
+		if config.TuiEnable {
+			err = errors.New("one-shot mode and terminal ui could not be enabled together")
+			return
+		}
+	}
+
+	grouping := accounting.Grouping{By: accounting.GroupByHost, PrefixV4: config.GroupPrefixV4, PrefixV6: config.GroupPrefixV6}
+	if config.PrintGroupBy != "" {
+		grouping.By = config.PrintGroupBy
+	}
+	err = grouping.Validate()
+	if err != nil {
+		return
+	}
+
+	if config.WebHookEnable {
+		if config.WebHookUrl == "" {
+			err = errors.New("no webhook url provided")
+			return
+		}
+
+		if config.WebHookInterval <= 0 {
+			err = errors.New("webhook interval should be positive")
+			return
+		}
+
+		if config.WebHookPostTimeout <= 0 {
+			err = errors.New("webhook post timeout should be positive")
+			return
+		}
+	}
+
+	err = notifierValidation()
+	if err != nil {
+		return
+	}
+
+	if config.MetricsTopN < 0 {
+		err = errors.New("metrics top n should not be negative")
+		return
+	}
+
+	if config.MetricsWindow <= 0 {
+		err = errors.New("metrics window should be positive")
+		return
+	}
+
+	return
+}
+
+// serverValidation checks the settings of aggregator mode, which accounts the flows of the nodes instead of
+// capturing
+func serverValidation() (err error) {
+	if len(config.Interfaces) > 0 {
+		err = errors.New("aggregator mode does not capture, no interface should be given")
+		return
+	}
+
+	if isOnce() {
+		err = errors.New("one-shot mode and aggregator mode could not be enabled together")
+		return
+	}
+
+	if config.ServerMaxSkew <= 0 {
+		err = errors.New("server max skew should be positive")
+		return
+	}
+
+	if config.ServerRetention <= 0 {
+		err = errors.New("server retention should be positive")
+		return
+	}
+
+	if config.ServerNodeTimeout < 0 {
+		err = errors.New("server node timeout should not be negative")
+		return
+	}
+
+	s, err := serverSettings()
+	if err != nil {
+		return
+	}
+
+	if s.Token == "" && len(s.HmacSecret) == 0 {
+		log.Warnf("WARNING: neither server token nor hmac secret is set, %s accepts the flows of anyone "+
+			"reaching the api in aggregator mode", "/api/v1/ingest")
+	}
+
+	return
+}
+
+// notifierValidation checks the settings and options of every notifier, and that stdout is only written by
+// one of the terminal ui, the one-shot summary and the notifiers
+func notifierValidation() (err error) {
+	ifaceNames := make(map[string]bool)
+	collectorNames := make(map[string]bool)
+	for _, c := range config.Interfaces {
+		if isCollector(c) {
+			collectorNames[c.Name] = true
+		} else {
+			ifaceNames[c.Name] = true
+		}
+	}
+
+	var stdoutUsers []string
+	if config.TuiEnable {
+		stdoutUsers = append(stdoutUsers, "terminal ui")
+	}
+	if isOnce() && isStdoutFile(config.OnceFile) {
+		stdoutUsers = append(stdoutUsers, "one-shot summary")
+	}
+
+	names := make(map[string]bool)
+	for _, s := range notifierSettings() {
+		if names[s.Name] {
+			err = errors.New("duplicate notifier name " + s.Name + ", notifiers of the same type need their own name")
 			return
 		}
+		names[s.Name] = true
+
+		// The interfaces of aggregator mode are only known once the nodes post them, and the ones of collectors
+		// once the exporters send flows
+		for _, ifaceName := range s.Interfaces {
+			collectorName, _, _, isExporterIface := engine.ParseCollectorInterfaceName(ifaceName)
+			if !config.ServerEnable && !ifaceNames[ifaceName] && !(isExporterIface && collectorNames[collectorName]) {
+				err = errors.New("unknown interface " + ifaceName + " of notifier " + s.Name)
+				return
+			}
+		}
+
+		// Notifiers are only created once the config is in effect, so checking does not read their files or open
+		// their sockets
+		var isStdout bool
+		isStdout, err = s.Check()
+		if err != nil {
+			return
+		}
+
+		if isStdout {
+			stdoutUsers = append(stdoutUsers, "notifier "+s.Name)
+		}
+	}
+
+	if len(stdoutUsers) > 1 {
+		err = errors.New("only one could write to stdout but got " + strings.Join(stdoutUsers, ", "))
+		return
+	}
+
+	return
+}
+
+func engineDirections(c config.InterfaceConfig) (directions []pcap.Direction) {
+	if c.Direction != config.DirectionOut {
+		directions = append(directions, pcap.DirectionIn)
+	}
+
+	if c.Direction != config.DirectionIn {
+		directions = append(directions, pcap.DirectionOut)
+	}
+
+	return
+}
+
+// newEngines creates one engine per captured direction of an interface
+func newEngines(c config.InterfaceConfig, ch chan *accounting.FlowCollection) (engineList []engine.PktCapEngine) {
+	opts := engine.DecodeOptions{
+		IsDecodeL4:  c.DecodeL4(),
+		UseVlan:     c.AccountVlans(),
+		TunnelDecap: c.DecapTunnels(),
+		TunnelTag:   c.TagTunnels(),
+	}
+
+	// The collector accounts both directions of the exporter interfaces by itself
+	if c.Engine == engine.CollectorEngineName {
+		exporters, _ := engine.ParseExporters(c.Exporters)
+		engineList = append(engineList, engine.NewCollectorEngine(c.Name, c.ListenAddr, exporters, c.IdleTimeout, opts,
+			accounting.GlobalAcct))
+		return
+	}
+
+	for _, direction := range engineDirections(c) {
+		var e engine.PktCapEngine
+		if c.Engine == engine.LibPcapEngineName {
+			e = engine.NewLibPcapEngine(c.Name, c.BpfFilter, direction, int32(c.SnapLen), opts, ch)
+		} else if c.Engine == engine.AfpacketEngineName {
+			e = engine.NewAfpacketEngine(c.Name, c.BpfFilter, direction, c.SnapLen, c.MmapBufferSizeMb,
+				c.FanoutWorkers, c.FanoutMode, opts, ch)
+		} else if c.Engine == engine.NflogEngineName {
+			groupId := c.NflogGroupIn
+			if direction == pcap.DirectionOut {
+				groupId = c.NflogGroupOut
+			}
+			e = engine.NewNflogEngine(c.Name, groupId, direction, opts, ch)
+		} else if c.Engine == engine.PcapFileEngineName {
+			e = engine.NewPcapFileEngine(c.ReplayFile, c.Name, direction, *c.ReplaySpeed, opts, ch)
+		}
+		engineList = append(engineList, e)
+	}
+
+	return
+}
+
+// Notifiers runs the print, output, webhook and netflow notifiers, which are restarted with the new settings on
+// reload
+type Notifiers struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     *sync.WaitGroup
+	source notify.Source
+}
+
+func NewNotifiers(ctx context.Context, source notify.Source) (n *Notifiers) {
+	n = &Notifiers{
+		ctx:    ctx,
+		wg:     &sync.WaitGroup{},
+		source: source,
+	}
+
+	return
+}
+
+// Start creates and runs the notifiers, notifiers failing to be created are skipped and the first error is
+// returned
+func (n *Notifiers) Start() (err error) {
+	var ctx context.Context
+	ctx, n.cancel = context.WithCancel(n.ctx)
+
+	for _, s := range notifierSettings() {
+		nt, berr := s.Build()
+		if berr != nil {
+			log.Errorf("failed to create notifier %s with err: %s", s.Name, berr.Error())
+			if err == nil {
+				err = berr
+			}
+			continue
+		}
+
+		n.wg.Add(1)
+		go func(ctx context.Context, s notify.Settings, nt notify.Notifier) {
+			defer n.wg.Done()
+
+			time.Sleep(1 * time.Second)
+			notify.Run(ctx, n.source, s, nt)
+		}(ctx, s, nt)
+	}
+
+	return
+}
+
+func (n *Notifiers) Stop() {
+	if n.cancel != nil {
+		n.cancel()
+	}
+	n.wg.Wait()
+}
+
+func isCollector(c config.InterfaceConfig) bool {
+	return c.Engine == engine.CollectorEngineName
+}
+
+// removeInterface drops the flows of an interface, or of the exporter interfaces of a collector
+func removeInterface(c config.InterfaceConfig) {
+	if !isCollector(c) {
+		accounting.GlobalAcct.RemoveInterface(c.Name)
+		log.Infof("interface %s removed", c.Name)
+		return
+	}
+
+	for _, ifaceName := range accounting.GlobalAcct.InterfaceNames() {
+		if engine.IsCollectorInterface(c.Name, ifaceName) {
+			accounting.GlobalAcct.RemoveInterface(ifaceName)
+			log.Infof("interface %s removed", ifaceName)
+		}
+	}
+}
+
+// Reload loads the config again and applies it to the running engines and notifiers. Interfaces kept by the
+// new config keep their history, and the current config stays in effect when the new one is invalid. Engines
+// fail after Reload returned, and only stop their own interface then, which is started again by the next reload.
+func Reload(engineMgr *engine.EngineManager, notifiers *Notifiers) (err error) {
+	saved := config.SaveConfig()
+	oldIfaces := make(map[string]config.InterfaceConfig)
+	for _, c := range config.Interfaces {
+		oldIfaces[c.Name] = c
+	}
+
+	err = config.ReloadConfig()
+	if err == nil {
+		err = ConfigValidation()
+	}
+	if err != nil {
+		saved.Restore()
+		return
+	}
+
+	newIfaces := make(map[string]config.InterfaceConfig)
+	for _, c := range config.Interfaces {
+		newIfaces[c.Name] = c
+	}
+
+	for name := range oldIfaces {
+		_, ok := newIfaces[name]
+		if !ok {
+			engineMgr.Stop(name)
+			removeInterface(oldIfaces[name])
+		}
+	}
+
+	for _, c := range config.Interfaces {
+		oldConf, ok := oldIfaces[c.Name]
+		if !ok {
+			if !isCollector(c) {
+				accounting.GlobalAcct.AddInterface(c.Name)
+			}
+			engineMgr.Start(c.Name, newEngines(c, accounting.GlobalAcct.Ch))
+			log.Infof("interface %s added", c.Name)
+		} else if !reflect.DeepEqual(oldConf, c) {
+			engineMgr.Start(c.Name, newEngines(c, accounting.GlobalAcct.Ch))
+			log.Infof("interface %s reconfigured", c.Name)
+		} else if !engineMgr.IsRunning(c.Name) {
+			engineMgr.Start(c.Name, newEngines(c, accounting.GlobalAcct.Ch))
+			log.Infof("interface %s restarted", c.Name)
+		}
+	}
+
+	if aggregator.GlobalAggregator != nil {
+		settings, _ := serverSettings()
+		aggregator.GlobalAggregator.SetSettings(settings)
+	}
+
+	// The notifiers failing to be created are logged, the others run with the new config
+	notifiers.Stop()
+	_ = notifiers.Start()
+
+	for _, name := range saved.ChangedFlags("http", "addr", "port", "profiling", "tui", "server", "server.retention") {
+		log.Warnf("setting %s is not changed by reload, restart to apply it", name)
 	}
 
+	log.Infoln("config reloaded")
+
 	return
 }
 
@@ -86,37 +815,72 @@ func main() {
 		os.Exit(0)
 	}
 
-	if os.Geteuid() != 0 {
-		log.Errorln("must run as root")
+	err := config.LoadConfig()
+	if err != nil {
+		log.Errorf("failed to load config with err: %s", err.Error())
 		os.Exit(1)
 	}
 
-	err := ArgsValidation()
+	err = ConfigValidation()
 	if err != nil {
-		log.Errorf("args validation failed with err: %s", err.Error())
+		log.Errorf("config validation failed with err: %s", err.Error())
 		os.Exit(1)
 	}
 
+	isLiveCapture := false
+	for _, c := range config.Interfaces {
+		if c.Engine != engine.PcapFileEngineName && c.Engine != engine.CollectorEngineName {
+			isLiveCapture = true
+		}
+	}
+
+	if os.Geteuid() != 0 && isLiveCapture {
+		log.Errorln("must run as root")
+		os.Exit(1)
+	}
+
+	// Keep logs out of the flows and the summary written to stdout
+	if isLogToStderr() {
+		log.SetOutput(os.Stderr)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	ExitWG := &sync.WaitGroup{}
 
-	if config.Engine == engine.NflogEngineName {
-		err = config.ParseNflogConfig()
-		if err != nil {
-			log.Errorln(err.Error())
-			os.Exit(1)
+	accounting.GlobalAcct = accounting.NewAccounting()
+	accounting.GlobalAcct.SetRetention(300)
+	if config.ServerEnable {
+		accounting.GlobalAcct.SetRetention(config.ServerRetention)
+	}
+	for _, c := range config.Interfaces {
+		if !isCollector(c) {
+			accounting.GlobalAcct.AddInterface(c.Name)
 		}
-	} else {
-		config.ParseIfaces()
 	}
 
-	accounting.GlobalAcct = accounting.NewAccounting()
-	accounting.GlobalAcct.SetRetention(300)
-	for _, iface := range config.IfaceList {
-		accounting.GlobalAcct.AddInterface(iface)
+	// One-shot mode keeps every sample for the summary, and ends after the duration, once the packets are
+	// accounted, or when the engines of all interfaces finished on their own like replays of pcap files
+	var onceTimerCh <-chan time.Time
+	var oncePacketCh chan *accounting.FlowCollection
+	var oncePacketSubId int
+	var oncePackets int64
+	onceDoneIfaces := make(map[string]bool)
+	if isOnce() {
+		accounting.GlobalAcct.SetRetention(0)
+
+		if config.OnceDuration > 0 {
+			timer := time.NewTimer(time.Duration(config.OnceDuration) * time.Second)
+			defer timer.Stop()
+			onceTimerCh = timer.C
+		}
+
+		// Every collection is counted, so the subscription blocks accounting until it is released at exit
+		if config.OncePackets > 0 {
+			oncePacketSubId, oncePacketCh = accounting.GlobalAcct.SubscribeBlocking()
+		}
 	}
 	ExitWG.Add(1)
 	go func(ctx context.Context) {
@@ -125,49 +889,33 @@ func main() {
 		accounting.GlobalAcct.Start(ctx)
 	}(ctx)
 
-	var engineList []engine.PktCapEngine
-	if config.Engine == engine.LibPcapEngineName {
-		for _, iface := range config.IfaceList {
-			eIn := engine.NewLibPcapEngine(iface, "", pcap.DirectionIn, 65535, config.IsDecodeL4, accounting.GlobalAcct.Ch)
-			eOut := engine.NewLibPcapEngine(iface, "", pcap.DirectionOut, 65535, config.IsDecodeL4, accounting.GlobalAcct.Ch)
-			engineList = append(engineList, eIn)
-			engineList = append(engineList, eOut)
-		}
-	} else if config.Engine == engine.AfpacketEngineName {
-		for _, iface := range config.IfaceList {
-			eIn := engine.NewAfpacketEngine(iface, pcap.DirectionIn, config.IsDecodeL4, accounting.GlobalAcct.Ch)
-			eOut := engine.NewAfpacketEngine(iface, pcap.DirectionOut, config.IsDecodeL4, accounting.GlobalAcct.Ch)
-			engineList = append(engineList, eIn)
-			engineList = append(engineList, eOut)
-		}
-	} else if config.Engine == engine.NflogEngineName {
-		for _, nflogConf := range config.NflogConfigList {
-			e := engine.NewNflogEngine(nflogConf.IfaceName, nflogConf.GroupId, nflogConf.Direction, config.IsDecodeL4, accounting.GlobalAcct.Ch)
-			engineList = append(engineList, e)
-		}
-	} else {
-		err = errors.New("invalid engine name: " + config.Engine)
-		log.Errorln(err.Error())
-		os.Exit(1)
+	engineMgr := engine.NewEngineManager(ctx)
+	engine.GlobalStatsProvider = engineMgr
+	for _, c := range config.Interfaces {
+		engineMgr.Start(c.Name, newEngines(c, accounting.GlobalAcct.Ch))
 	}
 
-	for _, e := range engineList {
-		go func(e engine.PktCapEngine) {
-			err = e.StartEngine()
-			if err != nil {
-				log.Errorf("failed to start engine with err: %s", err.Error())
-				os.Exit(1)
-			}
-		}(e)
+	// Aggregator mode accounts the flows posted by the nodes, with the capture statistics they posted
+	if config.ServerEnable {
+		settings, _ := serverSettings()
+		aggregator.GlobalAggregator = aggregator.NewAggregator(ctx, accounting.GlobalAcct, settings)
+		engine.GlobalStatsProvider = aggregator.GlobalAggregator
+
+		ExitWG.Add(1)
+		go func() {
+			defer ExitWG.Done()
+
+			aggregator.GlobalAggregator.Start()
+		}()
 	}
 
-	if config.IsEnableHttpSrv || config.IsProfiling {
+	if config.IsEnableHttpSrv || config.IsProfiling || config.ServerEnable {
 		router := api.InitRouter()
 		srv := &http.Server{
 			Addr:           config.HttpSrvAddr + ":" + config.HttpSrvPort,
 			Handler:        router,
 			ReadTimeout:    300 * time.Second,
-			WriteTimeout:   300 * time.Second,
+			WriteTimeout:   0, // Flow streams are long-lived responses
 			MaxHeaderBytes: 1 << 20,
 		}
 
@@ -196,30 +944,121 @@ func main() {
 		}(ctx)
 	}
 
-	if config.PrintEnable {
+	// Notifiers failing to be created, like by a missing token file, end the start like an invalid config
+	var engineErr error
+	isExit := false
+	notifiers := NewNotifiers(ctx, notify.NewSource(accounting.GlobalAcct, engine.GlobalStatsProvider))
+	err = notifiers.Start()
+	if err != nil {
+		engineErr = err
+		isExit = true
+	}
+
+	tuiExitCh := make(chan struct{})
+	if config.TuiEnable && !isExit {
 		time.Sleep(1 * time.Second)
+		log.SetOutput(io.Discard)
 		ExitWG.Add(1)
 		go func(ctx context.Context) {
 			defer ExitWG.Done()
+			defer close(tuiExitCh)
 
-			notify.PrintNotifier(ctx, config.PrintInterval)
+			err := tui.NewTui(v1.InterfaceDecodeL4).Run(ctx)
+			log.SetOutput(os.Stdout)
+			if err != nil {
+				log.Errorf("terminal ui exit with err: %s", err.Error())
+			}
 		}(ctx)
 	}
 
-	if config.WebHookEnable {
-		time.Sleep(1 * time.Second)
-		ExitWG.Add(1)
-		go func(ctx context.Context) {
-			defer ExitWG.Done()
+	for !isExit {
+		select {
+		case sig := <-signalCh:
+			if sig != syscall.SIGHUP {
+				isExit = true
+				break
+			}
 
-			notify.WebhookNotifier(ctx, config.WebHookInterval, config.WebHookNodeId, config.WebHookNodeOamAddr,
-				config.WebHookUrl, config.WebHookPostTimeout)
-		}(ctx)
+			log.Infoln("reload config on SIGHUP")
+			err = Reload(engineMgr, notifiers)
+			if err != nil {
+				log.Errorf("failed to reload config, keep the current config with err: %s", err.Error())
+			}
+		case result := <-v1.ReloadRequests:
+			log.Infoln("reload config on api request")
+			err = Reload(engineMgr, notifiers)
+			if err != nil {
+				log.Errorf("failed to reload config, keep the current config with err: %s", err.Error())
+			}
+			result <- err
+		case failure := <-engineMgr.ErrCh:
+			// One-shot mode ends as its summary would miss the interface, otherwise the other interfaces keep
+			// running
+			if isOnce() {
+				engineErr = failure
+				isExit = true
+				break
+			}
+
+			log.Errorf("%s, stop the interface", failure.Error())
+			engineMgr.StopFailed(failure)
+			if engineMgr.Len() == 0 {
+				engineErr = errors.New("engines of all interfaces failed")
+				isExit = true
+			}
+		case <-tuiExitCh:
+			isExit = true
+		case <-onceTimerCh:
+			log.Infof("one-shot duration of %d seconds reached", config.OnceDuration)
+			isExit = true
+		case flowCol := <-oncePacketCh:
+			for _, f := range flowCol.L3FlowMap {
+				oncePackets += f.TotalPackets()
+			}
+			if oncePackets >= config.OncePackets {
+				log.Infof("one-shot packets of %d reached", config.OncePackets)
+				isExit = true
+			}
+		case ifaceName := <-engineMgr.DoneCh:
+			if !isOnce() {
+				break
+			}
+
+			onceDoneIfaces[ifaceName] = true
+			if len(onceDoneIfaces) == len(config.Interfaces) {
+				log.Infoln("engines of all interfaces finished")
+				isExit = true
+			}
+		}
 	}
 
-	<-signalCh
+	// Capture statistics are gone once the engines stop
+	var onceStats []engine.EngineStats
+	if isOnce() {
+		onceStats = engineMgr.Stats("")
+	}
+	// Released before the engines flush for the last time, as nothing counts the packets any more
+	if oncePacketCh != nil {
+		accounting.GlobalAcct.Unsubscribe(oncePacketSubId)
+	}
+	engineMgr.StopAll()
 	cancel()
+	notifiers.Stop()
 	ExitWG.Wait()
 
+	// Logged after the terminal ui has given the terminal back
+	if engineErr != nil {
+		log.Errorf("goiftop exit with err: %s", engineErr.Error())
+		os.Exit(1)
+	}
+
+	if isOnce() {
+		err = notify.WriteSummary(config.OnceFile, config.OnceFormat, printOptions(), printGrouping(), onceStats)
+		if err != nil {
+			log.Errorf("failed to write summary with err: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	log.Infoln("goiftop exit")
 }
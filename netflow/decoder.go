@@ -0,0 +1,336 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const recordSizeV5 = 48
+
+// MaxTemplates bounds the templates kept by a decoder, further templates are not kept until others are withdrawn
+// or forgotten
+const MaxTemplates = 16384
+
+// variableLength is the length of IPFIX fields whose length is given in front of each value
+const variableLength = 0xffff
+
+// templateKey identifies a template of an exporter, template ids are only unique within an observation domain
+type templateKey struct {
+	exporter   string
+	version    uint16
+	domainId   uint32
+	templateId uint16
+}
+
+// Decoder decodes NetFlow v5, v9 and IPFIX messages into records. Templates are kept per exporter and
+// observation domain, and the data records of templates not received yet are skipped. Options templates are
+// not kept, so sampling intervals sent as options data are not applied. The times of the flows are not decoded.
+type Decoder struct {
+	templates map[templateKey][]Field
+	mu        sync.Mutex
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{
+		templates: make(map[templateKey][]Field),
+	}
+}
+
+// Decode returns the records of a message from exporter. Octets and packets are scaled up by the sampling
+// interval of the header of NetFlow v5, or by the sampling interval fields of the records.
+func (d *Decoder) Decode(exporter string, data []byte) (records []Record, err error) {
+	if len(data) < 2 {
+		err = errors.New("netflow message of " + strconv.Itoa(len(data)) + " bytes is too short")
+		return
+	}
+
+	version := binary.BigEndian.Uint16(data)
+	switch version {
+	case VersionV5:
+		records, err = decodeV5(data)
+	case VersionV9, VersionIpfix:
+		d.mu.Lock()
+		records, err = d.decodeSets(exporter, version, data)
+		d.mu.Unlock()
+	default:
+		err = errors.New("unsupported netflow version " + strconv.Itoa(int(version)))
+	}
+
+	return
+}
+
+// Forget drops the templates of an exporter, which are sent again by the exporter before its next data records
+// could be decoded
+func (d *Decoder) Forget(exporter string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key := range d.templates {
+		if key.exporter == exporter {
+			delete(d.templates, key)
+		}
+	}
+}
+
+func decodeV5(data []byte) (records []Record, err error) {
+	if len(data) < headerSizeV5 {
+		err = errors.New("netflow v5 header of " + strconv.Itoa(len(data)) + " bytes is too short")
+		return
+	}
+
+	count := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < headerSizeV5+count*recordSizeV5 {
+		err = errors.New("netflow v5 message of " + strconv.Itoa(len(data)) + " bytes is too short for " +
+			strconv.Itoa(count) + " records")
+		return
+	}
+
+	// The upper 2 bits are the sampling mode
+	sampling := uint64(binary.BigEndian.Uint16(data[22:]) & 0x3fff)
+
+	for i := 0; i < count; i++ {
+		b := data[headerSizeV5+i*recordSizeV5:]
+		r := Record{
+			SrcAddr:  copyIP(b[0:4]),
+			DstAddr:  copyIP(b[4:8]),
+			InputIf:  uint32(binary.BigEndian.Uint16(b[12:])),
+			OutputIf: uint32(binary.BigEndian.Uint16(b[14:])),
+			Packets:  uint64(binary.BigEndian.Uint32(b[16:])),
+			Octets:   uint64(binary.BigEndian.Uint32(b[20:])),
+			SrcPort:  binary.BigEndian.Uint16(b[32:]),
+			DstPort:  binary.BigEndian.Uint16(b[34:]),
+			Protocol: b[38],
+		}
+		r.scale(sampling)
+		records = append(records, r)
+	}
+
+	return
+}
+
+// decodeSets decodes the template and data sets of NetFlow v9 and IPFIX messages, which only differ in their
+// headers and set ids
+func (d *Decoder) decodeSets(exporter string, version uint16, data []byte) (records []Record, err error) {
+	var domainId uint32
+	var pos int
+	if version == VersionV9 {
+		if len(data) < headerSizeV9 {
+			err = errors.New("netflow v9 header of " + strconv.Itoa(len(data)) + " bytes is too short")
+			return
+		}
+		domainId = binary.BigEndian.Uint32(data[16:])
+		pos = headerSizeV9
+	} else {
+		if len(data) < headerSizeIpfix {
+			err = errors.New("ipfix header of " + strconv.Itoa(len(data)) + " bytes is too short")
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if length < headerSizeIpfix || length > len(data) {
+			err = errors.New("ipfix message length " + strconv.Itoa(length) + " does not match the " +
+				strconv.Itoa(len(data)) + " bytes received")
+			return
+		}
+		data = data[:length]
+		domainId = binary.BigEndian.Uint32(data[12:])
+		pos = headerSizeIpfix
+	}
+
+	key := templateKey{exporter: exporter, version: version, domainId: domainId}
+	for pos+4 <= len(data) {
+		setId := binary.BigEndian.Uint16(data[pos:])
+		setLength := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if setLength < 4 || pos+setLength > len(data) {
+			err = errors.New("invalid length " + strconv.Itoa(setLength) + " of set " + strconv.Itoa(int(setId)))
+			return
+		}
+		set := data[pos+4 : pos+setLength]
+		pos += setLength
+
+		switch {
+		case setId == TemplateSetIdV9 && version == VersionV9, setId == TemplateSetIdIpfix && version == VersionIpfix:
+			err = d.decodeTemplates(key, set)
+			if err != nil {
+				return
+			}
+		case setId >= TemplateIdV4:
+			key.templateId = setId
+			fields, ok := d.templates[key]
+			if ok {
+				records = append(records, decodeRecords(fields, set)...)
+			}
+		}
+	}
+
+	return
+}
+
+func (d *Decoder) decodeTemplates(key templateKey, set []byte) (err error) {
+	pos := 0
+	for pos+4 <= len(set) {
+		key.templateId = binary.BigEndian.Uint16(set[pos:])
+		count := int(binary.BigEndian.Uint16(set[pos+2:]))
+		pos += 4
+
+		// A template without fields withdraws the template in IPFIX
+		if count == 0 {
+			delete(d.templates, key)
+			continue
+		}
+
+		fields := make([]Field, 0, count)
+		for i := 0; i < count; i++ {
+			if pos+4 > len(set) {
+				err = errors.New("template " + strconv.Itoa(int(key.templateId)) + " is truncated")
+				return
+			}
+
+			f := Field{Id: binary.BigEndian.Uint16(set[pos:]), Length: binary.BigEndian.Uint16(set[pos+2:])}
+			pos += 4
+
+			// Fields of enterprises are skipped by the reserved id 0
+			if key.version == VersionIpfix && f.Id&0x8000 != 0 {
+				if pos+4 > len(set) {
+					err = errors.New("template " + strconv.Itoa(int(key.templateId)) + " is truncated")
+					return
+				}
+				f.Id = 0
+				pos += 4
+			}
+			fields = append(fields, f)
+		}
+
+		if key.templateId < TemplateIdV4 {
+			continue
+		}
+
+		_, ok := d.templates[key]
+		if ok || len(d.templates) < MaxTemplates {
+			d.templates[key] = fields
+		}
+	}
+
+	return
+}
+
+// decodeRecords decodes the records of a data set until the padding, records without addresses are skipped
+func decodeRecords(fields []Field, set []byte) (records []Record) {
+	minSize := 0
+	for _, f := range fields {
+		if f.Length == variableLength {
+			minSize++
+		} else {
+			minSize += int(f.Length)
+		}
+	}
+	if minSize == 0 {
+		return
+	}
+
+	pos := 0
+	for pos+minSize <= len(set) {
+		r, n, ok := decodeRecord(fields, set[pos:])
+		if !ok {
+			return
+		}
+		pos += n
+
+		if r.SrcAddr != nil && r.DstAddr != nil {
+			records = append(records, r)
+		}
+	}
+
+	return
+}
+
+func decodeRecord(fields []Field, data []byte) (r Record, n int, ok bool) {
+	var sampling uint64
+	for _, f := range fields {
+		length := int(f.Length)
+		if f.Length == variableLength {
+			if n+1 > len(data) {
+				return
+			}
+			length = int(data[n])
+			n++
+
+			if length == 255 {
+				if n+2 > len(data) {
+					return
+				}
+				length = int(binary.BigEndian.Uint16(data[n:]))
+				n += 2
+			}
+		}
+
+		if n+length > len(data) {
+			return
+		}
+		v := data[n : n+length]
+		n += length
+
+		switch f.Id {
+		case FieldSourceIPv4Address, FieldSourceIPv6Address:
+			r.SrcAddr = copyIP(v)
+		case FieldDestinationIPv4Address, FieldDestinationIPv6Address:
+			r.DstAddr = copyIP(v)
+		case FieldSourceTransportPort:
+			r.SrcPort = uint16(decodeUint(v))
+		case FieldDestinationTransportPort:
+			r.DstPort = uint16(decodeUint(v))
+		case FieldProtocolIdentifier:
+			r.Protocol = uint8(decodeUint(v))
+		case FieldFlowDirection:
+			r.Direction = uint8(decodeUint(v))
+		case FieldVlanId, FieldDot1qVlanId:
+			if r.Vlan == 0 {
+				r.Vlan = uint16(decodeUint(v)) & 0x0fff
+			}
+		case FieldIngressInterface:
+			r.InputIf = uint32(decodeUint(v))
+		case FieldEgressInterface:
+			r.OutputIf = uint32(decodeUint(v))
+		case FieldOctetDeltaCount:
+			r.Octets = decodeUint(v)
+		case FieldPacketDeltaCount:
+			r.Packets = decodeUint(v)
+		case FieldSamplingInterval, FieldSamplerRandomInterval, FieldSamplingPacketInterval:
+			sampling = decodeUint(v)
+		}
+	}
+
+	r.scale(sampling)
+	ok = true
+
+	return
+}
+
+// scale scales the counters of a record sampled 1 out of sampling packets
+func (r *Record) scale(sampling uint64) {
+	if sampling > 1 {
+		r.Octets *= sampling
+		r.Packets *= sampling
+	}
+}
+
+// decodeUint decodes unsigned integers of reduced size encoding, which drops the leading bytes
+func decodeUint(v []byte) (u uint64) {
+	for _, b := range v {
+		u = u<<8 | uint64(b)
+	}
+
+	return
+}
+
+// copyIP returns the address in v, or nil when it is neither IPv4 nor IPv6
+func copyIP(v []byte) net.IP {
+	if len(v) != net.IPv4len && len(v) != net.IPv6len {
+		return nil
+	}
+
+	return append(net.IP(nil), v...)
+}
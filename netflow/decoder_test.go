@@ -0,0 +1,272 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testRecords = []Record{
+	{
+		SrcAddr:  net.ParseIP("192.0.2.1").To4(),
+		DstAddr:  net.ParseIP("198.51.100.2").To4(),
+		SrcPort:  40000,
+		DstPort:  443,
+		Protocol: 6,
+		Vlan:     100,
+		InputIf:  1,
+		OutputIf: 2,
+		Octets:   15000,
+		Packets:  10,
+	},
+	{
+		SrcAddr:   net.ParseIP("2001:db8::1"),
+		DstAddr:   net.ParseIP("2001:db8::2"),
+		SrcPort:   53,
+		DstPort:   5353,
+		Protocol:  17,
+		Direction: DirectionEgress,
+		InputIf:   3,
+		OutputIf:  4,
+		Octets:    1200,
+		Packets:   3,
+	},
+}
+
+// withoutTimes returns the records without the times, which are not decoded
+func withoutTimes(records []Record) []Record {
+	out := make([]Record, len(records))
+	for i, r := range records {
+		r.Start, r.End = 0, 0
+		out[i] = r
+	}
+
+	return out
+}
+
+func TestEncodeDecode(t *testing.T) {
+	many := make([]Record, 100)
+	for i := range many {
+		many[i] = testRecords[i%len(testRecords)]
+		many[i].SrcPort = uint16(i)
+	}
+
+	tests := []struct {
+		name    string
+		version uint16
+		records []Record
+	}{
+		{"v9", VersionV9, testRecords},
+		{"ipfix", VersionIpfix, testRecords},
+		{"v9 split", VersionV9, many},
+		{"ipfix split", VersionIpfix, many},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := NewEncoder(tt.version, 7, DefaultMaxMessageSize).Encode(tt.records, true, time.Now())
+			if len(msgs) == 0 {
+				t.Fatal("no message encoded")
+			}
+
+			d := NewDecoder()
+			var records []Record
+			for _, msg := range msgs {
+				if len(msg) > DefaultMaxMessageSize {
+					t.Errorf("message of %d bytes exceeds %d bytes", len(msg), DefaultMaxMessageSize)
+				}
+
+				rs, err := d.Decode("192.0.2.254", msg)
+				if err != nil {
+					t.Fatalf("failed to decode message: %s", err.Error())
+				}
+				records = append(records, rs...)
+			}
+
+			// IPv4 records are encoded in front of IPv6 records, so records are compared regardless of order
+			want := withoutTimes(tt.records)
+			if len(records) != len(want) {
+				t.Fatalf("got %d records, want %d", len(records), len(want))
+			}
+			for _, w := range want {
+				found := false
+				for _, r := range records {
+					if reflect.DeepEqual(r, w) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("record %+v not decoded", w)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeWithoutTemplates(t *testing.T) {
+	e := NewEncoder(VersionIpfix, 1, DefaultMaxMessageSize)
+	d := NewDecoder()
+
+	msgs := e.Encode(testRecords, false, time.Now())
+	records, err := d.Decode("192.0.2.254", msgs[0])
+	if err != nil {
+		t.Fatalf("failed to decode message: %s", err.Error())
+	}
+	if len(records) != 0 {
+		t.Errorf("got %d records of templates not received", len(records))
+	}
+
+	_, _ = d.Decode("192.0.2.254", e.Encode(testRecords, true, time.Now())[0])
+	records, _ = d.Decode("192.0.2.254", e.Encode(testRecords, false, time.Now())[0])
+	if len(records) != len(testRecords) {
+		t.Errorf("got %d records, want %d", len(records), len(testRecords))
+	}
+
+	// Templates are kept per exporter and observation domain
+	records, _ = d.Decode("192.0.2.253", e.Encode(testRecords, false, time.Now())[0])
+	if len(records) != 0 {
+		t.Errorf("got %d records of another exporter", len(records))
+	}
+	records, _ = d.Decode("192.0.2.254", NewEncoder(VersionIpfix, 2, DefaultMaxMessageSize).Encode(testRecords,
+		false, time.Now())[0])
+	if len(records) != 0 {
+		t.Errorf("got %d records of another observation domain", len(records))
+	}
+
+	d.Forget("192.0.2.254")
+	records, _ = d.Decode("192.0.2.254", e.Encode(testRecords, false, time.Now())[0])
+	if len(records) != 0 {
+		t.Errorf("got %d records of forgotten templates", len(records))
+	}
+}
+
+func TestDecodeTemplateWithdrawal(t *testing.T) {
+	e := NewEncoder(VersionIpfix, 1, DefaultMaxMessageSize)
+	d := NewDecoder()
+	_, _ = d.Decode("192.0.2.254", e.Encode(testRecords, true, time.Now())[0])
+
+	withdrawal := ipfixMessage(1, ipfixSet(TemplateSetIdIpfix, []byte{1, 0, 0, 0}))
+	_, err := d.Decode("192.0.2.254", withdrawal)
+	if err != nil {
+		t.Fatalf("failed to decode withdrawal: %s", err.Error())
+	}
+
+	records, _ := d.Decode("192.0.2.254", e.Encode(testRecords, false, time.Now())[0])
+	if len(records) != 1 || records[0].IsIPv4() {
+		t.Errorf("got %d records, want the IPv6 record of the template not withdrawn", len(records))
+	}
+}
+
+func TestDecodeMaxTemplates(t *testing.T) {
+	d := NewDecoder()
+	template := []byte{1, 0, 0, 1, 0, FieldSourceIPv4Address, 0, 4}
+	for i := 0; i < MaxTemplates+10; i++ {
+		_, err := d.Decode(strconv.Itoa(i), ipfixMessage(1, ipfixSet(TemplateSetIdIpfix, template)))
+		if err != nil {
+			t.Fatalf("failed to decode template: %s", err.Error())
+		}
+	}
+
+	if len(d.templates) != MaxTemplates {
+		t.Errorf("got %d templates, want %d", len(d.templates), MaxTemplates)
+	}
+}
+
+func TestDecodeV5(t *testing.T) {
+	msg := make([]byte, headerSizeV5+recordSizeV5)
+	binary.BigEndian.PutUint16(msg[0:], VersionV5)
+	binary.BigEndian.PutUint16(msg[2:], 1)
+	binary.BigEndian.PutUint16(msg[22:], 1<<14|10)
+
+	b := msg[headerSizeV5:]
+	copy(b[0:], net.ParseIP("192.0.2.1").To4())
+	copy(b[4:], net.ParseIP("198.51.100.2").To4())
+	binary.BigEndian.PutUint16(b[12:], 1)
+	binary.BigEndian.PutUint16(b[14:], 2)
+	binary.BigEndian.PutUint32(b[16:], 3)
+	binary.BigEndian.PutUint32(b[20:], 300)
+	binary.BigEndian.PutUint16(b[32:], 1234)
+	binary.BigEndian.PutUint16(b[34:], 80)
+	b[38] = 6
+
+	records, err := NewDecoder().Decode("192.0.2.254", msg)
+	if err != nil {
+		t.Fatalf("failed to decode message: %s", err.Error())
+	}
+
+	want := []Record{{
+		SrcAddr:  net.ParseIP("192.0.2.1").To4(),
+		DstAddr:  net.ParseIP("198.51.100.2").To4(),
+		SrcPort:  1234,
+		DstPort:  80,
+		Protocol: 6,
+		InputIf:  1,
+		OutputIf: 2,
+		Octets:   3000,
+		Packets:  30,
+	}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %+v, want %+v", records, want)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	v9 := NewEncoder(VersionV9, 1, DefaultMaxMessageSize).Encode(testRecords, true, time.Now())[0]
+	ipfix := NewEncoder(VersionIpfix, 1, DefaultMaxMessageSize).Encode(testRecords, true, time.Now())[0]
+
+	v5 := make([]byte, headerSizeV5+recordSizeV5)
+	binary.BigEndian.PutUint16(v5[0:], VersionV5)
+	binary.BigEndian.PutUint16(v5[2:], 2)
+
+	badSet := append([]byte(nil), ipfix...)
+	binary.BigEndian.PutUint16(badSet[headerSizeIpfix+2:], 2)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte{0}},
+		{"unknown version", []byte{0, 4, 0, 0}},
+		{"garbage", []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef}},
+		{"v5 header truncated", v5[:headerSizeV5-1]},
+		{"v5 records truncated", v5},
+		{"v9 header truncated", v9[:headerSizeV9-1]},
+		{"v9 set truncated", v9[:len(v9)-1]},
+		{"ipfix header truncated", ipfix[:headerSizeIpfix-1]},
+		{"ipfix message truncated", ipfix[:len(ipfix)-1]},
+		{"ipfix invalid set length", badSet},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDecoder().Decode("192.0.2.254", tt.data)
+			if err == nil {
+				t.Error("invalid message decoded without error")
+			}
+		})
+	}
+}
+
+func ipfixSet(setId uint16, body []byte) []byte {
+	set := appendUint16(nil, setId)
+	set = appendUint16(set, uint16(4+len(body)))
+
+	return append(set, body...)
+}
+
+func ipfixMessage(domainId uint32, sets ...[]byte) []byte {
+	msg := make([]byte, headerSizeIpfix)
+	binary.BigEndian.PutUint16(msg[0:], VersionIpfix)
+	binary.BigEndian.PutUint32(msg[12:], domainId)
+	for _, set := range sets {
+		msg = append(msg, set...)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+
+	return msg
+}
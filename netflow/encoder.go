@@ -0,0 +1,211 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// Encoder encodes records into NetFlow v9 or IPFIX messages of one observation domain. The sequence number
+// continues over the messages encoded, it counts the messages for NetFlow v9 and the data records for IPFIX.
+type Encoder struct {
+	version  uint16
+	domainId uint32
+	maxSize  int
+	sequence uint32
+}
+
+func NewEncoder(version uint16, domainId uint32, maxSize int) *Encoder {
+	return &Encoder{
+		version:  version,
+		domainId: domainId,
+		maxSize:  maxSize,
+	}
+}
+
+// message is a message being encoded, with the set open for records
+type message struct {
+	buf     []byte
+	setId   uint16
+	setPos  int
+	records int
+	flows   int
+}
+
+// Encode returns the messages carrying records, sorted by template, with the templates in front of the first
+// message when withTemplates. Messages are split to stay within the max size.
+func (e *Encoder) Encode(records []Record, withTemplates bool, now time.Time) (msgs [][]byte) {
+	sorted := make([]Record, len(records))
+	copy(sorted, records)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].IsIPv4() && !sorted[j].IsIPv4()
+	})
+
+	m := e.newMessage()
+	if withTemplates {
+		e.appendTemplates(m)
+	}
+
+	for i := range sorted {
+		r := &sorted[i]
+		isIPv4 := r.IsIPv4()
+		setId := uint16(TemplateIdV6)
+		if isIPv4 {
+			setId = TemplateIdV4
+		}
+
+		size := recordSize(Template(e.version, isIPv4))
+		if m.setId != setId {
+			size += 4
+		}
+
+		if len(m.buf)+size > e.maxSize && m.records > 0 {
+			msgs = append(msgs, e.finish(m, now))
+			m = e.newMessage()
+		}
+
+		if m.setId != setId {
+			m.openSet(setId)
+		}
+		e.appendRecord(m, r, isIPv4)
+	}
+
+	if m.records > 0 {
+		msgs = append(msgs, e.finish(m, now))
+	}
+
+	return
+}
+
+func (e *Encoder) newMessage() *message {
+	headerSize := headerSizeIpfix
+	if e.version == VersionV9 {
+		headerSize = headerSizeV9
+	}
+
+	return &message{buf: make([]byte, headerSize, e.maxSize)}
+}
+
+func (m *message) openSet(setId uint16) {
+	m.closeSet()
+	m.setId = setId
+	m.setPos = len(m.buf)
+	m.buf = append(m.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(m.buf[m.setPos:], setId)
+}
+
+// closeSet pads the open set to 32 bits and writes its length
+func (m *message) closeSet() {
+	if m.setPos == 0 {
+		return
+	}
+
+	for len(m.buf)%4 != 0 {
+		m.buf = append(m.buf, 0)
+	}
+	binary.BigEndian.PutUint16(m.buf[m.setPos+2:], uint16(len(m.buf)-m.setPos))
+	m.setPos = 0
+	m.setId = 0
+}
+
+func (e *Encoder) appendTemplates(m *message) {
+	setId := uint16(TemplateSetIdIpfix)
+	if e.version == VersionV9 {
+		setId = TemplateSetIdV9
+	}
+	m.openSet(setId)
+
+	for _, isIPv4 := range []bool{true, false} {
+		templateId := uint16(TemplateIdV6)
+		if isIPv4 {
+			templateId = TemplateIdV4
+		}
+
+		fields := Template(e.version, isIPv4)
+		m.buf = appendUint16(m.buf, templateId)
+		m.buf = appendUint16(m.buf, uint16(len(fields)))
+		for _, f := range fields {
+			m.buf = appendUint16(m.buf, f.Id)
+			m.buf = appendUint16(m.buf, f.Length)
+		}
+		m.records++
+	}
+
+	m.closeSet()
+}
+
+func (e *Encoder) appendRecord(m *message, r *Record, isIPv4 bool) {
+	if isIPv4 {
+		m.buf = append(m.buf, r.SrcAddr.To4()...)
+		m.buf = append(m.buf, r.DstAddr.To4()...)
+	} else {
+		m.buf = append(m.buf, r.SrcAddr.To16()...)
+		m.buf = append(m.buf, r.DstAddr.To16()...)
+	}
+
+	m.buf = appendUint16(m.buf, r.SrcPort)
+	m.buf = appendUint16(m.buf, r.DstPort)
+	m.buf = append(m.buf, r.Protocol, r.Direction)
+	m.buf = appendUint16(m.buf, r.Vlan)
+	m.buf = appendUint32(m.buf, r.InputIf)
+	m.buf = appendUint32(m.buf, r.OutputIf)
+	m.buf = appendUint64(m.buf, r.Octets)
+	m.buf = appendUint64(m.buf, r.Packets)
+
+	if e.version == VersionV9 {
+		m.buf = appendUint32(m.buf, uptime(time.Unix(r.Start, 0)))
+		m.buf = appendUint32(m.buf, uptime(time.Unix(r.End, 0)))
+	} else {
+		m.buf = appendUint32(m.buf, uint32(r.Start))
+		m.buf = appendUint32(m.buf, uint32(r.End))
+	}
+
+	m.records++
+	m.flows++
+}
+
+// finish closes the open set and writes the header, which advances the sequence number
+func (e *Encoder) finish(m *message, now time.Time) []byte {
+	m.closeSet()
+
+	h := m.buf
+	binary.BigEndian.PutUint16(h[0:], e.version)
+	if e.version == VersionV9 {
+		binary.BigEndian.PutUint16(h[2:], uint16(m.records))
+		binary.BigEndian.PutUint32(h[4:], uptime(now))
+		binary.BigEndian.PutUint32(h[8:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(h[12:], e.sequence)
+		binary.BigEndian.PutUint32(h[16:], e.domainId)
+		e.sequence++
+	} else {
+		binary.BigEndian.PutUint16(h[2:], uint16(len(m.buf)))
+		binary.BigEndian.PutUint32(h[4:], uint32(now.Unix()))
+		binary.BigEndian.PutUint32(h[8:], e.sequence)
+		binary.BigEndian.PutUint32(h[12:], e.domainId)
+		e.sequence += uint32(m.flows)
+	}
+
+	return m.buf
+}
+
+// uptime returns the milliseconds since the exporter started at t, times before its start are 0
+func uptime(t time.Time) uint32 {
+	d := t.Sub(bootTime)
+	if d < 0 {
+		return 0
+	}
+
+	return uint32(d.Milliseconds())
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
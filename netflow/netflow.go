@@ -0,0 +1,150 @@
+package netflow
+
+import (
+	"net"
+	"time"
+)
+
+const VersionV5 = 5
+const VersionV9 = 9
+const VersionIpfix = 10
+
+// Information elements of the templates, the ids are the same in NetFlow v9 and IPFIX
+const (
+	FieldOctetDeltaCount          = 1
+	FieldPacketDeltaCount         = 2
+	FieldProtocolIdentifier       = 4
+	FieldSourceTransportPort      = 7
+	FieldSourceIPv4Address        = 8
+	FieldIngressInterface         = 10
+	FieldDestinationTransportPort = 11
+	FieldDestinationIPv4Address   = 12
+	FieldEgressInterface          = 14
+	FieldLastSwitched             = 21
+	FieldFirstSwitched            = 22
+	FieldSourceIPv6Address        = 27
+	FieldDestinationIPv6Address   = 28
+	FieldSamplingInterval         = 34
+	FieldSamplerRandomInterval    = 50
+	FieldVlanId                   = 58
+	FieldFlowDirection            = 61
+	FieldFlowStartSeconds         = 150
+	FieldFlowEndSeconds           = 151
+	FieldDot1qVlanId              = 243
+	FieldSamplingPacketInterval   = 305
+)
+
+// Template ids of the data records, lower ids are reserved for the sets of templates and options
+const TemplateIdV4 = 256
+const TemplateIdV6 = 257
+
+// Set ids of the template sets
+const TemplateSetIdV9 = 0
+const TemplateSetIdIpfix = 2
+const OptionsTemplateSetIdV9 = 1
+const OptionsTemplateSetIdIpfix = 3
+
+const DirectionIngress = 0
+const DirectionEgress = 1
+
+// DefaultMaxMessageSize keeps the messages within the MTU of ethernet with room for tunnels
+const DefaultMaxMessageSize = 1400
+
+const headerSizeV5 = 24
+const headerSizeV9 = 20
+const headerSizeIpfix = 16
+
+// bootTime is the start of the exporter, NetFlow v9 times are milliseconds of its uptime
+var bootTime = time.Now()
+
+var protocolNumbers = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+// ProtocolNumber returns the IP protocol number of a transport layer protocol of the flows
+func ProtocolNumber(name string) (number uint8, ok bool) {
+	number, ok = protocolNumbers[name]
+
+	return
+}
+
+// ProtocolName returns the transport layer protocol of the flows with an IP protocol number
+func ProtocolName(number uint8) (name string, ok bool) {
+	for n, num := range protocolNumbers {
+		if num == number {
+			return n, true
+		}
+	}
+
+	return
+}
+
+// Field is an information element of a template with its length in bytes
+type Field struct {
+	Id     uint16
+	Length uint16
+}
+
+// Record is a unidirectional flow, Start and End are the unix seconds of its first and last packets. InputIf
+// and OutputIf are the indexes of the ingress and egress interfaces, 0 when unknown.
+type Record struct {
+	SrcAddr   net.IP
+	DstAddr   net.IP
+	SrcPort   uint16
+	DstPort   uint16
+	Protocol  uint8
+	Direction uint8
+	Vlan      uint16
+	InputIf   uint32
+	OutputIf  uint32
+	Octets    uint64
+	Packets   uint64
+	Start     int64
+	End       int64
+}
+
+// IsIPv4 tells whether the record is exported by the template of IPv4 flows
+func (r *Record) IsIPv4() bool {
+	return r.SrcAddr.To4() != nil && r.DstAddr.To4() != nil
+}
+
+// Template returns the fields of the IPv4 or IPv6 template of a version, NetFlow v9 has the times as uptime
+// of the exporter and IPFIX as unix seconds
+func Template(version uint16, isIPv4 bool) (fields []Field) {
+	if isIPv4 {
+		fields = append(fields, Field{FieldSourceIPv4Address, 4}, Field{FieldDestinationIPv4Address, 4})
+	} else {
+		fields = append(fields, Field{FieldSourceIPv6Address, 16}, Field{FieldDestinationIPv6Address, 16})
+	}
+
+	fields = append(fields,
+		Field{FieldSourceTransportPort, 2},
+		Field{FieldDestinationTransportPort, 2},
+		Field{FieldProtocolIdentifier, 1},
+		Field{FieldFlowDirection, 1},
+		Field{FieldVlanId, 2},
+		Field{FieldIngressInterface, 4},
+		Field{FieldEgressInterface, 4},
+		Field{FieldOctetDeltaCount, 8},
+		Field{FieldPacketDeltaCount, 8},
+	)
+
+	if version == VersionV9 {
+		fields = append(fields, Field{FieldFirstSwitched, 4}, Field{FieldLastSwitched, 4})
+	} else {
+		fields = append(fields, Field{FieldFlowStartSeconds, 4}, Field{FieldFlowEndSeconds, 4})
+	}
+
+	return
+}
+
+func recordSize(fields []Field) (size int) {
+	for _, f := range fields {
+		size += int(f.Length)
+	}
+
+	return
+}
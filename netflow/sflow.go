@@ -0,0 +1,202 @@
+package netflow
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const SflowVersion5 = 5
+
+// Protocols of the packet headers sampled by sFlow
+const (
+	SflowHeaderEthernet = 1
+	SflowHeaderIPv4     = 11
+	SflowHeaderIPv6     = 12
+)
+
+// Formats of the sFlow samples and flow records of the standard enterprise
+const (
+	sflowFlowSample         = 1
+	sflowExpandedFlowSample = 3
+	sflowRawPacketHeader    = 1
+)
+
+const (
+	sflowAddressIPv4 = 1
+	sflowAddressIPv6 = 2
+)
+
+// SflowSample is a packet header sampled by an sFlow agent, it stands for SamplingRate packets. InputIf and
+// OutputIf are the indexes of the interfaces the packet was received and sent on, 0 when unknown.
+type SflowSample struct {
+	SamplingRate   uint32
+	InputIf        uint32
+	OutputIf       uint32
+	HeaderProtocol uint32
+	FrameLength    uint32
+	Header         []byte
+}
+
+// IsSflow tells whether a datagram is sFlow, whose version takes 32 bits where NetFlow and IPFIX have a 16 bits
+// version
+func IsSflow(data []byte) bool {
+	return len(data) >= 2 && binary.BigEndian.Uint16(data) == 0
+}
+
+// xdrReader reads the big endian fields of sFlow, the first field out of bounds sets err
+type xdrReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *xdrReader) uint32() (v uint32) {
+	if r.err != nil {
+		return
+	}
+
+	if r.pos+4 > len(r.data) {
+		r.err = errors.New("sflow datagram is truncated at byte " + strconv.Itoa(r.pos))
+		return
+	}
+	v = binary.BigEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+
+	return
+}
+
+// bytes returns n bytes, and skips the padding up to 32 bits
+func (r *xdrReader) bytes(n int) (v []byte) {
+	if r.err != nil {
+		return
+	}
+
+	padded := (n + 3) &^ 3
+	if n < 0 || r.pos+padded > len(r.data) {
+		r.err = errors.New("sflow datagram is truncated at byte " + strconv.Itoa(r.pos))
+		return
+	}
+	v = r.data[r.pos : r.pos+n]
+	r.pos += padded
+
+	return
+}
+
+// DecodeSflow returns the packet headers sampled in an sFlow v5 datagram, counter samples and other flow
+// records are skipped. The headers refer to data.
+func DecodeSflow(data []byte) (samples []SflowSample, err error) {
+	r := &xdrReader{data: data}
+	version := r.uint32()
+	if r.err == nil && version != SflowVersion5 {
+		err = errors.New("unsupported sflow version " + strconv.FormatUint(uint64(version), 10))
+		return
+	}
+
+	switch r.uint32() {
+	case sflowAddressIPv4:
+		r.bytes(4)
+	case sflowAddressIPv6:
+		r.bytes(16)
+	default:
+		if r.err == nil {
+			err = errors.New("invalid sflow agent address type")
+			return
+		}
+	}
+
+	// Sub agent id, sequence number and uptime
+	r.bytes(12)
+
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		format := r.uint32()
+		body := r.bytes(int(r.uint32()))
+		if r.err != nil {
+			break
+		}
+
+		switch format {
+		case sflowFlowSample, sflowExpandedFlowSample:
+			var flowSamples []SflowSample
+			flowSamples, err = decodeFlowSample(format, body)
+			if err != nil {
+				return
+			}
+			samples = append(samples, flowSamples...)
+		}
+	}
+
+	err = r.err
+
+	return
+}
+
+func decodeFlowSample(format uint32, body []byte) (samples []SflowSample, err error) {
+	r := &xdrReader{data: body}
+	var sample SflowSample
+
+	// Sequence number and source id, which takes two fields in expanded samples
+	r.bytes(8)
+	if format == sflowExpandedFlowSample {
+		r.bytes(4)
+	}
+
+	sample.SamplingRate = r.uint32()
+
+	// Sample pool and drops
+	r.bytes(8)
+
+	if format == sflowExpandedFlowSample {
+		sample.InputIf = expandedIfIndex(r.uint32(), r.uint32())
+		sample.OutputIf = expandedIfIndex(r.uint32(), r.uint32())
+	} else {
+		sample.InputIf = compactIfIndex(r.uint32())
+		sample.OutputIf = compactIfIndex(r.uint32())
+	}
+
+	count := r.uint32()
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		recordFormat := r.uint32()
+		record := r.bytes(int(r.uint32()))
+		if r.err != nil || recordFormat != sflowRawPacketHeader {
+			continue
+		}
+
+		rr := &xdrReader{data: record}
+		sample.HeaderProtocol = rr.uint32()
+		sample.FrameLength = rr.uint32()
+
+		// Bytes stripped from the frame
+		rr.uint32()
+
+		sample.Header = rr.bytes(int(rr.uint32()))
+		if rr.err != nil {
+			err = rr.err
+			return
+		}
+		samples = append(samples, sample)
+	}
+
+	err = r.err
+
+	return
+}
+
+// compactIfIndex returns the interface index of a compact flow sample, the upper 2 bits are the format and only
+// format 0 is a single interface
+func compactIfIndex(v uint32) uint32 {
+	if v>>30 != 0 {
+		return 0
+	}
+
+	return v
+}
+
+func expandedIfIndex(format uint32, v uint32) uint32 {
+	if format != 0 {
+		return 0
+	}
+
+	return v
+}
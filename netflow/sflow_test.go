@@ -0,0 +1,155 @@
+package netflow
+
+import (
+	"reflect"
+	"testing"
+)
+
+// sflowDatagram builds an sFlow v5 datagram of an IPv4 agent with samples
+func sflowDatagram(samples ...[]byte) []byte {
+	b := appendUint32(nil, SflowVersion5)
+	b = appendUint32(b, sflowAddressIPv4)
+	b = append(b, 192, 0, 2, 254)
+	b = append(b, make([]byte, 12)...)
+	b = appendUint32(b, uint32(len(samples)))
+	for _, s := range samples {
+		b = append(b, s...)
+	}
+
+	return b
+}
+
+// sflowFlowSampleOf builds a compact or expanded flow sample of a raw packet header
+func sflowFlowSampleOf(format uint32, rate uint32, inputIf uint32, outputIf uint32, header []byte) []byte {
+	body := make([]byte, 8)
+	if format == sflowExpandedFlowSample {
+		body = append(body, make([]byte, 4)...)
+	}
+	body = appendUint32(body, rate)
+	body = append(body, make([]byte, 8)...)
+	if format == sflowExpandedFlowSample {
+		body = appendUint32(appendUint32(body, 0), inputIf)
+		body = appendUint32(appendUint32(body, 0), outputIf)
+	} else {
+		body = appendUint32(body, inputIf)
+		body = appendUint32(body, outputIf)
+	}
+
+	record := appendUint32(nil, SflowHeaderIPv4)
+	record = appendUint32(record, 1500)
+	record = appendUint32(record, 4)
+	record = appendUint32(record, uint32(len(header)))
+	record = append(record, header...)
+	for len(record)%4 != 0 {
+		record = append(record, 0)
+	}
+
+	body = appendUint32(body, 1)
+	body = appendUint32(body, sflowRawPacketHeader)
+	body = appendUint32(body, uint32(len(record)))
+	body = append(body, record...)
+
+	sample := appendUint32(nil, format)
+	sample = appendUint32(sample, uint32(len(body)))
+
+	return append(sample, body...)
+}
+
+func TestDecodeSflow(t *testing.T) {
+	header := []byte{0x45, 0, 0, 20, 1, 2, 3}
+	counterSample := append(appendUint32(appendUint32(nil, 2), 4), 0, 0, 0, 0)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		want  []SflowSample
+		isErr bool
+	}{
+		{
+			name: "flow sample",
+			data: sflowDatagram(sflowFlowSampleOf(sflowFlowSample, 100, 1, 2, header)),
+			want: []SflowSample{{SamplingRate: 100, InputIf: 1, OutputIf: 2, HeaderProtocol: SflowHeaderIPv4,
+				FrameLength: 1500, Header: header}},
+		},
+		{
+			name: "expanded flow sample",
+			data: sflowDatagram(sflowFlowSampleOf(sflowExpandedFlowSample, 10, 70000, 3, header)),
+			want: []SflowSample{{SamplingRate: 10, InputIf: 70000, OutputIf: 3, HeaderProtocol: SflowHeaderIPv4,
+				FrameLength: 1500, Header: header}},
+		},
+		{
+			name: "interfaces of other formats",
+			data: sflowDatagram(sflowFlowSampleOf(sflowFlowSample, 1, 1<<30|5, 0x80000000, header)),
+			want: []SflowSample{{SamplingRate: 1, HeaderProtocol: SflowHeaderIPv4, FrameLength: 1500,
+				Header: header}},
+		},
+		{
+			name: "counter sample skipped",
+			data: sflowDatagram(counterSample, sflowFlowSampleOf(sflowFlowSample, 100, 1, 2, header)),
+			want: []SflowSample{{SamplingRate: 100, InputIf: 1, OutputIf: 2, HeaderProtocol: SflowHeaderIPv4,
+				FrameLength: 1500, Header: header}},
+		},
+		{
+			name:  "unsupported version",
+			data:  append(appendUint32(nil, 4), make([]byte, 24)...),
+			isErr: true,
+		},
+		{
+			name:  "invalid agent address type",
+			data:  append(appendUint32(appendUint32(nil, SflowVersion5), 3), make([]byte, 20)...),
+			isErr: true,
+		},
+		{
+			name:  "truncated header",
+			data:  sflowDatagram()[:10],
+			isErr: true,
+		},
+		{
+			name:  "truncated sample",
+			data:  sflowDatagram(sflowFlowSampleOf(sflowFlowSample, 100, 1, 2, header))[:60],
+			isErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !IsSflow(tt.data) {
+				t.Fatal("datagram is not taken as sflow")
+			}
+
+			samples, err := DecodeSflow(tt.data)
+			if tt.isErr {
+				if err == nil {
+					t.Error("invalid datagram decoded without error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("failed to decode datagram: %s", err.Error())
+			}
+			if !reflect.DeepEqual(samples, tt.want) {
+				t.Errorf("got %+v, want %+v", samples, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSflow(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want bool
+	}{
+		{nil, false},
+		{[]byte{0}, false},
+		{[]byte{0, 0, 0, 5}, true},
+		{[]byte{0, 5}, false},
+		{[]byte{0, 10, 0, 16}, false},
+	}
+
+	for _, tt := range tests {
+		if got := IsSflow(tt.data); got != tt.want {
+			t.Errorf("IsSflow(%v) = %t, want %t", tt.data, got, tt.want)
+		}
+	}
+}
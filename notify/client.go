@@ -0,0 +1,186 @@
+package notify
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const TimestampHeader = "X-Goiftop-Timestamp"
+const SignatureHeader = "X-Goiftop-Signature"
+const SignaturePrefix = "sha256="
+
+// WebhookClient posts json payloads to a webhook. With a token the request carries it as bearer token, and
+// with a hmac secret it carries the unix time in TimestampHeader and the HMAC-SHA256 of the time, a dot and
+// the body as sent in SignatureHeader, so the receiver could reject forged and replayed requests.
+type WebhookClient struct {
+	Url        string
+	Client     *http.Client
+	Token      string
+	HmacSecret []byte
+	IsGzip     bool
+}
+
+// StatusError is returned by a post the webhook answered with a status other than 2xx
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return "response code is not 2xx but " + strconv.Itoa(e.StatusCode)
+}
+
+// isRejected tells whether the webhook refused the payload itself by a 4xx status, so posting it again fails
+// the same way. Timeouts and rate limits are taken as failures of the moment.
+func isRejected(err error) bool {
+	var se *StatusError
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	return se.StatusCode/100 == 4 && se.StatusCode != http.StatusRequestTimeout &&
+		se.StatusCode != http.StatusTooManyRequests
+}
+
+// TLSOptions are the files of the CA bundle verifying the webhook server, default the system roots, and of
+// the client certificate and key for mutual TLS
+type TLSOptions struct {
+	CaFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// NewHttpClient returns a http client with timeout seconds and the TLS settings of opts
+func NewHttpClient(timeout int, opts TLSOptions) (client *http.Client, err error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if opts.CaFile != "" {
+		var pem []byte
+		pem, err = os.ReadFile(opts.CaFile)
+		if err != nil {
+			return
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			err = errors.New("no certificate found in ca file " + opts.CaFile)
+			return
+		}
+	}
+
+	if (opts.CertFile == "") != (opts.KeyFile == "") {
+		err = errors.New("client certificate and key should be given together")
+		return
+	}
+
+	if opts.CertFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(timeout) * time.Second,
+	}
+
+	return
+}
+
+// ReadSecret returns the secret given, or read from file with surrounding whitespace trimmed, only one of them
+// should be given
+func ReadSecret(secret string, file string) (string, error) {
+	if file == "" {
+		return secret, nil
+	}
+
+	if secret != "" {
+		return "", errors.New("secret and secret file should not be given together")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Sign returns the signature of body sent at timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return SignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post posts a json payload, responses other than 2xx are returned as error
+func (c *WebhookClient) Post(payload []byte) (err error) {
+	body := payload
+	if c.IsGzip {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		_, err = zw.Write(payload)
+		if err != nil {
+			return
+		}
+
+		err = zw.Close()
+		if err != nil {
+			return
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest("POST", c.Url, bytes.NewBuffer(body))
+	if err != nil {
+		return
+	}
+
+	req.Close = false
+	req.Header.Set("Content-Type", "application/json")
+	if c.IsGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if len(c.HmacSecret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(c.HmacSecret, timestamp, body))
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode/100 != 2 {
+		err = &StatusError{StatusCode: resp.StatusCode}
+		return
+	}
+
+	return
+}
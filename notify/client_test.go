@@ -0,0 +1,181 @@
+package notify
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"reference", "secret", "1700000000", "{}",
+			"sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sign([]byte(tt.secret), tt.timestamp, []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	// Any change of the secret, timestamp or body changes the signature
+	s := Sign([]byte("secret"), "1700000000", []byte("{}"))
+	for _, other := range []string{
+		Sign([]byte("secret2"), "1700000000", []byte("{}")),
+		Sign([]byte("secret"), "1700000001", []byte("{}")),
+		Sign([]byte("secret"), "1700000000", []byte("{ }")),
+	} {
+		if other == s {
+			t.Errorf("signature %s does not change", s)
+		}
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "secret")
+	err := os.WriteFile(file, []byte("  from-file\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		file   string
+		want   string
+		isErr  bool
+	}{
+		{"none", "", "", "", false},
+		{"secret", "inline", "", "inline", false},
+		{"file trimmed", "", file, "from-file", false},
+		{"both", "inline", file, "", true},
+		{"missing file", "", file + ".missing", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadSecret(tt.secret, tt.file)
+			if tt.isErr {
+				if err == nil {
+					t.Error("no error returned")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookClientPost(t *testing.T) {
+	payload := []byte(`{"Interfaces":[]}`)
+
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		isGzip bool
+	}{
+		{"plain", "", "", false},
+		{"token", "t0ken", "", false},
+		{"signed", "", "s3cret", false},
+		{"signed gzip", "t0ken", "s3cret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header http.Header
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer srv.Close()
+
+			client, err := NewHttpClient(2, TLSOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := &WebhookClient{Url: srv.URL, Client: client, Token: tt.token, HmacSecret: []byte(tt.secret),
+				IsGzip: tt.isGzip}
+			err = c.Post(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantAuth := ""
+			if tt.token != "" {
+				wantAuth = "Bearer " + tt.token
+			}
+			if got := header.Get("Authorization"); got != wantAuth {
+				t.Errorf("got authorization %q, want %q", got, wantAuth)
+			}
+
+			// The signature covers the body as sent
+			timestamp := header.Get(TimestampHeader)
+			signature := header.Get(SignatureHeader)
+			if tt.secret == "" {
+				if timestamp != "" || signature != "" {
+					t.Error("unsigned post carries a signature")
+				}
+			} else if signature != Sign([]byte(tt.secret), timestamp, body) {
+				t.Errorf("invalid signature %s", signature)
+			}
+
+			if tt.isGzip {
+				if header.Get("Content-Encoding") != "gzip" {
+					t.Error("gzip post without content encoding")
+				}
+
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err = io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(body, payload) {
+				t.Errorf("got body %s, want %s", body, payload)
+			}
+		})
+	}
+}
+
+func TestWebhookClientPostStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	client, err := NewHttpClient(2, TLSOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = (&WebhookClient{Url: srv.URL, Client: client}).Post([]byte("{}"))
+	if err == nil {
+		t.Error("post rejected by the webhook returned no error")
+	}
+}
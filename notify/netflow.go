@@ -0,0 +1,315 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/netflow"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const NetflowNotifierType = "netflow"
+
+func init() {
+	Register(NetflowNotifierType, newNetflowNotifier, checkNetflowOptions)
+}
+
+const NetflowVersionIpfix = "ipfix"
+const NetflowVersionV9 = "v9"
+
+const DefaultNetflowActiveTimeout = 60
+const DefaultNetflowInactiveTimeout = 15
+const DefaultNetflowTemplateRefresh = 60
+
+// netflowKey identifies a unidirectional flow in the cache, the inbound and outbound bytes of a flow are
+// exported as flows of their own with the ingress or egress direction
+type netflowKey struct {
+	Interface string
+	accounting.FlowFingerprint
+	Direction uint8
+}
+
+type netflowEntry struct {
+	record    netflow.Record
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// netflowNotifier exports the transport layer flows as NetFlow v9 or IPFIX records over udp to a collector.
+// Flows are added up in a cache from every per-second sample, and exported once no packets were seen for the
+// inactive timeout or the flow is cached for the active timeout, like the flow cache of a router. Templates
+// are sent with the first records and again every template refresh.
+type netflowNotifier struct {
+	name            string
+	collector       string
+	conn            net.Conn
+	encoder         *netflow.Encoder
+	activeTimeout   time.Duration
+	inactiveTimeout time.Duration
+	templateRefresh time.Duration
+	lastTemplates   time.Time
+	cache           map[netflowKey]*netflowEntry
+	ifIndexes       map[string]uint32
+}
+
+func newNetflowNotifier(name string, options Options) (n Notifier, err error) {
+	err = options.Check("collector", "version", "active_timeout", "inactive_timeout", "template_refresh",
+		"domain_id")
+	if err != nil {
+		return
+	}
+
+	nf := &netflowNotifier{
+		name:      name,
+		cache:     make(map[netflowKey]*netflowEntry),
+		ifIndexes: make(map[string]uint32),
+	}
+
+	nf.collector, err = options.String("collector", "")
+	if err != nil {
+		return
+	}
+
+	if nf.collector == "" {
+		err = errors.New("no netflow collector provided")
+		return
+	}
+
+	_, _, err = net.SplitHostPort(nf.collector)
+	if err != nil {
+		err = errors.New("invalid netflow collector " + nf.collector + ": " + err.Error())
+		return
+	}
+
+	version, err := options.String("version", NetflowVersionIpfix)
+	if err != nil {
+		return
+	}
+
+	var encoderVersion uint16
+	switch version {
+	case NetflowVersionIpfix:
+		encoderVersion = netflow.VersionIpfix
+	case NetflowVersionV9:
+		encoderVersion = netflow.VersionV9
+	default:
+		err = errors.New("unsupported netflow version: " + version)
+		return
+	}
+
+	activeTimeout, err := options.Int64("active_timeout", DefaultNetflowActiveTimeout)
+	if err != nil {
+		return
+	}
+
+	inactiveTimeout, err := options.Int64("inactive_timeout", DefaultNetflowInactiveTimeout)
+	if err != nil {
+		return
+	}
+
+	if inactiveTimeout <= 0 || activeTimeout < inactiveTimeout {
+		err = errors.New("netflow inactive timeout should be positive and not more than active timeout")
+		return
+	}
+	nf.activeTimeout = time.Duration(activeTimeout) * time.Second
+	nf.inactiveTimeout = time.Duration(inactiveTimeout) * time.Second
+
+	templateRefresh, err := options.Int64("template_refresh", DefaultNetflowTemplateRefresh)
+	if err != nil {
+		return
+	}
+
+	if templateRefresh <= 0 {
+		err = errors.New("netflow template refresh should be positive")
+		return
+	}
+	nf.templateRefresh = time.Duration(templateRefresh) * time.Second
+
+	domainId, err := options.Int64("domain_id", 0)
+	if err != nil {
+		return
+	}
+
+	if domainId < 0 || domainId > 0xffffffff {
+		err = errors.New("netflow domain id should be within 0 and " + strconv.FormatUint(0xffffffff, 10))
+		return
+	}
+
+	nf.encoder = netflow.NewEncoder(encoderVersion, uint32(domainId), netflow.DefaultMaxMessageSize)
+	n = nf
+
+	return
+}
+
+// checkNetflowOptions checks the options of a netflow notifier, which dials the collector on the first export
+func checkNetflowOptions(options Options) (isStdout bool, err error) {
+	_, err = newNetflowNotifier("", options)
+
+	return
+}
+
+func (nf *netflowNotifier) IsSampled() bool {
+	return true
+}
+
+func (nf *netflowNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	now := time.Now()
+	for _, ir := range r.Interfaces {
+		nf.update(ir, now)
+	}
+
+	err = nf.export(nf.expire(now, false), now)
+
+	return
+}
+
+// update adds the transport layer flows of a sample to the cache, flows are not rolled up by the grouping
+func (nf *netflowNotifier) update(ir *InterfaceReport, now time.Time) {
+	ifIndex := nf.ifIndex(ir.Interface)
+	for _, f := range ir.Flows(Layer4String) {
+		protocol, ok := netflow.ProtocolNumber(f.Protocol)
+		if !ok {
+			continue
+		}
+
+		srcAddr := net.ParseIP(f.SrcAddr)
+		dstAddr := net.ParseIP(f.DstAddr)
+		if srcAddr == nil || dstAddr == nil {
+			continue
+		}
+
+		record := netflow.Record{
+			SrcAddr:  srcAddr,
+			DstAddr:  dstAddr,
+			SrcPort:  f.SrcPort,
+			DstPort:  f.DstPort,
+			Protocol: protocol,
+			Vlan:     f.Vlan,
+		}
+
+		key := netflowKey{Interface: ir.Interface, FlowFingerprint: f.FlowFingerprint}
+		if f.InboundBytes > 0 || f.InboundPackets > 0 {
+			key.Direction = netflow.DirectionIngress
+			record.Direction = netflow.DirectionIngress
+			record.InputIf = ifIndex
+			nf.add(key, record, f.InboundBytes, f.InboundPackets, &ir.FlowTimestamp, now)
+		}
+
+		// Outbound bytes are accounted to the flow of the inbound packets, so the packets sent have the addresses
+		// and ports the other way round
+		if f.OutboundBytes > 0 || f.OutboundPackets > 0 {
+			key.Direction = netflow.DirectionEgress
+			record.Direction = netflow.DirectionEgress
+			record.InputIf, record.OutputIf = 0, ifIndex
+			record.SrcAddr, record.DstAddr = dstAddr, srcAddr
+			record.SrcPort, record.DstPort = f.DstPort, f.SrcPort
+			nf.add(key, record, f.OutboundBytes, f.OutboundPackets, &ir.FlowTimestamp, now)
+		}
+	}
+}
+
+func (nf *netflowNotifier) add(key netflowKey, record netflow.Record, bytes int64, packets int64,
+	ts *accounting.FlowTimestamp, now time.Time) {
+	e, ok := nf.cache[key]
+	if !ok {
+		record.Start = ts.Start
+		e = &netflowEntry{
+			record:    record,
+			firstSeen: now,
+		}
+		nf.cache[key] = e
+	}
+
+	e.record.Octets += uint64(bytes)
+	e.record.Packets += uint64(packets)
+	e.record.End = ts.End
+	e.lastSeen = now
+}
+
+// expire removes the flows timed out from the cache, or all flows, and returns them ordered by start
+func (nf *netflowNotifier) expire(now time.Time, isAll bool) (records []netflow.Record) {
+	for key, e := range nf.cache {
+		if isAll || now.Sub(e.lastSeen) >= nf.inactiveTimeout || now.Sub(e.firstSeen) >= nf.activeTimeout {
+			records = append(records, e.record)
+			delete(nf.cache, key)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Start < records[j].Start
+	})
+
+	return
+}
+
+// export sends the records to the collector, records failing to be sent are dropped like by a router
+func (nf *netflowNotifier) export(records []netflow.Record, now time.Time) (err error) {
+	if len(records) == 0 {
+		return
+	}
+
+	if nf.conn == nil {
+		nf.conn, err = net.Dial("udp", nf.collector)
+		if err != nil {
+			err = errors.New("failed to connect to netflow collector " + nf.collector + ": " + err.Error())
+			return
+		}
+	}
+
+	withTemplates := now.Sub(nf.lastTemplates) >= nf.templateRefresh
+	for _, msg := range nf.encoder.Encode(records, withTemplates, now) {
+		_, err = nf.conn.Write(msg)
+		if err != nil {
+			updateDeliveryStats(nf.name, func(ds *DeliveryStats) {
+				ds.Failed++
+			})
+			err = errors.New("failed to export " + strconv.Itoa(len(records)) + " flows to netflow collector " +
+				nf.collector + ": " + err.Error())
+			return
+		}
+
+		updateDeliveryStats(nf.name, func(ds *DeliveryStats) {
+			ds.Delivered++
+			ds.LastSuccess = now.Unix()
+		})
+	}
+
+	if withTemplates {
+		nf.lastTemplates = now
+	}
+
+	return
+}
+
+// ifIndex returns the index of an interface of this host, or 0 for interfaces like replays and nodes of the
+// aggregator
+func (nf *netflowNotifier) ifIndex(ifaceName string) uint32 {
+	idx, ok := nf.ifIndexes[ifaceName]
+	if ok {
+		return idx
+	}
+
+	iface, err := net.InterfaceByName(ifaceName)
+	if err == nil {
+		idx = uint32(iface.Index)
+	}
+	nf.ifIndexes[ifaceName] = idx
+
+	return idx
+}
+
+// Close exports the flows left in the cache
+func (nf *netflowNotifier) Close() (err error) {
+	err = nf.export(nf.expire(time.Now(), true), time.Now())
+	if nf.conn != nil {
+		cerr := nf.conn.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return
+}
@@ -0,0 +1,199 @@
+package notify
+
+import (
+	"context"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/netflow"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestNewNetflowNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		isErr   bool
+	}{
+		{"defaults", Options{"collector": "127.0.0.1:2055"}, false},
+		{"v9", Options{"collector": "127.0.0.1:2055", "version": "v9", "domain_id": 7}, false},
+		{"no collector", Options{}, true},
+		{"collector without port", Options{"collector": "127.0.0.1"}, true},
+		{"unknown option", Options{"collector": "127.0.0.1:2055", "port": 2055}, true},
+		{"unsupported version", Options{"collector": "127.0.0.1:2055", "version": "v5"}, true},
+		{"inactive timeout above active timeout",
+			Options{"collector": "127.0.0.1:2055", "active_timeout": 10, "inactive_timeout": 20}, true},
+		{"no template refresh", Options{"collector": "127.0.0.1:2055", "template_refresh": 0}, true},
+		{"domain id out of range", Options{"collector": "127.0.0.1:2055", "domain_id": -1}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newNetflowNotifier("netflow", tt.options)
+			if tt.isErr && err == nil {
+				t.Error("invalid options accepted")
+			}
+			if !tt.isErr && err != nil {
+				t.Errorf("valid options rejected: %s", err.Error())
+			}
+		})
+	}
+}
+
+// TestNetflowNotifierUpdate caches a flow in both directions, sample by sample. The outbound bytes of a flow are
+// exported with the addresses and ports of the packets sent.
+func TestNetflowNotifierUpdate(t *testing.T) {
+	n, err := newNetflowNotifier("netflow", Options{"collector": "127.0.0.1:2055"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nf := n.(*netflowNotifier)
+
+	f := &accounting.Flow{
+		FlowFingerprint: accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2",
+			SrcPort: 40000, DstPort: 443, Protocol: "tcp", Vlan: 10},
+		InboundBytes:    1000,
+		InboundPackets:  2,
+		OutboundBytes:   3000,
+		OutboundPackets: 4,
+	}
+	now := time.Now()
+	for _, start := range []int64{100, 101} {
+		nf.update(&InterfaceReport{
+			Interface:     "test0",
+			FlowTimestamp: accounting.FlowTimestamp{Start: start, End: start + 1},
+			L4Flows:       []*accounting.Flow{f},
+		}, now)
+	}
+
+	if records := nf.expire(now, false); len(records) != 0 {
+		t.Errorf("got %d records expired before their timeout", len(records))
+	}
+	records := nf.expire(now, true)
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Direction < records[j].Direction
+	})
+
+	ifIndex := nf.ifIndex("test0")
+	want := []netflow.Record{
+		{
+			SrcAddr:   net.ParseIP("192.0.2.1"),
+			DstAddr:   net.ParseIP("198.51.100.2"),
+			SrcPort:   40000,
+			DstPort:   443,
+			Protocol:  6,
+			Direction: netflow.DirectionIngress,
+			Vlan:      10,
+			InputIf:   ifIndex,
+			Octets:    2000,
+			Packets:   4,
+			Start:     100,
+			End:       102,
+		},
+		{
+			SrcAddr:   net.ParseIP("198.51.100.2"),
+			DstAddr:   net.ParseIP("192.0.2.1"),
+			SrcPort:   443,
+			DstPort:   40000,
+			Protocol:  6,
+			Direction: netflow.DirectionEgress,
+			Vlan:      10,
+			OutputIf:  ifIndex,
+			Octets:    6000,
+			Packets:   8,
+			Start:     100,
+			End:       102,
+		},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got %+v, want %+v", records, want)
+	}
+}
+
+// TestNetflowNotifierExport exports a flow in both directions and decodes the records received by a collector.
+// The outbound bytes of a flow are exported with the addresses and ports of the packets sent.
+func TestNetflowNotifierExport(t *testing.T) {
+	for _, version := range []string{NetflowVersionIpfix, NetflowVersionV9} {
+		t.Run(version, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			n, err := newNetflowNotifier("netflow", Options{"collector": conn.LocalAddr().String(),
+				"version": version})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f := &accounting.Flow{
+				FlowFingerprint: accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "198.51.100.2",
+					SrcPort: 40000, DstPort: 443, Protocol: "tcp", Vlan: 10},
+				InboundBytes:    1000,
+				InboundPackets:  2,
+				OutboundBytes:   3000,
+				OutboundPackets: 4,
+			}
+			ir := &InterfaceReport{
+				Interface:     "test0",
+				FlowTimestamp: accounting.FlowTimestamp{Start: 100, End: 101},
+				L4Flows:       []*accounting.Flow{f},
+			}
+
+			err = n.Notify(context.Background(), &Report{Interfaces: []*InterfaceReport{ir, ir}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = n.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 65535)
+			m, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			records, err := netflow.NewDecoder().Decode("127.0.0.1", buf[:m])
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(records, func(i, j int) bool {
+				return records[i].Direction < records[j].Direction
+			})
+
+			want := []netflow.Record{
+				{
+					SrcAddr:   net.ParseIP("192.0.2.1").To4(),
+					DstAddr:   net.ParseIP("198.51.100.2").To4(),
+					SrcPort:   40000,
+					DstPort:   443,
+					Protocol:  6,
+					Direction: netflow.DirectionIngress,
+					Vlan:      10,
+					Octets:    2000,
+					Packets:   4,
+				},
+				{
+					SrcAddr:   net.ParseIP("198.51.100.2").To4(),
+					DstAddr:   net.ParseIP("192.0.2.1").To4(),
+					SrcPort:   443,
+					DstPort:   40000,
+					Protocol:  6,
+					Direction: netflow.DirectionEgress,
+					Vlan:      10,
+					Octets:    6000,
+					Packets:   8,
+				},
+			}
+			if !reflect.DeepEqual(records, want) {
+				t.Errorf("got %+v, want %+v", records, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/utils/log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifier is a sink the flows of every interval are handed to. Notifiers are created by the factory registered
+// for their type and run by Run, which selects, filters and groups the flows, so a notifier only formats and
+// delivers the report.
+type Notifier interface {
+	Notify(ctx context.Context, r *Report) error
+	Close() error
+}
+
+// SampledNotifier is implemented by notifiers which need every per-second sample once instead of the flows
+// aggregated over the interval, like exporters keeping their own flow cache. Their report has an interface
+// report per sample not reported before, and the interval only sets how often they get it.
+type SampledNotifier interface {
+	IsSampled() bool
+}
+
+// Factory creates a notifier from its name and options, invalid or unknown options are returned as error. The
+// name is unique among the notifiers, so it could be used to keep state like files or metrics apart.
+type Factory func(name string, options Options) (Notifier, error)
+
+// Check validates the options of a notifier type without side effects like reading files or opening sockets,
+// so the config could be checked without creating the notifiers. It tells whether the notifier writes to
+// stdout, as only one notifier could.
+type Check func(options Options) (isStdout bool, err error)
+
+type notifierType struct {
+	factory Factory
+	check   Check
+}
+
+var registry = make(map[string]notifierType)
+var registryMu = &sync.Mutex{}
+
+// Register makes a notifier type available by name, usually from the init function of the notifier. It panics
+// when the name is registered twice.
+func Register(typ string, factory Factory, check Check) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	_, ok := registry[typ]
+	if ok {
+		panic("notifier type registered twice: " + typ)
+	}
+
+	registry[typ] = notifierType{factory: factory, check: check}
+}
+
+func lookup(typ string) (t notifierType, err error) {
+	registryMu.Lock()
+	t, ok := registry[typ]
+	registryMu.Unlock()
+
+	if !ok {
+		err = errors.New("unknown notifier type: " + typ)
+	}
+
+	return
+}
+
+// New creates a notifier of a registered type
+func New(typ string, name string, options Options) (n Notifier, err error) {
+	t, err := lookup(typ)
+	if err != nil {
+		return
+	}
+
+	return t.factory(name, options)
+}
+
+// CheckOptions checks the options of a notifier of a registered type, and tells whether it writes to stdout
+func CheckOptions(typ string, options Options) (isStdout bool, err error) {
+	t, err := lookup(typ)
+	if err != nil {
+		return
+	}
+
+	return t.check(options)
+}
+
+// Types returns the registered notifier types in sorted order
+func Types() (types []string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for typ := range registry {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	return
+}
+
+// Options are the settings of a notifier specific to its type, as decoded from the config file
+type Options map[string]interface{}
+
+// Check returns an error for the first option which is not one of keys, in sorted order
+func (o Options) Check(keys ...string) (err error) {
+	known := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		known[k] = true
+	}
+
+	unknown := make([]string, 0)
+	for k := range o {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+
+	if len(unknown) > 0 {
+		err = errors.New("unknown option: " + unknown[0])
+	}
+
+	return
+}
+
+func (o Options) String(key string, def string) (v string, err error) {
+	raw, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch val := raw.(type) {
+	case string:
+		v = val
+	case int, int64, uint64, float64, bool:
+		v = fmt.Sprint(val)
+	default:
+		err = errors.New("option " + key + " should be a string")
+	}
+
+	return
+}
+
+func (o Options) Int64(key string, def int64) (v int64, err error) {
+	raw, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch val := raw.(type) {
+	case int:
+		v = int64(val)
+	case int64:
+		v = val
+	case uint64:
+		v = int64(val)
+	case float64:
+		v = int64(val)
+		if float64(v) != val {
+			err = errors.New("option " + key + " should be an integer")
+		}
+	case string:
+		v, err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			err = errors.New("option " + key + " should be an integer")
+		}
+	default:
+		err = errors.New("option " + key + " should be an integer")
+	}
+
+	return
+}
+
+func (o Options) Int(key string, def int) (v int, err error) {
+	v64, err := o.Int64(key, int64(def))
+	v = int(v64)
+
+	return
+}
+
+func (o Options) Bool(key string, def bool) (v bool, err error) {
+	raw, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+
+	switch val := raw.(type) {
+	case bool:
+		v = val
+	case string:
+		v, err = strconv.ParseBool(val)
+		if err != nil {
+			err = errors.New("option " + key + " should be a boolean")
+		}
+	default:
+		err = errors.New("option " + key + " should be a boolean")
+	}
+
+	return
+}
+
+// Settings are the settings every notifier has regardless of its type. Interfaces selects the interfaces
+// reported, all interfaces when empty, Filter selects the flows, and flows are rolled up by Grouping when a
+// group key is given.
+type Settings struct {
+	Name       string
+	Type       string
+	Interval   int64
+	Interfaces []string
+	Filter     accounting.FlowFilter
+	Grouping   accounting.Grouping
+	Options    Options
+}
+
+func (s *Settings) Validate() (err error) {
+	// Names are part of the paths of the spools
+	if strings.ContainsAny(s.Name, `/\`) || strings.Contains(s.Name, "..") {
+		err = errors.New("invalid notifier name " + s.Name + ", should not contain path separators or ..")
+		return
+	}
+
+	if s.Interval <= 0 {
+		err = errors.New("interval of notifier " + s.Name + " should be positive")
+		return
+	}
+
+	if s.Grouping.By != "" {
+		err = s.Grouping.Validate()
+		if err != nil {
+			err = errors.New("invalid grouping of notifier " + s.Name + ": " + err.Error())
+			return
+		}
+	}
+
+	return
+}
+
+// Check validates the settings and the options without creating the notifier, and tells whether it writes to
+// stdout
+func (s *Settings) Check() (isStdout bool, err error) {
+	err = s.Validate()
+	if err != nil {
+		return
+	}
+
+	isStdout, err = CheckOptions(s.Type, s.Options)
+	if err != nil {
+		err = errors.New("invalid notifier " + s.Name + ": " + err.Error())
+		return
+	}
+
+	return
+}
+
+// Build validates the settings and creates the notifier
+func (s *Settings) Build() (n Notifier, err error) {
+	err = s.Validate()
+	if err != nil {
+		return
+	}
+
+	n, err = New(s.Type, s.Name, s.Options)
+	if err != nil {
+		err = errors.New("invalid notifier " + s.Name + ": " + err.Error())
+		return
+	}
+
+	return
+}
+
+// Run hands the report of the last interval, or the samples since the last report for sampled notifiers, to n
+// every interval until ctx is done, then closes n
+func Run(ctx context.Context, source Source, s Settings, n Notifier) {
+	var cursor sampleCursor
+	sn, ok := n.(SampledNotifier)
+	if ok && sn.IsSampled() {
+		cursor = getSampleCursor(s.Name, source)
+	}
+
+	ticker := time.NewTicker(time.Duration(s.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			err := n.Close()
+			if err != nil {
+				log.Errorf("failed to close notifier %s with err: %s", s.Name, err.Error())
+			}
+			log.Infof("%s notifier exit", s.Name)
+			return
+		case <-ticker.C:
+			var r *Report
+			if cursor != nil {
+				r = cursor.NewReport(source, s)
+			} else {
+				r = NewReport(source, s)
+			}
+
+			err := n.Notify(ctx, r)
+			if err != nil {
+				log.Errorf("notifier %s failed with err: %s", s.Name, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"io"
+	"os"
+	"strconv"
+)
+
+const OutputNotifierType = "output"
+
+func init() {
+	Register(OutputNotifierType, newOutputNotifier, checkOutputOptions)
+}
+
+const OutputFormatJson = "json"
+const OutputFormatCsv = "csv"
+
+var OutputFormatList = []string{OutputFormatJson, OutputFormatCsv}
+
+// OutputStdout is the output file name writing to stdout
+const OutputStdout = "-"
+
+func ValidateOutputFormat(format string) (err error) {
+	for _, f := range OutputFormatList {
+		if f == format {
+			return
+		}
+	}
+
+	err = errors.New("invalid output format: " + format)
+
+	return
+}
+
+// OutputRecord is one flow of an interval written by the output notifier, the fields of Flow are inlined
+type OutputRecord struct {
+	Interface string
+	Start     int64
+	End       int64
+	*Flow
+}
+
+var outputCsvHeader = []string{"Interface", "Start", "End", "Layer", "SrcAddr", "DstAddr", "SrcPort", "DstPort",
+	"Protocol", "Vlan", "InnerVlan", "Tunnel", "TunnelId", "InboundBytes", "InboundPackets", "InboundDuration",
+	"OutboundBytes", "OutboundPackets", "OutboundDuration"}
+
+func (r *OutputRecord) csvRecord() []string {
+	return []string{
+		r.Interface,
+		strconv.FormatInt(r.Start, 10),
+		strconv.FormatInt(r.End, 10),
+		r.Layer,
+		r.SrcAddr,
+		r.DstAddr,
+		strconv.Itoa(int(r.SrcPort)),
+		strconv.Itoa(int(r.DstPort)),
+		r.Protocol,
+		strconv.Itoa(int(r.Vlan)),
+		strconv.Itoa(int(r.InnerVlan)),
+		r.Tunnel,
+		strconv.FormatUint(uint64(r.TunnelId), 10),
+		strconv.FormatInt(r.InboundBytes, 10),
+		strconv.FormatInt(r.InboundPackets, 10),
+		strconv.FormatInt(r.InboundDuration, 10),
+		strconv.FormatInt(r.OutboundBytes, 10),
+		strconv.FormatInt(r.OutboundPackets, 10),
+		strconv.FormatInt(r.OutboundDuration, 10),
+	}
+}
+
+// OutputRecords returns the flows of an interface, grouped when a group key is given, as records ordered by
+// layer and bytes
+func OutputRecords(ir *InterfaceReport) (records []*OutputRecord) {
+	for _, layer := range []string{Layer3String, Layer4String} {
+		flows := ir.GroupedFlows(layer)
+		accounting.SortFlows(flows, accounting.SortByBytes, false)
+		for _, f := range flows {
+			records = append(records, &OutputRecord{
+				Interface: ir.Interface,
+				Start:     ir.Start,
+				End:       ir.End,
+				Flow:      NewFlow(layer, f),
+			})
+		}
+	}
+
+	return
+}
+
+// openOutput opens the output file for appending, or stdout. The csv header is only needed when the file is
+// empty.
+func openOutput(file string) (w io.WriteCloser, isEmpty bool, err error) {
+	if file == "" || file == OutputStdout {
+		return nopCloser{os.Stdout}, true, nil
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return
+	}
+
+	return f, info.Size() == 0, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// outputNotifier writes the flows of every interface as json lines or csv rows to a file, or to stdout when
+// the file is empty or "-". The file is opened on the first report.
+type outputNotifier struct {
+	format string
+	file   string
+
+	out         io.WriteCloser
+	bw          *bufio.Writer
+	csvWriter   *csv.Writer
+	jsonEncoder *json.Encoder
+}
+
+func newOutputNotifier(name string, options Options) (n Notifier, err error) {
+	o, err := parseOutputOptions(options)
+	if err != nil {
+		return
+	}
+
+	n = o
+
+	return
+}
+
+// checkOutputOptions checks the options of an output notifier, the file is only opened on the first report
+func checkOutputOptions(options Options) (isStdout bool, err error) {
+	o, err := parseOutputOptions(options)
+	if err != nil {
+		return
+	}
+
+	isStdout = o.isStdout()
+
+	return
+}
+
+func parseOutputOptions(options Options) (o *outputNotifier, err error) {
+	err = options.Check("format", "file")
+	if err != nil {
+		return
+	}
+
+	o = &outputNotifier{}
+	o.format, err = options.String("format", OutputFormatJson)
+	if err != nil {
+		return
+	}
+
+	err = ValidateOutputFormat(o.format)
+	if err != nil {
+		return
+	}
+
+	o.file, err = options.String("file", OutputStdout)
+
+	return
+}
+
+func (o *outputNotifier) open() (err error) {
+	out, isEmpty, err := openOutput(o.file)
+	if err != nil {
+		return
+	}
+
+	o.out = out
+	o.bw = bufio.NewWriter(out)
+	o.csvWriter = csv.NewWriter(o.bw)
+	o.jsonEncoder = json.NewEncoder(o.bw)
+	if o.format == OutputFormatCsv && isEmpty {
+		err = o.csvWriter.Write(outputCsvHeader)
+	}
+
+	return
+}
+
+func (o *outputNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	if o.out == nil {
+		err = o.open()
+		if err != nil {
+			return
+		}
+	}
+
+	for _, ir := range r.Interfaces {
+		for _, rec := range OutputRecords(ir) {
+			if o.format == OutputFormatCsv {
+				err = o.csvWriter.Write(rec.csvRecord())
+			} else {
+				err = o.jsonEncoder.Encode(rec)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	o.csvWriter.Flush()
+	err = o.csvWriter.Error()
+	if err != nil {
+		return
+	}
+
+	err = o.bw.Flush()
+
+	return
+}
+
+func (o *outputNotifier) Close() error {
+	if o.out == nil {
+		return nil
+	}
+
+	return o.out.Close()
+}
+
+func (o *outputNotifier) isStdout() bool {
+	return o.file == "" || o.file == OutputStdout
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOutputRecords(t *testing.T) {
+	fc := accounting.NewFlowCollection("eth0")
+	fc.UpdateL3Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.9"}, 100, 1)
+	fc.UpdateL3Outbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.9", DstAddr: "192.0.2.2"}, 300, 2)
+	fc.UpdateL4Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.9", SrcPort: 40000,
+		DstPort: 443, Protocol: "tcp", Vlan: 10}, 80, 1)
+	ts := &accounting.FlowTimestamp{Start: 100, End: 110}
+
+	records := OutputRecords(NewInterfaceReport("eth0", fc, ts, accounting.FlowFilter{}, accounting.Grouping{}, nil))
+	var got []string
+	for _, r := range records {
+		got = append(got, r.Layer+" "+r.SrcAddr)
+	}
+	want := []string{"l3 192.0.2.9", "l3 192.0.2.1", "l4 192.0.2.1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got records %q, want %q", got, want)
+	}
+
+	row := records[2].csvRecord()
+	wantRow := []string{"eth0", "100", "110", "l4", "192.0.2.1", "192.0.2.9", "40000", "443", "tcp", "10", "0", "",
+		"0", "80", "1", "0", "0", "0", "0"}
+	if len(row) != len(outputCsvHeader) || !reflect.DeepEqual(row, wantRow) {
+		t.Errorf("got csv row %q, want %q", row, wantRow)
+	}
+}
+
+// TestOpenOutput appends to an existing file, so the csv header is only written to an empty one
+func TestOpenOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flows.csv")
+
+	for _, wantEmpty := range []bool{true, false} {
+		w, isEmpty, err := openOutput(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isEmpty != wantEmpty {
+			t.Errorf("got empty %t, want %t", isEmpty, wantEmpty)
+		}
+
+		_, err = w.Write([]byte("row\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = w.Close()
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "row\nrow\n" {
+		t.Errorf("got %q, want both rows appended", data)
+	}
+
+	if _, isEmpty, _ := openOutput(OutputStdout); !isEmpty {
+		t.Error("stdout is not taken as empty")
+	}
+}
@@ -0,0 +1,219 @@
+package notify
+
+import (
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"github.com/fs714/goiftop/utils/version"
+	"os"
+	"strconv"
+	"time"
+)
+
+const PayloadVersion1 = 1
+const PayloadVersion2 = 2
+
+func ValidatePayloadVersion(v int) (err error) {
+	if v != PayloadVersion1 && v != PayloadVersion2 {
+		err = errors.New("unsupported payload version: " + strconv.Itoa(v))
+	}
+
+	return
+}
+
+// NewPayloadV1 returns the payload of the first version. The fields of earlier releases keep their names and
+// meaning for existing consumers, Start and End are the ones of the last interface, and the network layer flows
+// carry zero ports. StatsMap and the vlan and tunnel fields of the flows were added to it later on.
+func NewPayloadV1(r *Report, nodeId string, nodeOamAddr string) *Flows {
+	flows := &Flows{
+		RouterId: nodeId,
+		OamAddr:  nodeOamAddr,
+		FLowsMap: make(map[string][]*Flow),
+		StatsMap: make(map[string][]engine.EngineStats),
+	}
+	for _, ir := range r.Interfaces {
+		flows.Start = ir.Start
+		flows.End = ir.End
+
+		flowList := make([]*Flow, 0)
+		for _, layer := range []string{Layer3String, Layer4String} {
+			for _, f := range ir.GroupedFlows(layer) {
+				flowList = append(flowList, NewFlow(layer, f))
+			}
+		}
+
+		flows.FLowsMap[ir.Interface] = flowList
+		flows.StatsMap[ir.Interface] = ir.Stats
+	}
+
+	return flows
+}
+
+// PayloadV2 is the second version of the payload posted to webhooks. Fields are only added to it, renaming or
+// removing one needs a new version. Units are part of the field names: timestamps are unix seconds, durations
+// seconds, rates bits per second, and the capture statistics are counters since the engine started.
+type PayloadV2 struct {
+	Version    int            `json:"version"`
+	Node       NodeV2         `json:"node"`
+	SentAt     int64          `json:"sent_at_unix_sec"`
+	Interfaces []*InterfaceV2 `json:"interfaces"`
+}
+
+// NodeV2 identifies the node the flows are captured on
+type NodeV2 struct {
+	Id              string `json:"id"`
+	OamAddr         string `json:"oam_addr"`
+	Hostname        string `json:"hostname"`
+	SoftwareVersion string `json:"software_version"`
+	GitCommit       string `json:"git_commit,omitempty"`
+}
+
+// InterfaceV2 holds the flows of an interface over its own interval, with the flows rolled up per group when
+// GroupBy is given
+type InterfaceV2 struct {
+	Name       string           `json:"name"`
+	Start      int64            `json:"start_unix_sec"`
+	End        int64            `json:"end_unix_sec"`
+	Duration   int64            `json:"duration_sec"`
+	GroupBy    string           `json:"group_by,omitempty"`
+	InBytes    int64            `json:"in_bytes"`
+	InPackets  int64            `json:"in_packets"`
+	OutBytes   int64            `json:"out_bytes"`
+	OutPackets int64            `json:"out_packets"`
+	Engines    []*EngineStatsV2 `json:"engines"`
+	L3Flows    []*L3FlowV2      `json:"l3_flows"`
+	L4Flows    []*L4FlowV2      `json:"l4_flows"`
+}
+
+// EngineStatsV2 are the capture statistics of an engine of the interface since it started
+type EngineStatsV2 struct {
+	Direction        string `json:"direction"`
+	ReceivedPackets  uint64 `json:"received_packets_total"`
+	DroppedPackets   uint64 `json:"dropped_packets_total"`
+	IfDroppedPackets uint64 `json:"if_dropped_packets_total"`
+	QueueFreezes     uint64 `json:"queue_freezes_total"`
+}
+
+// L3FlowV2 is a network layer flow, the vlan and tunnel fields are omitted for flows without them
+type L3FlowV2 struct {
+	SrcAddr     string  `json:"src_addr"`
+	DstAddr     string  `json:"dst_addr"`
+	Vlan        uint16  `json:"vlan,omitempty"`
+	InnerVlan   uint16  `json:"inner_vlan,omitempty"`
+	Tunnel      string  `json:"tunnel,omitempty"`
+	TunnelId    uint32  `json:"tunnel_id,omitempty"`
+	InBytes     int64   `json:"in_bytes"`
+	InPackets   int64   `json:"in_packets"`
+	InDuration  int64   `json:"in_duration_sec"`
+	InRate      float64 `json:"in_rate_bps"`
+	OutBytes    int64   `json:"out_bytes"`
+	OutPackets  int64   `json:"out_packets"`
+	OutDuration int64   `json:"out_duration_sec"`
+	OutRate     float64 `json:"out_rate_bps"`
+}
+
+// L4FlowV2 is a transport layer flow, which has the protocol and ports the network layer flows do not
+type L4FlowV2 struct {
+	L3FlowV2
+	Protocol string `json:"protocol"`
+	SrcPort  uint16 `json:"src_port"`
+	DstPort  uint16 `json:"dst_port"`
+}
+
+// NewNodeV2 returns the metadata of this node, the hostname is left empty when it could not be read
+func NewNodeV2(nodeId string, nodeOamAddr string) NodeV2 {
+	hostname, _ := os.Hostname()
+
+	return NodeV2{
+		Id:              nodeId,
+		OamAddr:         nodeOamAddr,
+		Hostname:        hostname,
+		SoftwareVersion: version.Release,
+		GitCommit:       version.GitVersion,
+	}
+}
+
+func NewL3FlowV2(f *accounting.Flow) *L3FlowV2 {
+	return &L3FlowV2{
+		SrcAddr:     f.SrcAddr,
+		DstAddr:     f.DstAddr,
+		Vlan:        f.Vlan,
+		InnerVlan:   f.InnerVlan,
+		Tunnel:      f.Tunnel,
+		TunnelId:    f.TunnelId,
+		InBytes:     f.InboundBytes,
+		InPackets:   f.InboundPackets,
+		InDuration:  f.InboundDuration,
+		InRate:      f.InboundRate(),
+		OutBytes:    f.OutboundBytes,
+		OutPackets:  f.OutboundPackets,
+		OutDuration: f.OutboundDuration,
+		OutRate:     f.OutboundRate(),
+	}
+}
+
+func NewL4FlowV2(f *accounting.Flow) *L4FlowV2 {
+	return &L4FlowV2{
+		L3FlowV2: *NewL3FlowV2(f),
+		Protocol: f.Protocol,
+		SrcPort:  f.SrcPort,
+		DstPort:  f.DstPort,
+	}
+}
+
+func NewInterfaceV2(ir *InterfaceReport) *InterfaceV2 {
+	iface := &InterfaceV2{
+		Name:     ir.Interface,
+		Start:    ir.Start,
+		End:      ir.End,
+		Duration: ir.End - ir.Start,
+		GroupBy:  ir.Grouping.By,
+		Engines:  make([]*EngineStatsV2, 0, len(ir.Stats)),
+		L3Flows:  make([]*L3FlowV2, 0),
+		L4Flows:  make([]*L4FlowV2, 0),
+	}
+
+	for _, s := range ir.Stats {
+		iface.Engines = append(iface.Engines, &EngineStatsV2{
+			Direction:        s.Direction,
+			ReceivedPackets:  s.Received,
+			DroppedPackets:   s.Dropped,
+			IfDroppedPackets: s.IfDropped,
+			QueueFreezes:     s.QueueFreezes,
+		})
+	}
+
+	// Grouping keeps the totals, so the counters are summed up from the flows as they are
+	for _, f := range ir.L3Flows {
+		iface.InBytes += f.InboundBytes
+		iface.InPackets += f.InboundPackets
+		iface.OutBytes += f.OutboundBytes
+		iface.OutPackets += f.OutboundPackets
+	}
+
+	for _, f := range ir.GroupedFlows(Layer3String) {
+		iface.L3Flows = append(iface.L3Flows, NewL3FlowV2(f))
+	}
+
+	for _, f := range ir.GroupedFlows(Layer4String) {
+		iface.L4Flows = append(iface.L4Flows, NewL4FlowV2(f))
+	}
+
+	return iface
+}
+
+// NewPayloadV2 returns the payload of the second version, with the interfaces in the order of the report
+func NewPayloadV2(r *Report, node NodeV2) *PayloadV2 {
+	p := &PayloadV2{
+		Version:    PayloadVersion2,
+		Node:       node,
+		SentAt:     time.Now().Unix(),
+		Interfaces: make([]*InterfaceV2, 0, len(r.Interfaces)),
+	}
+
+	for _, ir := range r.Interfaces {
+		p.Interfaces = append(p.Interfaces, NewInterfaceV2(ir))
+	}
+
+	return p
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"encoding/json"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// payloadReport returns a report of eth0 over 10 seconds with a network and a transport layer flow
+func payloadReport(grouping accounting.Grouping) *Report {
+	fc := accounting.NewFlowCollection("eth0")
+	fc.SetTimestamp(100, 110)
+	fc.UpdateL3Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.9", Vlan: 10}, 1000, 4)
+	fc.UpdateL3Outbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.9", DstAddr: "192.0.2.2"}, 500, 2)
+	l4 := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.9", SrcPort: 40000, DstPort: 443,
+		Protocol: "tcp", Vlan: 10}
+	fc.UpdateL4Inbound(l4, 800, 4)
+	fc.L4FlowMap[l4].InboundDuration = 10
+	stats := []engine.EngineStats{{Interface: "eth0", Direction: "in",
+		CaptureStats: engine.CaptureStats{Received: 6, Dropped: 1}}}
+
+	return &Report{Interfaces: []*InterfaceReport{
+		NewInterfaceReport("eth0", fc, &fc.FlowTimestamp, accounting.FlowFilter{}, grouping, stats),
+	}}
+}
+
+func TestValidatePayloadVersion(t *testing.T) {
+	for v, wantErr := range map[int]bool{0: true, PayloadVersion1: false, PayloadVersion2: false, 3: true} {
+		if err := ValidatePayloadVersion(v); (err != nil) != wantErr {
+			t.Errorf("version %d: got err %v", v, err)
+		}
+	}
+}
+
+func TestNewPayloadV1(t *testing.T) {
+	flows := NewPayloadV1(payloadReport(accounting.Grouping{}), "node1", "192.0.2.100")
+	if flows.RouterId != "node1" || flows.OamAddr != "192.0.2.100" || flows.Start != 100 || flows.End != 110 {
+		t.Errorf("got %+v", flows)
+	}
+	if len(flows.FLowsMap["eth0"]) != 3 || len(flows.StatsMap["eth0"]) != 1 {
+		t.Errorf("got flows %+v and stats %+v", flows.FLowsMap, flows.StatsMap)
+	}
+
+	// The fields of earlier releases keep their names, and fields are only added
+	data, err := json.Marshal(flows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]json.RawMessage
+	if err = json.Unmarshal(data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	var flowsMap map[string][]map[string]interface{}
+	if err = json.Unmarshal(payload["FLowsMap"], &flowsMap); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for k := range payload {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if want := []string{"End", "FLowsMap", "OamAddr", "RouterId", "Start", "StatsMap"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got payload fields %q, want %q", keys, want)
+	}
+
+	keys = keys[:0]
+	for k := range flowsMap["eth0"][0] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	want := []string{"DstAddr", "DstPort", "InboundBytes", "InboundDuration", "InboundPackets", "InnerVlan", "Layer",
+		"OutboundBytes", "OutboundDuration", "OutboundPackets", "Protocol", "SrcAddr", "SrcPort", "Tunnel", "TunnelId",
+		"Vlan"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got flow fields %q, want %q", keys, want)
+	}
+}
+
+func TestNewPayloadV2(t *testing.T) {
+	p := NewPayloadV2(payloadReport(accounting.Grouping{}), NodeV2{Id: "node1", OamAddr: "192.0.2.100"})
+	if p.Version != PayloadVersion2 || p.Node.Id != "node1" || len(p.Interfaces) != 1 {
+		t.Fatalf("got %+v", p)
+	}
+
+	iface := p.Interfaces[0]
+	if iface.Name != "eth0" || iface.Start != 100 || iface.End != 110 || iface.Duration != 10 ||
+		iface.InBytes != 1000 || iface.InPackets != 4 || iface.OutBytes != 500 || iface.OutPackets != 2 {
+		t.Errorf("got interface %+v", iface)
+	}
+	if len(iface.Engines) != 1 || iface.Engines[0].ReceivedPackets != 6 || iface.Engines[0].DroppedPackets != 1 {
+		t.Errorf("got engines %+v", iface.Engines)
+	}
+	if len(iface.L3Flows) != 2 || len(iface.L4Flows) != 1 {
+		t.Fatalf("got l3 flows %+v and l4 flows %+v", iface.L3Flows, iface.L4Flows)
+	}
+
+	// Field names carry the units, and fields a flow does not have are omitted
+	data, err := json.Marshal(iface.L4Flows[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"src_addr": "192.0.2.1", "dst_addr": "192.0.2.9", "vlan": 10.0, "protocol": "tcp", "src_port": 40000.0,
+		"dst_port": 443.0, "in_bytes": 800.0, "in_packets": 4.0, "in_duration_sec": 10.0, "in_rate_bps": 640.0,
+		"out_bytes": 0.0, "out_packets": 0.0, "out_duration_sec": 0.0, "out_rate_bps": 0.0,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestNewPayloadV2Grouping rolls the flows up per group and keeps the totals of the interface
+func TestNewPayloadV2Grouping(t *testing.T) {
+	p := NewPayloadV2(payloadReport(accounting.Grouping{By: accounting.GroupByVlan}), NodeV2{})
+
+	iface := p.Interfaces[0]
+	if iface.GroupBy != accounting.GroupByVlan || iface.InBytes != 1000 || iface.OutBytes != 500 {
+		t.Errorf("got interface %+v", iface)
+	}
+	if len(iface.L3Flows) != 2 {
+		t.Errorf("got l3 flows %+v, want one per vlan", iface.L3Flows)
+	}
+}
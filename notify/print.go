@@ -2,118 +2,337 @@ package notify
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/fs714/goiftop/accounting"
-	"github.com/fs714/goiftop/utils/config"
-	"github.com/fs714/goiftop/utils/log"
 	"github.com/olekukonko/tablewriter"
+	"io"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func PrintNotifier(ctx context.Context, duration int64) {
-	ticker := time.NewTicker(time.Duration(duration) * time.Second)
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infoln("print notifier exit")
-			return
-		case <-ticker.C:
-			for ifaceName, flowColHist := range accounting.GlobalAcct.FlowAccd {
-				fc, ts := flowColHist.AggregationByDuration(duration)
-
-				start := time.Unix(ts.Start, 0).String()
-				end := time.Unix(ts.End, 0).String()
-				fmt.Printf("[%s %s - %s]\n", ifaceName, start, end)
-
-				fmt.Println("- [Network Layer]")
-				l3Buf := &strings.Builder{}
-				l3Table := tablewriter.NewWriter(l3Buf)
-				l3Table.SetHeader([]string{"Index", "SrcAddr", "DstAddr",
-					"BytesIn", "PacketsIn", "DurationIn", "RateIn",
-					"BytesOut", "PacketsOut", "DurationOut", "RateOut"})
-				l3Table.SetAutoFormatHeaders(false)
-				l3Table.SetRowLine(true)
-				l3Table.SetAutoMergeCells(false)
-				cnt := 0
-				for _, f := range fc.L3FlowMap {
-					inRateStr := "-"
-					outRateStr := "-"
-					if f.InboundDuration != 0 {
-						inRate := float64(f.InboundBytes*8/f.InboundDuration/1000) / 1000
-						inRateStr = fmt.Sprintf("%.2f", inRate)
-					}
-					if f.OutboundDuration != 0 {
-						outRate := float64(f.OutboundBytes*8/f.OutboundDuration/1000) / 1000
-						outRateStr = fmt.Sprintf("%.2f", outRate)
-					}
-					m := []string{
-						strconv.Itoa(cnt),
-						f.SrcAddr,
-						f.DstAddr,
-						strconv.FormatInt(f.InboundBytes, 10),
-						strconv.FormatInt(f.InboundPackets, 10),
-						strconv.FormatInt(f.InboundDuration, 10),
-						inRateStr,
-						strconv.FormatInt(f.OutboundBytes, 10),
-						strconv.FormatInt(f.OutboundPackets, 10),
-						strconv.FormatInt(f.OutboundDuration, 10),
-						outRateStr,
-					}
-					l3Table.Append(m)
-					cnt++
-				}
-				l3Table.Render()
-				fmt.Println(l3Buf.String())
-
-				if config.IsDecodeL4 {
-					fmt.Println("- [Transport Layer]")
-					l4Buf := &strings.Builder{}
-					l4Table := tablewriter.NewWriter(l4Buf)
-					l4Table.SetHeader([]string{"Index", "SrcAddr", "DstAddr", "SrcPort", "DstPort", "Protocol",
-						"BytesIn", "PacketsIn", "DurationIn", "RateIn",
-						"BytesOut", "PacketsOut", "DurationOut", "RateOut"})
-					l4Table.SetAutoFormatHeaders(false)
-					l4Table.SetRowLine(true)
-					l4Table.SetAutoMergeCells(false)
-					cnt := 0
-					for _, f := range fc.L4FlowMap {
-						inRateStr := "-"
-						outRateStr := "-"
-						if f.InboundDuration != 0 {
-							inRate := float64(f.InboundBytes*8/f.InboundDuration/1000) / 1000
-							inRateStr = fmt.Sprintf("%.2f", inRate)
-						}
-						if f.OutboundDuration != 0 {
-							outRate := float64(f.OutboundBytes*8/f.OutboundDuration/1000) / 1000
-							outRateStr = fmt.Sprintf("%.2f", outRate)
-						}
-						m := []string{
-							strconv.Itoa(cnt),
-							f.SrcAddr,
-							f.DstAddr,
-							strconv.Itoa(int(f.SrcPort)),
-							strconv.Itoa(int(f.DstPort)),
-							f.Protocol,
-							strconv.FormatInt(f.InboundBytes, 10),
-							strconv.FormatInt(f.InboundPackets, 10),
-							strconv.FormatInt(f.InboundDuration, 10),
-							inRateStr,
-							strconv.FormatInt(f.OutboundBytes, 10),
-							strconv.FormatInt(f.OutboundPackets, 10),
-							strconv.FormatInt(f.OutboundDuration, 10),
-							outRateStr,
-						}
-						l4Table.Append(m)
-						cnt++
-					}
-					l4Table.Render()
-					fmt.Println(l4Buf.String())
-				}
-
-				fmt.Println()
-			}
+const PrintNotifierType = "print"
+
+func init() {
+	Register(PrintNotifierType, newPrintNotifier, checkPrintOptions)
+}
+
+// PrintOptions are the settings of the print notifier. Flows are sorted by SortBy, and when TopN is positive
+// only the top N flows are printed and the rest are summed up into an others row. IsHuman prints bytes and
+// rates in KB, MB and Kbps, Mbps, Gbps instead of bytes and Mbps.
+type PrintOptions struct {
+	SortBy  string
+	TopN    int
+	IsHuman bool
+}
+
+// ParsePrintOptions reads the sort, top_n and human options of a print notifier
+func ParsePrintOptions(options Options) (opts PrintOptions, err error) {
+	err = options.Check("sort", "top_n", "human")
+	if err != nil {
+		return
+	}
+
+	opts.SortBy, err = options.String("sort", accounting.SortByBytes)
+	if err != nil {
+		return
+	}
+
+	err = accounting.ValidateSortBy(opts.SortBy)
+	if err != nil {
+		return
+	}
+
+	opts.TopN, err = options.Int("top_n", 0)
+	if err != nil {
+		return
+	}
+
+	if opts.TopN < 0 {
+		err = errors.New("print top n should not be negative")
+		return
+	}
+
+	opts.IsHuman, err = options.Bool("human", false)
+
+	return
+}
+
+// printNotifier prints the flows of every interface to stdout, with the groups first when a group key is given
+type printNotifier struct {
+	opts PrintOptions
+}
+
+func newPrintNotifier(name string, options Options) (n Notifier, err error) {
+	opts, err := ParsePrintOptions(options)
+	if err != nil {
+		return
+	}
+
+	n = &printNotifier{opts: opts}
+
+	return
+}
+
+// checkPrintOptions checks the options of a print notifier, which always writes to stdout
+func checkPrintOptions(options Options) (isStdout bool, err error) {
+	_, err = ParsePrintOptions(options)
+	isStdout = true
+
+	return
+}
+
+func (p *printNotifier) Notify(ctx context.Context, r *Report) error {
+	for _, ir := range r.Interfaces {
+		printInterface(os.Stdout, ir, p.opts)
+	}
+
+	return nil
+}
+
+func (p *printNotifier) Close() error {
+	return nil
+}
+
+// printInterface prints the flows and capture statistics of an interface
+func printInterface(w io.Writer, ir *InterfaceReport, opts PrintOptions) {
+	start := time.Unix(ir.Start, 0).String()
+	end := time.Unix(ir.End, 0).String()
+	_, _ = fmt.Fprintf(w, "[%s %s - %s]\n", ir.Interface, start, end)
+
+	if ir.Grouping.By != "" {
+		printGroups(w, ir, opts)
+	}
+
+	_, _ = fmt.Fprintln(w, "- [Network Layer]")
+	printFlows(w, ir.L3Flows, false, opts)
+
+	// Transport layer flows are only there for interfaces decoding them
+	if len(ir.L4Flows) > 0 {
+		_, _ = fmt.Fprintln(w, "- [Transport Layer]")
+		printFlows(w, ir.L4Flows, true, opts)
+	}
+
+	_, _ = fmt.Fprintln(w, "- [Capture]")
+	statsBuf := &strings.Builder{}
+	statsTable := tablewriter.NewWriter(statsBuf)
+	statsTable.SetHeader([]string{"Direction", "Received", "Dropped", "IfDropped", "QueueFreezes"})
+	statsTable.SetAutoFormatHeaders(false)
+	statsTable.SetAutoMergeCells(false)
+	for _, s := range ir.Stats {
+		statsTable.Append([]string{
+			s.Direction,
+			strconv.FormatUint(s.Received, 10),
+			strconv.FormatUint(s.Dropped, 10),
+			strconv.FormatUint(s.IfDropped, 10),
+			strconv.FormatUint(s.QueueFreezes, 10),
+		})
+	}
+	statsTable.Render()
+	_, _ = fmt.Fprintln(w, statsBuf.String())
+
+	_, _ = fmt.Fprintln(w)
+}
+
+// printFlows prints the flows sorted and limited to the top N with an others row, and the total
+// of all flows in the last row
+func printFlows(w io.Writer, flows []*accounting.Flow, isL4 bool, opts PrintOptions) {
+	flows = append([]*accounting.Flow(nil), flows...)
+	accounting.SortFlows(flows, opts.SortBy, false)
+
+	isVlan := IsVlanTagged(flows)
+	isTunnel := IsTunnelTagged(flows)
+
+	header := []string{"Index", "SrcAddr", "DstAddr"}
+	if isL4 {
+		header = append(header, "SrcPort", "DstPort", "Protocol")
+	}
+	if isVlan {
+		header = append(header, "Vlan")
+	}
+	if isTunnel {
+		header = append(header, "Tunnel")
+	}
+	fingerprintColumns := len(header)
+	header = append(header,
+		"BytesIn", "PacketsIn", "DurationIn", "RateIn",
+		"BytesOut", "PacketsOut", "DurationOut", "RateOut")
+
+	buf := &strings.Builder{}
+	table := tablewriter.NewWriter(buf)
+	table.SetHeader(header)
+	table.SetAutoFormatHeaders(false)
+	table.SetRowLine(true)
+	table.SetAutoMergeCells(false)
+
+	// Summary rows leave the fingerprint columns empty
+	appendSummary := func(name string, f *accounting.Flow) {
+		m := []string{"-", name}
+		for len(m) < fingerprintColumns {
+			m = append(m, "")
 		}
+		table.Append(append(m, counterColumns(f, opts.IsHuman)...))
 	}
+
+	total := &accounting.Flow{}
+	others := &accounting.Flow{}
+	othersCnt := 0
+	for i, f := range flows {
+		total.Combine(f)
+		if opts.TopN > 0 && i >= opts.TopN {
+			others.Combine(f)
+			othersCnt++
+			continue
+		}
+
+		m := []string{strconv.Itoa(i), f.SrcAddr, f.DstAddr}
+		if isL4 {
+			m = append(m, strconv.Itoa(int(f.SrcPort)), strconv.Itoa(int(f.DstPort)), f.Protocol)
+		}
+		if isVlan {
+			m = append(m, f.VlanString())
+		}
+		if isTunnel {
+			m = append(m, f.TunnelString())
+		}
+		table.Append(append(m, counterColumns(f, opts.IsHuman)...))
+	}
+
+	if othersCnt > 0 {
+		appendSummary("Others ("+strconv.Itoa(othersCnt)+")", others)
+	}
+	appendSummary("Total ("+strconv.Itoa(len(flows))+")", total)
+
+	table.Render()
+	_, _ = fmt.Fprintln(w, buf.String())
+}
+
+func printGroups(w io.Writer, ir *InterfaceReport, opts PrintOptions) {
+	groups, total := ir.Groups()
+	accounting.SortFlowGroups(groups, opts.SortBy, false)
+
+	_, _ = fmt.Fprintln(w, "- [Groups by "+ir.Grouping.By+"]")
+	buf := &strings.Builder{}
+	table := tablewriter.NewWriter(buf)
+	table.SetHeader([]string{"Index", "Group", "Flows",
+		"BytesIn", "PacketsIn", "DurationIn", "RateIn",
+		"BytesOut", "PacketsOut", "DurationOut", "RateOut"})
+	table.SetAutoFormatHeaders(false)
+	table.SetRowLine(true)
+	table.SetAutoMergeCells(false)
+
+	others := &accounting.FlowGroup{}
+	othersCnt := 0
+	for i, fg := range groups {
+		if opts.TopN > 0 && i >= opts.TopN {
+			others.Merge(fg)
+			othersCnt++
+			continue
+		}
+
+		table.Append(append([]string{strconv.Itoa(i), fg.Key, strconv.Itoa(fg.Flows)},
+			counterColumns(fg.Counters(), opts.IsHuman)...))
+	}
+
+	if othersCnt > 0 {
+		table.Append(append([]string{"-", "Others (" + strconv.Itoa(othersCnt) + ")", strconv.Itoa(others.Flows)},
+			counterColumns(others.Counters(), opts.IsHuman)...))
+	}
+	table.Append(append([]string{"-", "Total (" + strconv.Itoa(len(groups)) + ")", strconv.Itoa(total.Flows)},
+		counterColumns(total.Counters(), opts.IsHuman)...))
+
+	table.Render()
+	_, _ = fmt.Fprintln(w, buf.String())
+}
+
+// counterColumns returns the inbound and outbound bytes, packets, duration and rate columns of f
+func counterColumns(f *accounting.Flow, isHuman bool) []string {
+	inRateStr := "-"
+	outRateStr := "-"
+	if f.InboundDuration != 0 {
+		inRateStr = FormatRate(f.InboundRate(), isHuman)
+	}
+	if f.OutboundDuration != 0 {
+		outRateStr = FormatRate(f.OutboundRate(), isHuman)
+	}
+
+	return []string{
+		FormatBytes(f.InboundBytes, isHuman),
+		strconv.FormatInt(f.InboundPackets, 10),
+		strconv.FormatInt(f.InboundDuration, 10),
+		inRateStr,
+		FormatBytes(f.OutboundBytes, isHuman),
+		strconv.FormatInt(f.OutboundPackets, 10),
+		strconv.FormatInt(f.OutboundDuration, 10),
+		outRateStr,
+	}
+}
+
+// FormatBytes formats bytes in B, KB, MB, GB or TB by powers of 1024 when isHuman is set, or as a plain
+// number otherwise
+func FormatBytes(bytes int64, isHuman bool) string {
+	if !isHuman {
+		return strconv.FormatInt(bytes, 10)
+	}
+
+	if bytes < 1024 {
+		return strconv.FormatInt(bytes, 10) + "B"
+	}
+
+	v := float64(bytes)
+	unit := ""
+	for _, unit = range []string{"KB", "MB", "GB", "TB"} {
+		v /= 1024
+		if v < 1024 {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%.2f%s", v, unit)
+}
+
+// FormatRate formats a rate in bits per second in bps, Kbps, Mbps, Gbps or Tbps by powers of 1000 when
+// isHuman is set, or in Mbps without unit otherwise
+func FormatRate(rate float64, isHuman bool) string {
+	if !isHuman {
+		return fmt.Sprintf("%.2f", rate/1000000)
+	}
+
+	if rate < 1000 {
+		return fmt.Sprintf("%.0fbps", rate)
+	}
+
+	unit := ""
+	for _, unit = range []string{"Kbps", "Mbps", "Gbps", "Tbps"} {
+		rate /= 1000
+		if rate < 1000 {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%.2f%s", rate, unit)
+}
+
+// IsVlanTagged tells whether any of flows has a vlan, the vlan column is only shown then
+func IsVlanTagged(flows []*accounting.Flow) bool {
+	for _, f := range flows {
+		if f.Vlan != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsTunnelTagged tells whether any of flows is tagged with a tunnel, the tunnel column is only shown then
+func IsTunnelTagged(flows []*accounting.Flow) bool {
+	for _, f := range flows {
+		if f.Tunnel != "" {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes   int64
+		isHuman bool
+		want    string
+	}{
+		{bytes: 1536, isHuman: false, want: "1536"},
+		{bytes: 0, isHuman: true, want: "0B"},
+		{bytes: 1023, isHuman: true, want: "1023B"},
+		{bytes: 1024, isHuman: true, want: "1.00KB"},
+		{bytes: 1536, isHuman: true, want: "1.50KB"},
+		{bytes: 1000000, isHuman: true, want: "976.56KB"},
+		{bytes: 1 << 20, isHuman: true, want: "1.00MB"},
+		{bytes: 3 << 30, isHuman: true, want: "3.00GB"},
+		{bytes: 1 << 40, isHuman: true, want: "1.00TB"},
+		{bytes: 2048 << 40, isHuman: true, want: "2048.00TB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatBytes(tt.bytes, tt.isHuman); got != tt.want {
+			t.Errorf("FormatBytes(%d, %t): got %q, want %q", tt.bytes, tt.isHuman, got, tt.want)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		rate    float64
+		isHuman bool
+		want    string
+	}{
+		{rate: 1500000, isHuman: false, want: "1.50"},
+		{rate: 0, isHuman: true, want: "0bps"},
+		{rate: 999, isHuman: true, want: "999bps"},
+		{rate: 1000, isHuman: true, want: "1.00Kbps"},
+		{rate: 1024, isHuman: true, want: "1.02Kbps"},
+		{rate: 1500000, isHuman: true, want: "1.50Mbps"},
+		{rate: 10e9, isHuman: true, want: "10.00Gbps"},
+		{rate: 2e12, isHuman: true, want: "2.00Tbps"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatRate(tt.rate, tt.isHuman); got != tt.want {
+			t.Errorf("FormatRate(%v, %t): got %q, want %q", tt.rate, tt.isHuman, got, tt.want)
+		}
+	}
+}
+
+// TestPrintFlows prints the top N flows by bytes, sums the rest up into the others row and all flows into
+// the total row
+func TestPrintFlows(t *testing.T) {
+	var flows []*accounting.Flow
+	for i, bytes := range []int64{200, 400, 100, 300} {
+		flows = append(flows, &accounting.Flow{
+			FlowFingerprint: accounting.FlowFingerprint{SrcAddr: "192.0.2." + strconv.Itoa(i+1), DstAddr: "192.0.2.9"},
+			InboundBytes:    bytes,
+			InboundPackets:  1,
+			InboundDuration: 10,
+		})
+	}
+
+	tests := []struct {
+		opts PrintOptions
+		want [][]string
+	}{
+		{
+			opts: PrintOptions{SortBy: accounting.SortByBytes},
+			want: [][]string{
+				{"0", "192.0.2.2", "400", "1"},
+				{"1", "192.0.2.4", "300", "1"},
+				{"2", "192.0.2.1", "200", "1"},
+				{"3", "192.0.2.3", "100", "1"},
+				{"-", "Total (4)", "1000", "4"},
+			},
+		},
+		{
+			opts: PrintOptions{SortBy: accounting.SortByBytes, TopN: 2},
+			want: [][]string{
+				{"0", "192.0.2.2", "400", "1"},
+				{"1", "192.0.2.4", "300", "1"},
+				{"-", "Others (2)", "300", "2"},
+				{"-", "Total (4)", "1000", "4"},
+			},
+		},
+		{
+			opts: PrintOptions{SortBy: accounting.SortByBytes, TopN: 4, IsHuman: true},
+			want: [][]string{
+				{"0", "192.0.2.2", "400B", "1"},
+				{"1", "192.0.2.4", "300B", "1"},
+				{"2", "192.0.2.1", "200B", "1"},
+				{"3", "192.0.2.3", "100B", "1"},
+				{"-", "Total (4)", "1000B", "4"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		buf := &strings.Builder{}
+		printFlows(buf, flows, false, tt.opts)
+
+		// Keeps the index, source, bytes in and packets in columns of the table rows below the header
+		var got [][]string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if !strings.HasPrefix(line, "|") {
+				continue
+			}
+
+			cells := strings.Split(strings.Trim(line, "|"), "|")
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+			}
+			if cells[0] == "Index" {
+				continue
+			}
+			got = append(got, []string{cells[0], cells[1], cells[3], cells[4]})
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("top n %d: got rows %q, want %q", tt.opts.TopN, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package notify
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"sync"
+	"time"
+)
+
+// Source gives notifiers the flows of the accounted interfaces and the capture statistics of their engines
+type Source interface {
+	InterfaceNames() []string
+	Aggregate(ifaceName string, duration int64) (fc *accounting.FlowCollection, ts *accounting.FlowTimestamp, ok bool)
+	Samples(ifaceName string, after int64) []*accounting.FlowCollection
+	LastTimestamp(ifaceName string) (ts accounting.FlowTimestamp, ok bool)
+	CaptureStats(ifaceName string) []engine.EngineStats
+}
+
+type acctSource struct {
+	acct  *accounting.Accounting
+	stats engine.StatsProvider
+}
+
+// NewSource returns the source of the flows accounted by acct, with the capture statistics of stats
+func NewSource(acct *accounting.Accounting, stats engine.StatsProvider) Source {
+	return &acctSource{
+		acct:  acct,
+		stats: stats,
+	}
+}
+
+func (s *acctSource) InterfaceNames() []string {
+	return s.acct.InterfaceNames()
+}
+
+func (s *acctSource) Aggregate(ifaceName string, duration int64) (fc *accounting.FlowCollection,
+	ts *accounting.FlowTimestamp, ok bool) {
+	flowColHist, ok := s.acct.GetInterface(ifaceName)
+	if !ok {
+		return
+	}
+
+	fc, ts = flowColHist.AggregationByDuration(duration)
+
+	return
+}
+
+func (s *acctSource) Samples(ifaceName string, after int64) []*accounting.FlowCollection {
+	flowColHist, ok := s.acct.GetInterface(ifaceName)
+	if !ok {
+		return nil
+	}
+
+	return flowColHist.SamplesAfter(after)
+}
+
+func (s *acctSource) LastTimestamp(ifaceName string) (ts accounting.FlowTimestamp, ok bool) {
+	flowColHist, ok := s.acct.GetInterface(ifaceName)
+	if !ok {
+		return
+	}
+
+	flowColHist.Mu.Lock()
+	ts = flowColHist.LastTimestamp
+	flowColHist.Mu.Unlock()
+
+	return
+}
+
+func (s *acctSource) CaptureStats(ifaceName string) []engine.EngineStats {
+	if s.stats == nil {
+		return nil
+	}
+
+	return s.stats.Stats(ifaceName)
+}
+
+// Report is handed to a notifier every interval, with the interfaces in sorted order
+type Report struct {
+	Interfaces []*InterfaceReport
+}
+
+// InterfaceReport holds the flows of an interface over an interval matching the filter of the notifier
+type InterfaceReport struct {
+	Interface string
+	accounting.FlowTimestamp
+	L3Flows  []*accounting.Flow
+	L4Flows  []*accounting.Flow
+	Grouping accounting.Grouping
+	Stats    []engine.EngineStats
+}
+
+// NewInterfaceReport filters the flows of fc, they are rolled up by grouping only when asked for
+func NewInterfaceReport(ifaceName string, fc *accounting.FlowCollection, ts *accounting.FlowTimestamp,
+	filter accounting.FlowFilter, grouping accounting.Grouping, stats []engine.EngineStats) *InterfaceReport {
+	return &InterfaceReport{
+		Interface:     ifaceName,
+		FlowTimestamp: *ts,
+		L3Flows:       accounting.FilterFlows(accounting.FlowList(fc.L3FlowMap), filter),
+		L4Flows:       accounting.FilterFlows(accounting.FlowList(fc.L4FlowMap), filter),
+		Grouping:      grouping,
+		Stats:         stats,
+	}
+}
+
+// selectedInterfaces returns the interfaces of source selected by s
+func selectedInterfaces(source Source, s Settings) (names []string) {
+	selected := make(map[string]bool, len(s.Interfaces))
+	for _, ifaceName := range s.Interfaces {
+		selected[ifaceName] = true
+	}
+
+	for _, ifaceName := range source.InterfaceNames() {
+		if len(selected) > 0 && !selected[ifaceName] {
+			continue
+		}
+		names = append(names, ifaceName)
+	}
+
+	return
+}
+
+// NewReport aggregates the flows of the interfaces selected by s over the last interval of s
+func NewReport(source Source, s Settings) (r *Report) {
+	r = &Report{}
+	for _, ifaceName := range selectedInterfaces(source, s) {
+		fc, ts, ok := source.Aggregate(ifaceName, s.Interval)
+		if !ok {
+			continue
+		}
+
+		r.Interfaces = append(r.Interfaces,
+			NewInterfaceReport(ifaceName, fc, ts, s.Filter, s.Grouping, source.CaptureStats(ifaceName)))
+	}
+
+	return
+}
+
+// SampleLateness is how many seconds a sample could be accounted after a later one of the interface and still be
+// reported to a sampled notifier, like a sample posted late by a node to the aggregator
+const SampleLateness = 300
+
+// sampleCursor keeps the samples reported to a sampled notifier per interface
+type sampleCursor map[string]*interfaceCursor
+
+// interfaceCursor is the end of the samples not reported any more, with the samples after it reported so far
+type interfaceCursor struct {
+	after    int64
+	reported map[accounting.FlowTimestamp]bool
+}
+
+// sampleCursors are kept by notifier name across reloads, so a restarted notifier continues after the samples
+// reported before instead of reporting the history kept again
+var sampleCursors = make(map[string]sampleCursor)
+var sampleCursorsMu = &sync.Mutex{}
+
+// getSampleCursor returns the cursor of a notifier, a new one starts after the latest samples of the interfaces
+// of source, so the history kept before the notifier was created is not reported
+func getSampleCursor(name string, source Source) sampleCursor {
+	sampleCursorsMu.Lock()
+	defer sampleCursorsMu.Unlock()
+
+	c, ok := sampleCursors[name]
+	if !ok {
+		c = make(sampleCursor)
+		for _, ifaceName := range source.InterfaceNames() {
+			ts, ok := source.LastTimestamp(ifaceName)
+			if ok {
+				c[ifaceName] = &interfaceCursor{after: ts.End, reported: make(map[accounting.FlowTimestamp]bool)}
+			}
+		}
+		sampleCursors[name] = c
+	}
+
+	return c
+}
+
+// NewReport returns a report with an interface report per sample of the interfaces selected by s not
+// reported before, in time order per interface. Samples are held back for a flush interval after the last
+// second, as the engines of the other direction could still be adding to them, and samples accounted late are
+// reported as long as they are not SampleLateness older than the latest one.
+func (c sampleCursor) NewReport(source Source, s Settings) (r *Report) {
+	r = &Report{}
+	latest := time.Now().Unix() - 1 - engine.DefaultFlowColResetInterval
+	for _, ifaceName := range selectedInterfaces(source, s) {
+		ic, ok := c[ifaceName]
+		if !ok {
+			ic = &interfaceCursor{reported: make(map[accounting.FlowTimestamp]bool)}
+			c[ifaceName] = ic
+		}
+
+		samples := source.Samples(ifaceName, ic.after)
+		stats := source.CaptureStats(ifaceName)
+		for _, fc := range samples {
+			ts := fc.FlowTimestamp
+			if ts.End > latest || ic.reported[ts] {
+				continue
+			}
+
+			r.Interfaces = append(r.Interfaces, NewInterfaceReport(ifaceName, fc, &ts, s.Filter, s.Grouping, stats))
+			ic.reported[ts] = true
+		}
+
+		if len(samples) > 0 && samples[len(samples)-1].End-SampleLateness > ic.after {
+			ic.after = samples[len(samples)-1].End - SampleLateness
+		}
+		for ts := range ic.reported {
+			if ts.End <= ic.after {
+				delete(ic.reported, ts)
+			}
+		}
+	}
+
+	return
+}
+
+// Span returns the earliest start and the latest end of the interfaces reported
+func (r *Report) Span() (start int64, end int64) {
+	for _, ir := range r.Interfaces {
+		if start == 0 || ir.Start < start {
+			start = ir.Start
+		}
+		if ir.End > end {
+			end = ir.End
+		}
+	}
+
+	return
+}
+
+// Flows returns the flows of a layer
+func (r *InterfaceReport) Flows(layer string) []*accounting.Flow {
+	if layer == Layer4String {
+		return r.L4Flows
+	}
+
+	return r.L3Flows
+}
+
+// GroupedFlows returns the flows of a layer rolled up into one flow per group when a group key is given, or
+// the flows as they are otherwise
+func (r *InterfaceReport) GroupedFlows(layer string) []*accounting.Flow {
+	if r.Grouping.By == "" {
+		return r.Flows(layer)
+	}
+
+	return accounting.GroupFlows(r.Flows(layer), r.Grouping)
+}
+
+// Groups returns the network layer flows rolled up by the group key with their total, or nothing when no
+// group key is given
+func (r *InterfaceReport) Groups() (groups []*accounting.FlowGroup, total *accounting.FlowGroup) {
+	if r.Grouping.By == "" {
+		return
+	}
+
+	return accounting.AggregateFlows(r.L3Flows, r.Grouping)
+}
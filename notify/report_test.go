@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestSampleCursorNewReport reports each sample once, skips the history kept before the cursor was created,
+// holds back the latest samples and still reports samples accounted late
+func TestSampleCursorNewReport(t *testing.T) {
+	acct := accounting.NewAccounting()
+	acct.AddInterface("eth0")
+	h := acct.FlowAccd["eth0"]
+	addSample := func(start int64) {
+		fc := accounting.NewFlowCollection("eth0")
+		fc.SetTimestamp(start, start+1)
+		fc.UpdateL3Inbound(accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}, 100, 1)
+		h.HistCollection[fc.FlowTimestamp] = fc
+		if fc.End > h.LastTimestamp.End {
+			h.SetLastTimestamp(fc.FlowTimestamp)
+		}
+	}
+
+	now := time.Now().Unix()
+	addSample(now - 20)
+	source := NewSource(acct, nil)
+	c := getSampleCursor(t.Name(), source)
+	defer func() {
+		sampleCursorsMu.Lock()
+		delete(sampleCursors, t.Name())
+		sampleCursorsMu.Unlock()
+	}()
+
+	tests := []struct {
+		added []int64
+		want  []int64
+	}{
+		{added: []int64{now - 10, now - 1}, want: []int64{now - 10}},
+		{added: []int64{now - 15}, want: []int64{now - 15}},
+		{},
+	}
+	for i, tt := range tests {
+		for _, start := range tt.added {
+			addSample(start)
+		}
+
+		var got []int64
+		for _, ir := range c.NewReport(source, Settings{}).Interfaces {
+			got = append(got, ir.Start)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("report %d: got samples starting at %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const spoolFileExt = ".json"
+
+// spool keeps payloads failed to deliver as files of a directory, named by the time they were spooled so they
+// sort oldest first. Beyond max files the oldest are dropped.
+type spool struct {
+	dir string
+	max int
+}
+
+func newSpool(dir string, max int) *spool {
+	return &spool{
+		dir: dir,
+		max: max,
+	}
+}
+
+// files returns the names of the spooled payloads, oldest first
+func (s *spool) files() (names []string, err error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), spoolFileExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// put spools a payload, it is written to a temporary file first so a partial file is never drained. The number
+// of the oldest payloads dropped to keep the spool within max files is returned.
+func (s *spool) put(payload []byte) (dropped int, err error) {
+	err = os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return
+	}
+
+	name := fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolFileExt)
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	err = os.WriteFile(tmp, payload, 0644)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp, filepath.Join(s.dir, name))
+	if err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+
+	names, err := s.files()
+	if err != nil {
+		return
+	}
+
+	for len(names) > s.max {
+		err = s.remove(names[0])
+		if err != nil {
+			return
+		}
+		names = names[1:]
+		dropped++
+	}
+
+	return
+}
+
+func (s *spool) read(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.dir, name))
+}
+
+func (s *spool) remove(name string) error {
+	return os.Remove(filepath.Join(s.dir, name))
+}
+
+// DeliveryStats are the delivery counters of a notifier posting its reports. Delivered includes the payloads
+// drained from the spool, and Failed counts the payloads still failing after all retries.
+type DeliveryStats struct {
+	Notifier     string
+	Delivered    uint64
+	Failed       uint64
+	Retries      uint64
+	Spooled      uint64
+	SpoolDropped uint64
+	SpoolDrained uint64
+	SpoolFiles   int
+	LastSuccess  int64
+}
+
+var deliveryStats = make(map[string]*DeliveryStats)
+var deliveryStatsMu = &sync.Mutex{}
+
+// updateDeliveryStats updates the delivery counters of a notifier, which are kept across reloads
+func updateDeliveryStats(name string, update func(ds *DeliveryStats)) {
+	deliveryStatsMu.Lock()
+	defer deliveryStatsMu.Unlock()
+
+	ds, ok := deliveryStats[name]
+	if !ok {
+		ds = &DeliveryStats{Notifier: name}
+		deliveryStats[name] = ds
+	}
+
+	update(ds)
+}
+
+// GetDeliveryStats returns the delivery counters of every notifier posting its reports, ordered by notifier
+func GetDeliveryStats() (stats []DeliveryStats) {
+	deliveryStatsMu.Lock()
+	defer deliveryStatsMu.Unlock()
+
+	for _, ds := range deliveryStats {
+		stats = append(stats, *ds)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Notifier < stats[j].Notifier
+	})
+
+	return
+}
@@ -0,0 +1,259 @@
+package notify
+
+import (
+	"context"
+	"github.com/fs714/goiftop/accounting"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	tests := []struct {
+		name        string
+		max         int
+		puts        int
+		wantFiles   int
+		wantDropped int
+	}{
+		{"empty", 3, 0, 0, 0},
+		{"within max", 3, 2, 2, 0},
+		{"at max", 3, 3, 3, 0},
+		{"beyond max", 3, 5, 3, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSpool(filepath.Join(t.TempDir(), "webhook"), tt.max)
+
+			dropped := 0
+			for i := 0; i < tt.puts; i++ {
+				n, err := s.put([]byte(strconv.Itoa(i)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				dropped += n
+			}
+
+			names, err := s.files()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != tt.wantFiles || dropped != tt.wantDropped {
+				t.Fatalf("got %d files and %d dropped, want %d and %d", len(names), dropped, tt.wantFiles,
+					tt.wantDropped)
+			}
+
+			// The oldest payloads are dropped, and the others are returned oldest first
+			for i, name := range names {
+				payload, err := s.read(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := strconv.Itoa(tt.puts - tt.wantFiles + i); string(payload) != want {
+					t.Errorf("file %d has payload %s, want %s", i, payload, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSpoolIgnoresOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := newSpool(dir, 10)
+	_, err := s.put([]byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{".1.json.tmp", "notes.txt"} {
+		err = os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.Mkdir(filepath.Join(dir, "sub.json"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := s.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("got files %q, want only the spooled payload", names)
+	}
+}
+
+// TestWebhookSpoolDrain spools the payloads failing to post, and delivers them oldest first after the next
+// successful post
+func TestWebhookSpoolDrain(t *testing.T) {
+	mu := &sync.Mutex{}
+	isDown := true
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if isDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		posts++
+	}))
+	defer srv.Close()
+
+	spoolDir := t.TempDir()
+	n, err := newWebhookNotifier("spooled", Options{"url": srv.URL, "retries": 0, "spool_dir": spoolDir,
+		"spool_max": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := n.(*webhookNotifier)
+
+	r := &Report{Interfaces: []*InterfaceReport{{
+		Interface:     "eth0",
+		FlowTimestamp: accounting.FlowTimestamp{Start: 100, End: 101},
+	}}}
+	for i := 0; i < 3; i++ {
+		err = w.Notify(context.Background(), r)
+		if err == nil {
+			t.Fatal("post to a failing webhook returned no error")
+		}
+	}
+
+	names, err := w.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("got %d spooled payloads, want 2", len(names))
+	}
+
+	mu.Lock()
+	isDown = false
+	mu.Unlock()
+
+	err = w.Notify(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err = w.spool.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("%d payloads left in the spool after draining", len(names))
+	}
+	if posts != 3 {
+		t.Errorf("got %d posts, want the payload and 2 spooled payloads", posts)
+	}
+
+	for _, ds := range GetDeliveryStats() {
+		if ds.Notifier != "spooled" {
+			continue
+		}
+		if ds.Spooled != 3 || ds.SpoolDropped != 1 || ds.SpoolDrained != 2 || ds.SpoolFiles != 0 {
+			t.Errorf("got delivery stats %+v", ds)
+		}
+	}
+}
+
+func TestSettingsValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		isErr bool
+	}{
+		{"webhook", false},
+		{"webhook.eu-1", false},
+		{"../webhook", true},
+		{"a/b", true},
+		{`a\b`, true},
+		{"..", true},
+	}
+
+	for _, tt := range tests {
+		s := &Settings{Name: tt.name, Type: WebhookNotifierType, Interval: 1}
+		err := s.Validate()
+		if tt.isErr && err == nil {
+			t.Errorf("name %s accepted, which escapes the spool directory", tt.name)
+		}
+		if !tt.isErr && err != nil {
+			t.Errorf("name %s rejected: %s", tt.name, err.Error())
+		}
+	}
+}
+
+// TestWebhookSpoolDrainRejected drops a spooled payload the webhook rejects and delivers the ones after it,
+// while a failing webhook stops the drain
+func TestWebhookSpoolDrainRejected(t *testing.T) {
+	mu := &sync.Mutex{}
+	isDown := false
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case isDown:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case string(body) == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			posted = append(posted, string(body))
+		}
+	}))
+	defer srv.Close()
+
+	n, err := newWebhookNotifier("rejected", Options{"url": srv.URL, "retries": 0, "spool_dir": t.TempDir(),
+		"spool_max": 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := n.(*webhookNotifier)
+
+	put := func(payloads ...string) {
+		for _, p := range payloads {
+			_, err := w.spool.put([]byte(p))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	put("first")
+	mu.Lock()
+	isDown = true
+	mu.Unlock()
+	w.drain(context.Background())
+	if names, _ := w.spool.files(); len(names) != 1 {
+		t.Fatalf("got %d spooled payloads after a failing drain, want 1", len(names))
+	}
+
+	put("bad", "last")
+	mu.Lock()
+	isDown = false
+	mu.Unlock()
+	w.drain(context.Background())
+
+	if names, _ := w.spool.files(); len(names) != 0 {
+		t.Errorf("%d payloads left in the spool after draining", len(names))
+	}
+	if want := []string{"first", "last"}; !reflect.DeepEqual(posted, want) {
+		t.Errorf("got posts %q, want %q", posted, want)
+	}
+	for _, ds := range GetDeliveryStats() {
+		if ds.Notifier == "rejected" && (ds.Failed != 1 || ds.SpoolDrained != 2) {
+			t.Errorf("got delivery stats %+v", ds)
+		}
+	}
+}
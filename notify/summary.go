@@ -0,0 +1,140 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
+	"io"
+	"os"
+)
+
+const SummaryFormatTable = "table"
+
+var SummaryFormatList = []string{SummaryFormatTable, OutputFormatJson}
+
+func ValidateSummaryFormat(format string) (err error) {
+	for _, f := range SummaryFormatList {
+		if f == format {
+			return
+		}
+	}
+
+	err = errors.New("invalid summary format: " + format)
+
+	return
+}
+
+// InterfaceSummary is the summary of an interface over the whole run, the flows are sorted and limited like
+// the flows of the print notifier
+type InterfaceSummary struct {
+	Interface string
+	Start     int64
+	End       int64
+	accounting.InterfaceCounter
+	Flows []*Flow
+	Stats []engine.EngineStats
+}
+
+type Summary struct {
+	Interfaces []*InterfaceSummary
+}
+
+func summaryFlows(layer string, fl []*accounting.Flow, opts PrintOptions) (flows []*Flow) {
+	accounting.SortFlows(fl, opts.SortBy, false)
+	if opts.TopN > 0 && len(fl) > opts.TopN {
+		fl = fl[:opts.TopN]
+	}
+
+	for _, f := range fl {
+		flows = append(flows, NewFlow(layer, f))
+	}
+
+	return
+}
+
+func interfaceStats(ifaceName string, stats []engine.EngineStats) (ifaceStats []engine.EngineStats) {
+	for _, s := range stats {
+		if s.Interface == ifaceName {
+			ifaceStats = append(ifaceStats, s)
+		}
+	}
+
+	return
+}
+
+// summaryReports reports all the samples kept of every interface, with the capture statistics taken before
+// the engines stopped
+func summaryReports(grouping accounting.Grouping, stats []engine.EngineStats) (reports []*InterfaceReport) {
+	for _, ifaceName := range accounting.GlobalAcct.InterfaceNames() {
+		flowColHist, ok := accounting.GlobalAcct.GetInterface(ifaceName)
+		if !ok {
+			continue
+		}
+
+		fc, ts := flowColHist.AggregationAll()
+		reports = append(reports, NewInterfaceReport(ifaceName, fc, ts, accounting.FlowFilter{}, grouping,
+			interfaceStats(ifaceName, stats)))
+	}
+
+	return
+}
+
+// NewSummary summarizes the whole run of every interface, the flows are rolled up when a group key is given
+func NewSummary(opts PrintOptions, grouping accounting.Grouping, stats []engine.EngineStats) (s *Summary) {
+	s = &Summary{}
+	for _, ir := range summaryReports(grouping, stats) {
+		is := &InterfaceSummary{
+			Interface: ir.Interface,
+			Start:     ir.Start,
+			End:       ir.End,
+			Stats:     ir.Stats,
+		}
+		for _, f := range ir.L3Flows {
+			is.InboundBytes += f.InboundBytes
+			is.InboundPackets += f.InboundPackets
+			is.OutboundBytes += f.OutboundBytes
+			is.OutboundPackets += f.OutboundPackets
+		}
+		is.Flows = summaryFlows(Layer3String, ir.GroupedFlows(Layer3String), opts)
+		is.Flows = append(is.Flows, summaryFlows(Layer4String, ir.GroupedFlows(Layer4String), opts)...)
+
+		s.Interfaces = append(s.Interfaces, is)
+	}
+
+	return
+}
+
+// WriteSummary writes the summary of every interface over the whole run to file, or to stdout when file is
+// empty or "-", as the tables of the print notifier or as one json document
+func WriteSummary(file string, format string, opts PrintOptions, grouping accounting.Grouping,
+	stats []engine.EngineStats) (err error) {
+	var w io.Writer = os.Stdout
+	if file != "" && file != OutputStdout {
+		var f *os.File
+		f, err = os.Create(file)
+		if err != nil {
+			return
+		}
+		defer func() {
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+		}()
+		w = f
+	}
+
+	if format == OutputFormatJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(NewSummary(opts, grouping, stats))
+		return
+	}
+
+	for _, ir := range summaryReports(grouping, stats) {
+		printInterface(w, ir, opts)
+	}
+
+	return
+}
@@ -1,14 +1,13 @@
 package notify
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/engine"
 	"github.com/fs714/goiftop/utils/log"
-	"net/http"
-	"strconv"
+	"path/filepath"
 	"time"
 )
 
@@ -22,6 +21,10 @@ type Flow struct {
 	SrcPort          uint16
 	DstPort          uint16
 	Protocol         string
+	Vlan             uint16
+	InnerVlan        uint16
+	Tunnel           string
+	TunnelId         uint32
 	InboundBytes     int64
 	InboundPackets   int64
 	InboundDuration  int64
@@ -36,108 +39,458 @@ type Flows struct {
 	Start    int64
 	End      int64
 	FLowsMap map[string][]*Flow
+	StatsMap map[string][]engine.EngineStats
 }
 
-func WebhookNotifier(ctx context.Context, duration int64, nodeId string, nodeOamAddr string, url string, timeout int) {
-	ticker := time.NewTicker(time.Duration(duration) * time.Second)
-	for {
-		select {
-		case <-ctx.Done():
-			log.Infoln("webhook notifier exit")
-			return
-		case <-ticker.C:
-			flows := Flows{
-				RouterId: nodeId,
-				OamAddr:  nodeOamAddr,
-				FLowsMap: make(map[string][]*Flow),
-			}
-			for ifaceName, flowColHist := range accounting.GlobalAcct.FlowAccd {
-				fc, ts := flowColHist.AggregationByDuration(duration)
-
-				flows.Start = ts.Start
-				flows.End = ts.End
-
-				flowList := make([]*Flow, 0)
-
-				for _, f := range fc.L3FlowMap {
-					ff := Flow{
-						Layer:            Layer3String,
-						SrcAddr:          f.SrcAddr,
-						DstAddr:          f.DstAddr,
-						SrcPort:          f.SrcPort,
-						DstPort:          f.DstPort,
-						Protocol:         f.Protocol,
-						InboundBytes:     f.InboundBytes,
-						InboundPackets:   f.InboundPackets,
-						InboundDuration:  f.InboundDuration,
-						OutboundBytes:    f.OutboundBytes,
-						OutboundPackets:  f.OutboundPackets,
-						OutboundDuration: f.OutboundDuration,
-					}
-					flowList = append(flowList, &ff)
-				}
-
-				for _, f := range fc.L4FlowMap {
-					ff := Flow{
-						Layer:            Layer4String,
-						SrcAddr:          f.SrcAddr,
-						DstAddr:          f.DstAddr,
-						SrcPort:          f.SrcPort,
-						DstPort:          f.DstPort,
-						Protocol:         f.Protocol,
-						InboundBytes:     f.InboundBytes,
-						InboundPackets:   f.InboundPackets,
-						InboundDuration:  f.InboundDuration,
-						OutboundBytes:    f.OutboundBytes,
-						OutboundPackets:  f.OutboundPackets,
-						OutboundDuration: f.OutboundDuration,
-					}
-					flowList = append(flowList, &ff)
-				}
-
-				flows.FLowsMap[ifaceName] = flowList
-			}
+// CaptureStats returns the capture statistics of the engines of an interface
+func CaptureStats(ifaceName string) []engine.EngineStats {
+	if engine.GlobalStatsProvider == nil {
+		return nil
+	}
 
-			err := PostFlows(url, timeout, flows)
-			if err != nil {
-				log.Errorf("failed to post flows: %s - %s", time.Unix(flows.Start, 0), time.Unix(flows.End, 0))
-			}
+	return engine.GlobalStatsProvider.Stats(ifaceName)
+}
+
+func NewFlow(layer string, f *accounting.Flow) *Flow {
+	return &Flow{
+		Layer:            layer,
+		SrcAddr:          f.SrcAddr,
+		DstAddr:          f.DstAddr,
+		SrcPort:          f.SrcPort,
+		DstPort:          f.DstPort,
+		Protocol:         f.Protocol,
+		Vlan:             f.Vlan,
+		InnerVlan:        f.InnerVlan,
+		Tunnel:           f.Tunnel,
+		TunnelId:         f.TunnelId,
+		InboundBytes:     f.InboundBytes,
+		InboundPackets:   f.InboundPackets,
+		InboundDuration:  f.InboundDuration,
+		OutboundBytes:    f.OutboundBytes,
+		OutboundPackets:  f.OutboundPackets,
+		OutboundDuration: f.OutboundDuration,
+	}
+}
+
+const WebhookNotifierType = "webhook"
+
+func init() {
+	Register(WebhookNotifierType, newWebhookNotifier, checkWebhookOptions)
+}
+
+const DefaultWebhookRetries = 3
+const DefaultWebhookBackoff = 1
+const DefaultWebhookMaxBackoff = 30
+const DefaultWebhookSpoolMax = 1000
+
+// webhookNotifier posts the flows of every interface as json to an url, as the payload of the version given. A failed post is retried with
+// exponential backoff, and when it still fails the payload is spooled to disk, if a spool directory is given,
+// and delivered after the next successful post.
+type webhookNotifier struct {
+	name           string
+	client         *WebhookClient
+	nodeId         string
+	nodeOamAddr    string
+	payloadVersion int
+	retries        int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+	spool          *spool
+}
+
+func newWebhookNotifier(name string, options Options) (n Notifier, err error) {
+	w, clientOpts, err := parseWebhookOptions(name, options)
+	if err != nil {
+		return
+	}
+
+	w.client, err = newWebhookClient(clientOpts)
+	if err != nil {
+		return
+	}
+
+	n = w
+
+	return
+}
+
+// checkWebhookOptions checks the options of a webhook notifier, the secret and tls files are only read when the
+// notifier is created
+func checkWebhookOptions(options Options) (isStdout bool, err error) {
+	_, _, err = parseWebhookOptions("", options)
+
+	return
+}
+
+// webhookClientOptions are the options of the client posting to the webhook, whose secrets and certificates are
+// read from the files given when the client is created
+type webhookClientOptions struct {
+	url            string
+	postTimeout    int
+	token          string
+	tokenFile      string
+	hmacSecret     string
+	hmacSecretFile string
+	tls            TLSOptions
+	isGzip         bool
+}
+
+func parseWebhookOptions(name string, options Options) (w *webhookNotifier, clientOpts webhookClientOptions,
+	err error) {
+	err = options.Check("url", "post_timeout", "node_id", "node_oam_addr", "retries", "backoff", "max_backoff",
+		"spool_dir", "spool_max", "token", "token_file", "hmac_secret", "hmac_secret_file", "ca_file", "cert_file",
+		"key_file", "gzip", "payload_version")
+	if err != nil {
+		return
+	}
+
+	w = &webhookNotifier{name: name}
+	clientOpts, err = parseWebhookClientOptions(options)
+	if err != nil {
+		return
+	}
+
+	w.nodeId, err = options.String("node_id", "")
+	if err != nil {
+		return
+	}
+
+	w.nodeOamAddr, err = options.String("node_oam_addr", "")
+	if err != nil {
+		return
+	}
+
+	w.payloadVersion, err = options.Int("payload_version", PayloadVersion1)
+	if err != nil {
+		return
+	}
+
+	err = ValidatePayloadVersion(w.payloadVersion)
+	if err != nil {
+		err = errors.New("invalid webhook payload: " + err.Error())
+		return
+	}
+
+	w.retries, err = options.Int("retries", DefaultWebhookRetries)
+	if err != nil {
+		return
+	}
+
+	if w.retries < 0 {
+		err = errors.New("webhook retries should not be negative")
+		return
+	}
+
+	backoff, err := options.Int64("backoff", DefaultWebhookBackoff)
+	if err != nil {
+		return
+	}
+
+	maxBackoff, err := options.Int64("max_backoff", DefaultWebhookMaxBackoff)
+	if err != nil {
+		return
+	}
+
+	if backoff <= 0 || maxBackoff < backoff {
+		err = errors.New("webhook backoff should be positive and not more than max backoff")
+		return
+	}
+	w.backoff = time.Duration(backoff) * time.Second
+	w.maxBackoff = time.Duration(maxBackoff) * time.Second
+
+	spoolDir, err := options.String("spool_dir", "")
+	if err != nil {
+		return
+	}
+
+	spoolMax, err := options.Int("spool_max", DefaultWebhookSpoolMax)
+	if err != nil {
+		return
+	}
+
+	if spoolDir != "" {
+		if spoolMax <= 0 {
+			err = errors.New("webhook spool max should be positive")
+			return
 		}
+
+		// Every notifier has its own spool within the directory
+		w.spool = newSpool(filepath.Join(spoolDir, name), spoolMax)
+	}
+
+	return
+}
+
+func parseWebhookClientOptions(options Options) (o webhookClientOptions, err error) {
+	o.url, err = options.String("url", "")
+	if err != nil {
+		return
+	}
+
+	if o.url == "" {
+		err = errors.New("no webhook url provided")
+		return
+	}
+
+	o.postTimeout, err = options.Int("post_timeout", 2)
+	if err != nil {
+		return
+	}
+
+	if o.postTimeout <= 0 {
+		err = errors.New("webhook post timeout should be positive")
+		return
+	}
+
+	o.token, err = options.String("token", "")
+	if err != nil {
+		return
+	}
+
+	o.tokenFile, err = options.String("token_file", "")
+	if err != nil {
+		return
+	}
+
+	if o.token != "" && o.tokenFile != "" {
+		err = errors.New("invalid webhook token: secret and secret file should not be given together")
+		return
+	}
+
+	o.hmacSecret, err = options.String("hmac_secret", "")
+	if err != nil {
+		return
+	}
+
+	o.hmacSecretFile, err = options.String("hmac_secret_file", "")
+	if err != nil {
+		return
+	}
+
+	if o.hmacSecret != "" && o.hmacSecretFile != "" {
+		err = errors.New("invalid webhook hmac secret: secret and secret file should not be given together")
+		return
+	}
+
+	o.tls.CaFile, err = options.String("ca_file", "")
+	if err != nil {
+		return
+	}
+
+	o.tls.CertFile, err = options.String("cert_file", "")
+	if err != nil {
+		return
 	}
+
+	o.tls.KeyFile, err = options.String("key_file", "")
+	if err != nil {
+		return
+	}
+
+	o.isGzip, err = options.Bool("gzip", false)
+
+	return
 }
 
-func PostFlows(url string, timeout int, flows Flows) (err error) {
-	postJson, err := json.Marshal(flows)
+func newWebhookClient(o webhookClientOptions) (c *WebhookClient, err error) {
+	c = &WebhookClient{
+		Url:    o.url,
+		IsGzip: o.isGzip,
+	}
+
+	c.Token, err = ReadSecret(o.token, o.tokenFile)
 	if err != nil {
-		log.Errorf("failed to marshal flows to json with err: %s", err.Error())
+		err = errors.New("invalid webhook token: " + err.Error())
 		return
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(postJson))
+	hmacSecret, err := ReadSecret(o.hmacSecret, o.hmacSecretFile)
 	if err != nil {
-		log.Errorf("failed to new http request with err: %s", err.Error())
+		err = errors.New("invalid webhook hmac secret: " + err.Error())
+		return
+	}
+	c.HmacSecret = []byte(hmacSecret)
+
+	c.Client, err = NewHttpClient(o.postTimeout, o.tls)
+	if err != nil {
+		err = errors.New("invalid webhook tls settings: " + err.Error())
+		return
+	}
+
+	return
+}
+
+func (w *webhookNotifier) Notify(ctx context.Context, r *Report) (err error) {
+	var flows interface{}
+	if w.payloadVersion == PayloadVersion1 {
+		flows = NewPayloadV1(r, w.nodeId, w.nodeOamAddr)
+	} else {
+		flows = NewPayloadV2(r, NewNodeV2(w.nodeId, w.nodeOamAddr))
+	}
+
+	payload, err := json.Marshal(flows)
+	if err != nil {
+		return
+	}
+
+	err = w.post(ctx, payload)
+	if err != nil {
+		updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+			ds.Failed++
+		})
+
+		start, end := r.Span()
+		err = errors.New("failed to post flows: " + time.Unix(start, 0).String() + " - " +
+			time.Unix(end, 0).String() + ": " + err.Error())
+		if w.spool == nil {
+			return
+		}
+
+		dropped, serr := w.spool.put(payload)
+		if serr != nil {
+			err = errors.New(err.Error() + ", and failed to spool them: " + serr.Error())
+			return
+		}
+		if dropped > 0 {
+			log.Warnf("spool of notifier %s is full, %d oldest payloads dropped", w.name, dropped)
+		}
+		updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+			ds.Spooled++
+			ds.SpoolDropped += uint64(dropped)
+		})
+		w.updateSpoolFiles()
+
+		err = errors.New(err.Error() + ", spooled for later delivery")
 		return
 	}
 
-	req.Close = false
-	req.Header.Set("Content-Type", "application/json")
+	updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+		ds.Delivered++
+		ds.LastSuccess = time.Now().Unix()
+	})
 
-	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
-	resp, err := client.Do(req)
+	if w.spool != nil {
+		w.drain(ctx)
+	}
+
+	return
+}
+
+// post posts a payload, retrying with a backoff doubling up to the max backoff after every failure
+func (w *webhookNotifier) post(ctx context.Context, payload []byte) (err error) {
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.client.Post(payload)
+		if err == nil || attempt >= w.retries {
+			return
+		}
+
+		log.Warnf("failed to post flows of notifier %s, retry in %s with err: %s", w.name, backoff, err.Error())
+		updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+			ds.Retries++
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+	}
+}
+
+// drain delivers the spooled payloads oldest first, and stops at the first one failing again. Payloads which
+// could not be read or which the webhook rejects are dropped and counted as failed, so they do not hold back
+// the payloads spooled after them.
+func (w *webhookNotifier) drain(ctx context.Context) {
+	defer w.updateSpoolFiles()
+
+	names, err := w.spool.files()
 	if err != nil {
-		log.Errorf("http post failed with err: %s", err.Error())
+		log.Errorf("failed to read spool of notifier %s with err: %s", w.name, err.Error())
 		return
 	}
 
+	var drained int
 	defer func() {
-		_ = resp.Body.Close()
+		if drained > 0 {
+			log.Infof("delivered %d spooled payloads of notifier %s", drained, w.name)
+		}
 	}()
 
-	if resp.StatusCode/100 != 2 {
-		err = errors.New("response code is not 2xx but " + strconv.Itoa(resp.StatusCode))
-		log.Errorf(err.Error())
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return
+		}
+
+		payload, err := w.spool.read(name)
+		if err != nil {
+			log.Errorf("failed to read spooled payload %s of notifier %s, drop it with err: %s", name, w.name,
+				err.Error())
+			if !w.dropSpooled(name) {
+				return
+			}
+			continue
+		}
+
+		err = w.client.Post(payload)
+		if err != nil && isRejected(err) {
+			log.Errorf("spooled payload %s of notifier %s rejected, drop it with err: %s", name, w.name, err.Error())
+			if !w.dropSpooled(name) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			log.Warnf("failed to post spooled payload %s of notifier %s with err: %s", name, w.name, err.Error())
+			return
+		}
+
+		err = w.spool.remove(name)
+		if err != nil {
+			log.Errorf("failed to remove spooled payload %s of notifier %s with err: %s", name, w.name, err.Error())
+			return
+		}
+
+		drained++
+		updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+			ds.Delivered++
+			ds.SpoolDrained++
+		})
+	}
+}
+
+// dropSpooled removes a spooled payload never to be delivered and counts it as failed, it tells whether the
+// payload is gone
+func (w *webhookNotifier) dropSpooled(name string) bool {
+	err := w.spool.remove(name)
+	if err != nil {
+		log.Errorf("failed to remove spooled payload %s of notifier %s with err: %s", name, w.name, err.Error())
+		return false
+	}
+
+	updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+		ds.Failed++
+	})
+
+	return true
+}
+
+func (w *webhookNotifier) updateSpoolFiles() {
+	names, err := w.spool.files()
+	if err != nil {
 		return
 	}
 
-	return
+	updateDeliveryStats(w.name, func(ds *DeliveryStats) {
+		ds.SpoolFiles = len(names)
+	})
+}
+
+func (w *webhookNotifier) Close() error {
+	return nil
 }
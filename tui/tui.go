@@ -0,0 +1,429 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"github.com/fs714/goiftop/accounting"
+	"github.com/fs714/goiftop/utils/log"
+	"golang.org/x/term"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SortBy2s = iota
+	SortBy10s
+	SortBy40s
+	SortBySource
+	SortByDestination
+)
+
+const RefreshInterval = 1
+
+var RateWindows = []int64{2, 10, 40}
+var sortNames = []string{"2s", "10s", "40s", "source", "destination"}
+
+const (
+	keyCtrlC     = 3
+	keyTab       = 9
+	keyEnter     = 13
+	keyEsc       = 27
+	keyBackspace = 127
+)
+
+type row struct {
+	fingerprint accounting.FlowFingerprint
+	inRates     []float64
+	outRates    []float64
+}
+
+func (r *row) label(isL4 bool) (local string, remote string) {
+	if isL4 && r.fingerprint.Protocol != "" {
+		local = net.JoinHostPort(r.fingerprint.DstAddr, strconv.Itoa(int(r.fingerprint.DstPort)))
+		remote = net.JoinHostPort(r.fingerprint.SrcAddr, strconv.Itoa(int(r.fingerprint.SrcPort))) + " " + r.fingerprint.Protocol
+	} else {
+		local = r.fingerprint.DstAddr
+		remote = r.fingerprint.SrcAddr
+	}
+
+	if r.fingerprint.Vlan != 0 {
+		remote += " vlan " + r.fingerprint.VlanString()
+	}
+
+	if r.fingerprint.Tunnel != "" {
+		remote += " [" + r.fingerprint.TunnelString() + "]"
+	}
+
+	return
+}
+
+func (r *row) match(filter string) bool {
+	if filter == "" {
+		return true
+	}
+
+	f := r.fingerprint
+	s := strings.Join([]string{f.SrcAddr, f.DstAddr, strconv.Itoa(int(f.SrcPort)), strconv.Itoa(int(f.DstPort)), f.Protocol,
+		f.VlanString(), f.TunnelString()}, " ")
+
+	return strings.Contains(s, filter)
+}
+
+type Tui struct {
+	// IsDecodeL4 tells whether transport layer flows are decoded on an interface
+	IsDecodeL4 func(ifaceName string) bool
+
+	ifaceIdx    int
+	isL4        bool
+	sortBy      int
+	isPaused    bool
+	filter      string
+	filterInput string
+	isFiltering bool
+
+	rows     []*row
+	totalIn  []float64
+	totalOut []float64
+	tsEnd    int64
+}
+
+func NewTui(isDecodeL4 func(ifaceName string) bool) (t *Tui) {
+	t = &Tui{
+		IsDecodeL4: isDecodeL4,
+		sortBy:     SortBy2s,
+	}
+
+	return
+}
+
+// Run draws the flows on the terminal until ctx is done or the user quits
+func (t *Tui) Run(ctx context.Context) (err error) {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Errorf("failed to set terminal to raw mode with err: %s", err.Error())
+		return
+	}
+
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		_ = term.Restore(fd, oldState)
+	}()
+
+	keyCh := make(chan byte, 16)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keyCh)
+				return
+			}
+			for i := 0; i < n; i++ {
+				keyCh <- buf[i]
+			}
+		}
+	}()
+
+	t.update()
+	t.draw()
+
+	ticker := time.NewTicker(RefreshInterval * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !t.isPaused {
+				t.update()
+			}
+			t.draw()
+		case key, ok := <-keyCh:
+			if !ok {
+				return
+			}
+			if t.handleKey(key) {
+				return
+			}
+			t.draw()
+		}
+	}
+}
+
+// handleKey returns true when the user asks to quit
+func (t *Tui) handleKey(key byte) (isQuit bool) {
+	if key == keyCtrlC {
+		return true
+	}
+
+	if t.isFiltering {
+		switch key {
+		case keyEnter:
+			t.filter = t.filterInput
+			t.isFiltering = false
+			t.update()
+		case keyEsc:
+			t.isFiltering = false
+		case keyBackspace, 8:
+			if len(t.filterInput) > 0 {
+				t.filterInput = t.filterInput[:len(t.filterInput)-1]
+			}
+		default:
+			if key >= 32 && key < 127 {
+				t.filterInput += string(key)
+			}
+		}
+
+		return
+	}
+
+	switch key {
+	case 'q':
+		return true
+	case 'p', ' ':
+		t.isPaused = !t.isPaused
+	case 's':
+		t.sortBy = (t.sortBy + 1) % len(sortNames)
+		t.sortRows()
+	case 'l':
+		if t.IsDecodeL4(t.currentIface()) {
+			t.isL4 = !t.isL4
+			t.update()
+		}
+	case keyTab, 'i':
+		t.ifaceIdx++
+		t.update()
+	case '/':
+		t.isFiltering = true
+		t.filterInput = t.filter
+	}
+
+	return
+}
+
+func (t *Tui) ifaceNames() []string {
+	return accounting.GlobalAcct.InterfaceNames()
+}
+
+func (t *Tui) currentIface() string {
+	names := t.ifaceNames()
+	if len(names) == 0 {
+		return ""
+	}
+
+	return names[t.ifaceIdx%len(names)]
+}
+
+// update aggregates the 2s, 10s and 40s rates of the current interface from the flow history
+func (t *Tui) update() {
+	t.rows = t.rows[:0]
+	t.totalIn = make([]float64, len(RateWindows))
+	t.totalOut = make([]float64, len(RateWindows))
+
+	flowColHist, ok := accounting.GlobalAcct.GetInterface(t.currentIface())
+	if !ok {
+		return
+	}
+
+	// Switched to an interface without transport layer flows
+	if t.isL4 && !t.IsDecodeL4(t.currentIface()) {
+		t.isL4 = false
+	}
+
+	rowMap := make(map[accounting.FlowFingerprint]*row)
+	for i, window := range RateWindows {
+		fc, ts := flowColHist.AggregationByDuration(window)
+		if i == 0 {
+			t.tsEnd = ts.End
+		}
+
+		span := ts.End - ts.Start
+		if span < 1 {
+			span = 1
+		}
+
+		flowMap := fc.L3FlowMap
+		if t.isL4 {
+			flowMap = fc.L4FlowMap
+		}
+
+		for k, f := range flowMap {
+			r, ok := rowMap[k]
+			if !ok {
+				r = &row{
+					fingerprint: k,
+					inRates:     make([]float64, len(RateWindows)),
+					outRates:    make([]float64, len(RateWindows)),
+				}
+				if !r.match(t.filter) {
+					continue
+				}
+				rowMap[k] = r
+			}
+
+			r.inRates[i] = float64(f.InboundBytes*8) / float64(span)
+			r.outRates[i] = float64(f.OutboundBytes*8) / float64(span)
+			t.totalIn[i] += r.inRates[i]
+			t.totalOut[i] += r.outRates[i]
+		}
+	}
+
+	for _, r := range rowMap {
+		t.rows = append(t.rows, r)
+	}
+	t.sortRows()
+}
+
+// sortRows breaks ties on the fingerprint so rows of equal rates keep their place between refreshes
+func (t *Tui) sortRows() {
+	sort.Slice(t.rows, func(i, j int) bool {
+		ri, rj := t.rows[i], t.rows[j]
+		switch t.sortBy {
+		case SortBySource:
+			if ri.fingerprint.SrcAddr != rj.fingerprint.SrcAddr {
+				return ri.fingerprint.SrcAddr < rj.fingerprint.SrcAddr
+			}
+		case SortByDestination:
+			if ri.fingerprint.DstAddr != rj.fingerprint.DstAddr {
+				return ri.fingerprint.DstAddr < rj.fingerprint.DstAddr
+			}
+		default:
+			vi := ri.inRates[t.sortBy] + ri.outRates[t.sortBy]
+			vj := rj.inRates[t.sortBy] + rj.outRates[t.sortBy]
+			if vi != vj {
+				return vi > vj
+			}
+		}
+
+		return accounting.FingerprintLess(&ri.fingerprint, &rj.fingerprint)
+	})
+}
+
+func (t *Tui) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width < 40 || height < 8 {
+		width, height = 80, 24
+	}
+
+	rateWidth := 8
+	hostWidth := (width - 3*rateWidth - 4) / 2
+
+	scale := 10.0
+	for _, r := range t.rows {
+		for scale < r.inRates[1] || scale < r.outRates[1] {
+			scale *= 10
+		}
+	}
+
+	lines := make([]string, 0, height)
+
+	header := ""
+	for i := 1; i <= 5; i++ {
+		tick := formatRate(math.Pow(scale, float64(i)/5))
+		pos := width*i/5 - len(tick)
+		if pos > len(header) {
+			header += strings.Repeat(" ", pos-len(header)) + tick
+		}
+	}
+	lines = append(lines, header)
+	lines = append(lines, strings.Repeat("-", width))
+
+	footerLines := 5
+	maxRows := (height - len(lines) - footerLines) / 2
+	for i, r := range t.rows {
+		if i >= maxRows {
+			break
+		}
+
+		local, remote := r.label(t.isL4)
+		out := fmt.Sprintf("%-*s => %-*s%*s%*s%*s", hostWidth, truncate(local, hostWidth), hostWidth,
+			truncate(remote, hostWidth), rateWidth, formatRate(r.outRates[0]), rateWidth, formatRate(r.outRates[1]),
+			rateWidth, formatRate(r.outRates[2]))
+		in := fmt.Sprintf("%-*s <= %-*s%*s%*s%*s", hostWidth, "", hostWidth, "", rateWidth,
+			formatRate(r.inRates[0]), rateWidth, formatRate(r.inRates[1]), rateWidth, formatRate(r.inRates[2]))
+		lines = append(lines, bar(out, barLength(r.outRates[1], scale, len(out))))
+		lines = append(lines, bar(in, barLength(r.inRates[1], scale, len(in))))
+	}
+
+	for len(lines) < height-footerLines {
+		lines = append(lines, "")
+	}
+
+	lines = append(lines, strings.Repeat("-", width))
+	lines = append(lines, fmt.Sprintf("%-*s%*s%*s%*s", width-3*rateWidth, "TX:", rateWidth, formatRate(t.totalOut[0]),
+		rateWidth, formatRate(t.totalOut[1]), rateWidth, formatRate(t.totalOut[2])))
+	lines = append(lines, fmt.Sprintf("%-*s%*s%*s%*s", width-3*rateWidth, "RX:", rateWidth, formatRate(t.totalIn[0]),
+		rateWidth, formatRate(t.totalIn[1]), rateWidth, formatRate(t.totalIn[2])))
+
+	layer := "l3"
+	if t.isL4 {
+		layer = "l4"
+	}
+	status := fmt.Sprintf("[%s %s] sort: %s  filter: %q", t.currentIface(), layer, sortNames[t.sortBy], t.filter)
+	if t.isPaused {
+		status += "  PAUSED"
+	}
+	if t.tsEnd != 0 {
+		status += "  " + time.Unix(t.tsEnd, 0).Format("15:04:05")
+	}
+	lines = append(lines, truncate(status, width))
+
+	if t.isFiltering {
+		lines = append(lines, truncate("filter: "+t.filterInput+"_", width))
+	} else {
+		lines = append(lines, truncate("q:quit p:pause s:sort l:l3/l4 tab:interface /:filter", width))
+	}
+
+	fmt.Print("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n"))
+}
+
+// barLength maps rate to the line length on a logarithmic scale like iftop
+func barLength(rate float64, scale float64, lineLength int) int {
+	if rate < 1 {
+		return 0
+	}
+
+	l := int(math.Log10(rate) / math.Log10(scale) * float64(lineLength))
+	if l > lineLength {
+		l = lineLength
+	}
+
+	return l
+}
+
+func bar(line string, length int) string {
+	if length <= 0 {
+		return line
+	}
+
+	return "\x1b[7m" + line[:length] + "\x1b[0m" + line[length:]
+}
+
+func truncate(s string, width int) string {
+	if len(s) > width {
+		return s[:width]
+	}
+
+	return s
+}
+
+// formatRate formats bits per second like iftop
+func formatRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2fGb", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2fMb", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.2fKb", bps/1e3)
+	default:
+		return fmt.Sprintf("%.0fb", bps)
+	}
+}
@@ -0,0 +1,210 @@
+package tui
+
+import (
+	"github.com/fs714/goiftop/accounting"
+	"reflect"
+	"testing"
+)
+
+var (
+	fpA = accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.2"}
+	fpC = accounting.FlowFingerprint{SrcAddr: "192.0.2.3", DstAddr: "192.0.2.2"}
+)
+
+// setupAcct accounts eth0 with samples 1, 5 and 30 seconds before the last one and an empty eth1
+func setupAcct() {
+	accounting.GlobalAcct = accounting.NewAccounting()
+	accounting.GlobalAcct.AddInterface("eth0")
+	accounting.GlobalAcct.AddInterface("eth1")
+
+	h, _ := accounting.GlobalAcct.GetInterface("eth0")
+	addSample := func(start int64, inA int64, outC int64) {
+		fc := accounting.NewFlowCollection("eth0")
+		fc.SetTimestamp(start, start+1)
+		fc.UpdateL3Inbound(fpA, inA, 1)
+		if outC > 0 {
+			fc.UpdateL3Outbound(fpC, outC, 1)
+		}
+		h.HistCollection[fc.FlowTimestamp] = fc
+		if fc.End > h.LastTimestamp.End {
+			h.SetLastTimestamp(fc.FlowTimestamp)
+		}
+	}
+	addSample(99, 1000, 0)
+	addSample(95, 2000, 500)
+	addSample(70, 4000, 0)
+}
+
+func TestUpdate(t *testing.T) {
+	setupAcct()
+
+	tests := []struct {
+		filter    string
+		want      map[accounting.FlowFingerprint][2][]float64
+		wantOrder []accounting.FlowFingerprint
+		wantIn    []float64
+		wantOut   []float64
+	}{
+		{
+			want: map[accounting.FlowFingerprint][2][]float64{
+				fpA: {{4000, 2400, 1400}, {0, 0, 0}},
+				fpC: {{0, 0, 0}, {0, 400, 100}},
+			},
+			wantOrder: []accounting.FlowFingerprint{fpA, fpC},
+			wantIn:    []float64{4000, 2400, 1400},
+			wantOut:   []float64{0, 400, 100},
+		},
+		{
+			filter: "192.0.2.3",
+			want: map[accounting.FlowFingerprint][2][]float64{
+				fpC: {{0, 0, 0}, {0, 400, 100}},
+			},
+			wantOrder: []accounting.FlowFingerprint{fpC},
+			wantIn:    []float64{0, 0, 0},
+			wantOut:   []float64{0, 400, 100},
+		},
+	}
+
+	for _, tt := range tests {
+		tui := NewTui(func(string) bool { return false })
+		tui.filter = tt.filter
+		tui.update()
+
+		if tui.tsEnd != 100 {
+			t.Errorf("filter %q: got end %d, want 100", tt.filter, tui.tsEnd)
+		}
+
+		var order []accounting.FlowFingerprint
+		for _, r := range tui.rows {
+			order = append(order, r.fingerprint)
+			want, ok := tt.want[r.fingerprint]
+			if !ok {
+				t.Errorf("filter %q: got unexpected row %v", tt.filter, r.fingerprint)
+				continue
+			}
+			if !reflect.DeepEqual(r.inRates, want[0]) || !reflect.DeepEqual(r.outRates, want[1]) {
+				t.Errorf("filter %q: row %v got rates %v/%v, want %v/%v", tt.filter, r.fingerprint,
+					r.inRates, r.outRates, want[0], want[1])
+			}
+		}
+		if !reflect.DeepEqual(order, tt.wantOrder) {
+			t.Errorf("filter %q: got rows %v, want %v", tt.filter, order, tt.wantOrder)
+		}
+		if !reflect.DeepEqual(tui.totalIn, tt.wantIn) || !reflect.DeepEqual(tui.totalOut, tt.wantOut) {
+			t.Errorf("filter %q: got totals %v/%v, want %v/%v", tt.filter, tui.totalIn, tui.totalOut,
+				tt.wantIn, tt.wantOut)
+		}
+	}
+}
+
+// TestSortRows keeps rows of equal rates in the order of their fingerprints
+func TestSortRows(t *testing.T) {
+	fpB := accounting.FlowFingerprint{SrcAddr: "192.0.2.1", DstAddr: "192.0.2.4"}
+	newRow := func(fp accounting.FlowFingerprint, rate float64) *row {
+		return &row{fingerprint: fp, inRates: []float64{rate, rate, rate}, outRates: []float64{0, 0, 0}}
+	}
+
+	tests := []struct {
+		sortBy int
+		want   []accounting.FlowFingerprint
+	}{
+		{sortBy: SortBy2s, want: []accounting.FlowFingerprint{fpC, fpA, fpB}},
+		{sortBy: SortBySource, want: []accounting.FlowFingerprint{fpA, fpB, fpC}},
+		{sortBy: SortByDestination, want: []accounting.FlowFingerprint{fpA, fpC, fpB}},
+	}
+
+	for _, tt := range tests {
+		for n := 0; n < 10; n++ {
+			tui := &Tui{sortBy: tt.sortBy}
+			tui.rows = []*row{newRow(fpB, 10), newRow(fpA, 10), newRow(fpC, 20)}
+			if n%2 == 1 {
+				tui.rows[0], tui.rows[1] = tui.rows[1], tui.rows[0]
+			}
+			tui.sortRows()
+
+			var got []accounting.FlowFingerprint
+			for _, r := range tui.rows {
+				got = append(got, r.fingerprint)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sort %s: got %v, want %v", sortNames[tt.sortBy], got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHandleKey(t *testing.T) {
+	setupAcct()
+
+	type state struct {
+		ifaceIdx    int
+		isL4        bool
+		sortBy      int
+		isPaused    bool
+		filter      string
+		filterInput string
+		isFiltering bool
+	}
+
+	tests := []struct {
+		name   string
+		keys   string
+		want   state
+		isQuit bool
+	}{
+		{name: "quit", keys: "q", isQuit: true},
+		{name: "ctrl-c", keys: string([]byte{keyCtrlC}), isQuit: true},
+		{name: "pause", keys: "p", want: state{isPaused: true}},
+		{name: "pause twice", keys: "p ", want: state{}},
+		{name: "sort", keys: "ss", want: state{sortBy: SortBy40s}},
+		{name: "sort wraps", keys: "sssss", want: state{sortBy: SortBy2s}},
+		{name: "l4", keys: "l", want: state{isL4: true}},
+		{name: "l4 not decoded", keys: "il", want: state{ifaceIdx: 1}},
+		{name: "l4 reset on interface", keys: "li", want: state{ifaceIdx: 1}},
+		{name: "interface", keys: string([]byte{keyTab}) + "i", want: state{ifaceIdx: 2}},
+		{name: "filter", keys: "/10\r", want: state{filter: "10", filterInput: "10"}},
+		{name: "filter backspace", keys: "/103" + string([]byte{keyBackspace}) + "\r",
+			want: state{filter: "10", filterInput: "10"}},
+		{name: "filter cancel", keys: "/10" + string([]byte{keyEsc}), want: state{filterInput: "10"}},
+		{name: "filter typing q", keys: "/q", want: state{filterInput: "q", isFiltering: true}},
+		{name: "filter ctrl-c", keys: "/" + string([]byte{keyCtrlC}), isQuit: true,
+			want: state{isFiltering: true}},
+	}
+
+	for _, tt := range tests {
+		tui := NewTui(func(ifaceName string) bool { return ifaceName == "eth0" })
+
+		isQuit := false
+		for i := 0; i < len(tt.keys) && !isQuit; i++ {
+			isQuit = tui.handleKey(tt.keys[i])
+		}
+
+		got := state{tui.ifaceIdx, tui.isL4, tui.sortBy, tui.isPaused, tui.filter, tui.filterInput, tui.isFiltering}
+		if isQuit != tt.isQuit || got != tt.want {
+			t.Errorf("%s: got %+v quit %t, want %+v quit %t", tt.name, got, isQuit, tt.want, tt.isQuit)
+		}
+	}
+}
+
+func TestBarLength(t *testing.T) {
+	tests := []struct {
+		rate       float64
+		scale      float64
+		lineLength int
+		want       int
+	}{
+		{rate: 0, scale: 1e6, lineLength: 60, want: 0},
+		{rate: 0.5, scale: 1e6, lineLength: 60, want: 0},
+		{rate: 1, scale: 1e6, lineLength: 60, want: 0},
+		{rate: 1e3, scale: 1e6, lineLength: 60, want: 30},
+		{rate: 1e6, scale: 1e6, lineLength: 60, want: 60},
+		{rate: 1e9, scale: 1e6, lineLength: 60, want: 60},
+	}
+
+	for _, tt := range tests {
+		if got := barLength(tt.rate, tt.scale, tt.lineLength); got != tt.want {
+			t.Errorf("barLength(%v, %v, %d): got %d, want %d", tt.rate, tt.scale, tt.lineLength, got, tt.want)
+		}
+	}
+}
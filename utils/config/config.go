@@ -2,46 +2,183 @@ package config
 
 import (
 	"errors"
+	"flag"
 	"github.com/fs714/goiftop/utils/log"
-	"github.com/google/gopacket/pcap"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+var ConfigFile string
 var IfaceListString string
 var GroupListString string
 var Engine string
 var IsDecodeL4 bool
+var UseVlan bool
+var TunnelDecap bool
+var TunnelTag bool
+var ReplayFile string
+var ReplaySpeed float64
+var ReplayDirection string
+var CollectorListen string
+var CollectorExporters string
+var CollectorIdleTimeout int64
+var FanoutWorkers int
+var FanoutMode string
+var TuiEnable bool
 var PrintEnable bool
 var PrintInterval int64
+var PrintGroupBy string
+var PrintSortBy string
+var PrintTopN int
+var PrintHuman bool
+var GroupPrefixV4 int
+var GroupPrefixV6 int
+var OnceDuration int64
+var OncePackets int64
+var OnceFormat string
+var OnceFile string
+var OutputFormat string
+var OutputFile string
+var OutputInterval int64
 var WebHookEnable bool
 var WebHookUrl string
 var WebHookInterval int64
 var WebHookPostTimeout int
 var WebHookNodeId string
 var WebHookNodeOamAddr string
+var WebHookRetries int
+var WebHookBackoff int64
+var WebHookMaxBackoff int64
+var WebHookSpoolDir string
+var WebHookSpoolMax int
+var WebHookToken string
+var WebHookTokenFile string
+var WebHookHmacSecret string
+var WebHookHmacSecretFile string
+var WebHookCaFile string
+var WebHookCertFile string
+var WebHookKeyFile string
+var WebHookGzip bool
+var WebHookPayloadVersion int
+var NetflowCollector string
+var NetflowVersion string
+var NetflowActiveTimeout int64
+var NetflowInactiveTimeout int64
+var NetflowTemplateRefresh int64
+var NetflowDomainId int64
+var ServerEnable bool
+var ServerToken string
+var ServerTokenFile string
+var ServerHmacSecret string
+var ServerHmacSecretFile string
+var ServerMaxSkew int64
+var ServerRetention int64
+var ServerNodeTimeout int64
 var IsEnableHttpSrv bool
 var HttpSrvAddr string
 var HttpSrvPort string
 var IsProfiling bool
+var ReloadToken string
+var MetricsTopN int
+var MetricsWindow int64
 var IsShowVersion bool
 
-type NfLogConfig struct {
-	IfaceName string
-	GroupId   int
-	Direction pcap.Direction
-}
+var Interfaces []InterfaceConfig
+var Notifiers []NotifierConfig
+
+// LoadConfig merges the config file, if any, with the flags into Interfaces and the globals
+func LoadConfig() (err error) {
+	Interfaces = nil
+	Notifiers = nil
 
-var IfaceList []string
-var NflogConfigList []NfLogConfig
+	if ConfigFile != "" {
+		var fc *FileConfig
+		fc, err = ReadFileConfig(ConfigFile)
+		if err != nil {
+			err = errors.New("failed to read config file " + ConfigFile + ": " + err.Error())
+			log.Errorf(err.Error())
+			return
+		}
+		ApplyFileConfig(fc)
+	}
+
+	if len(Interfaces) == 0 {
+		if Engine == "nflog" {
+			err = ParseNflogConfig()
+		} else if Engine == "pcapfile" {
+			ParseReplayConfig()
+		} else if Engine == "collector" {
+			ParseCollectorConfig()
+		} else {
+			ParseIfaces()
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	NormalizeInterfaces()
+
+	return
+}
 
 func ParseIfaces() {
+	if IfaceListString == "" {
+		return
+	}
+
 	for _, iface := range strings.Split(IfaceListString, ",") {
-		IfaceList = append(IfaceList, strings.TrimSpace(iface))
+		Interfaces = append(Interfaces, InterfaceConfig{
+			Name:   strings.TrimSpace(iface),
+			Engine: Engine,
+		})
 	}
 }
 
+func ParseReplayConfig() {
+	if ReplayFile == "" {
+		return
+	}
+
+	speed := ReplaySpeed
+	ifaceConf := InterfaceConfig{
+		Name:        filepath.Base(ReplayFile),
+		Engine:      Engine,
+		Direction:   strings.ToLower(strings.TrimSpace(ReplayDirection)),
+		ReplayFile:  ReplayFile,
+		ReplaySpeed: &speed,
+	}
+	if IfaceListString != "" {
+		ifaceConf.Name = strings.TrimSpace(IfaceListString)
+	}
+
+	Interfaces = append(Interfaces, ifaceConf)
+}
+
+func ParseCollectorConfig() {
+	if CollectorListen == "" {
+		return
+	}
+
+	ifaceConf := InterfaceConfig{
+		Name:       DefaultCollectorName,
+		Engine:     Engine,
+		ListenAddr: CollectorListen,
+	}
+	if IfaceListString != "" {
+		ifaceConf.Name = strings.TrimSpace(IfaceListString)
+	}
+
+	Interfaces = append(Interfaces, ifaceConf)
+}
+
 func ParseNflogConfig() (err error) {
+	if GroupListString == "" {
+		return
+	}
+
+	ifaceIdx := make(map[string]int)
 	for _, gpString := range strings.Split(GroupListString, ",") {
 		gp := strings.Split(strings.TrimSpace(gpString), ":")
 
@@ -60,26 +197,185 @@ func ParseNflogConfig() (err error) {
 			return
 		}
 
-		var direction pcap.Direction
-		if strings.ToLower(strings.TrimSpace(gp[2])) == "in" {
-			direction = pcap.DirectionIn
-		} else if strings.ToLower(strings.TrimSpace(gp[2])) == "out" {
-			direction = pcap.DirectionOut
+		idx, ok := ifaceIdx[iface]
+		if !ok {
+			Interfaces = append(Interfaces, InterfaceConfig{
+				Name:   iface,
+				Engine: Engine,
+			})
+			idx = len(Interfaces) - 1
+			ifaceIdx[iface] = idx
+		}
+
+		if strings.ToLower(strings.TrimSpace(gp[2])) == DirectionIn {
+			Interfaces[idx].NflogGroupIn = groupId
+		} else if strings.ToLower(strings.TrimSpace(gp[2])) == DirectionOut {
+			Interfaces[idx].NflogGroupOut = groupId
 		} else {
 			err = errors.New("invalid interface, group id and direction list: " + GroupListString)
 			log.Errorf(err.Error())
 			return
 		}
+	}
+
+	for i := range Interfaces {
+		if Interfaces[i].NflogGroupIn != 0 && Interfaces[i].NflogGroupOut == 0 {
+			Interfaces[i].Direction = DirectionIn
+		} else if Interfaces[i].NflogGroupIn == 0 && Interfaces[i].NflogGroupOut != 0 {
+			Interfaces[i].Direction = DirectionOut
+		}
+	}
+
+	return
+}
+
+// NormalizeInterfaces fills in the defaults of the interface settings left empty
+func NormalizeInterfaces() {
+	for i := range Interfaces {
+		c := &Interfaces[i]
+		c.Name = strings.TrimSpace(c.Name)
+		c.Engine = strings.ToLower(strings.TrimSpace(c.Engine))
+		c.Direction = strings.ToLower(strings.TrimSpace(c.Direction))
+		c.FanoutMode = strings.ToLower(strings.TrimSpace(c.FanoutMode))
+
+		if c.Engine == "" {
+			c.Engine = Engine
+		}
 
-		nflogConf := NfLogConfig{
-			IfaceName: iface,
-			GroupId:   groupId,
-			Direction: direction,
+		if c.Name == "" && c.ReplayFile != "" {
+			c.Name = filepath.Base(c.ReplayFile)
 		}
 
-		IfaceList = append(IfaceList, iface)
-		NflogConfigList = append(NflogConfigList, nflogConf)
+		if c.Name == "" && c.ListenAddr != "" {
+			c.Name = DefaultCollectorName
+		}
+
+		if c.Direction == "" {
+			if c.ReplayFile != "" {
+				c.Direction = DirectionIn
+			} else {
+				c.Direction = DirectionBoth
+			}
+		}
+
+		if c.SnapLen == 0 {
+			c.SnapLen = DefaultSnapLen
+		}
+
+		if c.MmapBufferSizeMb == 0 {
+			c.MmapBufferSizeMb = DefaultMmapBufferSizeMb
+		}
+
+		if c.FanoutWorkers == 0 {
+			c.FanoutWorkers = FanoutWorkers
+		}
+
+		if c.FanoutMode == "" {
+			c.FanoutMode = FanoutMode
+		}
+
+		if c.Engine == "collector" {
+			if len(c.Exporters) == 0 && CollectorExporters != "" {
+				c.Exporters = strings.Split(CollectorExporters, ",")
+			}
+
+			if c.IdleTimeout == 0 {
+				c.IdleTimeout = CollectorIdleTimeout
+			}
+		}
+
+		if c.ReplaySpeed == nil {
+			speed := float64(1)
+			c.ReplaySpeed = &speed
+		}
+
+		// Resolved here so a changed global l4 setting shows up as a changed interface on reload
+		if c.IsDecodeL4 == nil {
+			isDecodeL4 := IsDecodeL4
+			c.IsDecodeL4 = &isDecodeL4
+		}
+
+		if c.UseVlan == nil {
+			useVlan := UseVlan
+			c.UseVlan = &useVlan
+		}
+
+		if c.TunnelDecap == nil {
+			tunnelDecap := TunnelDecap
+			c.TunnelDecap = &tunnelDecap
+		}
+
+		if c.TunnelTag == nil {
+			tunnelTag := TunnelTag
+			c.TunnelTag = &tunnelTag
+		}
+	}
+}
+
+// IfaceNames returns the distinct interface names in configuration order
+func IfaceNames() (names []string) {
+	seen := make(map[string]bool)
+	for _, c := range Interfaces {
+		if !seen[c.Name] {
+			seen[c.Name] = true
+			names = append(names, c.Name)
+		}
+	}
+
+	return
+}
+
+// ConfigState is a snapshot of the settings, used to roll back a reload with an invalid config
+type ConfigState struct {
+	values     map[string]string
+	interfaces []InterfaceConfig
+	notifiers  []NotifierConfig
+}
+
+func SaveConfig() (s *ConfigState) {
+	s = &ConfigState{
+		values:     make(map[string]string),
+		interfaces: append([]InterfaceConfig(nil), Interfaces...),
+		notifiers:  append([]NotifierConfig(nil), Notifiers...),
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		s.values[f.Name] = f.Value.String()
+	})
+
+	return
+}
+
+func (s *ConfigState) Restore() {
+	flag.VisitAll(func(f *flag.Flag) {
+		_ = f.Value.Set(s.values[f.Name])
+	})
+	Interfaces = s.interfaces
+	Notifiers = s.notifiers
+}
+
+// ChangedFlags returns which of the given settings, named by their flags, differ from the snapshot
+func (s *ConfigState) ChangedFlags(names ...string) (changed []string) {
+	for _, name := range names {
+		f := flag.Lookup(name)
+		if f != nil && f.Value.String() != s.values[name] {
+			changed = append(changed, name)
+		}
 	}
 
 	return
 }
+
+// ReloadConfig resets the settings not given on the command line to their defaults and loads the config
+// file again, so settings removed from the file fall back to their defaults as well
+func ReloadConfig() (err error) {
+	isSet := setFlags()
+	flag.VisitAll(func(f *flag.Flag) {
+		if !isSet[f.Name] {
+			_ = f.Value.Set(f.DefValue)
+		}
+	})
+
+	err = LoadConfig()
+
+	return
+}
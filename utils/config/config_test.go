@@ -0,0 +1,105 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestReloadConfig reloads a changed config file, settings removed from the file fall back to their defaults
+// and flags given on the command line are kept
+func TestReloadConfig(t *testing.T) {
+	path := writeFile(t, "goiftop.yaml", testYaml)
+	testFlags(t, "-config", path, "-l4=false")
+	err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path, []byte("l4: true\nvlan: true\ninterfaces:\n  - name: eth9\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if Engine != "libpcap" || PrintInterval != 2 || PrintSortBy != "bytes" || WebHookUrl != "" {
+		t.Errorf("settings removed from the file are not reset, got engine %s, print interval %d, sort %s and "+
+			"webhook url %s", Engine, PrintInterval, PrintSortBy, WebHookUrl)
+	}
+	if IsDecodeL4 || !UseVlan {
+		t.Errorf("got l4 %t and vlan %t, want the flag and the file", IsDecodeL4, UseVlan)
+	}
+	if names := IfaceNames(); !reflect.DeepEqual(names, []string{"eth9"}) || len(Notifiers) != 0 {
+		t.Errorf("got interfaces %q and %d notifiers", names, len(Notifiers))
+	}
+}
+
+// TestReloadConfigRestore rolls a reload of an invalid config file back to the settings before
+func TestReloadConfigRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"unknown key", "engine: afpacket\nprint:\n  intervall: 5\n"},
+		{"not yaml", "engine: [afpacket\n"},
+		{"removed", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, "goiftop.yaml", testYaml)
+			testFlags(t, "-config", path, "-print.sort", "packets")
+			err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantInterfaces := append([]InterfaceConfig(nil), Interfaces...)
+			wantNotifiers := append([]NotifierConfig(nil), Notifiers...)
+			state := SaveConfig()
+
+			if tt.content == "" {
+				err = os.Remove(path)
+			} else {
+				err = os.WriteFile(path, []byte(tt.content), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = ReloadConfig()
+			if err == nil {
+				t.Fatal("invalid config file reloaded")
+			}
+
+			state.Restore()
+			if Engine != "afpacket" || !IsDecodeL4 || PrintInterval != 5 || PrintSortBy != "packets" ||
+				WebHookUrl != "http://127.0.0.1:8080/flows" {
+				t.Errorf("settings not restored, got engine %s, l4 %t, print interval %d, sort %s and webhook "+
+					"url %s", Engine, IsDecodeL4, PrintInterval, PrintSortBy, WebHookUrl)
+			}
+			if !reflect.DeepEqual(Interfaces, wantInterfaces) || !reflect.DeepEqual(Notifiers, wantNotifiers) {
+				t.Errorf("got interfaces %+v and notifiers %+v", Interfaces, Notifiers)
+			}
+			if changed := state.ChangedFlags("engine", "l4", "print.interval"); len(changed) != 0 {
+				t.Errorf("flags %q changed after restore", changed)
+			}
+		})
+	}
+}
+
+func TestChangedFlags(t *testing.T) {
+	testFlags(t)
+	state := SaveConfig()
+
+	Engine = "afpacket"
+	PrintInterval = 5
+	changed := state.ChangedFlags("engine", "l4", "print.interval", "unknown")
+	if !reflect.DeepEqual(changed, []string{"engine", "print.interval"}) {
+		t.Errorf("got changed flags %q", changed)
+	}
+}
@@ -0,0 +1,339 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const DirectionIn = "in"
+const DirectionOut = "out"
+const DirectionBoth = "both"
+
+const DefaultSnapLen = 65535
+const DefaultMmapBufferSizeMb = 16
+const DefaultCollectorName = "collector"
+
+// InterfaceConfig holds the capture settings of one interface. Zero values fall back to the defaults and
+// the global settings when interfaces are normalized.
+type InterfaceConfig struct {
+	Name             string   `yaml:"name" toml:"name"`
+	Engine           string   `yaml:"engine" toml:"engine"`
+	BpfFilter        string   `yaml:"bpf_filter" toml:"bpf_filter"`
+	SnapLen          int      `yaml:"snaplen" toml:"snaplen"`
+	MmapBufferSizeMb int      `yaml:"mmap_buffer_mb" toml:"mmap_buffer_mb"`
+	UseVlan          *bool    `yaml:"vlan" toml:"vlan"`
+	FanoutWorkers    int      `yaml:"fanout_workers" toml:"fanout_workers"`
+	FanoutMode       string   `yaml:"fanout_mode" toml:"fanout_mode"`
+	IsDecodeL4       *bool    `yaml:"l4" toml:"l4"`
+	TunnelDecap      *bool    `yaml:"tunnel_decap" toml:"tunnel_decap"`
+	TunnelTag        *bool    `yaml:"tunnel_tag" toml:"tunnel_tag"`
+	Direction        string   `yaml:"direction" toml:"direction"`
+	NflogGroupIn     int      `yaml:"nflog_group_in" toml:"nflog_group_in"`
+	NflogGroupOut    int      `yaml:"nflog_group_out" toml:"nflog_group_out"`
+	ReplayFile       string   `yaml:"replay_file" toml:"replay_file"`
+	ReplaySpeed      *float64 `yaml:"replay_speed" toml:"replay_speed"`
+	ListenAddr       string   `yaml:"listen_addr" toml:"listen_addr"`
+	Exporters        []string `yaml:"exporters" toml:"exporters"`
+	IdleTimeout      int64    `yaml:"idle_timeout" toml:"idle_timeout"`
+}
+
+func (c *InterfaceConfig) DecodeL4() bool {
+	if c.IsDecodeL4 == nil {
+		return IsDecodeL4
+	}
+
+	return *c.IsDecodeL4
+}
+
+func (c *InterfaceConfig) AccountVlans() bool {
+	if c.UseVlan == nil {
+		return UseVlan
+	}
+
+	return *c.UseVlan
+}
+
+func (c *InterfaceConfig) DecapTunnels() bool {
+	if c.TunnelDecap == nil {
+		return TunnelDecap
+	}
+
+	return *c.TunnelDecap
+}
+
+func (c *InterfaceConfig) TagTunnels() bool {
+	if c.TunnelTag == nil {
+		return TunnelTag
+	}
+
+	return *c.TunnelTag
+}
+
+type AfpacketFileConfig struct {
+	FanoutWorkers *int    `yaml:"fanout_workers" toml:"fanout_workers"`
+	FanoutMode    *string `yaml:"fanout_mode" toml:"fanout_mode"`
+}
+
+type TunnelFileConfig struct {
+	Decap *bool `yaml:"decap" toml:"decap"`
+	Tag   *bool `yaml:"tag" toml:"tag"`
+}
+
+type PrintFileConfig struct {
+	Enable   *bool   `yaml:"enable" toml:"enable"`
+	Interval *int64  `yaml:"interval" toml:"interval"`
+	Group    *string `yaml:"group" toml:"group"`
+	Sort     *string `yaml:"sort" toml:"sort"`
+	TopN     *int    `yaml:"top_n" toml:"top_n"`
+	Human    *bool   `yaml:"human" toml:"human"`
+}
+
+type GroupFileConfig struct {
+	PrefixV4 *int `yaml:"prefix_v4" toml:"prefix_v4"`
+	PrefixV6 *int `yaml:"prefix_v6" toml:"prefix_v6"`
+}
+
+type OutputFileConfig struct {
+	Format   *string `yaml:"format" toml:"format"`
+	File     *string `yaml:"file" toml:"file"`
+	Interval *int64  `yaml:"interval" toml:"interval"`
+}
+
+// NotifierConfig is a notifier of the config file. Type selects a registered notifier type, and the notifier
+// reports the flows of Interfaces, or all interfaces when empty, matching the addr, port, protocol and vlan
+// filter, rolled up by the group key when given. Options are passed to the notifier type as they are.
+type NotifierConfig struct {
+	Name       string                 `yaml:"name" toml:"name"`
+	Type       string                 `yaml:"type" toml:"type"`
+	Interval   int64                  `yaml:"interval" toml:"interval"`
+	Interfaces []string               `yaml:"interfaces" toml:"interfaces"`
+	Addr       string                 `yaml:"addr" toml:"addr"`
+	Port       uint16                 `yaml:"port" toml:"port"`
+	Protocol   string                 `yaml:"protocol" toml:"protocol"`
+	Vlan       uint16                 `yaml:"vlan" toml:"vlan"`
+	Group      string                 `yaml:"group" toml:"group"`
+	PrefixV4   *int                   `yaml:"prefix_v4" toml:"prefix_v4"`
+	PrefixV6   *int                   `yaml:"prefix_v6" toml:"prefix_v6"`
+	Options    map[string]interface{} `yaml:"options" toml:"options"`
+}
+
+type WebhookFileConfig struct {
+	Enable         *bool   `yaml:"enable" toml:"enable"`
+	Url            *string `yaml:"url" toml:"url"`
+	Interval       *int64  `yaml:"interval" toml:"interval"`
+	PostTimeout    *int    `yaml:"post_timeout" toml:"post_timeout"`
+	NodeId         *string `yaml:"node_id" toml:"node_id"`
+	NodeOamAddr    *string `yaml:"node_oam_addr" toml:"node_oam_addr"`
+	Retries        *int    `yaml:"retries" toml:"retries"`
+	Backoff        *int64  `yaml:"backoff" toml:"backoff"`
+	MaxBackoff     *int64  `yaml:"max_backoff" toml:"max_backoff"`
+	SpoolDir       *string `yaml:"spool_dir" toml:"spool_dir"`
+	SpoolMax       *int    `yaml:"spool_max" toml:"spool_max"`
+	Token          *string `yaml:"token" toml:"token"`
+	TokenFile      *string `yaml:"token_file" toml:"token_file"`
+	HmacSecret     *string `yaml:"hmac_secret" toml:"hmac_secret"`
+	HmacSecretFile *string `yaml:"hmac_secret_file" toml:"hmac_secret_file"`
+	CaFile         *string `yaml:"ca_file" toml:"ca_file"`
+	CertFile       *string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile        *string `yaml:"key_file" toml:"key_file"`
+	Gzip           *bool   `yaml:"gzip" toml:"gzip"`
+	PayloadVersion *int    `yaml:"payload_version" toml:"payload_version"`
+}
+
+type NetflowFileConfig struct {
+	Collector       *string `yaml:"collector" toml:"collector"`
+	Version         *string `yaml:"version" toml:"version"`
+	ActiveTimeout   *int64  `yaml:"active_timeout" toml:"active_timeout"`
+	InactiveTimeout *int64  `yaml:"inactive_timeout" toml:"inactive_timeout"`
+	TemplateRefresh *int64  `yaml:"template_refresh" toml:"template_refresh"`
+	DomainId        *int64  `yaml:"domain_id" toml:"domain_id"`
+}
+
+type ServerFileConfig struct {
+	Enable         *bool   `yaml:"enable" toml:"enable"`
+	Token          *string `yaml:"token" toml:"token"`
+	TokenFile      *string `yaml:"token_file" toml:"token_file"`
+	HmacSecret     *string `yaml:"hmac_secret" toml:"hmac_secret"`
+	HmacSecretFile *string `yaml:"hmac_secret_file" toml:"hmac_secret_file"`
+	MaxSkew        *int64  `yaml:"max_skew" toml:"max_skew"`
+	Retention      *int64  `yaml:"retention" toml:"retention"`
+	NodeTimeout    *int64  `yaml:"node_timeout" toml:"node_timeout"`
+}
+
+type HttpFileConfig struct {
+	Enable      *bool   `yaml:"enable" toml:"enable"`
+	Addr        *string `yaml:"addr" toml:"addr"`
+	Port        *string `yaml:"port" toml:"port"`
+	Profiling   *bool   `yaml:"profiling" toml:"profiling"`
+	ReloadToken *string `yaml:"reload_token" toml:"reload_token"`
+}
+
+type MetricsFileConfig struct {
+	TopN   *int   `yaml:"top_n" toml:"top_n"`
+	Window *int64 `yaml:"window" toml:"window"`
+}
+
+// FileConfig is the layout of the yaml or toml configuration file, flags given on the command line
+// override the values of the file
+type FileConfig struct {
+	Engine     *string            `yaml:"engine" toml:"engine"`
+	IsDecodeL4 *bool              `yaml:"l4" toml:"l4"`
+	UseVlan    *bool              `yaml:"vlan" toml:"vlan"`
+	Tui        *bool              `yaml:"tui" toml:"tui"`
+	Interfaces []InterfaceConfig  `yaml:"interfaces" toml:"interfaces"`
+	Afpacket   AfpacketFileConfig `yaml:"afpacket" toml:"afpacket"`
+	Tunnel     TunnelFileConfig   `yaml:"tunnel" toml:"tunnel"`
+	Group      GroupFileConfig    `yaml:"group" toml:"group"`
+	Print      PrintFileConfig    `yaml:"print" toml:"print"`
+	Output     OutputFileConfig   `yaml:"output" toml:"output"`
+	Webhook    WebhookFileConfig  `yaml:"webhook" toml:"webhook"`
+	Netflow    NetflowFileConfig  `yaml:"netflow" toml:"netflow"`
+	Notifiers  []NotifierConfig   `yaml:"notifiers" toml:"notifiers"`
+	Server     ServerFileConfig   `yaml:"server" toml:"server"`
+	Http       HttpFileConfig     `yaml:"http" toml:"http"`
+	Metrics    MetricsFileConfig  `yaml:"metrics" toml:"metrics"`
+}
+
+// ReadFileConfig strictly decodes a yaml or toml file by its extension, unknown keys are rejected
+func ReadFileConfig(path string) (fc *FileConfig, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	fc = &FileConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, fc)
+	case ".toml":
+		d := toml.NewDecoder(bytes.NewReader(data))
+		d.DisallowUnknownFields()
+		err = d.Decode(fc)
+	default:
+		err = errors.New("unknown config file format: " + path)
+	}
+
+	return
+}
+
+func setFlags() (names map[string]bool) {
+	names = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+
+	return
+}
+
+func applyString(dst *string, src *string, flagName string, isSet map[string]bool) {
+	if src != nil && !isSet[flagName] {
+		*dst = *src
+	}
+}
+
+func applyBool(dst *bool, src *bool, flagName string, isSet map[string]bool) {
+	if src != nil && !isSet[flagName] {
+		*dst = *src
+	}
+}
+
+func applyInt(dst *int, src *int, flagName string, isSet map[string]bool) {
+	if src != nil && !isSet[flagName] {
+		*dst = *src
+	}
+}
+
+func applyInt64(dst *int64, src *int64, flagName string, isSet map[string]bool) {
+	if src != nil && !isSet[flagName] {
+		*dst = *src
+	}
+}
+
+// ApplyFileConfig sets the globals from fc unless the matching flag is given on the command line
+func ApplyFileConfig(fc *FileConfig) {
+	isSet := setFlags()
+
+	applyString(&Engine, fc.Engine, "engine", isSet)
+	applyBool(&IsDecodeL4, fc.IsDecodeL4, "l4", isSet)
+	applyBool(&UseVlan, fc.UseVlan, "vlan", isSet)
+	applyBool(&TuiEnable, fc.Tui, "tui", isSet)
+
+	applyInt(&FanoutWorkers, fc.Afpacket.FanoutWorkers, "afpacket.fanout_workers", isSet)
+	applyString(&FanoutMode, fc.Afpacket.FanoutMode, "afpacket.fanout_mode", isSet)
+
+	applyBool(&TunnelDecap, fc.Tunnel.Decap, "tunnel.decap", isSet)
+	applyBool(&TunnelTag, fc.Tunnel.Tag, "tunnel.tag", isSet)
+
+	applyInt(&GroupPrefixV4, fc.Group.PrefixV4, "group.prefix_v4", isSet)
+	applyInt(&GroupPrefixV6, fc.Group.PrefixV6, "group.prefix_v6", isSet)
+
+	applyBool(&PrintEnable, fc.Print.Enable, "print.enable", isSet)
+	applyInt64(&PrintInterval, fc.Print.Interval, "print.interval", isSet)
+	applyString(&PrintGroupBy, fc.Print.Group, "print.group", isSet)
+	applyString(&PrintSortBy, fc.Print.Sort, "print.sort", isSet)
+	applyInt(&PrintTopN, fc.Print.TopN, "print.top_n", isSet)
+	applyBool(&PrintHuman, fc.Print.Human, "print.human", isSet)
+
+	applyString(&OutputFormat, fc.Output.Format, "output.format", isSet)
+	applyString(&OutputFile, fc.Output.File, "output.file", isSet)
+	applyInt64(&OutputInterval, fc.Output.Interval, "output.interval", isSet)
+
+	applyBool(&WebHookEnable, fc.Webhook.Enable, "webhook.enable", isSet)
+	applyString(&WebHookUrl, fc.Webhook.Url, "webhook.url", isSet)
+	applyInt64(&WebHookInterval, fc.Webhook.Interval, "webhook.interval", isSet)
+	applyInt(&WebHookPostTimeout, fc.Webhook.PostTimeout, "webhook.post_timeout", isSet)
+	applyString(&WebHookNodeId, fc.Webhook.NodeId, "webhook.node_id", isSet)
+	applyString(&WebHookNodeOamAddr, fc.Webhook.NodeOamAddr, "webhook.node_oam_addr", isSet)
+	applyInt(&WebHookRetries, fc.Webhook.Retries, "webhook.retries", isSet)
+	applyInt64(&WebHookBackoff, fc.Webhook.Backoff, "webhook.backoff", isSet)
+	applyInt64(&WebHookMaxBackoff, fc.Webhook.MaxBackoff, "webhook.max_backoff", isSet)
+	applyString(&WebHookSpoolDir, fc.Webhook.SpoolDir, "webhook.spool_dir", isSet)
+	applyInt(&WebHookSpoolMax, fc.Webhook.SpoolMax, "webhook.spool_max", isSet)
+	applyString(&WebHookToken, fc.Webhook.Token, "webhook.token", isSet)
+	applyString(&WebHookTokenFile, fc.Webhook.TokenFile, "webhook.token_file", isSet)
+	applyString(&WebHookHmacSecret, fc.Webhook.HmacSecret, "webhook.hmac_secret", isSet)
+	applyString(&WebHookHmacSecretFile, fc.Webhook.HmacSecretFile, "webhook.hmac_secret_file", isSet)
+	applyString(&WebHookCaFile, fc.Webhook.CaFile, "webhook.ca_file", isSet)
+	applyString(&WebHookCertFile, fc.Webhook.CertFile, "webhook.cert_file", isSet)
+	applyString(&WebHookKeyFile, fc.Webhook.KeyFile, "webhook.key_file", isSet)
+	applyBool(&WebHookGzip, fc.Webhook.Gzip, "webhook.gzip", isSet)
+	applyInt(&WebHookPayloadVersion, fc.Webhook.PayloadVersion, "webhook.payload_version", isSet)
+
+	applyString(&NetflowCollector, fc.Netflow.Collector, "netflow.collector", isSet)
+	applyString(&NetflowVersion, fc.Netflow.Version, "netflow.version", isSet)
+	applyInt64(&NetflowActiveTimeout, fc.Netflow.ActiveTimeout, "netflow.active_timeout", isSet)
+	applyInt64(&NetflowInactiveTimeout, fc.Netflow.InactiveTimeout, "netflow.inactive_timeout", isSet)
+	applyInt64(&NetflowTemplateRefresh, fc.Netflow.TemplateRefresh, "netflow.template_refresh", isSet)
+	applyInt64(&NetflowDomainId, fc.Netflow.DomainId, "netflow.domain_id", isSet)
+
+	applyBool(&ServerEnable, fc.Server.Enable, "server", isSet)
+	applyString(&ServerToken, fc.Server.Token, "server.token", isSet)
+	applyString(&ServerTokenFile, fc.Server.TokenFile, "server.token_file", isSet)
+	applyString(&ServerHmacSecret, fc.Server.HmacSecret, "server.hmac_secret", isSet)
+	applyString(&ServerHmacSecretFile, fc.Server.HmacSecretFile, "server.hmac_secret_file", isSet)
+	applyInt64(&ServerMaxSkew, fc.Server.MaxSkew, "server.max_skew", isSet)
+	applyInt64(&ServerRetention, fc.Server.Retention, "server.retention", isSet)
+	applyInt64(&ServerNodeTimeout, fc.Server.NodeTimeout, "server.node_timeout", isSet)
+
+	applyBool(&IsEnableHttpSrv, fc.Http.Enable, "http", isSet)
+	applyString(&HttpSrvAddr, fc.Http.Addr, "addr", isSet)
+	applyString(&HttpSrvPort, fc.Http.Port, "port", isSet)
+	applyBool(&IsProfiling, fc.Http.Profiling, "profiling", isSet)
+	applyString(&ReloadToken, fc.Http.ReloadToken, "reload.token", isSet)
+
+	applyInt(&MetricsTopN, fc.Metrics.TopN, "metrics.top_n", isSet)
+	applyInt64(&MetricsWindow, fc.Metrics.Window, "metrics.window", isSet)
+
+	Notifiers = append(Notifiers, fc.Notifiers...)
+
+	// Interfaces given by flags replace the interfaces of the file as a whole
+	if !isSet["i"] && !isSet["nflog"] && !isSet["r"] && !isSet["collector.listen"] {
+		Interfaces = append(Interfaces, fc.Interfaces...)
+	}
+}
@@ -0,0 +1,299 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testFlags defines some of the flags of goiftop on a command line of their own, parsed from args, the command
+// line of the test is restored afterwards
+func testFlags(t *testing.T, args ...string) {
+	commandLine := flag.CommandLine
+	t.Cleanup(func() {
+		flag.CommandLine = commandLine
+	})
+
+	flag.CommandLine = flag.NewFlagSet("goiftop", flag.ContinueOnError)
+	flag.StringVar(&ConfigFile, "config", "", "")
+	flag.StringVar(&IfaceListString, "i", "", "")
+	flag.StringVar(&Engine, "engine", "libpcap", "")
+	flag.BoolVar(&IsDecodeL4, "l4", false, "")
+	flag.BoolVar(&UseVlan, "vlan", false, "")
+	flag.BoolVar(&TunnelDecap, "tunnel.decap", false, "")
+	flag.Int64Var(&PrintInterval, "print.interval", 2, "")
+	flag.StringVar(&PrintSortBy, "print.sort", "bytes", "")
+	flag.StringVar(&WebHookUrl, "webhook.url", "", "")
+
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+const testYaml = `
+engine: afpacket
+l4: true
+print:
+  interval: 5
+  sort: rate
+webhook:
+  url: http://127.0.0.1:8080/flows
+interfaces:
+  - name: eth0
+    l4: false
+    snaplen: 128
+  - name: eth1
+notifiers:
+  - name: stdout
+    type: print
+    interval: 10
+`
+
+const testToml = `
+engine = "afpacket"
+l4 = true
+
+[print]
+interval = 5
+sort = "rate"
+
+[webhook]
+url = "http://127.0.0.1:8080/flows"
+
+[[interfaces]]
+name = "eth0"
+l4 = false
+snaplen = 128
+
+[[interfaces]]
+name = "eth1"
+
+[[notifiers]]
+name = "stdout"
+type = "print"
+interval = 10
+`
+
+func TestReadFileConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		isErr   bool
+	}{
+		{"yaml", "goiftop.yaml", testYaml, false},
+		{"yml", "goiftop.yml", testYaml, false},
+		{"toml", "goiftop.toml", testToml, false},
+		{"unknown yaml key", "goiftop.yaml", "engine: afpacket\nengines: nflog\n", true},
+		{"unknown yaml interface key", "goiftop.yaml", "interfaces:\n  - name: eth0\n    snap_len: 128\n", true},
+		{"unknown toml key", "goiftop.toml", "engine = \"afpacket\"\nengines = \"nflog\"\n", true},
+		{"unknown toml section", "goiftop.toml", "[prints]\ninterval = 5\n", true},
+		{"yaml type mismatch", "goiftop.yaml", "print:\n  interval: soon\n", true},
+		{"toml type mismatch", "goiftop.toml", "[print]\ninterval = \"soon\"\n", true},
+		{"unknown format", "goiftop.json", "{}", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc, err := ReadFileConfig(writeFile(t, tt.file, tt.content))
+			if tt.isErr {
+				if err == nil {
+					t.Error("invalid config file accepted")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("valid config file rejected: %s", err.Error())
+			}
+			if fc.Engine == nil || *fc.Engine != "afpacket" || fc.IsDecodeL4 == nil || !*fc.IsDecodeL4 ||
+				fc.Print.Interval == nil || *fc.Print.Interval != 5 || len(fc.Interfaces) != 2 ||
+				fc.Interfaces[0].IsDecodeL4 == nil || *fc.Interfaces[0].IsDecodeL4 || fc.Interfaces[0].SnapLen != 128 ||
+				len(fc.Notifiers) != 1 || fc.Notifiers[0].Interval != 10 {
+				t.Errorf("got %+v", fc)
+			}
+			if fc.Tui != nil || fc.Metrics.TopN != nil || fc.UseVlan != nil || fc.Print.TopN != nil {
+				t.Error("settings not in the file are not left nil")
+			}
+		})
+	}
+
+	_, err := ReadFileConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err == nil {
+		t.Error("missing config file accepted")
+	}
+}
+
+// TestLoadConfig merges the config file with the flags, flags given on the command line win
+func TestLoadConfig(t *testing.T) {
+	path := writeFile(t, "goiftop.yaml", testYaml)
+
+	tests := []struct {
+		name           string
+		args           []string
+		wantEngine     string
+		wantL4         bool
+		wantInterval   int64
+		wantSort       string
+		wantInterfaces []string
+	}{
+		{"file", []string{"-config", path}, "afpacket", true, 5, "rate", []string{"eth0", "eth1"}},
+		{"flags win", []string{"-config", path, "-engine", "libpcap", "-l4=false", "-print.interval", "1"},
+			"libpcap", false, 1, "rate", []string{"eth0", "eth1"}},
+		{"flag set to its default wins", []string{"-config", path, "-print.sort", "bytes"}, "afpacket", true, 5,
+			"bytes", []string{"eth0", "eth1"}},
+		{"interfaces of flags replace the file", []string{"-config", path, "-i", "eth2, eth3"}, "afpacket", true, 5,
+			"rate", []string{"eth2", "eth3"}},
+		{"no file", []string{"-i", "eth2"}, "libpcap", false, 2, "bytes", []string{"eth2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testFlags(t, tt.args...)
+			err := LoadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if Engine != tt.wantEngine || IsDecodeL4 != tt.wantL4 || PrintInterval != tt.wantInterval ||
+				PrintSortBy != tt.wantSort {
+				t.Errorf("got engine %s, l4 %t, print interval %d and sort %s", Engine, IsDecodeL4, PrintInterval,
+					PrintSortBy)
+			}
+
+			names := IfaceNames()
+			if len(names) != len(tt.wantInterfaces) {
+				t.Fatalf("got interfaces %q, want %q", names, tt.wantInterfaces)
+			}
+			for i := range names {
+				if names[i] != tt.wantInterfaces[i] {
+					t.Fatalf("got interfaces %q, want %q", names, tt.wantInterfaces)
+				}
+			}
+
+			// Interfaces take the engine and l4 setting of the merged globals unless they set their own
+			for _, c := range Interfaces {
+				if c.Engine != tt.wantEngine {
+					t.Errorf("interface %s has engine %s, want %s", c.Name, c.Engine, tt.wantEngine)
+				}
+
+				wantL4 := tt.wantL4
+				if c.Name == "eth0" {
+					wantL4 = false
+				}
+				if c.DecodeL4() != wantL4 {
+					t.Errorf("interface %s has l4 %t, want %t", c.Name, c.DecodeL4(), wantL4)
+				}
+			}
+		})
+	}
+}
+
+// TestNormalizeInterfaces fills in the defaults of settings an interface leaves empty and keeps the ones
+// it sets itself
+func TestNormalizeInterfaces(t *testing.T) {
+	testFlags(t, "-engine", "afpacket", "-vlan")
+	CollectorExporters = "192.0.2.1,192.0.2.2"
+	CollectorIdleTimeout = 600
+	FanoutWorkers, FanoutMode = 4, "hash"
+	defer func() {
+		CollectorExporters, CollectorIdleTimeout = "", 0
+		FanoutWorkers, FanoutMode = 0, ""
+	}()
+	l4, speed := true, float64(0)
+
+	Interfaces = []InterfaceConfig{
+		{Name: " eth0 ", Direction: "IN"},
+		{ReplayFile: "/tmp/capture.pcap", Engine: "PcapFile", ReplaySpeed: &speed},
+		{Name: "eth1", Engine: "libpcap", SnapLen: 128, MmapBufferSizeMb: 64, IsDecodeL4: &l4, FanoutWorkers: 2,
+			FanoutMode: " CPU"},
+		{Engine: "collector", ListenAddr: ":2055"},
+		{Name: "nf", Engine: "collector", ListenAddr: ":2056", Exporters: []string{"198.51.100.1"}, IdleTimeout: 60},
+	}
+	NormalizeInterfaces()
+
+	c := Interfaces[0]
+	if c.Name != "eth0" || c.Engine != "afpacket" || c.Direction != DirectionIn || c.SnapLen != DefaultSnapLen ||
+		c.MmapBufferSizeMb != DefaultMmapBufferSizeMb || c.FanoutWorkers != 4 || c.FanoutMode != "hash" ||
+		!c.AccountVlans() || c.DecodeL4() || *c.ReplaySpeed != 1 {
+		t.Errorf("got %+v", c)
+	}
+
+	c = Interfaces[1]
+	if c.Name != "capture.pcap" || c.Engine != "pcapfile" || c.Direction != DirectionIn || *c.ReplaySpeed != 0 {
+		t.Errorf("got %+v", c)
+	}
+
+	c = Interfaces[2]
+	if c.Engine != "libpcap" || c.Direction != DirectionBoth || c.SnapLen != 128 || c.MmapBufferSizeMb != 64 ||
+		c.FanoutWorkers != 2 || c.FanoutMode != "cpu" || !c.DecodeL4() {
+		t.Errorf("got %+v", c)
+	}
+
+	c = Interfaces[3]
+	if c.Name != DefaultCollectorName || c.Engine != "collector" || c.Direction != DirectionBoth ||
+		len(c.Exporters) != 2 || c.IdleTimeout != 600 {
+		t.Errorf("got %+v", c)
+	}
+
+	c = Interfaces[4]
+	if len(c.Exporters) != 1 || c.IdleTimeout != 60 {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestParseNflogConfig(t *testing.T) {
+	testFlags(t, "-engine", "nflog")
+
+	tests := []struct {
+		groups string
+		want   []InterfaceConfig
+		isErr  bool
+	}{
+		{groups: "eth0:2:in, eth0:3:out, eth1:4:OUT", want: []InterfaceConfig{
+			{Name: "eth0", Engine: "nflog", NflogGroupIn: 2, NflogGroupOut: 3},
+			{Name: "eth1", Engine: "nflog", Direction: DirectionOut, NflogGroupOut: 4},
+		}},
+		{groups: "eth0:2", isErr: true},
+		{groups: "eth0:two:in", isErr: true},
+		{groups: "eth0:2:both", isErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.groups, func(t *testing.T) {
+			Interfaces = nil
+			GroupListString = tt.groups
+			defer func() {
+				GroupListString = ""
+			}()
+
+			err := ParseNflogConfig()
+			if tt.isErr {
+				if err == nil {
+					t.Errorf("invalid group list accepted as %+v", Interfaces)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(Interfaces, tt.want) {
+				t.Errorf("got %+v, want %+v", Interfaces, tt.want)
+			}
+		})
+	}
+}